@@ -0,0 +1,152 @@
+// Package cdm is a content decryption module interface common to the DRM
+// systems, so that callers can be written once and pick the system by its
+// key system ID
+package cdm
+
+import (
+   "encoding/hex"
+   "errors"
+   "fmt"
+   "time"
+)
+
+// Cdm is a content decryption module of one DRM system. Response decodes the
+// license answering a Challenge
+type Cdm interface {
+   SystemId() SystemId
+   // Challenge returns the license challenge for init data, which is either
+   // a pssh box or the system specific data, such as a PlayReady Object
+   Challenge(initData []byte) ([]byte, error)
+   Response(data []byte) (*License, error)
+}
+
+// License is the keys of a license response
+type License struct {
+   Keys []Key
+   // Expiration is the zero Time if the license does not expire
+   Expiration time.Time
+}
+
+// Key is a decrypted key. Kid is in UUID byte order, as in pssh and tenc
+// boxes
+type Key struct {
+   Kid  []byte
+   Key  []byte
+   Type KeyType
+}
+
+// KeyType is numbered as in the Widevine license protocol
+type KeyType int
+
+const (
+   KeyTypeUnknown KeyType = iota
+   KeyTypeSigning
+   KeyTypeContent
+   KeyTypeKeyControl
+   KeyTypeOperatorSession
+   KeyTypeEntitlement
+   KeyTypeOemContent
+)
+
+var keyTypeNames = map[KeyType]string{
+   KeyTypeUnknown:         "UNKNOWN",
+   KeyTypeSigning:         "SIGNING",
+   KeyTypeContent:         "CONTENT",
+   KeyTypeKeyControl:      "KEY_CONTROL",
+   KeyTypeOperatorSession: "OPERATOR_SESSION",
+   KeyTypeEntitlement:     "ENTITLEMENT",
+   KeyTypeOemContent:      "OEM_CONTENT",
+}
+
+func (k KeyType) String() string {
+   if name, ok := keyTypeNames[k]; ok {
+      return name
+   }
+   return fmt.Sprintf("KeyType(%d)", int(k))
+}
+
+// ContentKeys returns the keys of type KeyTypeContent
+func (l *License) ContentKeys() []Key {
+   var keys []Key
+   for _, key := range l.Keys {
+      if key.Type == KeyTypeContent {
+         keys = append(keys, key)
+      }
+   }
+   return keys
+}
+
+// Key returns the key of kid
+func (l *License) Key(kid []byte) ([]byte, bool) {
+   for _, key := range l.Keys {
+      if string(key.Kid) == string(kid) {
+         return key.Key, true
+      }
+   }
+   return nil, false
+}
+
+// SystemId is the DRM system ID of pssh boxes
+type SystemId [16]byte
+
+var (
+   // Widevine is EDEF8BA9-79D6-4ACE-A3C8-27DCD51D21ED
+   Widevine = SystemId{
+      0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce,
+      0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed,
+   }
+   // PlayReady is 9A04F079-9840-4286-AB92-E65BE0885F95
+   PlayReady = SystemId{
+      0x9a, 0x04, 0xf0, 0x79, 0x98, 0x40, 0x42, 0x86,
+      0xab, 0x92, 0xe6, 0x5b, 0xe0, 0x88, 0x5f, 0x95,
+   }
+)
+
+// keySystems maps EME key system names to system IDs
+var keySystems = map[string]SystemId{
+   "com.microsoft.playready":                PlayReady,
+   "com.microsoft.playready.recommendation": PlayReady,
+   "com.widevine.alpha":                     Widevine,
+}
+
+// KeySystem returns the system ID of an EME key system name, such as
+// "com.widevine.alpha"
+func KeySystem(name string) (SystemId, bool) {
+   id, ok := keySystems[name]
+   return id, ok
+}
+
+func (s SystemId) String() string {
+   data := hex.EncodeToString(s[:])
+   return data[:8] + "-" + data[8:12] + "-" + data[12:16] + "-" + data[16:20] + "-" + data[20:]
+}
+
+// ErrNoCdm means none of the CDMs is of the system ID
+var ErrNoCdm = errors.New("no CDM for system ID")
+
+// Select returns the CDM of systemId
+func Select(systemId SystemId, cdms ...Cdm) (Cdm, error) {
+   for _, c := range cdms {
+      if c.SystemId() == systemId {
+         return c, nil
+      }
+   }
+   return nil, fmt.Errorf("%w %v", ErrNoCdm, systemId)
+}
+
+// SelectPssh returns the first pssh box of data that one of the CDMs can
+// handle, along with that CDM. data is a sequence of pssh boxes, such as the
+// init data of an encrypted event
+func SelectPssh(data []byte, cdms ...Cdm) (Cdm, *Pssh, error) {
+   boxes, err := ParsePsshAll(data)
+   if err != nil {
+      return nil, nil, err
+   }
+   for _, box := range boxes {
+      c, err := Select(box.SystemId, cdms...)
+      if err == nil {
+         return c, box, nil
+      }
+   }
+   return nil, nil, ErrNoCdm
+}
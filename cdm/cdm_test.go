@@ -0,0 +1,95 @@
+package cdm
+
+import (
+   "bytes"
+   "errors"
+   "testing"
+)
+
+func TestPssh(t *testing.T) {
+   boxes := []*Pssh{
+      {SystemId: PlayReady, Data: []byte("pro")},
+      {
+         Version:  1,
+         SystemId: Widevine,
+         KeyIds:   [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)},
+         Data:     []byte("widevine"),
+      },
+   }
+   var data []byte
+   for _, box := range boxes {
+      data = append(data, box.Bytes()...)
+   }
+   parsed, err := ParsePsshAll(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(parsed) != 2 {
+      t.Fatalf("%v boxes", len(parsed))
+   }
+   for i, box := range parsed {
+      if !bytes.Equal(box.Bytes(), boxes[i].Bytes()) {
+         t.Fatalf("box %v: %+v", i, box)
+      }
+   }
+   if parsed[1].Version != 1 || len(parsed[1].KeyIds) != 2 {
+      t.Fatalf("%+v", parsed[1])
+   }
+   _, err = ParsePssh(data)
+   if err == nil {
+      t.Fatal("expected error for trailing box")
+   }
+   initData, err := InitData(data[:len(boxes[0].Bytes())], PlayReady)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(initData) != "pro" {
+      t.Fatalf("init data %q", initData)
+   }
+   initData, err = InitData([]byte("pro"), PlayReady)
+   if err != nil || string(initData) != "pro" {
+      t.Fatalf("init data %q, %v", initData, err)
+   }
+   _, err = InitData(boxes[1].Bytes(), PlayReady)
+   if err == nil {
+      t.Fatal("expected error for system ID")
+   }
+   if PlayReady.String() != "9a04f079-9840-4286-ab92-e65be0885f95" {
+      t.Fatal(PlayReady)
+   }
+}
+
+type testCdm SystemId
+
+func (t testCdm) SystemId() SystemId {
+   return SystemId(t)
+}
+
+func (testCdm) Challenge([]byte) ([]byte, error) {
+   return nil, nil
+}
+
+func (testCdm) Response([]byte) (*License, error) {
+   return nil, nil
+}
+
+func TestSelect(t *testing.T) {
+   cdms := []Cdm{testCdm(Widevine)}
+   system, ok := KeySystem("com.widevine.alpha")
+   if !ok {
+      t.Fatal("key system not found")
+   }
+   c, err := Select(system, cdms...)
+   if err != nil || c.SystemId() != Widevine {
+      t.Fatal(err)
+   }
+   _, err = Select(PlayReady, cdms...)
+   if !errors.Is(err, ErrNoCdm) {
+      t.Fatalf("expected ErrNoCdm, got %v", err)
+   }
+   data := append((&Pssh{SystemId: PlayReady}).Bytes(), (&Pssh{SystemId: Widevine}).Bytes()...)
+   c, box, err := SelectPssh(data, cdms...)
+   if err != nil || c.SystemId() != Widevine || box.SystemId != Widevine {
+      t.Fatal(err)
+   }
+}
@@ -0,0 +1,120 @@
+package cdm
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+)
+
+// Pssh is a Protection System Specific Header box
+type Pssh struct {
+   Version  uint8
+   Flags    uint32
+   SystemId SystemId
+   // KeyIds are only encoded in version 1 boxes
+   KeyIds [][]byte
+   Data   []byte
+}
+
+var errPsshType = errors.New("box is not pssh")
+
+// ParsePssh parses a single pssh box
+func ParsePssh(data []byte) (*Pssh, error) {
+   p, n, err := parsePssh(data)
+   if err != nil {
+      return nil, err
+   }
+   if n != len(data) {
+      return nil, fmt.Errorf("%v bytes after pssh box", len(data)-n)
+   }
+   return p, nil
+}
+
+// ParsePsshAll parses a sequence of pssh boxes
+func ParsePsshAll(data []byte) ([]*Pssh, error) {
+   var boxes []*Pssh
+   for len(data) >= 1 {
+      p, n, err := parsePssh(data)
+      if err != nil {
+         return nil, err
+      }
+      boxes = append(boxes, p)
+      data = data[n:]
+   }
+   return boxes, nil
+}
+
+func parsePssh(data []byte) (*Pssh, int, error) {
+   if len(data) < 32 {
+      return nil, 0, errors.New("pssh box too short")
+   }
+   size := int(binary.BigEndian.Uint32(data))
+   if string(data[4:8]) != "pssh" {
+      return nil, 0, errPsshType
+   }
+   if size < 32 || size > len(data) {
+      return nil, 0, fmt.Errorf("invalid pssh box size %v", size)
+   }
+   box := data[:size]
+   p := &Pssh{
+      Version: box[8],
+      Flags:   binary.BigEndian.Uint32(box[8:]) & 0xffffff,
+   }
+   copy(p.SystemId[:], box[12:28])
+   offset := 28
+   if p.Version >= 1 {
+      count := int(binary.BigEndian.Uint32(box[offset:]))
+      offset += 4
+      if count > (len(box)-offset-4)/16 {
+         return nil, 0, fmt.Errorf("invalid pssh KID count %v", count)
+      }
+      for range count {
+         p.KeyIds = append(p.KeyIds, box[offset:offset+16])
+         offset += 16
+      }
+   }
+   if len(box)-offset < 4 {
+      return nil, 0, errors.New("pssh box too short")
+   }
+   length := int(binary.BigEndian.Uint32(box[offset:]))
+   offset += 4
+   if length != len(box)-offset {
+      return nil, 0, fmt.Errorf("invalid pssh data size %v", length)
+   }
+   p.Data = box[offset:]
+   return p, size, nil
+}
+
+// Bytes encodes the box. KeyIds are encoded if Version is 1 or more
+func (p *Pssh) Bytes() []byte {
+   data := binary.BigEndian.AppendUint32(nil, 0)
+   data = append(data, "pssh"...)
+   data = binary.BigEndian.AppendUint32(data, uint32(p.Version)<<24|p.Flags&0xffffff)
+   data = append(data, p.SystemId[:]...)
+   if p.Version >= 1 {
+      data = binary.BigEndian.AppendUint32(data, uint32(len(p.KeyIds)))
+      for _, kid := range p.KeyIds {
+         data = append(data, kid...)
+      }
+   }
+   data = binary.BigEndian.AppendUint32(data, uint32(len(p.Data)))
+   data = append(data, p.Data...)
+   binary.BigEndian.PutUint32(data, uint32(len(data)))
+   return data
+}
+
+// InitData returns the data of systemId from init data, which is either a
+// pssh box or the system specific data itself
+func InitData(initData []byte, systemId SystemId) ([]byte, error) {
+   if len(initData) < 8 || string(initData[4:8]) != "pssh" {
+      return initData, nil
+   }
+   p, err := ParsePssh(initData)
+   if err != nil {
+      return nil, err
+   }
+   if p.SystemId != systemId {
+      return nil, fmt.Errorf("pssh box is for system %v, not %v", p.SystemId, systemId)
+   }
+   return p.Data, nil
+}
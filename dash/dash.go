@@ -0,0 +1,266 @@
+// Package dash reads the protection of DASH manifests, so that license
+// requests can be made from ContentProtection elements
+package dash
+
+import (
+   "bytes"
+   "encoding/base64"
+   "encoding/hex"
+   "fmt"
+   "slices"
+   "strings"
+
+   "41.neocities.org/diana/cdm"
+   "41.neocities.org/diana/playReady"
+   "41.neocities.org/diana/playReady/xml"
+   "41.neocities.org/diana/widevine"
+)
+
+const (
+   SchemeMp4Protection = "urn:mpeg:dash:mp4protection:2011"
+   SchemeWidevine      = "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"
+   SchemePlayReady     = "urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95"
+   // schemePlayReadyGuid is the PlayReady system ID in GUID byte order, as
+   // some manifests have it
+   schemePlayReadyGuid = "urn:uuid:79f0049a-4098-8642-ab92-e65be0885f95"
+)
+
+// Mpd is the part of an MPD with protection
+type Mpd struct {
+   Period []struct {
+      AdaptationSet []AdaptationSet
+   }
+}
+
+type AdaptationSet struct {
+   Id                string `xml:"id,attr"`
+   ContentType       string `xml:"contentType,attr"`
+   MimeType          string `xml:"mimeType,attr"`
+   ContentProtection []ContentProtection
+   Representation    []Representation
+}
+
+type Representation struct {
+   Id                string `xml:"id,attr"`
+   MimeType          string `xml:"mimeType,attr"`
+   ContentProtection []ContentProtection
+}
+
+// ContentProtection is matched by local name, whatever the namespace
+// prefixes of the manifest
+type ContentProtection struct {
+   SchemeIdUri string `xml:"schemeIdUri,attr"`
+   Value       string `xml:"value,attr"`
+   DefaultKid  string `xml:"default_KID,attr"`
+   // Pssh is a base64 pssh box
+   Pssh string `xml:"pssh"`
+   // Pro is a base64 PlayReady Object
+   Pro string `xml:"pro"`
+   // Other holds the license URL elements, such as dashif:Laurl
+   Other []struct {
+      XMLName xml.Name
+      Value   string `xml:",chardata"`
+   } `xml:",any"`
+}
+
+func (c *ContentProtection) system() string {
+   switch strings.ToLower(c.SchemeIdUri) {
+   case SchemeMp4Protection:
+      return SchemeMp4Protection
+   case SchemeWidevine:
+      return SchemeWidevine
+   case SchemePlayReady, schemePlayReadyGuid:
+      return SchemePlayReady
+   }
+   return ""
+}
+
+func (c *ContentProtection) laUrl() string {
+   for _, other := range c.Other {
+      if strings.EqualFold(other.XMLName.Local, "laurl") {
+         return strings.TrimSpace(other.Value)
+      }
+   }
+   return ""
+}
+
+// Protection is the protection of a Representation, along with that of its
+// AdaptationSet
+type Protection struct {
+   AdaptationSet  string
+   Representation string
+   // Scheme is the value of the mp4protection element, such as "cenc" or
+   // "cbcs"
+   Scheme string
+   // DefaultKid is in UUID byte order
+   DefaultKid []byte
+   // Widevine is made from default_KID if the manifest has no pssh
+   Widevine    *widevine.PsshData
+   WidevineUrl string
+   // PlayReady is made from default_KID if the manifest has no PRO or pssh
+   PlayReady *xml.WrmHeader
+   // PlayReadyUrl is from a license URL element, otherwise the LA_URL of
+   // the WRMHEADER
+   PlayReadyUrl string
+}
+
+// Parse returns the protection of every protected Representation of an MPD.
+// An AdaptationSet without Representation elements is returned as one
+func Parse(data []byte) ([]*Protection, error) {
+   var mpd Mpd
+   err := xml.Unmarshal(data, &mpd)
+   if err != nil {
+      return nil, err
+   }
+   var protections []*Protection
+   for _, period := range mpd.Period {
+      for _, adaptation := range period.AdaptationSet {
+         representations := adaptation.Representation
+         if len(representations) == 0 {
+            representations = []Representation{{}}
+         }
+         for _, representation := range representations {
+            elements := append(
+               append([]ContentProtection{}, adaptation.ContentProtection...),
+               representation.ContentProtection...,
+            )
+            if len(elements) == 0 {
+               continue
+            }
+            p, err := newProtection(elements)
+            if err != nil {
+               return nil, fmt.Errorf(
+                  "AdaptationSet %q Representation %q: %w",
+                  adaptation.Id, representation.Id, err,
+               )
+            }
+            p.AdaptationSet = adaptation.Id
+            p.Representation = representation.Id
+            protections = append(protections, p)
+         }
+      }
+   }
+   return protections, nil
+}
+
+// newProtection reads ContentProtection elements, later elements overriding
+// earlier ones. A new default_KID drops the earlier init data that does not
+// list it
+func newProtection(elements []ContentProtection) (*Protection, error) {
+   var p Protection
+   for _, element := range elements {
+      if element.DefaultKid != "" {
+         kid, err := ParseKid(element.DefaultKid)
+         if err != nil {
+            return nil, err
+         }
+         if !bytes.Equal(kid, p.DefaultKid) {
+            p.dropInitData(kid)
+         }
+         p.DefaultKid = kid
+      }
+      switch element.system() {
+      case SchemeMp4Protection:
+         p.Scheme = element.Value
+      case SchemeWidevine:
+         if url := element.laUrl(); url != "" {
+            p.WidevineUrl = url
+         }
+         if element.Pssh == "" {
+            continue
+         }
+         data, err := psshData(element.Pssh, cdm.Widevine)
+         if err != nil {
+            return nil, err
+         }
+         p.Widevine, err = widevine.DecodePsshData(data)
+         if err != nil {
+            return nil, err
+         }
+      case SchemePlayReady:
+         if url := element.laUrl(); url != "" {
+            p.PlayReadyUrl = url
+         }
+         var (
+            data []byte
+            err  error
+         )
+         switch {
+         case element.Pro != "":
+            data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(element.Pro))
+         case element.Pssh != "":
+            data, err = psshData(element.Pssh, cdm.PlayReady)
+         default:
+            continue
+         }
+         if err != nil {
+            return nil, err
+         }
+         p.PlayReady, err = playReady.ParsePro(data)
+         if err != nil {
+            return nil, err
+         }
+      }
+   }
+   if p.DefaultKid != nil {
+      if p.Widevine == nil {
+         p.Widevine = &widevine.PsshData{KeyIds: [][]byte{p.DefaultKid}}
+      }
+      if p.PlayReady == nil {
+         p.PlayReady = WrmHeader(p.DefaultKid)
+      }
+   }
+   if p.PlayReady != nil && p.PlayReadyUrl == "" {
+      p.PlayReadyUrl = p.PlayReady.Data.LaUrl
+   }
+   return &p, nil
+}
+
+// dropInitData drops the Widevine and PlayReady init data that do not list
+// kid, so that they are made from default_KID
+func (p *Protection) dropInitData(kid []byte) {
+   if p.Widevine != nil && !slices.ContainsFunc(p.Widevine.KeyIds, func(keyId []byte) bool {
+      return bytes.Equal(keyId, kid)
+   }) {
+      p.Widevine = nil
+   }
+   if p.PlayReady != nil && !bytes.Equal(p.PlayReady.Data.Kid, WrmHeader(kid).Data.Kid) {
+      p.PlayReady = nil
+   }
+}
+
+// psshData returns the data of a base64 pssh box of systemId
+func psshData(text string, systemId cdm.SystemId) ([]byte, error) {
+   data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+   if err != nil {
+      return nil, err
+   }
+   return cdm.InitData(data, systemId)
+}
+
+// ParseKid parses a KID such as 1077efec-c0b2-4d02-ace3-3c1e52e2fb4b, with or
+// without the hyphens
+func ParseKid(text string) ([]byte, error) {
+   kid, err := hex.DecodeString(strings.ReplaceAll(text, "-", ""))
+   if err != nil {
+      return nil, err
+   }
+   if len(kid) != 16 {
+      return nil, fmt.Errorf("invalid KID %q", text)
+   }
+   return kid, nil
+}
+
+// WrmHeader returns a version 4.0.0.0 WRMHEADER of a KID in UUID byte order
+func WrmHeader(kid []byte) *xml.WrmHeader {
+   guid := append([]byte{}, kid...)
+   playReady.UuidOrGuid(guid)
+   return &xml.WrmHeader{
+      XmlNs:   "http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader",
+      Version: "4.0.0.0",
+      Data: xml.WrmHeaderData{
+         Kid:         guid,
+         ProtectInfo: xml.ProtectInfo{AlgId: "AESCTR", KeyLen: 16},
+      },
+   }
+}
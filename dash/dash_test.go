@@ -0,0 +1,116 @@
+package dash
+
+import (
+   "bytes"
+   "encoding/base64"
+   "fmt"
+   "testing"
+
+   "41.neocities.org/diana/playReady"
+)
+
+const testMpd = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" xmlns:cenc="urn:mpeg:cenc:2013"
+   xmlns:mspr="urn:microsoft:playready" xmlns:dashif="https://dashif.org/CPS">
+   <Period>
+      <AdaptationSet id="1" contentType="video">
+         <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011"
+            value="cenc" cenc:default_KID="1077efec-c0b2-4d02-ace3-3c1e52e2fb4b"/>
+         <ContentProtection schemeIdUri="urn:uuid:EDEF8BA9-79D6-4ACE-A3C8-27DCD51D21ED">
+            <dashif:Laurl>https://widevine.example/license</dashif:Laurl>
+         </ContentProtection>
+         <ContentProtection schemeIdUri="urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95">
+            <mspr:pro>%v</mspr:pro>
+         </ContentProtection>
+         <Representation id="video-1"/>
+         <Representation id="video-2">
+            <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011"
+               value="cbcs" cenc:default_KID="00112233445566778899aabbccddeeff"/>
+         </Representation>
+      </AdaptationSet>
+      <AdaptationSet id="2" contentType="audio">
+         <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011"
+            value="cenc" cenc:default_KID="ffeeddcc-bbaa-9988-7766-554433221100"/>
+      </AdaptationSet>
+      <AdaptationSet id="3" contentType="text">
+         <Representation id="text"/>
+      </AdaptationSet>
+   </Period>
+</MPD>`
+
+func TestParse(t *testing.T) {
+   kid, err := ParseKid("1077efec-c0b2-4d02-ace3-3c1e52e2fb4b")
+   if err != nil {
+      t.Fatal(err)
+   }
+   header := WrmHeader(kid)
+   header.Data.LaUrl = "https://playready.example/rightsmanager.asmx"
+   pro, err := playReady.EncodePro(header)
+   if err != nil {
+      t.Fatal(err)
+   }
+   mpd := fmt.Sprintf(testMpd, base64.StdEncoding.EncodeToString(pro))
+   protections, err := Parse([]byte(mpd))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(protections) != 3 {
+      t.Fatalf("%v protections", len(protections))
+   }
+   video := protections[0]
+   if video.AdaptationSet != "1" || video.Representation != "video-1" {
+      t.Fatalf("%+v", video)
+   }
+   if video.Scheme != "cenc" || !bytes.Equal(video.DefaultKid, kid) {
+      t.Fatalf("%+v", video)
+   }
+   if video.WidevineUrl != "https://widevine.example/license" {
+      t.Fatal(video.WidevineUrl)
+   }
+   if !bytes.Equal(video.Widevine.KeyIds[0], kid) {
+      t.Fatalf("%+v", video.Widevine)
+   }
+   if video.PlayReadyUrl != header.Data.LaUrl {
+      t.Fatal(video.PlayReadyUrl)
+   }
+   if !bytes.Equal(video.PlayReady.Data.Kid, header.Data.Kid) {
+      t.Fatalf("%+v", video.PlayReady)
+   }
+   // Representation elements override those of the AdaptationSet, and init
+   // data without the new default_KID is made from it
+   override := protections[1]
+   if override.Scheme != "cbcs" || override.DefaultKid[0] != 0x00 {
+      t.Fatalf("%+v", override)
+   }
+   if !bytes.Equal(override.Widevine.KeyIds[0], override.DefaultKid) {
+      t.Fatalf("%+v", override.Widevine)
+   }
+   guid := override.PlayReady.Data.Kid
+   if guid[0] != 0x33 || guid[3] != 0x00 || override.PlayReady.Data.LaUrl != "" {
+      t.Fatalf("%+v", override.PlayReady)
+   }
+   if override.PlayReadyUrl != "" {
+      t.Fatal(override.PlayReadyUrl)
+   }
+   // KIDs only as default_KID
+   audio := protections[2]
+   if audio.Representation != "" || audio.Widevine == nil || audio.PlayReady == nil {
+      t.Fatalf("%+v", audio)
+   }
+   guid = audio.PlayReady.Data.Kid
+   if guid[0] != 0xcc || guid[3] != 0xff || guid[15] != 0x00 {
+      t.Fatalf("%x", guid)
+   }
+   if audio.PlayReadyUrl != "" {
+      t.Fatal(audio.PlayReadyUrl)
+   }
+}
+
+func TestParseKid(t *testing.T) {
+   for _, text := range []string{"", "1077efec", "1077efec-c0b2-4d02-ace3-3c1e52e2fb4z"} {
+      _, err := ParseKid(text)
+      if err == nil {
+         t.Fatalf("expected error for %q", text)
+      }
+   }
+}
@@ -2,6 +2,7 @@ package main
 
 import (
    "41.neocities.org/diana/playReady"
+   "encoding/json"
    "flag"
    "fmt"
    "log"
@@ -29,11 +30,7 @@ func (c *client) do_certificate_key() error {
    if err != nil {
       return err
    }
-   encryptKey, err := playReady.GenerateKey()
-   if err != nil {
-      return err
-   }
-   err = certificate.GenerateLeaf(modelKey, signingKey, encryptKey)
+   encryptKey, err := certificate.GenerateLeaf(modelKey, signingKey, nil, nil)
    if err != nil {
       return err
    }
@@ -96,9 +93,11 @@ func (c *client) do_certificate() error {
    if err != nil {
       return err
    }
-   for _, certificate := range chain.Certificates {
-      fmt.Printf("%+v\n", certificate.ManufacturerInfo)
+   data, err = json.MarshalIndent(chain, "", " ")
+   if err != nil {
+      return err
    }
+   fmt.Println(string(data))
    return nil
 }
 
@@ -0,0 +1,185 @@
+// Package hls reads the protection of HLS playlists, so that license requests
+// can be made from EXT-X-KEY and EXT-X-SESSION-KEY tags
+package hls
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/base64"
+   "encoding/hex"
+   "errors"
+   "fmt"
+   "net/url"
+   "strings"
+
+   "41.neocities.org/diana/cdm"
+   "41.neocities.org/diana/playReady"
+   "41.neocities.org/diana/playReady/xml"
+   "41.neocities.org/diana/widevine"
+)
+
+const (
+   KeyFormatWidevine  = "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"
+   KeyFormatPlayReady = "com.microsoft.playready"
+)
+
+// Key is an EXT-X-KEY or EXT-X-SESSION-KEY tag
+type Key struct {
+   Session           bool
+   Method            string
+   Uri               string
+   KeyFormat         string
+   KeyFormatVersions string
+   KeyId             []byte
+   Iv                []byte
+   // Scheme is "cenc" for SAMPLE-AES-CTR and "cbcs" for SAMPLE-AES
+   Scheme string
+   // Widevine is decoded from the URI of a Widevine key
+   Widevine *widevine.PsshData
+   // PlayReady is decoded from the URI of a PlayReady key
+   PlayReady *xml.WrmHeader
+}
+
+var schemes = map[string]string{
+   "SAMPLE-AES":     "cbcs",
+   "SAMPLE-AES-CTR": "cenc",
+}
+
+// Parse returns the keys of a playlist, once each. Keys with METHOD=NONE are
+// left out
+func Parse(data []byte) ([]*Key, error) {
+   var (
+      keys []*Key
+      seen = map[string]bool{}
+   )
+   scanner := bufio.NewScanner(bytes.NewReader(data))
+   scanner.Buffer(nil, 1<<20)
+   for scanner.Scan() {
+      line := strings.TrimSpace(scanner.Text())
+      tag, attributes, ok := strings.Cut(line, ":")
+      if !ok || tag != "#EXT-X-KEY" && tag != "#EXT-X-SESSION-KEY" {
+         continue
+      }
+      if seen[line] {
+         continue
+      }
+      seen[line] = true
+      key, err := parseKey(attributes)
+      if err != nil {
+         return nil, fmt.Errorf("%v: %w", tag, err)
+      }
+      if key.Method == "NONE" {
+         continue
+      }
+      key.Session = tag == "#EXT-X-SESSION-KEY"
+      keys = append(keys, key)
+   }
+   if err := scanner.Err(); err != nil {
+      return nil, err
+   }
+   return keys, nil
+}
+
+func parseKey(text string) (*Key, error) {
+   attributes, err := parseAttributes(text)
+   if err != nil {
+      return nil, err
+   }
+   key := &Key{
+      Method:            attributes["METHOD"],
+      Uri:               attributes["URI"],
+      KeyFormat:         attributes["KEYFORMAT"],
+      KeyFormatVersions: attributes["KEYFORMATVERSIONS"],
+      Scheme:            schemes[attributes["METHOD"]],
+   }
+   if key.Method == "" {
+      return nil, errors.New("METHOD not found")
+   }
+   if key.KeyId, err = hexAttribute(attributes["KEYID"]); err != nil {
+      return nil, err
+   }
+   if key.Iv, err = hexAttribute(attributes["IV"]); err != nil {
+      return nil, err
+   }
+   switch strings.ToLower(key.KeyFormat) {
+   case KeyFormatWidevine:
+      data, err := dataUri(key.Uri, cdm.Widevine)
+      if err != nil {
+         return nil, err
+      }
+      if key.Widevine, err = widevine.DecodePsshData(data); err != nil {
+         return nil, err
+      }
+      if len(key.Widevine.KeyIds) == 0 && key.KeyId != nil {
+         key.Widevine.KeyIds = [][]byte{key.KeyId}
+      }
+   case KeyFormatPlayReady:
+      data, err := dataUri(key.Uri, cdm.PlayReady)
+      if err != nil {
+         return nil, err
+      }
+      if key.PlayReady, err = playReady.ParsePro(data); err != nil {
+         return nil, err
+      }
+   }
+   return key, nil
+}
+
+// dataUri returns the data of a data URI, unwrapping a pssh box of systemId
+func dataUri(uri string, systemId cdm.SystemId) ([]byte, error) {
+   header, text, ok := strings.Cut(uri, ",")
+   if !ok || !strings.HasPrefix(header, "data:") {
+      return nil, fmt.Errorf("URI is not a data URI %q", uri)
+   }
+   var (
+      data []byte
+      err  error
+   )
+   if strings.HasSuffix(header, ";base64") {
+      data, err = base64.StdEncoding.DecodeString(text)
+   } else {
+      text, err = url.PathUnescape(text)
+      data = []byte(text)
+   }
+   if err != nil {
+      return nil, err
+   }
+   return cdm.InitData(data, systemId)
+}
+
+// hexAttribute decodes a hexadecimal attribute such as
+// 0x1077efecc0b24d02ace33c1e52e2fb4b
+func hexAttribute(text string) ([]byte, error) {
+   if text == "" {
+      return nil, nil
+   }
+   if len(text) < 2 || text[0] != '0' || text[1] != 'x' && text[1] != 'X' {
+      return nil, fmt.Errorf("invalid hexadecimal attribute %q", text)
+   }
+   return hex.DecodeString(text[2:])
+}
+
+// parseAttributes parses an attribute list, removing the quotes of quoted
+// strings
+func parseAttributes(text string) (map[string]string, error) {
+   attributes := map[string]string{}
+   for text != "" {
+      name, rest, ok := strings.Cut(text, "=")
+      if !ok {
+         return nil, fmt.Errorf("invalid attribute list %q", text)
+      }
+      var value string
+      if strings.HasPrefix(rest, `"`) {
+         end := strings.IndexByte(rest[1:], '"')
+         if end == -1 {
+            return nil, fmt.Errorf("unterminated quoted string %q", rest)
+         }
+         value, rest = rest[1:end+1], strings.TrimPrefix(rest[end+2:], ",")
+      } else {
+         value, rest, _ = strings.Cut(rest, ",")
+      }
+      attributes[strings.TrimSpace(name)] = value
+      text = strings.TrimSpace(rest)
+   }
+   return attributes, nil
+}
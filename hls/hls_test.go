@@ -0,0 +1,99 @@
+package hls
+
+import (
+   "bytes"
+   "encoding/base64"
+   "fmt"
+   "testing"
+
+   "41.neocities.org/diana/cdm"
+   "41.neocities.org/diana/playReady"
+   "41.neocities.org/diana/playReady/xml"
+)
+
+const testPlaylist = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES-CTR,KEYFORMAT="com.microsoft.playready",KEYFORMATVERSIONS="1",URI="data:text/plain;charset=UTF-16;base64,%v"
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key,with,commas",KEYFORMAT="com.apple.streamingkeydelivery",KEYID=0x1077EFECC0B24D02ACE33C1E52E2FB4B,IV=0x00000000000000000000000000000001
+#EXTINF:4.0,
+segment1.mp4
+#EXT-X-KEY:METHOD=SAMPLE-AES-CTR,KEYFORMAT="com.microsoft.playready",URI="data:text/plain;base64,%v"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key,with,commas",KEYFORMAT="com.apple.streamingkeydelivery",KEYID=0x1077EFECC0B24D02ACE33C1E52E2FB4B,IV=0x00000000000000000000000000000001
+#EXTINF:4.0,
+segment2.mp4
+`
+
+func TestParse(t *testing.T) {
+   kid := []byte{
+      0xec, 0xef, 0x77, 0x10, 0xb2, 0xc0, 0x02, 0x4d,
+      0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b,
+   }
+   header := &xml.WrmHeader{
+      XmlNs:   "http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader",
+      Version: "4.0.0.0",
+      Data: xml.WrmHeaderData{
+         Kid:         kid,
+         ProtectInfo: xml.ProtectInfo{AlgId: "AESCTR", KeyLen: 16},
+      },
+   }
+   pro, err := playReady.EncodePro(header)
+   if err != nil {
+      t.Fatal(err)
+   }
+   pssh := &cdm.Pssh{SystemId: cdm.PlayReady, Data: pro}
+   playlist := fmt.Sprintf(
+      testPlaylist,
+      base64.StdEncoding.EncodeToString(pro),
+      base64.StdEncoding.EncodeToString(pssh.Bytes()),
+   )
+   keys, err := Parse([]byte(playlist))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(keys) != 3 {
+      t.Fatalf("%v keys", len(keys))
+   }
+   session := keys[0]
+   if !session.Session || session.Scheme != "cenc" || session.KeyFormatVersions != "1" {
+      t.Fatalf("%+v", session)
+   }
+   if !bytes.Equal(session.PlayReady.Data.Kid, kid) {
+      t.Fatalf("%+v", session.PlayReady)
+   }
+   fairPlay := keys[1]
+   if fairPlay.Session || fairPlay.Scheme != "cbcs" || fairPlay.Uri != "skd://key,with,commas" {
+      t.Fatalf("%+v", fairPlay)
+   }
+   if fairPlay.KeyId[0] != 0x10 || fairPlay.Iv[15] != 1 {
+      t.Fatalf("%+v", fairPlay)
+   }
+   if fairPlay.PlayReady != nil || fairPlay.Widevine != nil {
+      t.Fatalf("%+v", fairPlay)
+   }
+   // a pssh box rather than a PlayReady Object
+   if !bytes.Equal(keys[2].PlayReady.Data.Kid, kid) {
+      t.Fatalf("%+v", keys[2].PlayReady)
+   }
+}
+
+func TestParseAttributes(t *testing.T) {
+   attributes, err := parseAttributes(`A=1,B="x,y=z", C=0x10,D=""`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   want := map[string]string{"A": "1", "B": "x,y=z", "C": "0x10", "D": ""}
+   if fmt.Sprint(attributes) != fmt.Sprint(want) {
+      t.Fatal(attributes)
+   }
+   for _, text := range []string{`A`, `A="1`} {
+      _, err = parseAttributes(text)
+      if err == nil {
+         t.Fatalf("expected error for %q", text)
+      }
+   }
+   _, err = Parse([]byte("#EXT-X-KEY:URI=\"a\"\n"))
+   if err == nil {
+      t.Fatal("expected error for missing METHOD")
+   }
+}
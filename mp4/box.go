@@ -0,0 +1,189 @@
+// Package mp4 encrypts and decrypts fragmented MP4 with the Common Encryption
+// schemes
+package mp4
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "slices"
+)
+
+// Box is an ISO BMFF box. Container boxes keep their children parsed, and
+// any fields before the children, such as those of a sample entry, in
+// Payload
+type Box struct {
+   Type     string
+   Payload  []byte
+   Children []*Box
+}
+
+// containers are the boxes whose payload is only child boxes
+var containers = map[string]bool{
+   "dinf": true, "edts": true, "mdia": true, "minf": true, "moof": true,
+   "moov": true, "mvex": true, "schi": true, "sinf": true, "stbl": true,
+   "traf": true, "trak": true,
+}
+
+// childOffset is the length of the fields before the children of the
+// container boxes that have any
+var childOffset = map[string]int{
+   "stsd": 8,
+   // visual sample entries
+   "avc1": 78, "avc3": 78, "av01": 78, "dvh1": 78, "dvhe": 78, "encv": 78,
+   "hev1": 78, "hvc1": 78, "vp08": 78, "vp09": 78,
+   // audio sample entries
+   "ac-3": 28, "ac-4": 28, "ec-3": 28, "enca": 28, "fLaC": 28, "mp4a": 28,
+   "Opus": 28,
+}
+
+var errBoxSize = errors.New("invalid box size")
+
+// ParseBoxes parses a sequence of boxes
+func ParseBoxes(data []byte) ([]*Box, error) {
+   var boxes []*Box
+   for len(data) >= 1 {
+      box, n, err := parseBox(data)
+      if err != nil {
+         return nil, err
+      }
+      boxes = append(boxes, box)
+      data = data[n:]
+   }
+   return boxes, nil
+}
+
+func parseBox(data []byte) (*Box, int, error) {
+   if len(data) < 8 {
+      return nil, 0, errBoxSize
+   }
+   size := uint64(binary.BigEndian.Uint32(data))
+   box := &Box{Type: string(data[4:8])}
+   header := 8
+   switch size {
+   case 0:
+      size = uint64(len(data))
+   case 1:
+      if len(data) < 16 {
+         return nil, 0, errBoxSize
+      }
+      size = binary.BigEndian.Uint64(data[8:])
+      header = 16
+   }
+   if size < uint64(header) || size > uint64(len(data)) {
+      return nil, 0, fmt.Errorf("%v: %w", box.Type, errBoxSize)
+   }
+   payload := data[header:size]
+   offset, ok := childOffset[box.Type]
+   if !ok && !containers[box.Type] {
+      box.Payload = payload
+      return box, int(size), nil
+   }
+   if offset > len(payload) {
+      return nil, 0, fmt.Errorf("%v: %w", box.Type, errBoxSize)
+   }
+   box.Payload = payload[:offset]
+   children, err := ParseBoxes(payload[offset:])
+   if err != nil {
+      return nil, 0, fmt.Errorf("%v: %w", box.Type, err)
+   }
+   // empty containers still encode as containers
+   box.Children = append([]*Box{}, children...)
+   return box, int(size), nil
+}
+
+// Size returns the encoded size of the box
+func (b *Box) Size() int {
+   size := 8 + len(b.Payload)
+   for _, child := range b.Children {
+      size += child.Size()
+   }
+   return size
+}
+
+// Bytes encodes the box
+func (b *Box) Bytes() []byte {
+   return b.Append(nil)
+}
+
+// Append appends the encoded box to data
+func (b *Box) Append(data []byte) []byte {
+   data = binary.BigEndian.AppendUint32(data, uint32(b.Size()))
+   data = append(data, b.Type...)
+   data = append(data, b.Payload...)
+   for _, child := range b.Children {
+      data = child.Append(data)
+   }
+   return data
+}
+
+// Child returns the first child of type boxType, or nil
+func (b *Box) Child(boxType string) *Box {
+   for _, child := range b.Children {
+      if child.Type == boxType {
+         return child
+      }
+   }
+   return nil
+}
+
+// Find returns the first descendant at path, such as "mdia/minf/stbl", or
+// nil
+func (b *Box) Find(path ...string) *Box {
+   for _, boxType := range path {
+      if b = b.Child(boxType); b == nil {
+         return nil
+      }
+   }
+   return b
+}
+
+// ChildrenOf returns the children of type boxType
+func (b *Box) ChildrenOf(boxType string) []*Box {
+   var boxes []*Box
+   for _, child := range b.Children {
+      if child.Type == boxType {
+         boxes = append(boxes, child)
+      }
+   }
+   return boxes
+}
+
+// Remove removes the children of type boxType
+func (b *Box) Remove(boxType string) {
+   b.Children = slices.DeleteFunc(b.Children, func(child *Box) bool {
+      return child.Type == boxType
+   })
+}
+
+// offset returns the offset of the payload of child from the start of b, or
+// -1
+func (b *Box) offset(child *Box) int {
+   offset := 8 + len(b.Payload)
+   for _, c := range b.Children {
+      if c == child {
+         return offset + 8
+      }
+      if inner := c.offset(child); inner >= 0 {
+         return offset + inner
+      }
+      offset += c.Size()
+   }
+   return -1
+}
+
+// fullBox returns the version and flags of a full box payload
+func fullBox(payload []byte) (uint8, uint32, error) {
+   if len(payload) < 4 {
+      return 0, 0, errBoxSize
+   }
+   return payload[0], binary.BigEndian.Uint32(payload) & 0xffffff, nil
+}
+
+func encodeBoxes(boxes []*Box) []byte {
+   var data []byte
+   for _, box := range boxes {
+      data = box.Append(data)
+   }
+   return data
+}
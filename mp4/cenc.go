@@ -0,0 +1,329 @@
+package mp4
+
+import (
+   "crypto/aes"
+   "crypto/cipher"
+   "encoding/binary"
+   "errors"
+   "fmt"
+)
+
+// Scheme is a Common Encryption scheme type
+type Scheme string
+
+const (
+   // SchemeCenc is full sample AES-CTR
+   SchemeCenc Scheme = "cenc"
+   // SchemeCbc1 is full sample AES-CBC
+   SchemeCbc1 Scheme = "cbc1"
+   // SchemeCens is pattern AES-CTR
+   SchemeCens Scheme = "cens"
+   // SchemeCbcs is pattern AES-CBC with a constant IV
+   SchemeCbcs Scheme = "cbcs"
+)
+
+func (s Scheme) cbc() bool {
+   return s == SchemeCbc1 || s == SchemeCbcs
+}
+
+func (s Scheme) pattern() bool {
+   return s == SchemeCens || s == SchemeCbcs
+}
+
+func (s Scheme) valid() bool {
+   switch s {
+   case SchemeCenc, SchemeCbc1, SchemeCens, SchemeCbcs:
+      return true
+   }
+   return false
+}
+
+// Subsample is a range of a sample: BytesOfClearData followed by
+// BytesOfProtectedData
+type Subsample struct {
+   BytesOfClearData     uint16
+   BytesOfProtectedData uint32
+}
+
+// Tenc is a track encryption box
+type Tenc struct {
+   // CryptByteBlock and SkipByteBlock are the pattern of the cens and cbcs
+   // schemes, in 16 byte blocks
+   CryptByteBlock uint8
+   SkipByteBlock  uint8
+   IsProtected    bool
+   // PerSampleIvSize is 0, 8 or 16. 0 means ConstantIv is used
+   PerSampleIvSize uint8
+   Kid             [16]byte
+   ConstantIv      []byte
+}
+
+func parseTenc(payload []byte) (*Tenc, error) {
+   version, _, err := fullBox(payload)
+   if err != nil {
+      return nil, err
+   }
+   if len(payload) < 24 {
+      return nil, errors.New("tenc box too short")
+   }
+   t := &Tenc{
+      IsProtected:     payload[6] == 1,
+      PerSampleIvSize: payload[7],
+   }
+   if version >= 1 {
+      t.CryptByteBlock = payload[5] >> 4
+      t.SkipByteBlock = payload[5] & 0xf
+   }
+   copy(t.Kid[:], payload[8:24])
+   if t.IsProtected && t.PerSampleIvSize == 0 {
+      if len(payload) < 25 || len(payload) < 25+int(payload[24]) {
+         return nil, errors.New("tenc box too short")
+      }
+      t.ConstantIv = payload[25 : 25+int(payload[24])]
+   }
+   return t, nil
+}
+
+func (t *Tenc) box() *Box {
+   var version uint8
+   if t.CryptByteBlock >= 1 || t.SkipByteBlock >= 1 {
+      version = 1
+   }
+   payload := []byte{version, 0, 0, 0, 0}
+   if version >= 1 {
+      payload = append(payload, t.CryptByteBlock<<4|t.SkipByteBlock&0xf)
+   } else {
+      payload = append(payload, 0)
+   }
+   if t.IsProtected {
+      payload = append(payload, 1)
+   } else {
+      payload = append(payload, 0)
+   }
+   payload = append(payload, t.PerSampleIvSize)
+   payload = append(payload, t.Kid[:]...)
+   if t.IsProtected && t.PerSampleIvSize == 0 {
+      payload = append(payload, uint8(len(t.ConstantIv)))
+      payload = append(payload, t.ConstantIv...)
+   }
+   return &Box{Type: "tenc", Payload: payload}
+}
+
+// sampleEncryption is the auxiliary information of one sample
+type sampleEncryption struct {
+   Iv         []byte
+   Subsamples []Subsample
+}
+
+const (
+   // sencOverrideTrackEncryption is set on a senc box with its own algorithm
+   // ID, IV size and KID, as in PIFF
+   sencOverrideTrackEncryption = 0x1
+   sencUseSubsamples           = 0x2
+)
+
+// sencOverride is the track encryption of a senc box that overrides tenc.
+// AlgorithmId 0 means the samples are clear
+type sencOverride struct {
+   AlgorithmId uint32
+   IvSize      uint8
+   Kid         [16]byte
+}
+
+// parseSenc parses a senc box. ivSize is the per sample IV size of the track,
+// unless the box overrides it
+func parseSenc(payload []byte, ivSize int) ([]sampleEncryption, *sencOverride, error) {
+   _, flags, err := fullBox(payload)
+   if err != nil {
+      return nil, nil, err
+   }
+   data := payload[4:]
+   var override *sencOverride
+   if flags&sencOverrideTrackEncryption != 0 {
+      if len(data) < 20 {
+         return nil, nil, errors.New("senc box too short")
+      }
+      override = &sencOverride{
+         AlgorithmId: binary.BigEndian.Uint32(data) >> 8,
+         IvSize:      data[3],
+      }
+      copy(override.Kid[:], data[4:20])
+      ivSize = int(override.IvSize)
+      data = data[20:]
+   }
+   if len(data) < 4 {
+      return nil, nil, errors.New("senc box too short")
+   }
+   count := binary.BigEndian.Uint32(data)
+   data = data[4:]
+   var samples []sampleEncryption
+   for range count {
+      if len(data) < ivSize {
+         return nil, nil, errors.New("senc box too short")
+      }
+      sample := sampleEncryption{Iv: data[:ivSize]}
+      data = data[ivSize:]
+      if flags&sencUseSubsamples != 0 {
+         if len(data) < 2 {
+            return nil, nil, errors.New("senc box too short")
+         }
+         n := int(binary.BigEndian.Uint16(data))
+         data = data[2:]
+         if len(data) < n*6 {
+            return nil, nil, errors.New("senc box too short")
+         }
+         for range n {
+            sample.Subsamples = append(sample.Subsamples, Subsample{
+               BytesOfClearData:     binary.BigEndian.Uint16(data),
+               BytesOfProtectedData: binary.BigEndian.Uint32(data[2:]),
+            })
+            data = data[6:]
+         }
+      }
+      samples = append(samples, sample)
+   }
+   return samples, override, nil
+}
+
+// encodeSenc returns the senc box, along with the size of the auxiliary
+// information of each sample for the saiz box
+func encodeSenc(samples []sampleEncryption, subsamples bool) (*Box, []uint8) {
+   var flags uint32
+   if subsamples {
+      flags = sencUseSubsamples
+   }
+   payload := binary.BigEndian.AppendUint32(nil, flags)
+   payload = binary.BigEndian.AppendUint32(payload, uint32(len(samples)))
+   sizes := make([]uint8, len(samples))
+   for i, sample := range samples {
+      start := len(payload)
+      payload = append(payload, sample.Iv...)
+      if subsamples {
+         payload = binary.BigEndian.AppendUint16(payload, uint16(len(sample.Subsamples)))
+         for _, sub := range sample.Subsamples {
+            payload = binary.BigEndian.AppendUint16(payload, sub.BytesOfClearData)
+            payload = binary.BigEndian.AppendUint32(payload, sub.BytesOfProtectedData)
+         }
+      }
+      sizes[i] = uint8(len(payload) - start)
+   }
+   return &Box{Type: "senc", Payload: payload}, sizes
+}
+
+// cryptor encrypts or decrypts samples of one track
+type cryptor struct {
+   scheme Scheme
+   block  cipher.Block
+   crypt  int
+   skip   int
+}
+
+func newCryptor(scheme Scheme, key []byte, crypt, skip uint8) (*cryptor, error) {
+   if !scheme.valid() {
+      return nil, fmt.Errorf("unsupported scheme %q", scheme)
+   }
+   block, err := aes.NewCipher(key)
+   if err != nil {
+      return nil, err
+   }
+   c := &cryptor{scheme: scheme, block: block}
+   if scheme.pattern() {
+      c.crypt, c.skip = int(crypt), int(skip)
+      if c.crypt == 0 {
+         return nil, errors.New("pattern with no encrypted blocks")
+      }
+   }
+   return c, nil
+}
+
+// sample encrypts or decrypts sample in place. No subsamples means the whole
+// sample is protected
+func (c *cryptor) sample(sample, iv []byte, subsamples []Subsample, encrypt bool) error {
+   if len(iv) == 8 {
+      iv = append(iv[:8:8], make([]byte, 8)...)
+   }
+   if len(iv) != 16 {
+      return fmt.Errorf("invalid IV length %v", len(iv))
+   }
+   ranges, err := protectedRanges(len(sample), subsamples)
+   if err != nil {
+      return err
+   }
+   var (
+      stream cipher.Stream
+      mode   cipher.BlockMode
+   )
+   switch {
+   case !c.scheme.cbc():
+      // the key stream runs on across the protected ranges of a sample
+      stream = cipher.NewCTR(c.block, iv)
+   case c.scheme == SchemeCbc1:
+      mode = c.cbcMode(iv, encrypt)
+   }
+   for _, r := range ranges {
+      data := sample[r[0]:r[1]]
+      if c.scheme == SchemeCbcs {
+         // each subsample starts over with the constant IV
+         mode = c.cbcMode(iv, encrypt)
+      }
+      c.protect(data, stream, mode)
+   }
+   return nil
+}
+
+func (c *cryptor) cbcMode(iv []byte, encrypt bool) cipher.BlockMode {
+   if encrypt {
+      return cipher.NewCBCEncrypter(c.block, iv)
+   }
+   return cipher.NewCBCDecrypter(c.block, iv)
+}
+
+// protect transforms one protected range. Any trailing partial block of a
+// CBC or pattern scheme stays clear
+func (c *cryptor) protect(data []byte, stream cipher.Stream, mode cipher.BlockMode) {
+   if !c.scheme.pattern() {
+      if mode != nil {
+         n := len(data) / aes.BlockSize * aes.BlockSize
+         mode.CryptBlocks(data[:n], data[:n])
+      } else {
+         stream.XORKeyStream(data, data)
+      }
+      return
+   }
+   for len(data) >= aes.BlockSize {
+      n := min(c.crypt*aes.BlockSize, len(data)/aes.BlockSize*aes.BlockSize)
+      if mode != nil {
+         mode.CryptBlocks(data[:n], data[:n])
+      } else {
+         stream.XORKeyStream(data[:n], data[:n])
+      }
+      data = data[n:]
+      data = data[min(c.skip*aes.BlockSize, len(data)):]
+   }
+}
+
+// protectedRanges returns the protected [start, end) ranges of a sample
+func protectedRanges(size int, subsamples []Subsample) ([][2]int, error) {
+   if len(subsamples) == 0 {
+      return [][2]int{{0, size}}, nil
+   }
+   var (
+      ranges [][2]int
+      offset int
+   )
+   for _, sub := range subsamples {
+      offset += int(sub.BytesOfClearData)
+      end := offset + int(sub.BytesOfProtectedData)
+      if end > size {
+         return nil, errors.New("subsamples exceed sample size")
+      }
+      if end > offset {
+         ranges = append(ranges, [2]int{offset, end})
+      }
+      offset = end
+   }
+   if offset != size {
+      return nil, errors.New("subsamples do not cover the sample")
+   }
+   return ranges, nil
+}
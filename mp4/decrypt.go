@@ -0,0 +1,434 @@
+package mp4
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "io"
+   "math"
+
+   "41.neocities.org/diana/cdm"
+)
+
+// Decrypter decrypts fragmented MP4 protected with any of the Common
+// Encryption schemes. Init must be called with the init segment before
+// Segment is called with the media segments
+type Decrypter struct {
+   // Keys are the content keys by KID
+   Keys map[[16]byte][]byte
+   // tracks are the protection of the sample entries of each track ID, nil
+   // for clear entries
+   tracks map[uint32][]*protection
+   trexs  map[uint32]trex
+}
+
+// protection is the scheme and track encryption of a sample entry
+type protection struct {
+   scheme Scheme
+   tenc   *Tenc
+}
+
+// AddLicense adds the content keys of a license to Keys
+func (d *Decrypter) AddLicense(license *cdm.License) {
+   if d.Keys == nil {
+      d.Keys = map[[16]byte][]byte{}
+   }
+   for _, key := range license.ContentKeys() {
+      var kid [16]byte
+      if copy(kid[:], key.Kid) == 16 {
+         d.Keys[kid] = key.Key
+      }
+   }
+}
+
+// Init reads the protection of the tracks of an init segment, and returns it
+// with the original sample entries and without pssh boxes
+func (d *Decrypter) Init(data []byte) ([]byte, error) {
+   boxes, err := ParseBoxes(data)
+   if err != nil {
+      return nil, err
+   }
+   moov := findBox(boxes, "moov")
+   if moov == nil {
+      return nil, errors.New("moov not found")
+   }
+   d.tracks = map[uint32][]*protection{}
+   for _, trak := range moov.ChildrenOf("trak") {
+      id, err := trackId(trak)
+      if err != nil {
+         return nil, err
+      }
+      stsd := trak.Find("mdia", "minf", "stbl", "stsd")
+      if stsd == nil {
+         continue
+      }
+      entries := make([]*protection, len(stsd.Children))
+      for i, entry := range stsd.Children {
+         if entry.Type != "encv" && entry.Type != "enca" {
+            continue
+         }
+         entries[i], err = parseSinf(entry)
+         if err != nil {
+            return nil, fmt.Errorf("track %v: %w", id, err)
+         }
+      }
+      d.tracks[id] = entries
+   }
+   moov.Remove("pssh")
+   d.trexs = parseTrexs(moov)
+   return encodeBoxes(boxes), nil
+}
+
+// parseSinf reads the protection of a sample entry, and restores the
+// original format
+func parseSinf(entry *Box) (*protection, error) {
+   sinf := entry.Child("sinf")
+   if sinf == nil {
+      return nil, fmt.Errorf("sinf not found in %v", entry.Type)
+   }
+   frma, schm := sinf.Child("frma"), sinf.Child("schm")
+   if frma == nil || len(frma.Payload) != 4 {
+      return nil, errors.New("frma not found in sinf")
+   }
+   if schm == nil || len(schm.Payload) < 8 {
+      return nil, errors.New("schm not found in sinf")
+   }
+   scheme := Scheme(schm.Payload[4:8])
+   if !scheme.valid() {
+      return nil, fmt.Errorf("unsupported scheme %q", scheme)
+   }
+   box := sinf.Find("schi", "tenc")
+   if box == nil {
+      return nil, errors.New("tenc not found in sinf")
+   }
+   tenc, err := parseTenc(box.Payload)
+   if err != nil {
+      return nil, err
+   }
+   entry.Type = string(frma.Payload)
+   entry.Remove("sinf")
+   return &protection{scheme: scheme, tenc: tenc}, nil
+}
+
+// trackId returns the track ID of the tkhd of trak
+func trackId(trak *Box) (uint32, error) {
+   tkhd := trak.Child("tkhd")
+   if tkhd == nil {
+      return 0, errors.New("tkhd not found in trak")
+   }
+   version, _, err := fullBox(tkhd.Payload)
+   if err != nil {
+      return 0, err
+   }
+   offset := 12
+   if version >= 1 {
+      offset = 20
+   }
+   if len(tkhd.Payload) < offset+4 {
+      return 0, errors.New("tkhd box too short")
+   }
+   return binary.BigEndian.Uint32(tkhd.Payload[offset:]), nil
+}
+
+// Segment decrypts the samples of a media segment, removing the senc, saiz
+// and saio boxes. Clear tracks are left as they are, but a track fragment
+// with senc or saiz must be of a track protected in the init segment
+func (d *Decrypter) Segment(data []byte) ([]byte, error) {
+   return segmentBoxes(data, func(moof *Box, moofStart int, segment []byte) error {
+      tracks, err := fragmentTracks(moof, moofStart, segment, d.trexs)
+      if err != nil {
+         return err
+      }
+      size := moof.Size()
+      for _, track := range tracks {
+         entries := d.tracks[track.tfhd.trackId]
+         index := int(track.tfhd.sampleDescriptionIndex) - 1
+         if index < 0 || index >= len(entries) || entries[index] == nil {
+            if track.traf.Child("senc") != nil || track.traf.Child("saiz") != nil {
+               return fmt.Errorf(
+                  "track %v: encrypted, but not protected in the init segment",
+                  track.tfhd.trackId,
+               )
+            }
+            continue
+         }
+         err = d.track(track, entries[index], moofStart, segment)
+         if err != nil {
+            return fmt.Errorf("track %v: %w", track.tfhd.trackId, err)
+         }
+         for _, boxType := range []string{"senc", "saiz", "saio"} {
+            track.traf.Remove(boxType)
+         }
+      }
+      delta := moof.Size() - size
+      for _, traf := range moof.ChildrenOf("traf") {
+         for _, trun := range traf.ChildrenOf("trun") {
+            setTrunDataOffset(trun.Payload, delta)
+         }
+      }
+      return nil
+   })
+}
+
+func (d *Decrypter) track(track *fragmentTrack, p *protection, moofStart int, segment []byte) error {
+   if !p.tenc.IsProtected {
+      return nil
+   }
+   kid, ivSize := p.tenc.Kid, int(p.tenc.PerSampleIvSize)
+   var (
+      samples []sampleEncryption
+      err     error
+   )
+   if senc := track.traf.Child("senc"); senc != nil {
+      var override *sencOverride
+      samples, override, err = parseSenc(senc.Payload, ivSize)
+      if err != nil {
+         return err
+      }
+      if override != nil {
+         if override.AlgorithmId == 0 {
+            return nil
+         }
+         kid, ivSize = override.Kid, int(override.IvSize)
+      }
+   } else {
+      samples, err = auxiliaryInfo(track.traf, moofStart, segment, ivSize)
+      if err != nil {
+         return err
+      }
+   }
+   key, ok := d.Keys[kid]
+   if !ok {
+      return fmt.Errorf("key not found for KID %x", kid)
+   }
+   c, err := newCryptor(p.scheme, key, p.tenc.CryptByteBlock, p.tenc.SkipByteBlock)
+   if err != nil {
+      return err
+   }
+   if len(samples) != len(track.samples) {
+      return fmt.Errorf(
+         "%v samples with auxiliary information, %v samples",
+         len(samples), len(track.samples),
+      )
+   }
+   for i, r := range track.samples {
+      iv := samples[i].Iv
+      if ivSize == 0 {
+         iv = p.tenc.ConstantIv
+      }
+      err = c.sample(segment[r[0]:r[1]], iv, samples[i].Subsamples, false)
+      if err != nil {
+         return fmt.Errorf("sample %v: %w", i, err)
+      }
+   }
+   return nil
+}
+
+// auxiliaryInfo reads the sample auxiliary information that saiz and saio
+// point to, for segments without senc
+func auxiliaryInfo(traf *Box, moofStart int, segment []byte, ivSize int) ([]sampleEncryption, error) {
+   saiz, saio := traf.Child("saiz"), traf.Child("saio")
+   if saiz == nil || saio == nil {
+      return nil, errors.New("senc, or saiz and saio, not found in traf")
+   }
+   sizes, err := parseSaiz(saiz.Payload)
+   if err != nil {
+      return nil, err
+   }
+   offset, err := parseSaio(saio.Payload)
+   if err != nil {
+      return nil, err
+   }
+   start := uint64(moofStart) + offset
+   samples := make([]sampleEncryption, len(sizes))
+   for i, size := range sizes {
+      end := start + uint64(size)
+      if end > uint64(len(segment)) || int(size) < ivSize {
+         return nil, errors.New("auxiliary information outside of segment")
+      }
+      info := segment[start:end]
+      samples[i].Iv = info[:ivSize]
+      if len(info) > ivSize {
+         // the senc layout of one sample with subsamples
+         payload := binary.BigEndian.AppendUint32(nil, sencUseSubsamples)
+         payload = binary.BigEndian.AppendUint32(payload, 1)
+         sample, _, err := parseSenc(append(payload, info...), ivSize)
+         if err != nil {
+            return nil, err
+         }
+         samples[i] = sample[0]
+      }
+      start = end
+   }
+   return samples, nil
+}
+
+// parseSaiz returns the auxiliary information size of each sample
+func parseSaiz(payload []byte) ([]uint8, error) {
+   _, flags, err := fullBox(payload)
+   if err != nil {
+      return nil, err
+   }
+   data := payload[4:]
+   if flags&1 != 0 {
+      data = data[min(8, len(data)):]
+   }
+   if len(data) < 5 {
+      return nil, errors.New("saiz box too short")
+   }
+   count := binary.BigEndian.Uint32(data[1:])
+   if data[0] >= 1 {
+      sizes := make([]uint8, count)
+      for i := range sizes {
+         sizes[i] = data[0]
+      }
+      return sizes, nil
+   }
+   if uint64(len(data)-5) < uint64(count) {
+      return nil, errors.New("saiz box too short")
+   }
+   return data[5 : 5+count], nil
+}
+
+// parseSaio returns the offset of the auxiliary information of a track
+// fragment, which must be in one piece
+func parseSaio(payload []byte) (uint64, error) {
+   version, flags, err := fullBox(payload)
+   if err != nil {
+      return 0, err
+   }
+   data := payload[4:]
+   if flags&1 != 0 {
+      data = data[min(8, len(data)):]
+   }
+   if len(data) < 4 {
+      return 0, errors.New("saio box too short")
+   }
+   if binary.BigEndian.Uint32(data) != 1 {
+      return 0, errors.New("saio entry count is not 1")
+   }
+   data = data[4:]
+   if version >= 1 {
+      if len(data) < 8 {
+         return 0, errors.New("saio box too short")
+      }
+      return binary.BigEndian.Uint64(data), nil
+   }
+   if len(data) < 4 {
+      return 0, errors.New("saio box too short")
+   }
+   return uint64(binary.BigEndian.Uint32(data)), nil
+}
+
+// Decrypt decrypts a whole fragmented MP4 from src to dst. Only a moov, or a
+// moof along with its mdat, is held in memory, other boxes are copied through
+func (d *Decrypter) Decrypt(dst io.Writer, src io.Reader) error {
+   r := bufio.NewReader(src)
+   for {
+      header, size, err := readHeader(r)
+      if err == io.EOF {
+         return nil
+      }
+      if err != nil {
+         return err
+      }
+      var box []byte
+      switch string(header[4:8]) {
+      case "moov":
+         box, err = readBox(r, header, size)
+         if err != nil {
+            return err
+         }
+         box, err = d.Init(box)
+      case "moof":
+         box, err = readBox(r, header, size)
+         if err != nil {
+            return err
+         }
+         header, size, err = readHeader(r)
+         if err != nil {
+            return fmt.Errorf("mdat after moof: %w", err)
+         }
+         if string(header[4:8]) != "mdat" {
+            return fmt.Errorf("%v after moof", string(header[4:8]))
+         }
+         var mdat []byte
+         mdat, err = readBox(r, header, size)
+         if err != nil {
+            return err
+         }
+         box, err = d.Segment(append(box, mdat...))
+      default:
+         _, err = dst.Write(header)
+         if err != nil {
+            return err
+         }
+         if size == 0 {
+            _, err = io.Copy(dst, r)
+         } else {
+            _, err = io.CopyN(dst, r, int64(size)-int64(len(header)))
+         }
+         if err != nil {
+            return err
+         }
+         continue
+      }
+      if err != nil {
+         return err
+      }
+      _, err = dst.Write(box)
+      if err != nil {
+         return err
+      }
+   }
+}
+
+// readHeader reads the header of a box, along with the box size. Size 0 means
+// the box extends to the end of r
+func readHeader(r io.Reader) ([]byte, uint64, error) {
+   header := make([]byte, 8, 16)
+   _, err := io.ReadFull(r, header)
+   if err != nil {
+      if err == io.ErrUnexpectedEOF {
+         return nil, 0, errBoxSize
+      }
+      return nil, 0, err
+   }
+   size := uint64(binary.BigEndian.Uint32(header))
+   if size == 1 {
+      header = header[:16]
+      _, err = io.ReadFull(r, header[8:])
+      if err != nil {
+         return nil, 0, errBoxSize
+      }
+      size = binary.BigEndian.Uint64(header[8:])
+   }
+   if size != 0 && (size < uint64(len(header)) || size > math.MaxInt64) {
+      return nil, 0, fmt.Errorf("%v: %w", string(header[4:8]), errBoxSize)
+   }
+   return header, size, nil
+}
+
+// readBox reads the rest of a box after its header. The box is read as it
+// arrives, rather than allocated at the size of the header
+func readBox(r io.Reader, header []byte, size uint64) ([]byte, error) {
+   box := bytes.NewBuffer(header)
+   if size == 0 {
+      _, err := box.ReadFrom(r)
+      if err != nil {
+         return nil, err
+      }
+      return box.Bytes(), nil
+   }
+   rest := size - uint64(len(header))
+   n, err := box.ReadFrom(io.LimitReader(r, int64(rest)))
+   if err != nil {
+      return nil, err
+   }
+   if uint64(n) != rest {
+      return nil, fmt.Errorf("%v: %w", string(header[4:8]), errBoxSize)
+   }
+   return box.Bytes(), nil
+}
@@ -0,0 +1,206 @@
+package mp4
+
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "io"
+   "testing"
+
+   "41.neocities.org/diana/cdm"
+)
+
+func TestDecrypt(t *testing.T) {
+   tests := []Encrypter{
+      {Scheme: SchemeCenc, Iv: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+      {Scheme: SchemeCbc1, Iv: bytes.Repeat([]byte{3}, 16)},
+      {Scheme: SchemeCens, Iv: bytes.Repeat([]byte{4}, 8), CryptByteBlock: 2, SkipByteBlock: 1},
+      {Scheme: SchemeCbcs, Iv: bytes.Repeat([]byte{5}, 16)},
+      {
+         Scheme: SchemeCbcs,
+         Iv:     bytes.Repeat([]byte{6}, 16),
+         Subsamples: func(_ uint32, sample []byte) []Subsample {
+            half := len(sample) / 2
+            return []Subsample{
+               {3, uint32(half - 3)},
+               {7, uint32(len(sample) - half - 7)},
+            }
+         },
+      },
+   }
+   for _, e := range tests {
+      e.Kid, e.Key = testKid, testKey
+      init, err := e.Init(testInit())
+      if err != nil {
+         t.Fatal(e.Scheme, err)
+      }
+      segment, err := e.Segment(testSegment(testSamples()))
+      if err != nil {
+         t.Fatal(e.Scheme, err)
+      }
+      var d Decrypter
+      d.AddLicense(&cdm.License{Keys: []cdm.Key{
+         {Kid: testKid[:], Key: testKey, Type: cdm.KeyTypeContent},
+      }})
+      clearInit, err := d.Init(init)
+      if err != nil {
+         t.Fatal(e.Scheme, err)
+      }
+      if !bytes.Equal(clearInit, testInit()) {
+         t.Fatal(e.Scheme, "init")
+      }
+      clear, err := d.Segment(segment)
+      if err != nil {
+         t.Fatal(e.Scheme, err)
+      }
+      if !bytes.Equal(clear, testSegment(testSamples())) {
+         t.Fatal(e.Scheme, "segment")
+      }
+   }
+}
+
+func TestDecryptStream(t *testing.T) {
+   e := &Encrypter{
+      Scheme: SchemeCenc,
+      Kid:    testKid,
+      Key:    testKey,
+      Iv:     bytes.Repeat([]byte{2}, 8),
+      Pssh:   []*cdm.Pssh{{SystemId: cdm.Widevine, Data: []byte("widevine")}},
+   }
+   init, err := e.Init(testInit())
+   if err != nil {
+      t.Fatal(err)
+   }
+   var src []byte
+   src = append(src, init...)
+   for range 3 {
+      segment, err := e.Segment(testSegment(testSamples()))
+      if err != nil {
+         t.Fatal(err)
+      }
+      src = append(src, segment...)
+   }
+   d := &Decrypter{Keys: map[[16]byte][]byte{testKid: testKey}}
+   var dst bytes.Buffer
+   err = d.Decrypt(&dst, bytes.NewReader(src))
+   if err != nil {
+      t.Fatal(err)
+   }
+   want := testInit()
+   for range 3 {
+      want = append(want, testSegment(testSamples())...)
+   }
+   if !bytes.Equal(dst.Bytes(), want) {
+      t.Fatal("stream")
+   }
+   _, err = (&Decrypter{}).Segment(src[len(init):])
+   if err == nil {
+      t.Fatal("expected error for encrypted segment without init")
+   }
+   _, err = (&Decrypter{}).Segment(testSegment(testSamples()))
+   if err != nil {
+      t.Fatal("clear segment without init should pass through", err)
+   }
+   d = &Decrypter{}
+   err = d.Decrypt(&dst, bytes.NewReader(src))
+   if err == nil {
+      t.Fatal("expected error for missing key")
+   }
+}
+
+// TestDecryptSaio reads the auxiliary information through saiz and saio, as
+// for segments without senc
+func TestDecryptSaio(t *testing.T) {
+   e := &Encrypter{
+      Scheme: SchemeCenc,
+      Kid:    testKid,
+      Key:    testKey,
+      Iv:     bytes.Repeat([]byte{9}, 16),
+      Subsamples: func(_ uint32, sample []byte) []Subsample {
+         return []Subsample{{16, uint32(len(sample) - 16)}}
+      },
+   }
+   init, err := e.Init(testInit())
+   if err != nil {
+      t.Fatal(err)
+   }
+   segment, err := e.Segment(testSegment(testSamples()))
+   if err != nil {
+      t.Fatal(err)
+   }
+   boxes, err := ParseBoxes(segment)
+   if err != nil {
+      t.Fatal(err)
+   }
+   findBox(boxes, "moof").Find("traf", "senc").Type = "free"
+   d := &Decrypter{Keys: map[[16]byte][]byte{testKid: testKey}}
+   _, err = d.Init(init)
+   if err != nil {
+      t.Fatal(err)
+   }
+   clear, err := d.Segment(encodeBoxes(boxes))
+   if err != nil {
+      t.Fatal(err)
+   }
+   boxes, err = ParseBoxes(clear)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(findBox(boxes, "mdat").Payload, bytes.Join(testSamples(), nil)) {
+      t.Fatal("samples")
+   }
+}
+
+// TestDecryptSencOverride decrypts a senc box with its own IV size and KID
+func TestDecryptSencOverride(t *testing.T) {
+   e := &Encrypter{
+      Scheme: SchemeCenc, Kid: testKid, Key: testKey, Iv: bytes.Repeat([]byte{8}, 8),
+   }
+   init, err := e.Init(testInit())
+   if err != nil {
+      t.Fatal(err)
+   }
+   segment, err := e.Segment(testSegment(testSamples()))
+   if err != nil {
+      t.Fatal(err)
+   }
+   boxes, err := ParseBoxes(segment)
+   if err != nil {
+      t.Fatal(err)
+   }
+   traf := findBox(boxes, "moof").Child("traf")
+   senc := traf.Child("senc")
+   kid := [16]byte{0xff}
+   payload := binary.BigEndian.AppendUint32(nil, sencOverrideTrackEncryption)
+   payload = append(payload, 0, 0, 1, 8)
+   payload = append(payload, kid[:]...)
+   senc.Payload = append(payload, senc.Payload[4:]...)
+   setTrunDataOffset(traf.Child("trun").Payload, 20)
+   d := &Decrypter{Keys: map[[16]byte][]byte{kid: testKey}}
+   _, err = d.Init(init)
+   if err != nil {
+      t.Fatal(err)
+   }
+   clear, err := d.Segment(encodeBoxes(boxes))
+   if err != nil {
+      t.Fatal(err)
+   }
+   boxes, err = ParseBoxes(clear)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(findBox(boxes, "mdat").Payload, bytes.Join(testSamples(), nil)) {
+      t.Fatal("samples")
+   }
+}
+
+// TestReadBox reads a moof claiming to be far larger than the stream
+func TestReadBox(t *testing.T) {
+   header := binary.BigEndian.AppendUint32(nil, 1)
+   header = append(header, "moof"...)
+   header = binary.BigEndian.AppendUint64(header, 1<<40)
+   err := (&Decrypter{}).Decrypt(io.Discard, bytes.NewReader(append(header, 1, 2, 3)))
+   if !errors.Is(err, errBoxSize) {
+      t.Fatalf("expected errBoxSize, got %v", err)
+   }
+}
@@ -0,0 +1,224 @@
+package mp4
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+
+   "41.neocities.org/diana/cdm"
+)
+
+// Encrypter encrypts fragmented MP4 with a single key. Init must be called
+// with the init segment before Segment is called with the media segments
+type Encrypter struct {
+   // Scheme is usually SchemeCenc or SchemeCbcs
+   Scheme Scheme
+   Kid    [16]byte
+   Key    []byte
+   // Iv is the constant 16 byte IV of cbcs. Otherwise it is the 8 or 16 byte
+   // IV of the first sample, and the first 8 bytes are incremented for every
+   // sample after it
+   Iv []byte
+   // CryptByteBlock and SkipByteBlock are the pattern of the pattern
+   // schemes. Zero for both means 1:9
+   CryptByteBlock uint8
+   SkipByteBlock  uint8
+   // Pssh is added to moov
+   Pssh []*cdm.Pssh
+   // Subsamples returns the clear and protected ranges of a sample, such as
+   // to leave NAL unit headers clear. If nil, whole samples are protected
+   Subsamples func(trackId uint32, sample []byte) []Subsample
+   trexs      map[uint32]trex
+   samples    uint64
+}
+
+func (e *Encrypter) tenc() (*Tenc, error) {
+   if len(e.Key) != 16 {
+      return nil, fmt.Errorf("invalid key length %v", len(e.Key))
+   }
+   t := &Tenc{IsProtected: true, Kid: e.Kid}
+   if e.Scheme.pattern() {
+      t.CryptByteBlock, t.SkipByteBlock = e.CryptByteBlock, e.SkipByteBlock
+      if t.CryptByteBlock == 0 && t.SkipByteBlock == 0 {
+         t.CryptByteBlock, t.SkipByteBlock = 1, 9
+      }
+   }
+   switch {
+   case e.Scheme == SchemeCbcs:
+      if len(e.Iv) != 16 {
+         return nil, fmt.Errorf("invalid constant IV length %v", len(e.Iv))
+      }
+      t.ConstantIv = e.Iv
+   case len(e.Iv) == 8 || len(e.Iv) == 16:
+      t.PerSampleIvSize = uint8(len(e.Iv))
+   default:
+      return nil, fmt.Errorf("invalid IV length %v", len(e.Iv))
+   }
+   return t, nil
+}
+
+// Init encrypts the sample entries of the audio and video tracks of an init
+// segment, and adds the pssh boxes
+func (e *Encrypter) Init(data []byte) ([]byte, error) {
+   if !e.Scheme.valid() {
+      return nil, fmt.Errorf("unsupported scheme %q", e.Scheme)
+   }
+   tenc, err := e.tenc()
+   if err != nil {
+      return nil, err
+   }
+   boxes, err := ParseBoxes(data)
+   if err != nil {
+      return nil, err
+   }
+   moov := findBox(boxes, "moov")
+   if moov == nil {
+      return nil, errors.New("moov not found")
+   }
+   for _, trak := range moov.ChildrenOf("trak") {
+      var entryType string
+      switch handlerType(trak) {
+      case "vide":
+         entryType = "encv"
+      case "soun":
+         entryType = "enca"
+      default:
+         continue
+      }
+      stsd := trak.Find("mdia", "minf", "stbl", "stsd")
+      if stsd == nil {
+         return nil, errors.New("stsd not found in trak")
+      }
+      for _, entry := range stsd.Children {
+         if entry.Type == "encv" || entry.Type == "enca" {
+            return nil, fmt.Errorf("sample entry %v is already encrypted", entry.Type)
+         }
+         schm := binary.BigEndian.AppendUint32(nil, 0)
+         schm = append(schm, e.Scheme...)
+         schm = binary.BigEndian.AppendUint32(schm, 0x10000)
+         entry.Children = append(entry.Children, &Box{
+            Type: "sinf",
+            Children: []*Box{
+               {Type: "frma", Payload: []byte(entry.Type)},
+               {Type: "schm", Payload: schm},
+               {Type: "schi", Children: []*Box{tenc.box()}},
+            },
+         })
+         entry.Type = entryType
+      }
+   }
+   for _, pssh := range e.Pssh {
+      box, _, err := parseBox(pssh.Bytes())
+      if err != nil {
+         return nil, err
+      }
+      moov.Children = append(moov.Children, box)
+   }
+   e.trexs = parseTrexs(moov)
+   return encodeBoxes(boxes), nil
+}
+
+// Segment encrypts the samples of a media segment, adding the senc, saiz and
+// saio boxes to every track fragment
+func (e *Encrypter) Segment(data []byte) ([]byte, error) {
+   tenc, err := e.tenc()
+   if err != nil {
+      return nil, err
+   }
+   c, err := newCryptor(e.Scheme, e.Key, tenc.CryptByteBlock, tenc.SkipByteBlock)
+   if err != nil {
+      return nil, err
+   }
+   return segmentBoxes(data, func(moof *Box, moofStart int, segment []byte) error {
+      tracks, err := fragmentTracks(moof, moofStart, segment, e.trexs)
+      if err != nil {
+         return err
+      }
+      size := moof.Size()
+      saios := map[*Box]*Box{}
+      for _, track := range tracks {
+         if track.traf.Child("senc") != nil {
+            return fmt.Errorf("track %v is already encrypted", track.tfhd.trackId)
+         }
+         samples := make([]sampleEncryption, len(track.samples))
+         for i, r := range track.samples {
+            sample := segment[r[0]:r[1]]
+            if e.Subsamples != nil {
+               samples[i].Subsamples = e.Subsamples(track.tfhd.trackId, sample)
+            }
+            iv := e.Iv
+            if tenc.PerSampleIvSize >= 1 {
+               iv = e.nextIv()
+               samples[i].Iv = iv
+            }
+            err = c.sample(sample, iv, samples[i].Subsamples, true)
+            if err != nil {
+               return err
+            }
+         }
+         senc, sizes := encodeSenc(samples, e.Subsamples != nil)
+         saio := &Box{Type: "saio", Payload: make([]byte, 12)}
+         binary.BigEndian.PutUint32(saio.Payload[4:], 1)
+         track.traf.Children = append(
+            track.traf.Children, saizBox(sizes), saio, senc,
+         )
+         saios[senc] = saio
+      }
+      delta := moof.Size() - size
+      for _, traf := range moof.ChildrenOf("traf") {
+         for _, trun := range traf.ChildrenOf("trun") {
+            setTrunDataOffset(trun.Payload, delta)
+         }
+      }
+      // saio points past the flags and sample count of senc
+      for senc, saio := range saios {
+         binary.BigEndian.PutUint32(saio.Payload[8:], uint32(moof.offset(senc)+8))
+      }
+      return nil
+   })
+}
+
+func (e *Encrypter) nextIv() []byte {
+   iv := append([]byte{}, e.Iv...)
+   binary.BigEndian.PutUint64(iv, binary.BigEndian.Uint64(iv)+e.samples)
+   e.samples++
+   return iv
+}
+
+func saizBox(sizes []uint8) *Box {
+   payload := make([]byte, 4, 9+len(sizes))
+   var size uint8
+   if len(sizes) >= 1 {
+      size = sizes[0]
+      for _, s := range sizes {
+         if s != size {
+            size = 0
+            break
+         }
+      }
+   }
+   payload = append(payload, size)
+   payload = binary.BigEndian.AppendUint32(payload, uint32(len(sizes)))
+   if size == 0 {
+      payload = append(payload, sizes...)
+   }
+   return &Box{Type: "saiz", Payload: payload}
+}
+
+func findBox(boxes []*Box, boxType string) *Box {
+   for _, box := range boxes {
+      if box.Type == boxType {
+         return box
+      }
+   }
+   return nil
+}
+
+// handlerType returns the handler type of a trak, such as "vide" or "soun"
+func handlerType(trak *Box) string {
+   hdlr := trak.Find("mdia", "hdlr")
+   if hdlr == nil || len(hdlr.Payload) < 12 {
+      return ""
+   }
+   return string(hdlr.Payload[8:12])
+}
@@ -0,0 +1,251 @@
+package mp4
+
+import (
+   "bytes"
+   "crypto/aes"
+   "crypto/cipher"
+   "encoding/binary"
+   "testing"
+
+   "41.neocities.org/diana/cdm"
+)
+
+var (
+   testKey = []byte("0123456789abcdef")
+   testKid = [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+func testInit() []byte {
+   hdlr := make([]byte, 8, 25)
+   hdlr = append(hdlr, "vide"...)
+   hdlr = append(hdlr, make([]byte, 13)...)
+   tkhd := make([]byte, 84)
+   binary.BigEndian.PutUint32(tkhd[12:], 1)
+   trex := make([]byte, 24)
+   binary.BigEndian.PutUint32(trex[4:], 1)
+   binary.BigEndian.PutUint32(trex[8:], 1)
+   return encodeBoxes([]*Box{
+      {Type: "ftyp", Payload: []byte("iso6\x00\x00\x00\x00")},
+      {Type: "moov", Children: []*Box{
+         {Type: "mvhd", Payload: make([]byte, 100)},
+         {Type: "trak", Children: []*Box{
+            {Type: "tkhd", Payload: tkhd},
+            {Type: "mdia", Children: []*Box{
+               {Type: "mdhd", Payload: make([]byte, 24)},
+               {Type: "hdlr", Payload: hdlr},
+               {Type: "minf", Children: []*Box{
+                  {Type: "stbl", Children: []*Box{
+                     {Type: "stsd", Payload: []byte{0, 0, 0, 0, 0, 0, 0, 1}, Children: []*Box{
+                        {Type: "avc1", Payload: make([]byte, 78), Children: []*Box{
+                           {Type: "avcC", Payload: []byte{1, 0x64, 0, 0x1f}},
+                        }},
+                     }},
+                  }},
+               }},
+            }},
+         }},
+         {Type: "mvex", Children: []*Box{{Type: "trex", Payload: trex}}},
+      }},
+   })
+}
+
+func testSegment(samples [][]byte) []byte {
+   tfhd := binary.BigEndian.AppendUint32(nil, tfhdDefaultBaseIsMoof)
+   tfhd = binary.BigEndian.AppendUint32(tfhd, 1)
+   trun := binary.BigEndian.AppendUint32(nil, trunDataOffset|trunSampleSize)
+   trun = binary.BigEndian.AppendUint32(trun, uint32(len(samples)))
+   trun = binary.BigEndian.AppendUint32(trun, 0)
+   var mdat []byte
+   for _, sample := range samples {
+      trun = binary.BigEndian.AppendUint32(trun, uint32(len(sample)))
+      mdat = append(mdat, sample...)
+   }
+   moof := &Box{Type: "moof", Children: []*Box{
+      {Type: "mfhd", Payload: make([]byte, 8)},
+      {Type: "traf", Children: []*Box{
+         {Type: "tfhd", Payload: tfhd},
+         {Type: "tfdt", Payload: make([]byte, 8)},
+         {Type: "trun", Payload: trun},
+      }},
+   }}
+   binary.BigEndian.PutUint32(trun[8:], uint32(moof.Size()+8))
+   return encodeBoxes([]*Box{
+      {Type: "styp", Payload: []byte("msdh\x00\x00\x00\x00")},
+      moof,
+      {Type: "mdat", Payload: mdat},
+   })
+}
+
+func testSamples() [][]byte {
+   var samples [][]byte
+   for i := range 3 {
+      sample := make([]byte, 100+i*37)
+      for j := range sample {
+         sample[j] = byte(i + j)
+      }
+      samples = append(samples, sample)
+   }
+   return samples
+}
+
+// encryptedSamples returns the senc samples of the first track fragment,
+// checking saio, and the samples as located by trun
+func encryptedSamples(t *testing.T, segment []byte, ivSize int) ([]sampleEncryption, [][]byte) {
+   t.Helper()
+   boxes, err := ParseBoxes(segment)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moofStart := findBox(boxes, "styp").Size()
+   moof := findBox(boxes, "moof")
+   traf := moof.Child("traf")
+   senc, saio, saiz := traf.Child("senc"), traf.Child("saio"), traf.Child("saiz")
+   if senc == nil || saio == nil || saiz == nil {
+      t.Fatal("senc, saio or saiz not found")
+   }
+   offset := moofStart + int(binary.BigEndian.Uint32(saio.Payload[8:]))
+   if !bytes.HasPrefix(segment[offset:], senc.Payload[8:]) {
+      t.Fatal("saio does not point to senc")
+   }
+   info, _, err := parseSenc(senc.Payload, ivSize)
+   if err != nil {
+      t.Fatal(err)
+   }
+   tracks, err := fragmentTracks(moof, moofStart, segment, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   var samples [][]byte
+   for _, r := range tracks[0].samples {
+      samples = append(samples, segment[r[0]:r[1]])
+   }
+   return info, samples
+}
+
+func TestEncryptInit(t *testing.T) {
+   e := &Encrypter{
+      Scheme: SchemeCenc,
+      Kid:    testKid,
+      Key:    testKey,
+      Iv:     []byte{0, 0, 0, 0, 0, 0, 0, 1},
+      Pssh: []*cdm.Pssh{
+         {SystemId: cdm.Widevine, Data: []byte("widevine")},
+         {SystemId: cdm.PlayReady, Data: []byte("pro")},
+      },
+   }
+   init, err := e.Init(testInit())
+   if err != nil {
+      t.Fatal(err)
+   }
+   boxes, err := ParseBoxes(init)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov := findBox(boxes, "moov")
+   if n := len(moov.ChildrenOf("pssh")); n != 2 {
+      t.Fatalf("%v pssh boxes", n)
+   }
+   entry := moov.Find("trak", "mdia", "minf", "stbl", "stsd", "encv")
+   if entry == nil {
+      t.Fatal("encv not found")
+   }
+   if entry.Child("avcC") == nil {
+      t.Fatal("avcC not kept")
+   }
+   if frma := entry.Find("sinf", "frma"); string(frma.Payload) != "avc1" {
+      t.Fatalf("frma %q", frma.Payload)
+   }
+   if schm := entry.Find("sinf", "schm"); string(schm.Payload[4:8]) != "cenc" {
+      t.Fatalf("schm %q", schm.Payload)
+   }
+   tenc, err := parseTenc(entry.Find("sinf", "schi", "tenc").Payload)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if tenc.Kid != testKid || !tenc.IsProtected || tenc.PerSampleIvSize != 8 {
+      t.Fatalf("%+v", tenc)
+   }
+   _, err = e.Init(init)
+   if err == nil {
+      t.Fatal("expected error for encrypted init")
+   }
+}
+
+func TestEncryptCenc(t *testing.T) {
+   e := &Encrypter{
+      Scheme: SchemeCenc,
+      Kid:    testKid,
+      Key:    testKey,
+      Iv:     []byte{9, 9, 9, 9, 0, 0, 0, 0},
+      Subsamples: func(_ uint32, sample []byte) []Subsample {
+         return []Subsample{{5, uint32(len(sample) - 5)}}
+      },
+   }
+   _, err := e.Init(testInit())
+   if err != nil {
+      t.Fatal(err)
+   }
+   clear := testSamples()
+   segment, err := e.Segment(testSegment(clear))
+   if err != nil {
+      t.Fatal(err)
+   }
+   info, samples := encryptedSamples(t, segment, 8)
+   if len(info) != len(clear) || len(samples) != len(clear) {
+      t.Fatalf("%v senc samples, %v samples", len(info), len(samples))
+   }
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   for i, sample := range samples {
+      if binary.BigEndian.Uint64(info[i].Iv) != 0x0909090900000000+uint64(i) {
+         t.Fatalf("sample %v IV %x", i, info[i].Iv)
+      }
+      if !bytes.Equal(sample[:5], clear[i][:5]) {
+         t.Fatalf("sample %v clear data changed", i)
+      }
+      if bytes.Equal(sample, clear[i]) {
+         t.Fatalf("sample %v not encrypted", i)
+      }
+      iv := append(bytes.Clone(info[i].Iv), make([]byte, 8)...)
+      decrypted := bytes.Clone(sample)
+      cipher.NewCTR(block, iv).XORKeyStream(decrypted[5:], decrypted[5:])
+      if !bytes.Equal(decrypted, clear[i]) {
+         t.Fatalf("sample %v", i)
+      }
+   }
+}
+
+func TestEncryptCbcs(t *testing.T) {
+   iv := bytes.Repeat([]byte{7}, 16)
+   e := &Encrypter{Scheme: SchemeCbcs, Kid: testKid, Key: testKey, Iv: iv}
+   _, err := e.Init(testInit())
+   if err != nil {
+      t.Fatal(err)
+   }
+   clear := testSamples()
+   segment, err := e.Segment(testSegment(clear))
+   if err != nil {
+      t.Fatal(err)
+   }
+   info, samples := encryptedSamples(t, segment, 0)
+   block, err := aes.NewCipher(testKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   for i, sample := range samples {
+      if len(info[i].Iv) >= 1 {
+         t.Fatalf("sample %v has IV with constant IV", i)
+      }
+      // 1:9 pattern: the first block is encrypted and the next nine are clear
+      first := make([]byte, 16)
+      cipher.NewCBCDecrypter(block, iv).CryptBlocks(first, sample[:16])
+      if !bytes.Equal(first, clear[i][:16]) {
+         t.Fatalf("sample %v first block", i)
+      }
+      if !bytes.Equal(sample[16:], clear[i][16:]) {
+         t.Fatalf("sample %v skipped blocks changed", i)
+      }
+   }
+}
@@ -0,0 +1,226 @@
+package mp4
+
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "fmt"
+)
+
+const (
+   tfhdBaseDataOffset         = 0x1
+   tfhdSampleDescriptionIndex = 0x2
+   tfhdDefaultSampleDuration  = 0x8
+   tfhdDefaultSampleSize      = 0x10
+   tfhdDefaultSampleFlags     = 0x20
+   tfhdDefaultBaseIsMoof      = 0x20000
+
+   trunDataOffset       = 0x1
+   trunFirstSampleFlags = 0x4
+   trunSampleDuration   = 0x100
+   trunSampleSize       = 0x200
+   trunSampleFlags      = 0x400
+   trunCompositionTime  = 0x800
+)
+
+// trex is the track extends defaults of the init segment
+type trex struct {
+   sampleDescriptionIndex uint32
+   sampleSize             uint32
+}
+
+// tfhd is a track fragment header
+type tfhd struct {
+   trackId                uint32
+   flags                  uint32
+   sampleDescriptionIndex uint32
+   sampleSize             uint32
+   hasSampleSize          bool
+}
+
+func parseTfhd(payload []byte) (*tfhd, error) {
+   _, flags, err := fullBox(payload)
+   if err != nil {
+      return nil, err
+   }
+   if len(payload) < 8 {
+      return nil, errors.New("tfhd box too short")
+   }
+   t := &tfhd{trackId: binary.BigEndian.Uint32(payload[4:]), flags: flags}
+   if flags&tfhdBaseDataOffset != 0 {
+      return nil, errors.New("tfhd base data offset is not supported")
+   }
+   offset := 8
+   read := func() (uint32, error) {
+      if len(payload) < offset+4 {
+         return 0, errors.New("tfhd box too short")
+      }
+      offset += 4
+      return binary.BigEndian.Uint32(payload[offset-4:]), nil
+   }
+   if flags&tfhdSampleDescriptionIndex != 0 {
+      if t.sampleDescriptionIndex, err = read(); err != nil {
+         return nil, err
+      }
+   }
+   if flags&tfhdDefaultSampleDuration != 0 {
+      if _, err = read(); err != nil {
+         return nil, err
+      }
+   }
+   if flags&tfhdDefaultSampleSize != 0 {
+      if t.sampleSize, err = read(); err != nil {
+         return nil, err
+      }
+      t.hasSampleSize = true
+   }
+   return t, nil
+}
+
+// trun is a track run: its data offset and the sample sizes
+type trun struct {
+   dataOffset int32
+   sizes      []uint32
+}
+
+func parseTrun(payload []byte, defaultSize uint32) (*trun, error) {
+   _, flags, err := fullBox(payload)
+   if err != nil {
+      return nil, err
+   }
+   if flags&trunDataOffset == 0 {
+      return nil, errors.New("trun without data offset is not supported")
+   }
+   if len(payload) < 12 {
+      return nil, errors.New("trun box too short")
+   }
+   count := binary.BigEndian.Uint32(payload[4:])
+   t := &trun{dataOffset: int32(binary.BigEndian.Uint32(payload[8:]))}
+   offset := 12
+   if flags&trunFirstSampleFlags != 0 {
+      offset += 4
+   }
+   var fieldSize int
+   for _, flag := range []uint32{
+      trunSampleDuration, trunSampleSize, trunSampleFlags, trunCompositionTime,
+   } {
+      if flags&flag != 0 {
+         fieldSize += 4
+      }
+   }
+   if uint64(count)*uint64(fieldSize) > uint64(len(payload)-min(offset, len(payload))) {
+      return nil, errors.New("trun box too short")
+   }
+   t.sizes = make([]uint32, count)
+   for i := range t.sizes {
+      field := offset
+      if flags&trunSampleDuration != 0 {
+         field += 4
+      }
+      if flags&trunSampleSize != 0 {
+         t.sizes[i] = binary.BigEndian.Uint32(payload[field:])
+      } else {
+         t.sizes[i] = defaultSize
+      }
+      offset += fieldSize
+   }
+   return t, nil
+}
+
+// setTrunDataOffset shifts the data offset of a trun payload by delta
+func setTrunDataOffset(payload []byte, delta int) {
+   offset := int32(binary.BigEndian.Uint32(payload[8:]))
+   binary.BigEndian.PutUint32(payload[8:], uint32(offset+int32(delta)))
+}
+
+// fragmentTrack is a track fragment along with the position of its samples
+// in the segment
+type fragmentTrack struct {
+   traf    *Box
+   tfhd    *tfhd
+   samples [][2]int
+}
+
+// fragmentTracks locates the samples of every track fragment of moof, which
+// starts at moofStart in segment
+func fragmentTracks(moof *Box, moofStart int, segment []byte, trexs map[uint32]trex) ([]*fragmentTrack, error) {
+   var tracks []*fragmentTrack
+   for i, traf := range moof.ChildrenOf("traf") {
+      box := traf.Child("tfhd")
+      if box == nil {
+         return nil, errors.New("tfhd not found in traf")
+      }
+      header, err := parseTfhd(box.Payload)
+      if err != nil {
+         return nil, err
+      }
+      // otherwise the data of this track follows that of the one before
+      if i >= 1 && header.flags&tfhdDefaultBaseIsMoof == 0 {
+         return nil, errors.New("tfhd without default base is moof is not supported")
+      }
+      defaults := trexs[header.trackId]
+      if !header.hasSampleSize {
+         header.sampleSize = defaults.sampleSize
+      }
+      if header.flags&tfhdSampleDescriptionIndex == 0 {
+         header.sampleDescriptionIndex = defaults.sampleDescriptionIndex
+      }
+      track := &fragmentTrack{traf: traf, tfhd: header}
+      for _, box := range traf.ChildrenOf("trun") {
+         run, err := parseTrun(box.Payload, header.sampleSize)
+         if err != nil {
+            return nil, err
+         }
+         start := moofStart + int(run.dataOffset)
+         for _, size := range run.sizes {
+            end := start + int(size)
+            if start < 0 || end > len(segment) {
+               return nil, fmt.Errorf("track %v sample outside of segment", header.trackId)
+            }
+            track.samples = append(track.samples, [2]int{start, end})
+            start = end
+         }
+      }
+      tracks = append(tracks, track)
+   }
+   return tracks, nil
+}
+
+// parseTrexs returns the track extends defaults of moov by track ID
+func parseTrexs(moov *Box) map[uint32]trex {
+   trexs := map[uint32]trex{}
+   if mvex := moov.Child("mvex"); mvex != nil {
+      for _, box := range mvex.ChildrenOf("trex") {
+         if len(box.Payload) >= 24 {
+            trexs[binary.BigEndian.Uint32(box.Payload[4:])] = trex{
+               sampleDescriptionIndex: binary.BigEndian.Uint32(box.Payload[8:]),
+               sampleSize:             binary.BigEndian.Uint32(box.Payload[16:]),
+            }
+         }
+      }
+   }
+   return trexs
+}
+
+// segmentBoxes walks the top level boxes of a copy of a media segment,
+// calling do for each moof along with the copy and the moof offset in it, and
+// returns the copy encoded again. Samples can be changed in place
+func segmentBoxes(segment []byte, do func(moof *Box, moofStart int, segment []byte) error) ([]byte, error) {
+   segment = bytes.Clone(segment)
+   boxes, err := ParseBoxes(segment)
+   if err != nil {
+      return nil, err
+   }
+   var offset int
+   for _, box := range boxes {
+      size := box.Size()
+      if box.Type == "moof" {
+         err = do(box, offset, segment)
+         if err != nil {
+            return nil, err
+         }
+      }
+      offset += size
+   }
+   return encodeBoxes(boxes), nil
+}
@@ -0,0 +1,93 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "errors"
+
+   "41.neocities.org/diana/playReady/xml"
+)
+
+// AcknowledgementRequired reports whether the server expects an
+// AcknowledgeLicense challenge for this license
+func (l *License) AcknowledgementRequired() bool {
+   return len(l.TransactionId) >= 1
+}
+
+// AcknowledgeRequestBytes builds a signed AcknowledgeLicense SOAP challenge
+// for licenses, which must all come from the same license response
+func (c *Chain) AcknowledgeRequestBytes(signingKey *ecdsa.PrivateKey, licenses ...*License) ([]byte, error) {
+   if len(licenses) == 0 {
+      return nil, errors.New("no licenses to acknowledge")
+   }
+   transactionId := licenses[0].TransactionId
+   if len(transactionId) == 0 {
+      return nil, errors.New("license has no transaction ID")
+   }
+   var results xml.LicenseStorageResults
+   for _, license := range licenses {
+      if !bytes.Equal(license.TransactionId, transactionId) {
+         return nil, errors.New("licenses have different transaction IDs")
+      }
+      results.License = append(results.License, xml.LicenseStorageResult{
+         Kid: license.ContainerOuter.ContainerKeys.ContentKey.GuidKeyID, // microsoft.com
+         Lid: license.RightsIdBuffer,                                    // microsoft.com
+      })
+   }
+
+   encryptedData, err := c.encryptedData(nil)
+   if err != nil {
+      return nil, err
+   }
+
+   ack := &xml.Ack{
+      EncryptedData:         *encryptedData,                                       // microsoft.com
+      Id:                    "SignedData",                                         // microsoft.com
+      LicenseStorageResults: results,                                              // microsoft.com
+      TransactionId:         transactionId,                                        // microsoft.com
+      Version:               "1",                                                  // microsoft.com
+      XmlNs:                 "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+   }
+   ackData, err := xml.Marshal(ack)
+   if err != nil {
+      return nil, err
+   }
+   signature, err := newSignature(signingKey, ackData)
+   if err != nil {
+      return nil, err
+   }
+
+   envelope := xml.Envelope{
+      Body: xml.Body{ // microsoft.com
+         AcknowledgeLicense: &xml.AcknowledgeLicense{ // microsoft.com
+            Challenge: xml.OuterChallenge{ // microsoft.com
+               Challenge: xml.InnerChallenge{ // microsoft.com
+                  Ack:       ack,                                                           // microsoft.com
+                  Signature: *signature,                                                    // microsoft.com
+                  XmlNs:     "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+               },
+            },
+            XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+         },
+      },
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   }
+   return xml.Marshal(envelope)
+}
+
+// ParseAcknowledgement checks an AcknowledgeLicense response. A SOAP fault is
+// returned as *FaultError
+func ParseAcknowledgement(data []byte, transactionId []byte) error {
+   envelope, err := decodeEnvelope(data)
+   if err != nil {
+      return err
+   }
+   if envelope.Body.AcknowledgeLicenseResponse == nil {
+      return errors.New("AcknowledgeLicenseResponse not found")
+   }
+   response := &envelope.Body.AcknowledgeLicenseResponse.AcknowledgeLicenseResult.Response.AckResponse
+   if !bytes.Equal(response.TransactionId, transactionId) {
+      return errors.New("acknowledgement transaction ID mismatch")
+   }
+   return nil
+}
@@ -21,30 +21,34 @@ const (
 )
 
 func ParsePro(data []byte) (*xml.WrmHeader, error) {
-   if len(data) < 10 {
-      return nil, errors.New("data too short for PlayReady Object")
+   if len(data) < 6 {
+      return nil, &DecodeError{formatPro, 0, ErrTruncated}
    }
    proLength := binary.LittleEndian.Uint32(data[0:4])
+   if proLength < 6 {
+      return nil, &DecodeError{formatPro, 0, ErrInvalidLength}
+   }
    if proLength > uint32(len(data)) {
-      return nil, errors.New("PRO length exceeds data size")
+      return nil, &DecodeError{formatPro, 0, ErrTruncated}
    }
+   data = data[:proLength]
    recordCount := binary.LittleEndian.Uint16(data[4:6])
-   var offset uint16 = 6
+   offset := 6
    for range recordCount {
-      if int(offset+4) > len(data) {
-         break
+      if offset+4 > len(data) {
+         return nil, &DecodeError{formatPro, offset, ErrTruncated}
       }
       recordType := binary.LittleEndian.Uint16(data[offset : offset+2])
-      recordLength := binary.LittleEndian.Uint16(data[offset+2 : offset+4])
-      offset += 4
-      if int(offset+recordLength) > len(data) {
-         return nil, errors.New("record length exceeds data size")
+      recordLength := int(binary.LittleEndian.Uint16(data[offset+2 : offset+4]))
+      if offset+4+recordLength > len(data) {
+         return nil, &DecodeError{formatPro, offset + 2, ErrTruncated}
       }
+      offset += 4
       // Type 1 is the Rights Management (RM) Header which contains the XML
       if recordType == 1 {
          xmlData := data[offset : offset+recordLength]
          if len(xmlData)%2 != 0 {
-            return nil, errors.New("invalid UTF-16LE data length")
+            return nil, &DecodeError{formatPro, offset - 2, ErrInvalidLength}
          }
          u16s := make([]uint16, len(xmlData)/2)
          for j := range u16s {
@@ -62,6 +66,30 @@ func ParsePro(data []byte) (*xml.WrmHeader, error) {
    return nil, errors.New("WRMHEADER record not found")
 }
 
+// EncodePro returns a PlayReady Object holding header as its only record. The
+// KID is in GUID byte order
+func EncodePro(header *xml.WrmHeader) ([]byte, error) {
+   text, err := xml.Marshal(struct {
+      XMLName xml.Name `xml:"WRMHEADER"`
+      *xml.WrmHeader
+   }{WrmHeader: header})
+   if err != nil {
+      return nil, err
+   }
+   var record []byte
+   for _, u := range utf16.Encode([]rune(string(text))) {
+      record = binary.LittleEndian.AppendUint16(record, u)
+   }
+   if len(record) > 0xffff {
+      return nil, errors.New("WRMHEADER too long for a PRO record")
+   }
+   data := binary.LittleEndian.AppendUint32(nil, uint32(10+len(record)))
+   data = binary.LittleEndian.AppendUint16(data, 1)
+   data = binary.LittleEndian.AppendUint16(data, 1)
+   data = binary.LittleEndian.AppendUint16(data, uint16(len(record)))
+   return append(data, record...), nil
+}
+
 type BasicInfo struct {
    Header         ObjectHeader
    CertificateID  CertId
@@ -96,6 +124,82 @@ const (
    BcertObjectSecurityVersion2 BcertObject = 0x0011
 )
 
+// CertType is BasicInfo.Type
+type CertType uint32
+
+const (
+   CertTypeUnknown          CertType = 0x00000000
+   CertTypePc               CertType = 0x00000001
+   CertTypeDevice           CertType = 0x00000002
+   CertTypeDomain           CertType = 0x00000003
+   CertTypeIssuer           CertType = 0x00000004
+   CertTypeCrlSigner        CertType = 0x00000005
+   CertTypeService          CertType = 0x00000006
+   CertTypeSilverlight      CertType = 0x00000007
+   CertTypeApplication      CertType = 0x00000008
+   CertTypeMetering         CertType = 0x00000009
+   CertTypeKeyFileSigner    CertType = 0x0000000a
+   CertTypeServer           CertType = 0x0000000b
+   CertTypeLicenseSigner    CertType = 0x0000000c
+   CertTypeSecureTimeServer CertType = 0x0000000d
+   CertTypeRprovModelAuth   CertType = 0x0000000e
+)
+
+// KeyUsage is an entry of CertKey.UsageSet
+type KeyUsage uint32
+
+const (
+   KeyUsageUnknown                             KeyUsage = 0x00000000
+   KeyUsageSign                                KeyUsage = 0x00000001
+   KeyUsageEncryptKey                          KeyUsage = 0x00000002
+   KeyUsageSignCrl                             KeyUsage = 0x00000003
+   KeyUsageIssuerAll                           KeyUsage = 0x00000004
+   KeyUsageIssuerIndiv                         KeyUsage = 0x00000005
+   KeyUsageIssuerDevice                        KeyUsage = 0x00000006
+   KeyUsageIssuerLink                          KeyUsage = 0x00000007
+   KeyUsageIssuerDomain                        KeyUsage = 0x00000008
+   KeyUsageIssuerSilverlight                   KeyUsage = 0x00000009
+   KeyUsageIssuerApplication                   KeyUsage = 0x0000000a
+   KeyUsageIssuerCrl                           KeyUsage = 0x0000000b
+   KeyUsageIssuerMetering                      KeyUsage = 0x0000000c
+   KeyUsageIssuerSignKeyFile                   KeyUsage = 0x0000000d
+   KeyUsageSignKeyFile                         KeyUsage = 0x0000000e
+   KeyUsageIssuerServer                        KeyUsage = 0x0000000f
+   KeyUsageEncryptKeySampleProtectionRc4       KeyUsage = 0x00000010
+   KeyUsageReserved2                           KeyUsage = 0x00000011
+   KeyUsageIssuerSignLicense                   KeyUsage = 0x00000012
+   KeyUsageSignLicense                         KeyUsage = 0x00000013
+   KeyUsageSignResponse                        KeyUsage = 0x00000014
+   KeyUsagePrndEncryptKeyDeprecated            KeyUsage = 0x00000015
+   KeyUsageEncryptKeySampleProtectionAes128Ctr KeyUsage = 0x00000016
+   KeyUsageIssuerSecurityVersion               KeyUsage = 0x00000017
+   KeyUsageSignSecurityVersion                 KeyUsage = 0x00000018
+)
+
+// Feature is an entry of FeatureInfo.FeatureSet
+type Feature uint32
+
+const (
+   FeatureTransmitter         Feature = 0x00000001
+   FeatureReceiver            Feature = 0x00000002
+   FeatureSharedCertificate   Feature = 0x00000003
+   FeatureSecureClock         Feature = 0x00000004
+   FeatureAntiRollbackClock   Feature = 0x00000005
+   FeatureReservedMetering    Feature = 0x00000006
+   FeatureReservedLicSync     Feature = 0x00000007
+   FeatureReservedSymOpt      Feature = 0x00000008
+   FeatureSupportsCrls        Feature = 0x00000009
+   FeatureServerBuildDevice   Feature = 0x0000000a
+   FeatureServerBuildService  Feature = 0x0000000b
+   FeatureSupportsPr3Features Feature = 0x0000000c
+   FeatureScalable            Feature = 0x0000000d
+)
+
+// SignatureType is SignatureInfo.SignatureType
+type SignatureType uint16
+
+const SignatureTypeP256 SignatureType = 0x0001
+
 type CertHeader struct {
    HeaderTag           uint32 // = CertHeaderTag
    Version             uint32 // = CertVersion
@@ -204,6 +308,18 @@ type Certificate struct {
    ManufacturerInfo *ManufacturerInfo
    SignatureInfo    *SignatureInfo
 
+   DomainInfo         *DomainInfo
+   PcInfo             *PcInfo
+   SilverlightInfo    *SilverlightInfo
+   MeteringInfo       *MeteringInfo
+   ExtDataSignKeyInfo *ExtDataSignKeyInfo
+   ExtDataContainer   *ExtDataContainer
+   ExtDataSignature   *ExtDataSignature
+   ExtDataHwid        *ExtDataHwid
+   ServerInfo         *ServerInfo
+   SecurityVersion    *SecurityVersionInfo
+   SecurityVersion2   *SecurityVersionInfo
+
    RecordOrder    []uint16
    UnknownRecords map[uint16][]UnknownRecord
 }
@@ -2,6 +2,9 @@ package playReady
 
 import (
    "encoding/hex"
+   "errors"
+   "reflect"
+   "strings"
    "testing"
 )
 
@@ -49,4 +52,32 @@ func TestParsePro(t *testing.T) {
    }
 }
 
+func TestEncodePro(t *testing.T) {
+   data, err := hex.DecodeString(hexStr)
+   if err != nil {
+      t.Fatal(err)
+   }
+   header, err := ParsePro(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   data, err = EncodePro(header)
+   if err != nil {
+      t.Fatal(err)
+   }
+   decoded, err := ParsePro(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !reflect.DeepEqual(decoded, header) {
+      t.Fatalf("%+v", decoded)
+   }
+   header.Data.LaUrl = strings.Repeat("a", 0x8000)
+   _, err = EncodePro(header)
+   var decodeErr *DecodeError
+   if err == nil || errors.As(err, &decodeErr) {
+      t.Fatalf("expected encoding error, got %v", err)
+   }
+}
+
 const hexStr = "0e0300000100010004033c00570052004d00480045004100440045005200200078006d006c006e0073003d00220068007400740070003a002f002f0073006300680065006d00610073002e006d006900630072006f0073006f00660074002e0063006f006d002f00440052004d002f0032003000300037002f00300033002f0050006c00610079005200650061006400790048006500610064006500720022002000760065007200730069006f006e003d00220034002e0030002e0030002e00300022003e003c0044004100540041003e003c00500052004f00540045004300540049004e0046004f003e003c004b00450059004c0045004e003e00310036003c002f004b00450059004c0045004e003e003c0041004c004700490044003e004100450053004300540052003c002f0041004c004700490044003e003c002f00500052004f00540045004300540049004e0046004f003e003c004b00490044003e004800790071005700500036007100320058004e007500380053004500330032006e00660032007000630051003d003d003c002f004b00490044003e003c004c0041005f00550052004c003e0068007400740070003a002f002f006c006900630065006e00730065002e003900630039006d0065006400690061002e00630061002f0070006c0061007900720065006100640079003c002f004c0041005f00550052004c003e003c0043004800450043004b00530055004d003e004b00480063003200500049006900680038006b006f003d003c002f0043004800450043004b00530055004d003e003c0043005500530054004f004d0041005400540052004900420055005400450053003e003c0043004f004e00540045004e005400490044003e00660066002d00340031006600340034003600620064002d0031003400370034003200340037003c002f0043004f004e00540045004e005400490044003e003c002f0043005500530054004f004d0041005400540052004900420055005400450053003e003c002f0044004100540041003e003c002f00570052004d004800450041004400450052003e00"
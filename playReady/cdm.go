@@ -0,0 +1,155 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "crypto/rand"
+   "errors"
+   "sync"
+   "time"
+
+   "41.neocities.org/diana/cdm"
+   "41.neocities.org/diana/playReady/xml"
+)
+
+// Cdm implements cdm.Cdm with a device certificate chain and its keys
+type Cdm struct {
+   Chain      *Chain
+   SigningKey *ecdsa.PrivateKey
+   EncryptKey *ecdsa.PrivateKey
+   // Options is used for every challenge, and can be nil. Without a
+   // LicenseNonce, each challenge has a random one
+   Options *ChallengeOptions
+   // ResponseOptions checks the signature of every response, and can be nil.
+   // LicenseNonce is that of the challenge the response answers
+   ResponseOptions *ResponseOptions
+   // Licenses keeps root licenses for chained leaf licenses, and joined
+   // domains for domain bound licenses
+   Licenses LicenseStore
+   mu       sync.Mutex
+   // challenges are the KIDs of the challenges not yet answered, by license
+   // nonce
+   challenges map[string][]byte
+}
+
+func (c *Cdm) SystemId() cdm.SystemId {
+   return cdm.PlayReady
+}
+
+// Challenge returns an AcquireLicense challenge for a PlayReady Object, or a
+// pssh box holding one
+func (c *Cdm) Challenge(initData []byte) ([]byte, error) {
+   data, err := cdm.InitData(initData, cdm.PlayReady)
+   if err != nil {
+      return nil, err
+   }
+   header, err := ParsePro(data)
+   if err != nil {
+      return nil, err
+   }
+   if len(header.Data.Kid) == 0 {
+      return nil, errors.New("KID not found in WRMHEADER")
+   }
+   var contentId string
+   if header.Data.CustomAttributes != nil {
+      contentId = header.Data.CustomAttributes.ContentId
+   }
+   var opts ChallengeOptions
+   if c.Options != nil {
+      opts = *c.Options
+   }
+   if opts.LicenseNonce == nil {
+      opts.LicenseNonce = make([]byte, 16)
+      rand.Read(opts.LicenseNonce)
+   }
+   challenge, err := c.Chain.LicenseRequestBytes(c.SigningKey, header.Data.Kid, contentId, &opts)
+   if err != nil {
+      return nil, err
+   }
+   c.mu.Lock()
+   defer c.mu.Unlock()
+   if c.challenges == nil {
+      c.challenges = map[string][]byte{}
+   }
+   c.challenges[string(opts.LicenseNonce)] = header.Data.Kid
+   return challenge, nil
+}
+
+// Response verifies an AcquireLicense response to a challenge, then decrypts
+// every license. Root licenses are decrypted before the leaf licenses chained
+// to them. A license without KID, as with an optimized content key, is for
+// the KID of the challenge
+func (c *Cdm) Response(data []byte) (*cdm.License, error) {
+   decoded, err := decodeLicenseResponse(data)
+   if err != nil {
+      return nil, err
+   }
+   c.mu.Lock()
+   challengeKid, ok := c.challenges[string(decoded.LicenseNonce)]
+   c.mu.Unlock()
+   if !ok {
+      return nil, errors.New("no challenge with the license nonce")
+   }
+   var opts ResponseOptions
+   if c.ResponseOptions != nil {
+      opts = *c.ResponseOptions
+   }
+   opts.LicenseNonce = decoded.LicenseNonce
+   err = decoded.verify(&opts)
+   if err != nil {
+      return nil, err
+   }
+   var roots, leaves []*License
+   for _, data := range decoded.licenses {
+      l := &License{}
+      err = l.decode(data)
+      if err != nil {
+         return nil, err
+      }
+      if l.IsLeaf() {
+         leaves = append(leaves, l)
+      } else {
+         roots = append(roots, l)
+      }
+   }
+   var response cdm.License
+   for _, l := range append(roots, leaves...) {
+      contentKey, err := c.Licenses.Decrypt(l, c.EncryptKey)
+      if err != nil {
+         return nil, err
+      }
+      key, err := l.ContainerOuter.ContainerKeys.contentKey()
+      if err != nil {
+         return nil, err
+      }
+      kid := key.GuidKeyID
+      if kid == nil {
+         kid = challengeKid
+      }
+      kid = bytes.Clone(kid)
+      UuidOrGuid(kid)
+      response.Keys = append(response.Keys, cdm.Key{
+         Kid: kid, Key: contentKey, Type: cdm.KeyTypeContent,
+      })
+      expiration := &l.ContainerOuter.Expiration
+      if expiration.Valid && expiration.EndDate != neverExpires {
+         end := time.Unix(int64(expiration.EndDate), 0)
+         if response.Expiration.IsZero() || end.Before(response.Expiration) {
+            response.Expiration = end
+         }
+      }
+   }
+   c.mu.Lock()
+   delete(c.challenges, string(decoded.LicenseNonce))
+   c.mu.Unlock()
+   return &response, nil
+}
+
+// PsshPro returns a version 0 pssh box holding a PlayReady Object of header
+func PsshPro(header *xml.WrmHeader) (*cdm.Pssh, error) {
+   data, err := EncodePro(header)
+   if err != nil {
+      return nil, err
+   }
+   return &cdm.Pssh{SystemId: cdm.PlayReady, Data: data}, nil
+}
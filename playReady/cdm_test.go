@@ -0,0 +1,104 @@
+package playReady
+
+import (
+   "bytes"
+   "encoding/hex"
+   "errors"
+   "slices"
+   "testing"
+   "time"
+
+   "41.neocities.org/diana/cdm"
+)
+
+func TestCdm(t *testing.T) {
+   pro, err := hex.DecodeString(hexStr)
+   if err != nil {
+      t.Fatal(err)
+   }
+   header, err := ParsePro(pro)
+   if err != nil {
+      t.Fatal(err)
+   }
+   setup := newTestSetup(t, &EcosystemOptions{
+      Model: IssuerOptions{KeyUsages: []KeyUsage{KeyUsageIssuerDevice, KeyUsageIssuerServer}},
+   })
+   device, server := setup.device, setup.server
+   roots, err := setup.ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   serverCert, err := setup.ecosystem.NewDevice(&LeafOptions{Type: CertTypeServer})
+   if err != nil {
+      t.Fatal(err)
+   }
+   expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+   server.ContentKeys = map[string][]byte{string(header.Data.Kid): []byte(testContentKey)}
+   server.License.Expiration = expiration
+   var system cdm.Cdm = &Cdm{
+      Chain:           device.Chain,
+      SigningKey:      device.SigningKey,
+      EncryptKey:      device.EncryptKey,
+      Options:         &ChallengeOptions{ServerKey: &server.Key.PublicKey},
+      ResponseOptions: &ResponseOptions{Verify: &VerifyOptions{Roots: roots}},
+   }
+   system, err = cdm.Select(cdm.PlayReady, system)
+   if err != nil {
+      t.Fatal(err)
+   }
+   box := &cdm.Pssh{SystemId: cdm.PlayReady, Data: pro}
+   challenge, err := system.Challenge(pro)
+   if err != nil {
+      t.Fatal(err)
+   }
+   unsigned, err := server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = system.Response(unsigned)
+   if !errors.Is(err, ErrResponseUnsigned) {
+      t.Fatalf("expected ErrResponseUnsigned, got %v", err)
+   }
+   server.SigningKey, server.Chain = serverCert.SigningKey, serverCert.Chain
+   var responses [][]byte
+   for _, initData := range [][]byte{pro, box.Bytes()} {
+      challenge, err := system.Challenge(initData)
+      if err != nil {
+         t.Fatal(err)
+      }
+      response, err := server.Response(challenge)
+      if err != nil {
+         t.Fatal(err)
+      }
+      responses = append(responses, response)
+   }
+   // answered in any order, each once
+   slices.Reverse(responses)
+   for _, response := range responses {
+      license, err := system.Response(response)
+      if err != nil {
+         t.Fatal(err)
+      }
+      kid := bytes.Clone(header.Data.Kid)
+      UuidOrGuid(kid)
+      key, ok := license.Key(kid)
+      if !ok || string(key) != testContentKey {
+         t.Fatalf("%+v", license.Keys)
+      }
+      if license.Keys[0].Type != cdm.KeyTypeContent {
+         t.Fatal(license.Keys[0].Type)
+      }
+      if !license.Expiration.Equal(expiration) {
+         t.Fatalf("expiration %v", license.Expiration)
+      }
+      _, err = system.Response(response)
+      if err == nil {
+         t.Fatal("expected error for answered challenge")
+      }
+   }
+   box.SystemId = cdm.Widevine
+   _, err = system.Challenge(box.Bytes())
+   if err == nil {
+      t.Fatal("expected error for Widevine pssh box")
+   }
+}
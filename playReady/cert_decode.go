@@ -6,17 +6,21 @@ import (
    "crypto/elliptic"
    "crypto/sha256"
    "encoding/binary"
-   "errors"
+   "fmt"
    "math/big"
 )
 
-func (c *Certificate) decode(data []byte) (int, error) {
-   n := 0
-   magic := data[0:4]
-   if string(magic) != "CERT" {
-      return 0, errors.New("failed to find cert magic")
+// decode reads one certificate. offset is the position of data within the
+// buffer given to ParseChain, for error reporting
+func (c *Certificate) decode(data []byte, offset int) (int, error) {
+   if len(data) < 16 {
+      return 0, &DecodeError{formatBcert, offset, ErrTruncated}
+   }
+   if string(data[0:4]) != "CERT" {
+      return 0, &DecodeError{formatBcert, offset, ErrInvalidMagic}
    }
 
+   n := 0
    c.Header.HeaderTag = binary.BigEndian.Uint32(data[n:])
    n += 4
    c.Header.Version = binary.BigEndian.Uint32(data[n:])
@@ -26,27 +30,36 @@ func (c *Certificate) decode(data []byte) (int, error) {
    c.Header.CbCertificateSigned = binary.BigEndian.Uint32(data[n:])
    n += 4
 
-   certDataLen := int(c.Header.CbCertificate - 16)
-   if len(data[n:]) < certDataLen {
-      return 0, errors.New("data too short")
+   if c.Header.CbCertificate < 16 {
+      return 0, &DecodeError{formatBcert, offset + 8, ErrInvalidLength}
    }
-   certData := data[n : n+certDataLen]
-   n += certDataLen
+   certDataLen := uint64(c.Header.CbCertificate - 16)
+   if uint64(len(data[n:])) < certDataLen {
+      return 0, &DecodeError{formatBcert, offset + 8, ErrTruncated}
+   }
+   certData := data[n : n+int(certDataLen)]
+   n += int(certDataLen)
 
    c.UnknownRecords = make(map[uint16][]UnknownRecord)
+   // only the first record of a type is typed, see Certificate.encode
+   seen := make(map[uint16]bool)
 
    var n1 int
    for n1 < len(certData) {
+      recOffset := offset + 16 + n1
       if len(certData)-n1 < 8 {
-         break
+         return 0, &DecodeError{formatBcert, recOffset, ErrTruncated}
       }
 
       flags := binary.BigEndian.Uint16(certData[n1 : n1+2])
       recType := binary.BigEndian.Uint16(certData[n1+2 : n1+4])
       recLen := binary.BigEndian.Uint32(certData[n1+4 : n1+8])
 
-      if recLen < 8 || n1+int(recLen) > len(certData) {
-         break
+      if recLen < 8 {
+         return 0, &DecodeError{formatBcert, recOffset + 4, ErrInvalidLength}
+      }
+      if uint64(len(certData)-n1) < uint64(recLen) {
+         return 0, &DecodeError{formatBcert, recOffset + 4, ErrTruncated}
       }
 
       valBytes := certData[n1+8 : n1+int(recLen)]
@@ -56,92 +69,272 @@ func (c *Certificate) decode(data []byte) (int, error) {
 
       headerData := ObjectHeader{Flags: flags, Type: recType, CbLength: recLen}
 
-      switch BcertObject(recType) {
-      case BcertObjectBasic:
-         c.BasicInfo = &BasicInfo{Header: headerData}
-         copy(c.BasicInfo.CertificateID.Rgb[:], valBytes[0:16])
-         c.BasicInfo.SecurityLevel = binary.BigEndian.Uint32(valBytes[16:20])
-         c.BasicInfo.Flags = binary.BigEndian.Uint32(valBytes[20:24])
-         c.BasicInfo.Type = binary.BigEndian.Uint32(valBytes[24:28])
-         copy(c.BasicInfo.DigestValue[:], valBytes[28:60])
-         c.BasicInfo.ExpirationDate = binary.BigEndian.Uint32(valBytes[60:64])
-         if len(valBytes) >= 80 {
-            copy(c.BasicInfo.ClientID.Rgb[:], valBytes[64:80])
-         }
-      case BcertObjectDevice:
-         c.DeviceInfo = &DeviceInfo{Header: headerData}
-         c.DeviceInfo.CbMaxLicense = binary.BigEndian.Uint32(valBytes[0:4])
-         c.DeviceInfo.CbMaxHeader = binary.BigEndian.Uint32(valBytes[4:8])
-         c.DeviceInfo.MaxChainDepth = binary.BigEndian.Uint32(valBytes[8:12])
-      case BcertObjectFeature:
-         c.FeatureInfo = &FeatureInfo{Header: headerData}
-         c.FeatureInfo.NumFeatureEntries = binary.BigEndian.Uint32(valBytes[0:4])
-         off := 4
-         for i := uint32(0); i < c.FeatureInfo.NumFeatureEntries; i++ {
-            c.FeatureInfo.FeatureSet = append(c.FeatureInfo.FeatureSet, binary.BigEndian.Uint32(valBytes[off:off+4]))
-            off += 4
-         }
-      case BcertObjectKey:
-         c.KeyInfo = &KeyInfo{Header: headerData}
-         c.KeyInfo.NumKeys = binary.BigEndian.Uint32(valBytes[0:4])
-         off := 4
-         for i := uint32(0); i < c.KeyInfo.NumKeys; i++ {
-            var kv CertKey
-            kv.Type = binary.BigEndian.Uint16(valBytes[off : off+2])
-            kv.Length = binary.BigEndian.Uint16(valBytes[off+2 : off+4])
-            kv.Flags = binary.BigEndian.Uint32(valBytes[off+4 : off+8])
-            off += 8
-
-            kv.Value = make([]byte, 64) // For ECC P256
-            copy(kv.Value, valBytes[off:off+64])
-            off += 64
-
-            usagesCount := binary.BigEndian.Uint32(valBytes[off : off+4])
-            off += 4
-            for u := uint32(0); u < usagesCount; u++ {
-               kv.UsageSet = append(kv.UsageSet, binary.BigEndian.Uint32(valBytes[off:off+4]))
-               off += 4
+      typed := false
+      if !seen[recType] {
+         var err error
+         typed, err = c.decodeObject(headerData, valBytes)
+         if err != nil {
+            return 0, &DecodeError{
+               formatBcert, recOffset + 8, fmt.Errorf("%v object: %w", BcertObject(recType), err),
             }
-            c.KeyInfo.Keys = append(c.KeyInfo.Keys, kv)
          }
-      case BcertObjectManufacturer:
-         c.ManufacturerInfo = &ManufacturerInfo{Header: headerData}
-         c.ManufacturerInfo.Flags = binary.BigEndian.Uint32(valBytes[0:4])
-
-         off := 4
-         manStr, manLen := decodePaddedString(valBytes[off:])
-         c.ManufacturerInfo.ManufacturerStrings.ManufacturerName = manStr
-         off += manLen
-
-         modStr, modLen := decodePaddedString(valBytes[off:])
-         c.ManufacturerInfo.ManufacturerStrings.ModelName = modStr
-         off += modLen
-
-         numStr, _ := decodePaddedString(valBytes[off:])
-         c.ManufacturerInfo.ManufacturerStrings.ModelNumber = numStr
-
-      case BcertObjectSignature:
-         c.SignatureInfo = &SignatureInfo{Header: headerData}
-         c.SignatureInfo.SignatureType = binary.BigEndian.Uint16(valBytes[0:2])
-         sigLen := binary.BigEndian.Uint16(valBytes[2:4])
-         c.SignatureInfo.SignatureData.Cb = sigLen
-         c.SignatureInfo.SignatureData.Value = valBytes[4 : 4+int(sigLen)]
-
-         off := 4 + int(sigLen)
-         c.SignatureInfo.IssuerKeyLength = binary.BigEndian.Uint32(valBytes[off : off+4])
-         off += 4
-         keyBytes := int(c.SignatureInfo.IssuerKeyLength) / 8
-         c.SignatureInfo.IssuerKey = valBytes[off : off+keyBytes]
-      default:
+      }
+      if !typed {
          c.UnknownRecords[recType] = append(c.UnknownRecords[recType], UnknownRecord{
             Flags: flags,
             Value: valBytes,
          })
       }
+      seen[recType] = true
    }
    return n, nil
 }
 
+// decodeObject stores a typed object. It reports false for unknown types and
+// for optional objects that do not round trip, and an error for malformed
+// required objects
+func (c *Certificate) decodeObject(headerData ObjectHeader, valBytes []byte) (bool, error) {
+   switch BcertObject(headerData.Type) {
+   case BcertObjectBasic:
+      info := &BasicInfo{Header: headerData}
+      if err := info.decode(valBytes); err != nil {
+         return false, err
+      }
+      c.BasicInfo = info
+   case BcertObjectDevice:
+      info := &DeviceInfo{Header: headerData}
+      if err := info.decode(valBytes); err != nil {
+         return false, err
+      }
+      c.DeviceInfo = info
+   case BcertObjectFeature:
+      info := &FeatureInfo{Header: headerData}
+      if err := info.decode(valBytes); err != nil {
+         return false, err
+      }
+      c.FeatureInfo = info
+   case BcertObjectKey:
+      info := &KeyInfo{Header: headerData}
+      if err := info.decode(valBytes); err != nil {
+         return false, err
+      }
+      c.KeyInfo = info
+   case BcertObjectManufacturer:
+      info := &ManufacturerInfo{Header: headerData}
+      if err := info.decode(valBytes); err != nil {
+         return false, err
+      }
+      c.ManufacturerInfo = info
+   case BcertObjectSignature:
+      info := &SignatureInfo{Header: headerData}
+      if err := info.decode(valBytes); err != nil {
+         return false, err
+      }
+      c.SignatureInfo = info
+   case BcertObjectDomain:
+      info := &DomainInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.DomainInfo = info
+   case BcertObjectPc:
+      info := &PcInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.PcInfo = info
+   case BcertObjectSilverlight:
+      info := &SilverlightInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.SilverlightInfo = info
+   case BcertObjectMetering:
+      info := &MeteringInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.MeteringInfo = info
+   case BcertObjectExtDataSignKey:
+      info := &ExtDataSignKeyInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.ExtDataSignKeyInfo = info
+   case BcertObjectExtDataContainer:
+      info := &ExtDataContainer{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.ExtDataContainer = info
+   case BcertObjectExtDataSignature:
+      info := &ExtDataSignature{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.ExtDataSignature = info
+   case BcertObjectExtDataHwid:
+      info := &ExtDataHwid{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.ExtDataHwid = info
+   case BcertObjectServer:
+      info := &ServerInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.ServerInfo = info
+   case BcertObjectSecurityVersion:
+      info := &SecurityVersionInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.SecurityVersion = info
+   case BcertObjectSecurityVersion2:
+      info := &SecurityVersionInfo{Header: headerData}
+      if !decodeObject(info, valBytes) {
+         return false, nil
+      }
+      c.SecurityVersion2 = info
+   default:
+      return false, nil
+   }
+   return true, nil
+}
+
+func (b *BasicInfo) decode(valBytes []byte) error {
+   if len(valBytes) < 64 {
+      return ErrTruncated
+   }
+   copy(b.CertificateID.Rgb[:], valBytes[0:16])
+   b.SecurityLevel = binary.BigEndian.Uint32(valBytes[16:20])
+   b.Flags = binary.BigEndian.Uint32(valBytes[20:24])
+   b.Type = binary.BigEndian.Uint32(valBytes[24:28])
+   copy(b.DigestValue[:], valBytes[28:60])
+   b.ExpirationDate = binary.BigEndian.Uint32(valBytes[60:64])
+   if len(valBytes) >= 80 {
+      copy(b.ClientID.Rgb[:], valBytes[64:80])
+   }
+   return nil
+}
+
+func (d *DeviceInfo) decode(valBytes []byte) error {
+   if len(valBytes) < 12 {
+      return ErrTruncated
+   }
+   d.CbMaxLicense = binary.BigEndian.Uint32(valBytes[0:4])
+   d.CbMaxHeader = binary.BigEndian.Uint32(valBytes[4:8])
+   d.MaxChainDepth = binary.BigEndian.Uint32(valBytes[8:12])
+   return nil
+}
+
+func (f *FeatureInfo) decode(valBytes []byte) error {
+   if len(valBytes) < 4 {
+      return ErrTruncated
+   }
+   f.NumFeatureEntries = binary.BigEndian.Uint32(valBytes[0:4])
+   if uint64(len(valBytes[4:])) < uint64(f.NumFeatureEntries)*4 {
+      return ErrTruncated
+   }
+   off := 4
+   for i := uint32(0); i < f.NumFeatureEntries; i++ {
+      f.FeatureSet = append(f.FeatureSet, binary.BigEndian.Uint32(valBytes[off:off+4]))
+      off += 4
+   }
+   return nil
+}
+
+func (k *KeyInfo) decode(valBytes []byte) error {
+   if len(valBytes) < 4 {
+      return ErrTruncated
+   }
+   k.NumKeys = binary.BigEndian.Uint32(valBytes[0:4])
+   off := 4
+   for i := uint32(0); i < k.NumKeys; i++ {
+      if len(valBytes[off:]) < 8 {
+         return ErrTruncated
+      }
+      var kv CertKey
+      kv.Type = binary.BigEndian.Uint16(valBytes[off : off+2])
+      kv.Length = binary.BigEndian.Uint16(valBytes[off+2 : off+4])
+      kv.Flags = binary.BigEndian.Uint32(valBytes[off+4 : off+8])
+      off += 8
+
+      keyLen := int(kv.Length) / 8
+      if len(valBytes[off:]) < keyLen+4 {
+         return ErrTruncated
+      }
+      kv.Value = make([]byte, keyLen)
+      copy(kv.Value, valBytes[off:off+keyLen])
+      off += keyLen
+
+      usagesCount := binary.BigEndian.Uint32(valBytes[off : off+4])
+      off += 4
+      if uint64(len(valBytes[off:])) < uint64(usagesCount)*4 {
+         return ErrTruncated
+      }
+      for u := uint32(0); u < usagesCount; u++ {
+         kv.UsageSet = append(kv.UsageSet, binary.BigEndian.Uint32(valBytes[off:off+4]))
+         off += 4
+      }
+      k.Keys = append(k.Keys, kv)
+   }
+   return nil
+}
+
+func (m *ManufacturerInfo) decode(valBytes []byte) error {
+   if len(valBytes) < 4 {
+      return ErrTruncated
+   }
+   m.Flags = binary.BigEndian.Uint32(valBytes[0:4])
+
+   off := 4
+   manStr, manLen, err := decodePaddedString(valBytes[off:])
+   if err != nil {
+      return err
+   }
+   m.ManufacturerStrings.ManufacturerName = manStr
+   off += manLen
+
+   modStr, modLen, err := decodePaddedString(valBytes[off:])
+   if err != nil {
+      return err
+   }
+   m.ManufacturerStrings.ModelName = modStr
+   off += modLen
+
+   numStr, _, err := decodePaddedString(valBytes[off:])
+   if err != nil {
+      return err
+   }
+   m.ManufacturerStrings.ModelNumber = numStr
+   return nil
+}
+
+func (s *SignatureInfo) decode(valBytes []byte) error {
+   if len(valBytes) < 4 {
+      return ErrTruncated
+   }
+   s.SignatureType = binary.BigEndian.Uint16(valBytes[0:2])
+   sigLen := binary.BigEndian.Uint16(valBytes[2:4])
+   if len(valBytes[4:]) < int(sigLen)+4 {
+      return ErrTruncated
+   }
+   s.SignatureData.Cb = sigLen
+   s.SignatureData.Value = valBytes[4 : 4+int(sigLen)]
+
+   off := 4 + int(sigLen)
+   s.IssuerKeyLength = binary.BigEndian.Uint32(valBytes[off : off+4])
+   off += 4
+   keyBytes := uint64(s.IssuerKeyLength) / 8
+   if uint64(len(valBytes[off:])) < keyBytes {
+      return ErrTruncated
+   }
+   s.IssuerKey = valBytes[off : off+int(keyBytes)]
+   return nil
+}
+
 func (c *Certificate) verify(pubKey []byte) bool {
    if c.SignatureInfo == nil || !bytes.Equal(c.SignatureInfo.IssuerKey, pubKey) {
       return false
@@ -2,93 +2,299 @@ package playReady
 
 import (
    "encoding/binary"
+   "errors"
+   "reflect"
+   "slices"
 )
 
-func (c *Certificate) encode() []byte {
-   var raw []byte
-   var lengthToSignature uint32
-   unknownIdx := make(map[uint16]int)
+func (b *BasicInfo) encode() []byte {
+   valBytes := make([]byte, 80)
+   copy(valBytes[0:16], b.CertificateID.Rgb[:])
+   binary.BigEndian.PutUint32(valBytes[16:20], b.SecurityLevel)
+   binary.BigEndian.PutUint32(valBytes[20:24], b.Flags)
+   binary.BigEndian.PutUint32(valBytes[24:28], b.Type)
+   copy(valBytes[28:60], b.DigestValue[:])
+   binary.BigEndian.PutUint32(valBytes[60:64], b.ExpirationDate)
+   copy(valBytes[64:80], b.ClientID.Rgb[:])
+   return valBytes
+}
 
-   for _, recType := range c.RecordOrder {
-      if BcertObject(recType) == BcertObjectSignature {
-         lengthToSignature = uint32(16 + len(raw))
+func (d *DeviceInfo) encode() []byte {
+   valBytes := binary.BigEndian.AppendUint32(nil, d.CbMaxLicense)
+   valBytes = binary.BigEndian.AppendUint32(valBytes, d.CbMaxHeader)
+   return binary.BigEndian.AppendUint32(valBytes, d.MaxChainDepth)
+}
+
+func (f *FeatureInfo) encode() []byte {
+   valBytes := binary.BigEndian.AppendUint32(nil, uint32(len(f.FeatureSet)))
+   for _, feat := range f.FeatureSet {
+      valBytes = binary.BigEndian.AppendUint32(valBytes, feat)
+   }
+   return valBytes
+}
+
+func (k *KeyInfo) encode() []byte {
+   valBytes := binary.BigEndian.AppendUint32(nil, uint32(len(k.Keys)))
+   for _, key := range k.Keys {
+      valBytes = binary.BigEndian.AppendUint16(valBytes, key.Type)
+      valBytes = binary.BigEndian.AppendUint16(valBytes, uint16(len(key.Value)*8))
+      valBytes = binary.BigEndian.AppendUint32(valBytes, key.Flags)
+      valBytes = append(valBytes, key.Value...)
+      valBytes = binary.BigEndian.AppendUint32(valBytes, uint32(len(key.UsageSet)))
+      for _, usage := range key.UsageSet {
+         valBytes = binary.BigEndian.AppendUint32(valBytes, usage)
       }
+   }
+   return valBytes
+}
 
-      var valBytes []byte
-      flags := uint16(1)
-
-      switch BcertObject(recType) {
-      case BcertObjectBasic:
-         if c.BasicInfo != nil {
-            flags = c.BasicInfo.Header.Flags
-            valBytes = make([]byte, 80)
-            copy(valBytes[0:16], c.BasicInfo.CertificateID.Rgb[:])
-            binary.BigEndian.PutUint32(valBytes[16:20], c.BasicInfo.SecurityLevel)
-            binary.BigEndian.PutUint32(valBytes[20:24], c.BasicInfo.Flags)
-            binary.BigEndian.PutUint32(valBytes[24:28], c.BasicInfo.Type)
-            copy(valBytes[28:60], c.BasicInfo.DigestValue[:])
-            binary.BigEndian.PutUint32(valBytes[60:64], c.BasicInfo.ExpirationDate)
-            copy(valBytes[64:80], c.BasicInfo.ClientID.Rgb[:])
-         }
-      case BcertObjectDevice:
-         if c.DeviceInfo != nil {
-            flags = c.DeviceInfo.Header.Flags
-            valBytes = binary.BigEndian.AppendUint32(nil, c.DeviceInfo.CbMaxLicense)
-            valBytes = binary.BigEndian.AppendUint32(valBytes, c.DeviceInfo.CbMaxHeader)
-            valBytes = binary.BigEndian.AppendUint32(valBytes, c.DeviceInfo.MaxChainDepth)
-         }
-      case BcertObjectFeature:
-         if c.FeatureInfo != nil {
-            flags = c.FeatureInfo.Header.Flags
-            valBytes = binary.BigEndian.AppendUint32(nil, c.FeatureInfo.NumFeatureEntries)
-            for _, feat := range c.FeatureInfo.FeatureSet {
-               valBytes = binary.BigEndian.AppendUint32(valBytes, feat)
-            }
-         }
-      case BcertObjectKey:
-         if c.KeyInfo != nil {
-            flags = c.KeyInfo.Header.Flags
-            valBytes = binary.BigEndian.AppendUint32(nil, c.KeyInfo.NumKeys)
-            for _, key := range c.KeyInfo.Keys {
-               valBytes = binary.BigEndian.AppendUint16(valBytes, key.Type)
-               valBytes = binary.BigEndian.AppendUint16(valBytes, key.Length)
-               valBytes = binary.BigEndian.AppendUint32(valBytes, key.Flags)
-               valBytes = append(valBytes, key.Value...)
-               valBytes = binary.BigEndian.AppendUint32(valBytes, uint32(len(key.UsageSet)))
-               for _, usage := range key.UsageSet {
-                  valBytes = binary.BigEndian.AppendUint32(valBytes, usage)
-               }
-            }
-         }
-      case BcertObjectManufacturer:
-         if c.ManufacturerInfo != nil {
-            flags = c.ManufacturerInfo.Header.Flags
-            valBytes = binary.BigEndian.AppendUint32(nil, c.ManufacturerInfo.Flags)
-            valBytes = append(valBytes, encodePaddedString(c.ManufacturerInfo.ManufacturerStrings.ManufacturerName)...)
-            valBytes = append(valBytes, encodePaddedString(c.ManufacturerInfo.ManufacturerStrings.ModelName)...)
-            valBytes = append(valBytes, encodePaddedString(c.ManufacturerInfo.ManufacturerStrings.ModelNumber)...)
-         }
-      case BcertObjectSignature:
-         if c.SignatureInfo != nil {
-            flags = c.SignatureInfo.Header.Flags
-            valBytes = binary.BigEndian.AppendUint16(nil, c.SignatureInfo.SignatureType)
-            valBytes = binary.BigEndian.AppendUint16(valBytes, c.SignatureInfo.SignatureData.Cb)
-            valBytes = append(valBytes, c.SignatureInfo.SignatureData.Value...)
-            valBytes = binary.BigEndian.AppendUint32(valBytes, c.SignatureInfo.IssuerKeyLength)
-            valBytes = append(valBytes, c.SignatureInfo.IssuerKey...)
+func (m *ManufacturerInfo) encode() []byte {
+   valBytes := binary.BigEndian.AppendUint32(nil, m.Flags)
+   valBytes = append(valBytes, encodePaddedString(m.ManufacturerStrings.ManufacturerName)...)
+   valBytes = append(valBytes, encodePaddedString(m.ManufacturerStrings.ModelName)...)
+   return append(valBytes, encodePaddedString(m.ManufacturerStrings.ModelNumber)...)
+}
+
+func (s *SignatureInfo) encode() []byte {
+   valBytes := binary.BigEndian.AppendUint16(nil, s.SignatureType)
+   valBytes = binary.BigEndian.AppendUint16(valBytes, uint16(len(s.SignatureData.Value)))
+   valBytes = append(valBytes, s.SignatureData.Value...)
+   valBytes = binary.BigEndian.AppendUint32(valBytes, uint32(len(s.IssuerKey)*8))
+   return append(valBytes, s.IssuerKey...)
+}
+
+// typedObject is a typed certificate object along with its header
+type typedObject struct {
+   header *ObjectHeader
+   object interface{ encode() []byte }
+}
+
+// objects returns the typed objects the certificate has
+func (c *Certificate) objects() map[BcertObject]typedObject {
+   objects := map[BcertObject]typedObject{}
+   add := func(recType BcertObject, header *ObjectHeader, object interface{ encode() []byte }) {
+      objects[recType] = typedObject{header, object}
+   }
+   if c.BasicInfo != nil {
+      add(BcertObjectBasic, &c.BasicInfo.Header, c.BasicInfo)
+   }
+   if c.DomainInfo != nil {
+      add(BcertObjectDomain, &c.DomainInfo.Header, c.DomainInfo)
+   }
+   if c.PcInfo != nil {
+      add(BcertObjectPc, &c.PcInfo.Header, c.PcInfo)
+   }
+   if c.DeviceInfo != nil {
+      add(BcertObjectDevice, &c.DeviceInfo.Header, c.DeviceInfo)
+   }
+   if c.FeatureInfo != nil {
+      add(BcertObjectFeature, &c.FeatureInfo.Header, c.FeatureInfo)
+   }
+   if c.KeyInfo != nil {
+      add(BcertObjectKey, &c.KeyInfo.Header, c.KeyInfo)
+   }
+   if c.ManufacturerInfo != nil {
+      add(BcertObjectManufacturer, &c.ManufacturerInfo.Header, c.ManufacturerInfo)
+   }
+   if c.SignatureInfo != nil {
+      add(BcertObjectSignature, &c.SignatureInfo.Header, c.SignatureInfo)
+   }
+   if c.SilverlightInfo != nil {
+      add(BcertObjectSilverlight, &c.SilverlightInfo.Header, c.SilverlightInfo)
+   }
+   if c.MeteringInfo != nil {
+      add(BcertObjectMetering, &c.MeteringInfo.Header, c.MeteringInfo)
+   }
+   if c.ExtDataSignKeyInfo != nil {
+      add(BcertObjectExtDataSignKey, &c.ExtDataSignKeyInfo.Header, c.ExtDataSignKeyInfo)
+   }
+   if c.ExtDataContainer != nil {
+      add(BcertObjectExtDataContainer, &c.ExtDataContainer.Header, c.ExtDataContainer)
+   }
+   if c.ExtDataSignature != nil {
+      add(BcertObjectExtDataSignature, &c.ExtDataSignature.Header, c.ExtDataSignature)
+   }
+   if c.ExtDataHwid != nil {
+      add(BcertObjectExtDataHwid, &c.ExtDataHwid.Header, c.ExtDataHwid)
+   }
+   if c.ServerInfo != nil {
+      add(BcertObjectServer, &c.ServerInfo.Header, c.ServerInfo)
+   }
+   if c.SecurityVersion != nil {
+      add(BcertObjectSecurityVersion, &c.SecurityVersion.Header, c.SecurityVersion)
+   }
+   if c.SecurityVersion2 != nil {
+      add(BcertObjectSecurityVersion2, &c.SecurityVersion2.Header, c.SecurityVersion2)
+   }
+   return objects
+}
+
+// UpdateLengths sets every count, length and header field to the value Bytes
+// encodes
+func (c *Certificate) UpdateLengths() {
+   if c.FeatureInfo != nil {
+      c.FeatureInfo.NumFeatureEntries = uint32(len(c.FeatureInfo.FeatureSet))
+   }
+   if c.KeyInfo != nil {
+      c.KeyInfo.NumKeys = uint32(len(c.KeyInfo.Keys))
+      for i := range c.KeyInfo.Keys {
+         c.KeyInfo.Keys[i].Length = uint16(len(c.KeyInfo.Keys[i].Value) * 8)
+      }
+   }
+   if c.SignatureInfo != nil {
+      c.SignatureInfo.SignatureData.Cb = uint16(len(c.SignatureInfo.SignatureData.Value))
+      c.SignatureInfo.IssuerKeyLength = uint32(len(c.SignatureInfo.IssuerKey) * 8)
+   }
+   if c.ExtDataSignature != nil {
+      c.ExtDataSignature.SignatureData.Cb = uint16(len(c.ExtDataSignature.SignatureData.Value))
+   }
+   if c.ExtDataSignKeyInfo != nil {
+      c.ExtDataSignKeyInfo.Length = uint16(len(c.ExtDataSignKeyInfo.Value) * 8)
+   }
+   if c.ExtDataContainer != nil {
+      for _, record := range c.ExtDataContainer.Records {
+         switch {
+         case record.Hwid != nil:
+            record.Hwid.Header.Type = uint16(BcertObjectExtDataHwid)
+            record.Hwid.Header.CbLength = uint32(8 + len(record.Hwid.encode()))
+         case record.Signature != nil:
+            record.Signature.SignatureData.Cb = uint16(len(record.Signature.SignatureData.Value))
+            record.Signature.Header.Type = uint16(BcertObjectExtDataSignature)
+            record.Signature.Header.CbLength = uint32(8 + len(record.Signature.encode()))
          }
-      default:
-         records := c.UnknownRecords[recType]
+      }
+   }
+   for recType, object := range c.objects() {
+      object.header.Type = uint16(recType)
+      object.header.CbLength = uint32(8 + len(object.object.encode()))
+   }
+   data := c.encode()
+   c.Header.CbCertificate = binary.BigEndian.Uint32(data[8:12])
+   c.Header.CbCertificateSigned = binary.BigEndian.Uint32(data[12:16])
+}
+
+// Bytes returns the encoded certificate, with every length derived from the
+// content. The certificate is not changed, see UpdateLengths. Unknown records
+// keep their parsed value
+func (c *Certificate) Bytes() []byte {
+   return c.encode()
+}
+
+// CheckEncoding reports an error unless the certificate decodes back to
+// itself after Bytes, lengths aside
+func (c *Certificate) CheckEncoding() error {
+   var decoded Certificate
+   _, err := decoded.decode(c.Bytes(), 0)
+   if err != nil {
+      return err
+   }
+   normal := c.clone()
+   normal.UpdateLengths()
+   if !reflect.DeepEqual(decoded.normalize(), normal.normalize()) {
+      return errors.New("certificate does not decode to itself")
+   }
+   return nil
+}
+
+// clone returns a copy of the certificate sharing none of the objects
+// UpdateLengths changes
+func (c *Certificate) clone() *Certificate {
+   clone := *c
+   clone.BasicInfo = clonePointer(c.BasicInfo)
+   clone.DeviceInfo = clonePointer(c.DeviceInfo)
+   clone.FeatureInfo = clonePointer(c.FeatureInfo)
+   clone.KeyInfo = clonePointer(c.KeyInfo)
+   if clone.KeyInfo != nil {
+      clone.KeyInfo.Keys = slices.Clone(c.KeyInfo.Keys)
+   }
+   clone.ManufacturerInfo = clonePointer(c.ManufacturerInfo)
+   clone.SignatureInfo = clonePointer(c.SignatureInfo)
+   clone.DomainInfo = clonePointer(c.DomainInfo)
+   clone.PcInfo = clonePointer(c.PcInfo)
+   clone.SilverlightInfo = clonePointer(c.SilverlightInfo)
+   clone.MeteringInfo = clonePointer(c.MeteringInfo)
+   clone.ExtDataSignKeyInfo = clonePointer(c.ExtDataSignKeyInfo)
+   clone.ExtDataContainer = clonePointer(c.ExtDataContainer)
+   if clone.ExtDataContainer != nil {
+      clone.ExtDataContainer.Records = nil
+      for _, record := range c.ExtDataContainer.Records {
+         clone.ExtDataContainer.Records = append(clone.ExtDataContainer.Records, ExtDataRecord{
+            Hwid:      clonePointer(record.Hwid),
+            Signature: clonePointer(record.Signature),
+         })
+      }
+   }
+   clone.ExtDataSignature = clonePointer(c.ExtDataSignature)
+   clone.ExtDataHwid = clonePointer(c.ExtDataHwid)
+   clone.ServerInfo = clonePointer(c.ServerInfo)
+   clone.SecurityVersion = clonePointer(c.SecurityVersion)
+   clone.SecurityVersion2 = clonePointer(c.SecurityVersion2)
+   return &clone
+}
+
+func clonePointer[T any](p *T) *T {
+   if p == nil {
+      return nil
+   }
+   value := *p
+   return &value
+}
+
+// normalize returns a copy without the differences decoding can not preserve
+func (c *Certificate) normalize() Certificate {
+   normal := *c
+   if len(normal.UnknownRecords) == 0 {
+      normal.UnknownRecords = nil
+   }
+   return normal
+}
+
+// record is an encoded certificate object
+type record struct {
+   Type  BcertObject
+   Flags uint16
+   Value []byte
+}
+
+// records returns the encoded objects in RecordOrder
+func (c *Certificate) records() []record {
+   var records []record
+   unknownIdx := make(map[uint16]int)
+   typed := make(map[uint16]bool)
+   objects := c.objects()
+
+   for _, recType := range c.RecordOrder {
+      rec := record{Type: BcertObject(recType), Flags: 1}
+
+      // a record type is typed once, repeats come from UnknownRecords
+      object, ok := objects[BcertObject(recType)]
+      if ok && !typed[recType] {
+         typed[recType] = true
+         rec.Value = object.object.encode()
+         rec.Flags = object.header.Flags
+      } else if unknown := c.UnknownRecords[recType]; unknownIdx[recType] < len(unknown) {
          idx := unknownIdx[recType]
-         valBytes = records[idx].Value
-         flags = records[idx].Flags
+         rec.Value = unknown[idx].Value
+         rec.Flags = unknown[idx].Flags
          unknownIdx[recType]++
       }
+      records = append(records, rec)
+   }
+   return records
+}
+
+func (c *Certificate) encode() []byte {
+   var raw []byte
+   var lengthToSignature uint32
 
-      raw = binary.BigEndian.AppendUint16(raw, flags)
-      raw = binary.BigEndian.AppendUint16(raw, recType)
-      raw = binary.BigEndian.AppendUint32(raw, uint32(len(valBytes)+8))
-      raw = append(raw, valBytes...)
+   for _, rec := range c.records() {
+      if rec.Type == BcertObjectSignature {
+         lengthToSignature = uint32(16 + len(raw))
+      }
+      raw = binary.BigEndian.AppendUint16(raw, rec.Flags)
+      raw = binary.BigEndian.AppendUint16(raw, uint16(rec.Type))
+      raw = binary.BigEndian.AppendUint32(raw, uint32(len(rec.Value)+8))
+      raw = append(raw, rec.Value...)
    }
 
    if lengthToSignature == 0 {
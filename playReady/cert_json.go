@@ -0,0 +1,692 @@
+package playReady
+
+import (
+   "encoding/hex"
+   "encoding/json"
+   "errors"
+   "fmt"
+   "time"
+)
+
+// The JSON form names every enumeration and leaves out the counts and
+// lengths, which Bytes derives. ObjectFlags is ObjectHeader.Flags
+
+// hexBytes is a byte string written as hex
+type hexBytes []byte
+
+func (h hexBytes) MarshalText() ([]byte, error) {
+   return hex.AppendEncode(nil, h), nil
+}
+
+func (h *hexBytes) UnmarshalText(text []byte) error {
+   var err error
+   *h, err = hex.AppendDecode(nil, text)
+   return err
+}
+
+// copyHex fills the array dst
+func copyHex(dst []byte, src hexBytes) error {
+   if len(src) != len(dst) {
+      return fmt.Errorf("hex length %v, want %v", len(src), len(dst))
+   }
+   copy(dst, src)
+   return nil
+}
+
+func (c CertId) MarshalText() ([]byte, error) {
+   return hexBytes(c.Rgb[:]).MarshalText()
+}
+
+func (c *CertId) UnmarshalText(text []byte) error {
+   var value hexBytes
+   err := value.UnmarshalText(text)
+   if err != nil {
+      return err
+   }
+   return copyHex(c.Rgb[:], value)
+}
+
+func (c ClientId) MarshalText() ([]byte, error) {
+   return hexBytes(c.Rgb[:]).MarshalText()
+}
+
+func (c *ClientId) UnmarshalText(text []byte) error {
+   var value hexBytes
+   err := value.UnmarshalText(text)
+   if err != nil {
+      return err
+   }
+   return copyHex(c.Rgb[:], value)
+}
+
+// expirationDate is BasicInfo.ExpirationDate, written as RFC 3339 or "never"
+type expirationDate uint32
+
+func (e expirationDate) MarshalText() ([]byte, error) {
+   if e == neverExpires {
+      return []byte("never"), nil
+   }
+   return time.Unix(int64(e), 0).UTC().AppendFormat(nil, time.RFC3339), nil
+}
+
+func (e *expirationDate) UnmarshalText(text []byte) error {
+   if string(text) == "never" {
+      *e = neverExpires
+      return nil
+   }
+   date, err := time.Parse(time.RFC3339, string(text))
+   if err != nil {
+      return err
+   }
+   *e = expirationDate(date.Unix())
+   return nil
+}
+
+type basicInfoJSON struct {
+   ObjectFlags    uint16
+   CertificateID  CertId
+   SecurityLevel  uint32
+   Flags          uint32
+   Type           CertType
+   DigestValue    hexBytes
+   ExpirationDate expirationDate
+   ClientID       ClientId
+}
+
+func (b *BasicInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(basicInfoJSON{
+      ObjectFlags:    b.Header.Flags,
+      CertificateID:  b.CertificateID,
+      SecurityLevel:  b.SecurityLevel,
+      Flags:          b.Flags,
+      Type:           CertType(b.Type),
+      DigestValue:    b.DigestValue[:],
+      ExpirationDate: expirationDate(b.ExpirationDate),
+      ClientID:       b.ClientID,
+   })
+}
+
+func (b *BasicInfo) UnmarshalJSON(data []byte) error {
+   var value basicInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *b = BasicInfo{
+      Header:         ObjectHeader{Flags: value.ObjectFlags},
+      CertificateID:  value.CertificateID,
+      SecurityLevel:  value.SecurityLevel,
+      Flags:          value.Flags,
+      Type:           uint32(value.Type),
+      ExpirationDate: uint32(value.ExpirationDate),
+      ClientID:       value.ClientID,
+   }
+   return copyHex(b.DigestValue[:], value.DigestValue)
+}
+
+type deviceInfoJSON struct {
+   ObjectFlags   uint16
+   CbMaxLicense  uint32
+   CbMaxHeader   uint32
+   MaxChainDepth uint32
+}
+
+func (d *DeviceInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(deviceInfoJSON{
+      d.Header.Flags, d.CbMaxLicense, d.CbMaxHeader, d.MaxChainDepth,
+   })
+}
+
+func (d *DeviceInfo) UnmarshalJSON(data []byte) error {
+   var value deviceInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *d = DeviceInfo{
+      Header:        ObjectHeader{Flags: value.ObjectFlags},
+      CbMaxLicense:  value.CbMaxLicense,
+      CbMaxHeader:   value.CbMaxHeader,
+      MaxChainDepth: value.MaxChainDepth,
+   }
+   return nil
+}
+
+type featureInfoJSON struct {
+   ObjectFlags uint16
+   FeatureSet  []Feature
+}
+
+func (f *FeatureInfo) MarshalJSON() ([]byte, error) {
+   value := featureInfoJSON{ObjectFlags: f.Header.Flags, FeatureSet: []Feature{}}
+   for _, feature := range f.FeatureSet {
+      value.FeatureSet = append(value.FeatureSet, Feature(feature))
+   }
+   return json.Marshal(value)
+}
+
+func (f *FeatureInfo) UnmarshalJSON(data []byte) error {
+   var value featureInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *f = FeatureInfo{Header: ObjectHeader{Flags: value.ObjectFlags}}
+   for _, feature := range value.FeatureSet {
+      f.FeatureSet = append(f.FeatureSet, uint32(feature))
+   }
+   f.NumFeatureEntries = uint32(len(f.FeatureSet))
+   return nil
+}
+
+type certKeyJSON struct {
+   Type     uint16
+   Flags    uint32
+   Value    hexBytes
+   UsageSet []KeyUsage
+}
+
+func (k *CertKey) MarshalJSON() ([]byte, error) {
+   value := certKeyJSON{Type: k.Type, Flags: k.Flags, Value: k.Value, UsageSet: []KeyUsage{}}
+   for _, usage := range k.UsageSet {
+      value.UsageSet = append(value.UsageSet, KeyUsage(usage))
+   }
+   return json.Marshal(value)
+}
+
+func (k *CertKey) UnmarshalJSON(data []byte) error {
+   var value certKeyJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *k = CertKey{
+      Type:   value.Type,
+      Length: uint16(len(value.Value) * 8),
+      Flags:  value.Flags,
+      Value:  value.Value,
+   }
+   for _, usage := range value.UsageSet {
+      k.UsageSet = append(k.UsageSet, uint32(usage))
+   }
+   return nil
+}
+
+type keyInfoJSON struct {
+   ObjectFlags uint16
+   Keys        []CertKey
+}
+
+func (k *KeyInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(keyInfoJSON{k.Header.Flags, k.Keys})
+}
+
+func (k *KeyInfo) UnmarshalJSON(data []byte) error {
+   var value keyInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *k = KeyInfo{
+      Header:  ObjectHeader{Flags: value.ObjectFlags},
+      NumKeys: uint32(len(value.Keys)),
+      Keys:    value.Keys,
+   }
+   return nil
+}
+
+type manufacturerInfoJSON struct {
+   ObjectFlags         uint16
+   Flags               uint32
+   ManufacturerStrings ManufacturerStrings
+}
+
+func (m *ManufacturerInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(manufacturerInfoJSON{m.Header.Flags, m.Flags, m.ManufacturerStrings})
+}
+
+func (m *ManufacturerInfo) UnmarshalJSON(data []byte) error {
+   var value manufacturerInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *m = ManufacturerInfo{
+      Header:              ObjectHeader{Flags: value.ObjectFlags},
+      Flags:               value.Flags,
+      ManufacturerStrings: value.ManufacturerStrings,
+   }
+   return nil
+}
+
+type signatureInfoJSON struct {
+   ObjectFlags   uint16
+   SignatureType SignatureType
+   Signature     hexBytes
+   IssuerKey     hexBytes
+}
+
+func (s *SignatureInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(signatureInfoJSON{
+      ObjectFlags:   s.Header.Flags,
+      SignatureType: SignatureType(s.SignatureType),
+      Signature:     s.SignatureData.Value,
+      IssuerKey:     s.IssuerKey,
+   })
+}
+
+func (s *SignatureInfo) UnmarshalJSON(data []byte) error {
+   var value signatureInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *s = SignatureInfo{
+      Header:        ObjectHeader{Flags: value.ObjectFlags},
+      SignatureType: uint16(value.SignatureType),
+      SignatureData: SignatureData{
+         Cb: uint16(len(value.Signature)), Value: value.Signature,
+      },
+      IssuerKeyLength: uint32(len(value.IssuerKey) * 8),
+      IssuerKey:       value.IssuerKey,
+   }
+   return nil
+}
+
+type domainInfoJSON struct {
+   ObjectFlags       uint16
+   ServiceId         hexBytes
+   AccountId         hexBytes
+   RevisionTimestamp uint32
+   DomainUrl         PaddedString
+}
+
+func (d *DomainInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(domainInfoJSON{
+      d.Header.Flags, d.ServiceId[:], d.AccountId[:], d.RevisionTimestamp, d.DomainUrl,
+   })
+}
+
+func (d *DomainInfo) UnmarshalJSON(data []byte) error {
+   var value domainInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *d = DomainInfo{
+      Header:            ObjectHeader{Flags: value.ObjectFlags},
+      RevisionTimestamp: value.RevisionTimestamp,
+      DomainUrl:         value.DomainUrl,
+   }
+   err = copyHex(d.ServiceId[:], value.ServiceId)
+   if err != nil {
+      return err
+   }
+   return copyHex(d.AccountId[:], value.AccountId)
+}
+
+type pcInfoJSON struct {
+   ObjectFlags     uint16
+   SecurityVersion uint32
+}
+
+func (p *PcInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(pcInfoJSON{p.Header.Flags, p.SecurityVersion})
+}
+
+func (p *PcInfo) UnmarshalJSON(data []byte) error {
+   var value pcInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *p = PcInfo{
+      Header: ObjectHeader{Flags: value.ObjectFlags}, SecurityVersion: value.SecurityVersion,
+   }
+   return nil
+}
+
+type silverlightInfoJSON struct {
+   ObjectFlags        uint16
+   SecurityVersion    uint32
+   PlatformIdentifier uint32
+}
+
+func (s *SilverlightInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(silverlightInfoJSON{
+      s.Header.Flags, s.SecurityVersion, s.PlatformIdentifier,
+   })
+}
+
+func (s *SilverlightInfo) UnmarshalJSON(data []byte) error {
+   var value silverlightInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *s = SilverlightInfo{
+      Header:             ObjectHeader{Flags: value.ObjectFlags},
+      SecurityVersion:    value.SecurityVersion,
+      PlatformIdentifier: value.PlatformIdentifier,
+   }
+   return nil
+}
+
+type meteringInfoJSON struct {
+   ObjectFlags uint16
+   MeteringId  hexBytes
+   MeteringUrl PaddedString
+}
+
+func (m *MeteringInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(meteringInfoJSON{m.Header.Flags, m.MeteringId[:], m.MeteringUrl})
+}
+
+func (m *MeteringInfo) UnmarshalJSON(data []byte) error {
+   var value meteringInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *m = MeteringInfo{
+      Header: ObjectHeader{Flags: value.ObjectFlags}, MeteringUrl: value.MeteringUrl,
+   }
+   return copyHex(m.MeteringId[:], value.MeteringId)
+}
+
+type extDataSignKeyInfoJSON struct {
+   ObjectFlags uint16
+   Type        uint16
+   Flags       uint32
+   Value       hexBytes
+}
+
+func (e *ExtDataSignKeyInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(extDataSignKeyInfoJSON{e.Header.Flags, e.Type, e.Flags, e.Value})
+}
+
+func (e *ExtDataSignKeyInfo) UnmarshalJSON(data []byte) error {
+   var value extDataSignKeyInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *e = ExtDataSignKeyInfo{
+      Header: ObjectHeader{Flags: value.ObjectFlags},
+      Type:   value.Type,
+      Length: uint16(len(value.Value) * 8),
+      Flags:  value.Flags,
+      Value:  value.Value,
+   }
+   return nil
+}
+
+type extDataSignatureJSON struct {
+   ObjectFlags   uint16
+   SignatureType SignatureType
+   Signature     hexBytes
+}
+
+func (e *ExtDataSignature) MarshalJSON() ([]byte, error) {
+   return json.Marshal(extDataSignatureJSON{
+      e.Header.Flags, SignatureType(e.SignatureType), e.SignatureData.Value,
+   })
+}
+
+func (e *ExtDataSignature) UnmarshalJSON(data []byte) error {
+   var value extDataSignatureJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *e = ExtDataSignature{
+      Header:        ObjectHeader{Flags: value.ObjectFlags},
+      SignatureType: uint16(value.SignatureType),
+      SignatureData: SignatureData{
+         Cb: uint16(len(value.Signature)), Value: value.Signature,
+      },
+   }
+   return nil
+}
+
+type extDataHwidJSON struct {
+   ObjectFlags uint16
+   Data        hexBytes
+}
+
+func (e *ExtDataHwid) MarshalJSON() ([]byte, error) {
+   return json.Marshal(extDataHwidJSON{e.Header.Flags, e.Data})
+}
+
+func (e *ExtDataHwid) UnmarshalJSON(data []byte) error {
+   var value extDataHwidJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *e = ExtDataHwid{Header: ObjectHeader{Flags: value.ObjectFlags}, Data: value.Data}
+   return nil
+}
+
+type extDataRecordJSON struct {
+   Hwid      *ExtDataHwid      `json:",omitempty"`
+   Signature *ExtDataSignature `json:",omitempty"`
+}
+
+type extDataContainerJSON struct {
+   ObjectFlags uint16
+   Records     []extDataRecordJSON
+}
+
+func (e *ExtDataContainer) MarshalJSON() ([]byte, error) {
+   value := extDataContainerJSON{ObjectFlags: e.Header.Flags, Records: []extDataRecordJSON{}}
+   for _, record := range e.Records {
+      value.Records = append(value.Records, extDataRecordJSON(record))
+   }
+   return json.Marshal(value)
+}
+
+func (e *ExtDataContainer) UnmarshalJSON(data []byte) error {
+   var value extDataContainerJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *e = ExtDataContainer{Header: ObjectHeader{Flags: value.ObjectFlags}}
+   for _, record := range value.Records {
+      if (record.Hwid == nil) == (record.Signature == nil) {
+         return errors.New("ExtDataContainer record needs one of Hwid or Signature")
+      }
+      e.Records = append(e.Records, ExtDataRecord(record))
+   }
+   return nil
+}
+
+type serverInfoJSON struct {
+   ObjectFlags uint16
+   WarningDays uint32
+}
+
+func (s *ServerInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(serverInfoJSON{s.Header.Flags, s.WarningDays})
+}
+
+func (s *ServerInfo) UnmarshalJSON(data []byte) error {
+   var value serverInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *s = ServerInfo{Header: ObjectHeader{Flags: value.ObjectFlags}, WarningDays: value.WarningDays}
+   return nil
+}
+
+type securityVersionInfoJSON struct {
+   ObjectFlags        uint16
+   SecurityVersion    uint32
+   PlatformIdentifier uint32
+}
+
+func (s *SecurityVersionInfo) MarshalJSON() ([]byte, error) {
+   return json.Marshal(securityVersionInfoJSON{
+      s.Header.Flags, s.SecurityVersion, s.PlatformIdentifier,
+   })
+}
+
+func (s *SecurityVersionInfo) UnmarshalJSON(data []byte) error {
+   var value securityVersionInfoJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *s = SecurityVersionInfo{
+      Header:             ObjectHeader{Flags: value.ObjectFlags},
+      SecurityVersion:    value.SecurityVersion,
+      PlatformIdentifier: value.PlatformIdentifier,
+   }
+   return nil
+}
+
+type unknownRecordJSON struct {
+   Flags uint16
+   Value hexBytes
+}
+
+type certificateJSON struct {
+   Version          uint32
+   BasicInfo        *BasicInfo        `json:",omitempty"`
+   DeviceInfo       *DeviceInfo       `json:",omitempty"`
+   FeatureInfo      *FeatureInfo      `json:",omitempty"`
+   KeyInfo          *KeyInfo          `json:",omitempty"`
+   ManufacturerInfo *ManufacturerInfo `json:",omitempty"`
+   SignatureInfo    *SignatureInfo    `json:",omitempty"`
+
+   DomainInfo         *DomainInfo          `json:",omitempty"`
+   PcInfo             *PcInfo              `json:",omitempty"`
+   SilverlightInfo    *SilverlightInfo     `json:",omitempty"`
+   MeteringInfo       *MeteringInfo        `json:",omitempty"`
+   ExtDataSignKeyInfo *ExtDataSignKeyInfo  `json:",omitempty"`
+   ExtDataContainer   *ExtDataContainer    `json:",omitempty"`
+   ExtDataSignature   *ExtDataSignature    `json:",omitempty"`
+   ExtDataHwid        *ExtDataHwid         `json:",omitempty"`
+   ServerInfo         *ServerInfo          `json:",omitempty"`
+   SecurityVersion    *SecurityVersionInfo `json:",omitempty"`
+   SecurityVersion2   *SecurityVersionInfo `json:",omitempty"`
+
+   RecordOrder    []BcertObject
+   UnknownRecords map[BcertObject][]unknownRecordJSON `json:",omitempty"`
+}
+
+func (c *Certificate) MarshalJSON() ([]byte, error) {
+   value := certificateJSON{
+      Version:          c.Header.Version,
+      BasicInfo:        c.BasicInfo,
+      DeviceInfo:       c.DeviceInfo,
+      FeatureInfo:      c.FeatureInfo,
+      KeyInfo:          c.KeyInfo,
+      ManufacturerInfo: c.ManufacturerInfo,
+      SignatureInfo:    c.SignatureInfo,
+
+      DomainInfo:         c.DomainInfo,
+      PcInfo:             c.PcInfo,
+      SilverlightInfo:    c.SilverlightInfo,
+      MeteringInfo:       c.MeteringInfo,
+      ExtDataSignKeyInfo: c.ExtDataSignKeyInfo,
+      ExtDataContainer:   c.ExtDataContainer,
+      ExtDataSignature:   c.ExtDataSignature,
+      ExtDataHwid:        c.ExtDataHwid,
+      ServerInfo:         c.ServerInfo,
+      SecurityVersion:    c.SecurityVersion,
+      SecurityVersion2:   c.SecurityVersion2,
+
+      RecordOrder: []BcertObject{},
+   }
+   for _, recType := range c.RecordOrder {
+      value.RecordOrder = append(value.RecordOrder, BcertObject(recType))
+   }
+   for recType, records := range c.UnknownRecords {
+      if value.UnknownRecords == nil {
+         value.UnknownRecords = map[BcertObject][]unknownRecordJSON{}
+      }
+      for _, record := range records {
+         value.UnknownRecords[BcertObject(recType)] = append(
+            value.UnknownRecords[BcertObject(recType)], unknownRecordJSON{record.Flags, record.Value},
+         )
+      }
+   }
+   return json.Marshal(value)
+}
+
+// UnmarshalJSON sets the certificate from its JSON form. Call Bytes to derive
+// the lengths
+func (c *Certificate) UnmarshalJSON(data []byte) error {
+   var value certificateJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *c = Certificate{
+      Header:           CertHeader{HeaderTag: CertHeaderTag, Version: value.Version},
+      BasicInfo:        value.BasicInfo,
+      DeviceInfo:       value.DeviceInfo,
+      FeatureInfo:      value.FeatureInfo,
+      KeyInfo:          value.KeyInfo,
+      ManufacturerInfo: value.ManufacturerInfo,
+      SignatureInfo:    value.SignatureInfo,
+
+      DomainInfo:         value.DomainInfo,
+      PcInfo:             value.PcInfo,
+      SilverlightInfo:    value.SilverlightInfo,
+      MeteringInfo:       value.MeteringInfo,
+      ExtDataSignKeyInfo: value.ExtDataSignKeyInfo,
+      ExtDataContainer:   value.ExtDataContainer,
+      ExtDataSignature:   value.ExtDataSignature,
+      ExtDataHwid:        value.ExtDataHwid,
+      ServerInfo:         value.ServerInfo,
+      SecurityVersion:    value.SecurityVersion,
+      SecurityVersion2:   value.SecurityVersion2,
+
+      UnknownRecords: map[uint16][]UnknownRecord{},
+   }
+   for _, recType := range value.RecordOrder {
+      c.RecordOrder = append(c.RecordOrder, uint16(recType))
+   }
+   for recType, records := range value.UnknownRecords {
+      for _, record := range records {
+         c.UnknownRecords[uint16(recType)] = append(
+            c.UnknownRecords[uint16(recType)], UnknownRecord{record.Flags, record.Value},
+         )
+      }
+   }
+   return nil
+}
+
+type chainJSON struct {
+   Version      uint32
+   Flags        uint32
+   Certificates []Certificate
+}
+
+func (c *Chain) MarshalJSON() ([]byte, error) {
+   return json.Marshal(chainJSON{c.Header.Version, c.Header.Flags, c.Certificates})
+}
+
+// UnmarshalJSON sets the chain from its JSON form. Call Bytes to derive the
+// lengths
+func (c *Chain) UnmarshalJSON(data []byte) error {
+   var value chainJSON
+   err := json.Unmarshal(data, &value)
+   if err != nil {
+      return err
+   }
+   *c = Chain{
+      Header: ChainHeader{
+         HeaderTag: ChainHeaderTag,
+         Version:   value.Version,
+         Flags:     value.Flags,
+         Certs:     uint32(len(value.Certificates)),
+      },
+      Certificates: value.Certificates,
+   }
+   return nil
+}
@@ -0,0 +1,292 @@
+package playReady
+
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+)
+
+type DomainInfo struct {
+   Header            ObjectHeader
+   ServiceId         [16]byte
+   AccountId         [16]byte
+   RevisionTimestamp uint32
+   DomainUrl         PaddedString
+}
+
+type PcInfo struct {
+   Header          ObjectHeader
+   SecurityVersion uint32
+}
+
+type SilverlightInfo struct {
+   Header             ObjectHeader
+   SecurityVersion    uint32
+   PlatformIdentifier uint32
+}
+
+type MeteringInfo struct {
+   Header      ObjectHeader
+   MeteringId  [16]byte
+   MeteringUrl PaddedString
+}
+
+type ExtDataSignKeyInfo struct {
+   Header ObjectHeader
+   Type   uint16
+   Length uint16 // bits
+   Flags  uint32
+   Value  []byte
+}
+
+type ExtDataSignature struct {
+   Header        ObjectHeader
+   SignatureType uint16
+   SignatureData SignatureData
+}
+
+type ExtDataHwid struct {
+   Header ObjectHeader
+   Data   []byte
+}
+
+// ExtDataRecord is an object nested in ExtDataContainer
+type ExtDataRecord struct {
+   Hwid      *ExtDataHwid
+   Signature *ExtDataSignature
+}
+
+type ExtDataContainer struct {
+   Header  ObjectHeader
+   Records []ExtDataRecord
+}
+
+type ServerInfo struct {
+   Header      ObjectHeader
+   WarningDays uint32
+}
+
+// SecurityVersionInfo is used by both BcertObjectSecurityVersion and
+// BcertObjectSecurityVersion2
+type SecurityVersionInfo struct {
+   Header             ObjectHeader
+   SecurityVersion    uint32
+   PlatformIdentifier uint32
+}
+
+type certObject interface {
+   decode([]byte) error
+   encode() []byte
+}
+
+var errObjectTooShort = errors.New("certificate object too short")
+
+// decodeObject reports whether data decodes into object and encodes back to
+// the same bytes. Anything else is kept as an UnknownRecord
+func decodeObject(object certObject, data []byte) bool {
+   if object.decode(data) != nil {
+      return false
+   }
+   return bytes.Equal(object.encode(), data)
+}
+
+func (d *DomainInfo) decode(data []byte) error {
+   if len(data) < 40 {
+      return errObjectTooShort
+   }
+   copy(d.ServiceId[:], data[0:16])
+   copy(d.AccountId[:], data[16:32])
+   d.RevisionTimestamp = binary.BigEndian.Uint32(data[32:36])
+   var err error
+   d.DomainUrl, _, err = decodePaddedString(data[36:])
+   return err
+}
+
+func (d *DomainInfo) encode() []byte {
+   var data []byte
+   data = append(data, d.ServiceId[:]...)
+   data = append(data, d.AccountId[:]...)
+   data = binary.BigEndian.AppendUint32(data, d.RevisionTimestamp)
+   return append(data, encodePaddedString(d.DomainUrl)...)
+}
+
+func (p *PcInfo) decode(data []byte) error {
+   if len(data) < 4 {
+      return errObjectTooShort
+   }
+   p.SecurityVersion = binary.BigEndian.Uint32(data)
+   return nil
+}
+
+func (p *PcInfo) encode() []byte {
+   return binary.BigEndian.AppendUint32(nil, p.SecurityVersion)
+}
+
+func (s *SilverlightInfo) decode(data []byte) error {
+   if len(data) < 8 {
+      return errObjectTooShort
+   }
+   s.SecurityVersion = binary.BigEndian.Uint32(data)
+   s.PlatformIdentifier = binary.BigEndian.Uint32(data[4:])
+   return nil
+}
+
+func (s *SilverlightInfo) encode() []byte {
+   data := binary.BigEndian.AppendUint32(nil, s.SecurityVersion)
+   return binary.BigEndian.AppendUint32(data, s.PlatformIdentifier)
+}
+
+func (m *MeteringInfo) decode(data []byte) error {
+   if len(data) < 20 {
+      return errObjectTooShort
+   }
+   copy(m.MeteringId[:], data[0:16])
+   var err error
+   m.MeteringUrl, _, err = decodePaddedString(data[16:])
+   return err
+}
+
+func (m *MeteringInfo) encode() []byte {
+   var data []byte
+   data = append(data, m.MeteringId[:]...)
+   return append(data, encodePaddedString(m.MeteringUrl)...)
+}
+
+func (e *ExtDataSignKeyInfo) decode(data []byte) error {
+   if len(data) < 8 {
+      return errObjectTooShort
+   }
+   e.Type = binary.BigEndian.Uint16(data)
+   e.Length = binary.BigEndian.Uint16(data[2:])
+   e.Flags = binary.BigEndian.Uint32(data[4:])
+   size := int(e.Length) / 8
+   if len(data[8:]) < size {
+      return errObjectTooShort
+   }
+   e.Value = data[8:][:size]
+   return nil
+}
+
+func (e *ExtDataSignKeyInfo) encode() []byte {
+   data := binary.BigEndian.AppendUint16(nil, e.Type)
+   data = binary.BigEndian.AppendUint16(data, uint16(len(e.Value)*8))
+   data = binary.BigEndian.AppendUint32(data, e.Flags)
+   return append(data, e.Value...)
+}
+
+func (e *ExtDataSignature) decode(data []byte) error {
+   if len(data) < 4 {
+      return errObjectTooShort
+   }
+   e.SignatureType = binary.BigEndian.Uint16(data)
+   e.SignatureData.Cb = binary.BigEndian.Uint16(data[2:])
+   if len(data[4:]) < int(e.SignatureData.Cb) {
+      return errObjectTooShort
+   }
+   e.SignatureData.Value = data[4:][:e.SignatureData.Cb]
+   return nil
+}
+
+func (e *ExtDataSignature) encode() []byte {
+   data := binary.BigEndian.AppendUint16(nil, e.SignatureType)
+   data = binary.BigEndian.AppendUint16(data, uint16(len(e.SignatureData.Value)))
+   return append(data, e.SignatureData.Value...)
+}
+
+func (e *ExtDataHwid) decode(data []byte) error {
+   if len(data) < 4 {
+      return errObjectTooShort
+   }
+   size := binary.BigEndian.Uint32(data)
+   if uint32(len(data[4:])) < size {
+      return errObjectTooShort
+   }
+   e.Data = data[4:][:size]
+   return nil
+}
+
+func (e *ExtDataHwid) encode() []byte {
+   data := binary.BigEndian.AppendUint32(nil, uint32(len(e.Data)))
+   return append(data, e.Data...)
+}
+
+func (e *ExtDataContainer) decode(data []byte) error {
+   for len(data) >= 1 {
+      if len(data) < 8 {
+         return errObjectTooShort
+      }
+      header := ObjectHeader{
+         Flags:    binary.BigEndian.Uint16(data),
+         Type:     binary.BigEndian.Uint16(data[2:]),
+         CbLength: binary.BigEndian.Uint32(data[4:]),
+      }
+      if header.CbLength < 8 || uint32(len(data)) < header.CbLength {
+         return errObjectTooShort
+      }
+      value := data[8:header.CbLength]
+      data = data[header.CbLength:]
+      var record ExtDataRecord
+      switch BcertObject(header.Type) {
+      case BcertObjectExtDataHwid:
+         record.Hwid = &ExtDataHwid{Header: header}
+         if !decodeObject(record.Hwid, value) {
+            return errors.New("invalid ExtDataHwid record")
+         }
+      case BcertObjectExtDataSignature:
+         record.Signature = &ExtDataSignature{Header: header}
+         if !decodeObject(record.Signature, value) {
+            return errors.New("invalid ExtDataSignature record")
+         }
+      default:
+         return errors.New("unknown ExtDataContainer record")
+      }
+      e.Records = append(e.Records, record)
+   }
+   return nil
+}
+
+func (e *ExtDataContainer) encode() []byte {
+   var data []byte
+   for _, record := range e.Records {
+      switch {
+      case record.Hwid != nil:
+         data = appendObject(data, record.Hwid.Header.Flags, BcertObjectExtDataHwid, record.Hwid.encode())
+      case record.Signature != nil:
+         data = appendObject(data, record.Signature.Header.Flags, BcertObjectExtDataSignature, record.Signature.encode())
+      }
+   }
+   return data
+}
+
+func (s *ServerInfo) decode(data []byte) error {
+   if len(data) < 4 {
+      return errObjectTooShort
+   }
+   s.WarningDays = binary.BigEndian.Uint32(data)
+   return nil
+}
+
+func (s *ServerInfo) encode() []byte {
+   return binary.BigEndian.AppendUint32(nil, s.WarningDays)
+}
+
+func (s *SecurityVersionInfo) decode(data []byte) error {
+   if len(data) < 8 {
+      return errObjectTooShort
+   }
+   s.SecurityVersion = binary.BigEndian.Uint32(data)
+   s.PlatformIdentifier = binary.BigEndian.Uint32(data[4:])
+   return nil
+}
+
+func (s *SecurityVersionInfo) encode() []byte {
+   data := binary.BigEndian.AppendUint32(nil, s.SecurityVersion)
+   return binary.BigEndian.AppendUint32(data, s.PlatformIdentifier)
+}
+
+func appendObject(data []byte, flags uint16, object BcertObject, value []byte) []byte {
+   data = binary.BigEndian.AppendUint16(data, flags)
+   data = binary.BigEndian.AppendUint16(data, uint16(object))
+   data = binary.BigEndian.AppendUint32(data, uint32(len(value)+8))
+   return append(data, value...)
+}
@@ -0,0 +1,206 @@
+package playReady
+
+import (
+   "bytes"
+   "encoding/json"
+   "sync"
+   "testing"
+   "time"
+)
+
+func TestCertificateObjects(t *testing.T) {
+   cert := Certificate{
+      Header:             CertHeader{HeaderTag: CertHeaderTag, Version: CertVersion},
+      DomainInfo:         &DomainInfo{RevisionTimestamp: 7, DomainUrl: "http://domain"},
+      PcInfo:             &PcInfo{SecurityVersion: 1},
+      SilverlightInfo:    &SilverlightInfo{SecurityVersion: 2, PlatformIdentifier: 3},
+      MeteringInfo:       &MeteringInfo{MeteringUrl: "http://metering.example"},
+      ExtDataSignKeyInfo: &ExtDataSignKeyInfo{Type: 1, Length: 512, Value: make([]byte, 64)},
+      ExtDataContainer: &ExtDataContainer{
+         Records: []ExtDataRecord{
+            {Hwid: &ExtDataHwid{Data: []byte("hwid")}},
+            {Signature: &ExtDataSignature{
+               SignatureType: 1, SignatureData: SignatureData{Cb: 4, Value: []byte("sign")},
+            }},
+         },
+      },
+      ServerInfo:       &ServerInfo{WarningDays: 30},
+      SecurityVersion:  &SecurityVersionInfo{SecurityVersion: 4, PlatformIdentifier: 5},
+      SecurityVersion2: &SecurityVersionInfo{SecurityVersion: 6, PlatformIdentifier: 7},
+      RecordOrder: []uint16{
+         uint16(BcertObjectDomain),
+         uint16(BcertObjectPc),
+         uint16(BcertObjectSilverlight),
+         uint16(BcertObjectMetering),
+         uint16(BcertObjectServer),
+         uint16(BcertObjectSecurityVersion),
+         uint16(BcertObjectSecurityVersion2),
+         uint16(BcertObjectExtDataSignKey),
+         uint16(BcertObjectExtDataContainer),
+         uint16(BcertObjectExtDataHwid),
+      },
+      UnknownRecords: map[uint16][]UnknownRecord{
+         uint16(BcertObjectExtDataHwid): {{Flags: 1, Value: []byte{1, 2}}},
+      },
+   }
+   err := cert.CheckEncoding()
+   if err != nil {
+      t.Fatal(err)
+   }
+   data := cert.encode()
+   var decoded Certificate
+   _, err = decoded.decode(data, 0)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(decoded.encode(), data) {
+      t.Fatal("round trip")
+   }
+   text, err := json.Marshal(&decoded)
+   if err != nil {
+      t.Fatal(err)
+   }
+   var unmarshaled Certificate
+   err = json.Unmarshal(text, &unmarshaled)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(unmarshaled.Bytes(), data) {
+      t.Fatalf("JSON round trip %s", text)
+   }
+   if decoded.DomainInfo == nil || decoded.DomainInfo.DomainUrl != "http://domain" {
+      t.Errorf("DomainInfo %+v", decoded.DomainInfo)
+   }
+   if decoded.MeteringInfo == nil || decoded.MeteringInfo.MeteringUrl != "http://metering.example" {
+      t.Errorf("MeteringInfo %+v", decoded.MeteringInfo)
+   }
+   if decoded.SecurityVersion2 == nil || decoded.SecurityVersion2.PlatformIdentifier != 7 {
+      t.Errorf("SecurityVersion2 %+v", decoded.SecurityVersion2)
+   }
+   container := decoded.ExtDataContainer
+   if container == nil || len(container.Records) != 2 || string(container.Records[0].Hwid.Data) != "hwid" {
+      t.Errorf("ExtDataContainer %+v", container)
+   }
+   // a truncated ExtDataHwid does not decode and stays an UnknownRecord
+   if decoded.ExtDataHwid != nil || len(decoded.UnknownRecords[uint16(BcertObjectExtDataHwid)]) != 1 {
+      t.Errorf("ExtDataHwid %+v", decoded.ExtDataHwid)
+   }
+}
+
+func TestCertificateLengths(t *testing.T) {
+   keys := testKeys(t, 2)
+   chain := testIssuer(t, keys[0], keys[1], KeyUsageIssuerAll)
+   cert := &chain.Certificates[0]
+   cert.FeatureInfo = &FeatureInfo{
+      FeatureSet: []uint32{uint32(FeatureSecureClock), uint32(FeatureSupportsCrls)},
+   }
+   cert.RecordOrder = append([]uint16{uint16(BcertObjectFeature)}, cert.RecordOrder...)
+   cert.KeyInfo.Keys = append(cert.KeyInfo.Keys, CertKey{
+      Type: 1, Value: make([]byte, 64), UsageSet: []uint32{uint32(KeyUsageSign)},
+   })
+   err := cert.CheckEncoding()
+   if err != nil {
+      t.Fatal(err)
+   }
+   decoded, err := ParseChain(chain.Bytes())
+   if err != nil {
+      t.Fatal(err)
+   }
+   // Bytes and CheckEncoding leave the lengths alone
+   if cert.FeatureInfo.Header.CbLength != 0 || cert.KeyInfo.NumKeys != 1 {
+      t.Fatalf("%+v %+v", cert.FeatureInfo.Header, cert.KeyInfo.NumKeys)
+   }
+   if decoded.Certificates[0].Header == cert.Header {
+      t.Fatalf("%+v", cert.Header)
+   }
+   chain.UpdateLengths()
+   if cert.FeatureInfo.Header.CbLength != 8+4+8 || cert.KeyInfo.NumKeys != 2 {
+      t.Fatalf("%+v %+v", cert.FeatureInfo.Header, cert.KeyInfo.NumKeys)
+   }
+   if decoded.Certificates[0].Header != cert.Header || decoded.Header != chain.Header {
+      t.Fatalf("%+v", decoded.Certificates[0].Header)
+   }
+   // a field the encoding does not carry
+   cert.KeyInfo.Keys[0].UsageSet = nil
+   cert.KeyInfo.Keys[0].Value = nil
+   cert.KeyInfo.Keys[0].Type = 0
+   cert.DeviceInfo = &DeviceInfo{}
+   if cert.CheckEncoding() == nil {
+      t.Fatal("expected error for object missing from RecordOrder")
+   }
+}
+
+// Bytes only reads the chain, so it can be called concurrently
+func TestChainBytesConcurrent(t *testing.T) {
+   keys := testKeys(t, 2)
+   chain := testIssuer(t, keys[0], keys[1], KeyUsageIssuerAll)
+   want := chain.Bytes()
+   var group sync.WaitGroup
+   for range 4 {
+      group.Go(func() {
+         if !bytes.Equal(chain.Bytes(), want) {
+            t.Error("Bytes changed")
+         }
+      })
+   }
+   group.Wait()
+}
+
+func TestChainJSON(t *testing.T) {
+   ecosystem, err := NewEcosystem(&EcosystemOptions{
+      Model: IssuerOptions{Features: []Feature{FeatureSecureClock, Feature(0xff)}},
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   device, err := ecosystem.NewDevice(&LeafOptions{
+      Features:   []Feature{FeatureSecureClock},
+      Expiration: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   data := device.Chain.Bytes()
+   text, err := json.Marshal(device.Chain)
+   if err != nil {
+      t.Fatal(err)
+   }
+   for _, name := range []string{
+      `"SECURE_CLOCK"`, `"Feature(0x000000ff)"`, `"ISSUER_DEVICE"`, `"ENCRYPT_KEY"`,
+      `"Type":"DEVICE"`, `"P256"`, `"2030-01-01T00:00:00Z"`, `"never"`,
+   } {
+      if !bytes.Contains(text, []byte(name)) {
+         t.Fatalf("%v missing from %s", name, text)
+      }
+   }
+   var chain Chain
+   err = json.Unmarshal(text, &chain)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(chain.Bytes(), data) {
+      t.Fatal("JSON round trip")
+   }
+   roots, err := ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = chain.Verify(&VerifyOptions{Roots: roots})
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = json.Unmarshal([]byte(`{"Certificates":[{"FeatureInfo":{"FeatureSet":["FAST"]}}]}`), &chain)
+   if err == nil {
+      t.Fatal("expected error for unknown feature")
+   }
+   var feature Feature
+   for _, text := range []string{"KeyUsage(0x000000ff)", "x(0xff)", "(0xff)"} {
+      if feature.UnmarshalText([]byte(text)) == nil {
+         t.Fatalf("expected error for %q", text)
+      }
+   }
+   err = feature.UnmarshalText([]byte("Feature(0x000000ff)"))
+   if err != nil || feature != 0xff {
+      t.Fatal(feature, err)
+   }
+}
@@ -2,19 +2,27 @@ package playReady
 
 import (
    "bytes"
+   "cmp"
    "crypto/aes"
    "crypto/cipher"
    "crypto/ecdsa"
    "crypto/sha256"
    "encoding/binary"
    "errors"
+   "fmt"
    "slices"
+   "time"
 
    "41.neocities.org/diana/playReady/xml"
    "github.com/emmansun/gmsm/padding"
 )
 
-func (c *Chain) LicenseRequestBytes(signingKey *ecdsa.PrivateKey, kid []byte, contentID string) ([]byte, error) {
+// LicenseRequestBytes builds a signed AcquireLicense SOAP challenge. opts can
+// be nil
+func (c *Chain) LicenseRequestBytes(signingKey *ecdsa.PrivateKey, kid []byte, contentID string, opts *ChallengeOptions) ([]byte, error) {
+   if opts == nil {
+      opts = &ChallengeOptions{}
+   }
    var key xmlKey
    err := key.initialize()
    if err != nil {
@@ -26,7 +34,7 @@ func (c *Chain) LicenseRequestBytes(signingKey *ecdsa.PrivateKey, kid []byte, co
       return nil, err
    }
 
-   laRequest, err := newLa(key.PublicKey, cipherOutput, kid, contentID)
+   laRequest, err := newLa(key.PublicKey, cipherOutput, kid, contentID, opts)
    if err != nil {
       return nil, err
    }
@@ -35,19 +43,63 @@ func (c *Chain) LicenseRequestBytes(signingKey *ecdsa.PrivateKey, kid []byte, co
    if err != nil {
       return nil, err
    }
-   laDigest := sha256.Sum256(laData)
+   signature, err := newSignature(signingKey, laData)
+   if err != nil {
+      return nil, err
+   }
+
+   envelope := xml.Envelope{
+      Body: xml.Body{ // microsoft.com
+         AcquireLicense: &xml.AcquireLicense{ // microsoft.com
+            Challenge: xml.OuterChallenge{ // microsoft.com
+               Challenge: xml.InnerChallenge{ // microsoft.com
+                  La:        laRequest,                                                     // microsoft.com
+                  Signature: *signature,                                                    // microsoft.com
+                  XmlNs:     "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+               },
+            },
+            XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+         },
+      },
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   }
+   return xml.Marshal(envelope)
+}
+
+// newSignature signs the "#SignedData" element data with signingKey. data is
+// canonicalized on its own, so it must declare the namespaces it uses
+func newSignature(signingKey *ecdsa.PrivateKey, data []byte) (*xml.Signature, error) {
+   data, err := xml.Canonicalize(data, data, xml.ExclusiveCanonical)
+   if err != nil {
+      return nil, err
+   }
+   digest := sha256.Sum256(data)
 
    signedInfo := xml.SignedInfo{
+      CanonicalizationMethod: xml.Method{ // microsoft.com
+         Algorithm: xml.ExclusiveCanonical, // microsoft.com
+      },
+      SignatureMethod: xml.Method{ // microsoft.com
+         Algorithm: "http://schemas.microsoft.com/DRM/2007/03/protocols#ecdsa-sha256", // microsoft.com
+      },
       Reference: xml.Reference{ // microsoft.com
-         DigestValue: laDigest[:],   // microsoft.com
+         DigestMethod: xml.Method{ // microsoft.com
+            Algorithm: "http://schemas.microsoft.com/DRM/2007/03/protocols#sha256", // microsoft.com
+         },
+         DigestValue: digest[:],     // microsoft.com
          Uri:         "#SignedData", // microsoft.com
       },
+      XmlNs: xml.NamespaceSignature, // microsoft.com
    }
 
    signedData, err := xml.Marshal(signedInfo)
    if err != nil {
       return nil, err
    }
+   signedData, err = xml.Canonicalize(signedData, signedData, xml.ExclusiveCanonical)
+   if err != nil {
+      return nil, err
+   }
    signedDigest := sha256.Sum256(signedData)
 
    sigR, sigS, err := ecdsa.Sign(nil, signingKey, signedDigest[:])
@@ -59,25 +111,26 @@ func (c *Chain) LicenseRequestBytes(signingKey *ecdsa.PrivateKey, kid []byte, co
    sigR.FillBytes(sign[:32])
    sigS.FillBytes(sign[32:])
 
-   envelope := xml.Envelope{
-      Body: xml.Body{ // microsoft.com
-         AcquireLicense: &xml.AcquireLicense{ // microsoft.com
-            Challenge: xml.OuterChallenge{ // microsoft.com
-               Challenge: xml.InnerChallenge{ // microsoft.com
-                  La: laRequest, // microsoft.com
-                  Signature: xml.Signature{ // microsoft.com
-                     SignatureValue: sign[:],    // microsoft.com
-                     SignedInfo:     signedInfo, // microsoft.com
-                  },
-                  XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
-               },
-            },
-            XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
-         },
-      },
-      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   return &xml.Signature{ // microsoft.com
+      SignatureValue: sign[:],                // microsoft.com
+      SignedInfo:     signedInfo,             // microsoft.com
+      XmlNs:          xml.NamespaceSignature, // microsoft.com
+   }, nil
+}
+
+// encryptedData encrypts the chain for challenges other than AcquireLicense.
+// serverKey nil means the WMRM server key
+func (c *Chain) encryptedData(serverKey *ecdsa.PublicKey) (*xml.EncryptedData, error) {
+   var key xmlKey
+   err := key.initialize()
+   if err != nil {
+      return nil, err
    }
-   return xml.Marshal(envelope)
+   cipherOutput, err := c.cipherData(&key)
+   if err != nil {
+      return nil, err
+   }
+   return newEncryptedData(key.PublicKey, cipherOutput, serverKey)
 }
 
 func (c *Chain) cipherData(key *xmlKey) ([]byte, error) {
@@ -107,48 +160,58 @@ func (c *Chain) cipherData(key *xmlKey) ([]byte, error) {
 func ParseChain(data []byte) (*Chain, error) {
    c := &Chain{}
    if len(data) < 20 {
-      return nil, errors.New("chain data too short")
+      return nil, &DecodeError{formatChain, 0, ErrTruncated}
    }
 
    tag := binary.BigEndian.Uint32(data)
    if tag != ChainHeaderTag {
-      return nil, errors.New("failed to find chain magic")
+      return nil, &DecodeError{formatChain, 0, ErrInvalidMagic}
    }
-   data = data[4:]
 
    c.Header.HeaderTag = tag
-   c.Header.Version = binary.BigEndian.Uint32(data)
-   data = data[4:]
-
-   c.Header.CbChain = binary.BigEndian.Uint32(data)
-   data = data[4:]
-
-   c.Header.Flags = binary.BigEndian.Uint32(data)
-   data = data[4:]
-
-   certCount := binary.BigEndian.Uint32(data)
-   data = data[4:]
+   c.Header.Version = binary.BigEndian.Uint32(data[4:])
+   c.Header.CbChain = binary.BigEndian.Uint32(data[8:])
+   c.Header.Flags = binary.BigEndian.Uint32(data[12:])
+   certCount := binary.BigEndian.Uint32(data[16:])
+   offset := 20
+
+   // every certificate needs at least its 16 byte header
+   if uint64(certCount)*16 > uint64(len(data)-offset) {
+      return nil, &DecodeError{formatChain, 16, ErrInvalidLength}
+   }
 
    c.Header.Certs = certCount
    c.Certificates = make([]Certificate, certCount)
 
-   for index := uint32(0); index < certCount; index++ {
-      var cert Certificate
-      bytesRead, err := cert.decode(data)
+   for index := range c.Certificates {
+      bytesRead, err := c.Certificates[index].decode(data[offset:], offset)
       if err != nil {
          return nil, err
       }
-      c.Certificates[index] = cert
-      data = data[bytesRead:]
+      offset += bytesRead
    }
 
    return c, nil
 }
 
+// UpdateLengths sets the header and every certificate length to the value
+// Bytes encodes, see Certificate.UpdateLengths
+func (c *Chain) UpdateLengths() {
+   length := 20
+   for i := range c.Certificates {
+      c.Certificates[i].UpdateLengths()
+      length += int(c.Certificates[i].Header.CbCertificate)
+   }
+   c.Header.CbChain = uint32(length)
+   c.Header.Certs = uint32(len(c.Certificates))
+}
+
+// Bytes encodes the chain, deriving every length field. The chain is not
+// changed, see UpdateLengths
 func (c *Chain) Bytes() []byte {
    var certsData []byte
-   for _, cert := range c.Certificates {
-      certsData = append(certsData, cert.encode()...)
+   for i := range c.Certificates {
+      certsData = append(certsData, c.Certificates[i].Bytes()...)
    }
 
    length := uint32(20 + len(certsData))
@@ -163,36 +226,76 @@ func (c *Chain) Bytes() []byte {
    return append(data, certsData...)
 }
 
-func (c *Chain) verify() bool {
-   modelBase := c.Certificates[len(c.Certificates)-1].SignatureInfo.IssuerKey
-   for index := len(c.Certificates) - 1; index >= 0; index-- {
-      valid := c.Certificates[index].verify(modelBase)
-      if !valid {
-         return false
-      }
-      modelBase = c.Certificates[index].KeyInfo.Keys[0].Value
-   }
-   return true
+// LeafOptions is the template of a certificate made by GenerateLeaf. The zero
+// value makes the same leaf as before
+type LeafOptions struct {
+   // Type defaults to CertTypeDevice
+   Type CertType
+   // SecurityLevel defaults to the model certificate security level, and can
+   // not exceed it
+   SecurityLevel uint32
+   // Features defaults to FeatureScalable. When set, every feature must be
+   // listed by the model certificate, if it has a feature object
+   Features []Feature
+   // Expiration defaults to never. It can not be after the model certificate
+   // expiration
+   Expiration time.Time
+   // CbMaxLicense, CbMaxHeader and MaxChainDepth default to 10240, 15360 and
+   // 2
+   CbMaxLicense  uint32
+   CbMaxHeader   uint32
+   MaxChainDepth uint32
+   ClientId      [16]byte
+   // Manufacturer defaults to the model certificate manufacturer strings
+   Manufacturer *ManufacturerStrings
+   // EncryptKeyUsages defaults to KeyUsageEncryptKey
+   EncryptKeyUsages []KeyUsage
+   // Metering is the Metering object of a CertTypeMetering leaf
+   Metering *MeteringInfo
+   // Verify is used to check the chain before the leaf is added. nil trusts
+   // RootPublicKey only
+   Verify *VerifyOptions
 }
 
-func (c *Chain) GenerateLeaf(modelKey, signingKey, encryptKey *ecdsa.PrivateKey) error {
-   if !c.verify() {
-      return errors.New("cert is not valid")
+// GenerateLeaf signs a new leaf certificate with modelKey and inserts it at
+// the front of the chain. encryptKey can be nil, in which case a key is
+// generated. It returns the encryption key. opts can be nil
+func (c *Chain) GenerateLeaf(modelKey, signingKey, encryptKey *ecdsa.PrivateKey, opts *LeafOptions) (*ecdsa.PrivateKey, error) {
+   if opts == nil {
+      opts = &LeafOptions{}
    }
+   if len(c.Certificates) == 0 {
+      return nil, errors.New("chain has no model certificate")
+   }
+   err := c.Verify(opts.Verify)
+   if err != nil {
+      return nil, err
+   }
+   model := &c.Certificates[0]
    modelPub, err := publicKeyBytes(modelKey)
    if err != nil {
-      return err
+      return nil, err
    }
-   if !bytes.Equal(c.Certificates[0].KeyInfo.Keys[0].Value, modelPub) {
-      return errors.New("zgpriv not for cert")
+   if !bytes.Equal(model.KeyInfo.Keys[0].Value, modelPub) {
+      return nil, errors.New("zgpriv not for cert")
+   }
+   err = opts.check(model)
+   if err != nil {
+      return nil, err
+   }
+   if encryptKey == nil {
+      encryptKey, err = GenerateKey()
+      if err != nil {
+         return nil, err
+      }
    }
    signPub, err := publicKeyBytes(signingKey)
    if err != nil {
-      return err
+      return nil, err
    }
    encPub, err := publicKeyBytes(encryptKey)
    if err != nil {
-      return err
+      return nil, err
    }
 
    var unsignedCert Certificate
@@ -204,73 +307,136 @@ func (c *Chain) GenerateLeaf(modelKey, signingKey, encryptKey *ecdsa.PrivateKey)
 
    unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectBasic))
    unsignedCert.BasicInfo = &BasicInfo{
-      Header:         ObjectHeader{Flags: 0, Type: uint16(BcertObjectBasic), CbLength: 88},
-      SecurityLevel:  c.Certificates[0].BasicInfo.SecurityLevel,
-      Type:           2,
-      ExpirationDate: 4294967295,
+      SecurityLevel:  model.BasicInfo.SecurityLevel,
+      Type:           uint32(CertTypeDevice),
+      ExpirationDate: neverExpires,
+      ClientID:       ClientId{Rgb: opts.ClientId},
+   }
+   if opts.SecurityLevel >= 1 {
+      unsignedCert.BasicInfo.SecurityLevel = opts.SecurityLevel
+   }
+   if opts.Type != CertTypeUnknown {
+      unsignedCert.BasicInfo.Type = uint32(opts.Type)
+   }
+   if !opts.Expiration.IsZero() {
+      unsignedCert.BasicInfo.ExpirationDate = uint32(opts.Expiration.Unix())
    }
    copy(unsignedCert.BasicInfo.DigestValue[:], digest[:])
 
    unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectDevice))
    unsignedCert.DeviceInfo = &DeviceInfo{
-      Header:        ObjectHeader{Flags: 0, Type: uint16(BcertObjectDevice), CbLength: 20},
-      CbMaxLicense:  10240,
-      CbMaxHeader:   15360,
-      MaxChainDepth: 2,
+      CbMaxLicense:  cmp.Or(opts.CbMaxLicense, 10240),
+      CbMaxHeader:   cmp.Or(opts.CbMaxHeader, 15360),
+      MaxChainDepth: cmp.Or(opts.MaxChainDepth, 2),
    }
 
+   features := opts.Features
+   if features == nil {
+      features = []Feature{FeatureScalable}
+   }
    unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectFeature))
-   unsignedCert.FeatureInfo = &FeatureInfo{
-      Header:            ObjectHeader{Flags: 0, Type: uint16(BcertObjectFeature), CbLength: 16},
-      NumFeatureEntries: 1,
-      FeatureSet:        []uint32{0xD}, // SCALABLE
+   unsignedCert.FeatureInfo = &FeatureInfo{}
+   for _, feature := range features {
+      unsignedCert.FeatureInfo.FeatureSet = append(unsignedCert.FeatureInfo.FeatureSet, uint32(feature))
    }
 
+   encryptUsages := opts.EncryptKeyUsages
+   if encryptUsages == nil {
+      encryptUsages = []KeyUsage{KeyUsageEncryptKey}
+   }
    unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectKey))
    keySign := CertKey{
       Type:     1, // ECC 256
-      Length:   512,
       Value:    signPub,
-      UsageSet: []uint32{1},
+      UsageSet: []uint32{uint32(KeyUsageSign)},
    }
    keyEnc := CertKey{
-      Type:     1, // ECC 256
-      Length:   512,
-      Value:    encPub,
-      UsageSet: []uint32{2},
+      Type:  1, // ECC 256
+      Value: encPub,
+   }
+   for _, usage := range encryptUsages {
+      keyEnc.UsageSet = append(keyEnc.UsageSet, uint32(usage))
    }
    unsignedCert.KeyInfo = &KeyInfo{
-      Header:  ObjectHeader{Flags: 0, Type: uint16(BcertObjectKey), CbLength: 180},
-      NumKeys: 2,
-      Keys:    []CertKey{keySign, keyEnc},
+      Keys: []CertKey{keySign, keyEnc},
    }
 
-   unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectManufacturer))
-   unsignedCert.ManufacturerInfo = c.Certificates[0].ManufacturerInfo
+   manufacturer := model.ManufacturerInfo
+   if opts.Manufacturer != nil {
+      manufacturer = &ManufacturerInfo{ManufacturerStrings: *opts.Manufacturer}
+   }
+   if manufacturer != nil {
+      unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectManufacturer))
+      unsignedCert.ManufacturerInfo = manufacturer
+   }
+
+   if opts.Metering != nil {
+      unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectMetering))
+      unsignedCert.MeteringInfo = opts.Metering
+   }
 
    unsignedCert.RecordOrder = append(unsignedCert.RecordOrder, uint16(BcertObjectSignature))
    unsignedCert.SignatureInfo = &SignatureInfo{
-      Header:          ObjectHeader{Flags: 1, Type: uint16(BcertObjectSignature), CbLength: 82},
-      SignatureType:   1,
-      SignatureData:   SignatureData{Cb: 64, Value: make([]byte, 64)},
-      IssuerKeyLength: uint32(len(modelPub)) * 8, // Bits representation natively
-      IssuerKey:       modelPub,
+      Header:        ObjectHeader{Flags: 1},
+      SignatureType: uint16(SignatureTypeP256),
+      SignatureData: SignatureData{Value: make([]byte, 64)},
+      IssuerKey:     modelPub,
+   }
+
+   err = unsignedCert.sign(modelKey)
+   if err != nil {
+      return nil, err
    }
 
-   certData := unsignedCert.encode()
-   lengthToSig := binary.BigEndian.Uint32(certData[12:16])
-   sigDigest := sha256.Sum256(certData[:lengthToSig])
+   c.Certificates = slices.Insert(c.Certificates, 0, unsignedCert)
+   c.UpdateLengths()
+   return encryptKey, nil
+}
 
-   sigR, sigS, err := ecdsa.Sign(nil, modelKey, sigDigest[:])
+// sign sets the signature of the certificate, and derives its lengths, see
+// UpdateLengths
+func (c *Certificate) sign(issuerKey *ecdsa.PrivateKey) error {
+   // the signed header holds the full length, signature included
+   c.SignatureInfo.SignatureData.Value = make([]byte, 64)
+   c.UpdateLengths()
+   data := c.Bytes()
+   digest := sha256.Sum256(data[:c.Header.CbCertificateSigned])
+   sigR, sigS, err := ecdsa.Sign(nil, issuerKey, digest[:])
    if err != nil {
       return err
    }
-
    var sign [64]byte
    sigR.FillBytes(sign[:32])
    sigS.FillBytes(sign[32:])
-   unsignedCert.SignatureInfo.SignatureData.Value = sign[:]
+   c.SignatureInfo.SignatureData.Value = sign[:]
+   return nil
+}
 
-   c.Certificates = slices.Insert(c.Certificates, 0, unsignedCert)
+// check validates the options against the model certificate
+func (o *LeafOptions) check(model *Certificate) error {
+   certType := cmp.Or(o.Type, CertTypeDevice)
+   modelKey := &model.KeyInfo.Keys[0]
+   if usage, ok := issuerUsages[certType]; !modelKey.hasUsage(KeyUsageIssuerAll) {
+      if !ok || !modelKey.hasUsage(usage) {
+         return fmt.Errorf("model can not issue certificate type %v", certType)
+      }
+   }
+   if o.SecurityLevel > model.BasicInfo.SecurityLevel {
+      return fmt.Errorf(
+         "security level %v above model %v", o.SecurityLevel, model.BasicInfo.SecurityLevel,
+      )
+   }
+   if !o.Expiration.IsZero() && model.BasicInfo.ExpirationDate != neverExpires {
+      if o.Expiration.After(time.Unix(int64(model.BasicInfo.ExpirationDate), 0)) {
+         return errors.New("expiration after model expiration")
+      }
+   }
+   if model.FeatureInfo != nil {
+      for _, feature := range o.Features {
+         if !slices.Contains(model.FeatureInfo.FeatureSet, uint32(feature)) {
+            return fmt.Errorf("feature %v not permitted by model", feature)
+         }
+      }
+   }
    return nil
 }
@@ -0,0 +1,144 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "errors"
+   "fmt"
+   "slices"
+)
+
+// ReplaceLeaf removes the leaf certificate and generates a new one, see
+// GenerateLeaf. The chain is unchanged on error
+func (c *Chain) ReplaceLeaf(modelKey, signingKey, encryptKey *ecdsa.PrivateKey, opts *LeafOptions) (*ecdsa.PrivateKey, error) {
+   if !c.hasLeaf() {
+      return nil, errors.New("chain has no leaf certificate")
+   }
+   model := Chain{Header: c.Header, Certificates: cloneCertificates(c.Certificates[1:])}
+   encryptKey, err := model.GenerateLeaf(modelKey, signingKey, encryptKey, opts)
+   if err != nil {
+      return nil, err
+   }
+   c.Certificates = model.Certificates
+   c.UpdateLengths()
+   return encryptKey, nil
+}
+
+// ModelChain returns a copy of the chain without the leaf certificate, that
+// is the issuer certificates GenerateLeaf expects
+func (c *Chain) ModelChain() (*Chain, error) {
+   certs := c.Certificates
+   if c.hasLeaf() {
+      certs = certs[1:]
+   }
+   if len(certs) == 0 {
+      return nil, errors.New("chain has no model certificate")
+   }
+   model := &Chain{Header: c.Header, Certificates: cloneCertificates(certs)}
+   model.UpdateLengths()
+   return model, nil
+}
+
+// cloneCertificates returns a copy of certs sharing none of the objects
+// UpdateLengths changes
+func cloneCertificates(certs []Certificate) []Certificate {
+   clones := make([]Certificate, len(certs))
+   for i := range certs {
+      clones[i] = *certs[i].clone()
+   }
+   return clones
+}
+
+// hasLeaf reports whether the first certificate is not an issuer
+func (c *Chain) hasLeaf() bool {
+   if len(c.Certificates) == 0 {
+      return false
+   }
+   basic := c.Certificates[0].BasicInfo
+   return basic == nil || CertType(basic.Type) != CertTypeIssuer
+}
+
+// RecordDiff is a record that differs between two chains. Records are
+// matched by certificate index, type and occurrence
+type RecordDiff struct {
+   // Index is the certificate index, 0 is the leaf
+   Index int
+   Type  BcertObject
+   // Old is nil for an added record, and New is nil for a removed one
+   Old []byte
+   New []byte
+}
+
+func (r RecordDiff) String() string {
+   switch {
+   case r.Old == nil:
+      return fmt.Sprintf("certificate %v: %v added", r.Index, r.Type)
+   case r.New == nil:
+      return fmt.Sprintf("certificate %v: %v removed", r.Index, r.Type)
+   }
+   return fmt.Sprintf("certificate %v: %v changed", r.Index, r.Type)
+}
+
+// Diff compares the chain with other record by record
+func (c *Chain) Diff(other *Chain) []RecordDiff {
+   var diffs []RecordDiff
+   for index := range max(len(c.Certificates), len(other.Certificates)) {
+      var oldRecords, newRecords []record
+      if index < len(c.Certificates) {
+         oldRecords = c.Certificates[index].records()
+      }
+      if index < len(other.Certificates) {
+         newRecords = other.Certificates[index].records()
+      }
+      diffs = append(diffs, diffRecords(index, oldRecords, newRecords)...)
+   }
+   return diffs
+}
+
+func diffRecords(index int, oldRecords, newRecords []record) []RecordDiff {
+   type recordKey struct {
+      Type BcertObject
+      N    int
+   }
+   keys := func(records []record) []recordKey {
+      count := map[BcertObject]int{}
+      var keys []recordKey
+      for _, rec := range records {
+         keys = append(keys, recordKey{rec.Type, count[rec.Type]})
+         count[rec.Type]++
+      }
+      return keys
+   }
+   newKeys := keys(newRecords)
+   matched := make([]bool, len(newRecords))
+   var diffs []RecordDiff
+   for i, key := range keys(oldRecords) {
+      old := nonNil(oldRecords[i].Value)
+      j := slices.Index(newKeys, key)
+      if j == -1 {
+         diffs = append(diffs, RecordDiff{Index: index, Type: key.Type, Old: old})
+         continue
+      }
+      matched[j] = true
+      rec := newRecords[j]
+      if rec.Flags != oldRecords[i].Flags || !bytes.Equal(rec.Value, old) {
+         diffs = append(diffs, RecordDiff{
+            Index: index, Type: key.Type, Old: old, New: nonNil(rec.Value),
+         })
+      }
+   }
+   for j, rec := range newRecords {
+      if !matched[j] {
+         diffs = append(diffs, RecordDiff{Index: index, Type: rec.Type, New: nonNil(rec.Value)})
+      }
+   }
+   return diffs
+}
+
+// nonNil keeps empty records apart from missing ones
+func nonNil(data []byte) []byte {
+   if data == nil {
+      return []byte{}
+   }
+   return data
+}
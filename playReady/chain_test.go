@@ -8,7 +8,9 @@ import (
    "log"
    "net/http"
    "os"
+   "slices"
    "testing"
+   "time"
 )
 
 func TestKey(t *testing.T) {
@@ -44,7 +46,7 @@ func TestKey(t *testing.T) {
       }
       UuidOrGuid(kid)
       payload, err := chain_data.LicenseRequestBytes(
-         signingKey, kid, test.content_id,
+         signingKey, kid, test.content_id, nil,
       )
       if err != nil {
          t.Fatal(err)
@@ -186,7 +188,7 @@ func TestChain(t *testing.T) {
       if err != nil {
          t.Fatal(err)
       }
-      err = chain_data.GenerateLeaf(modelKey, signingKey, encrypt_key)
+      _, err = chain_data.GenerateLeaf(modelKey, signingKey, encrypt_key, nil)
       if err != nil {
          t.Fatal(err)
       }
@@ -212,3 +214,160 @@ func TestChain(t *testing.T) {
       }
    }
 }
+
+func TestLeafOptions(t *testing.T) {
+   keys := testKeys(t, 3)
+   rootKey, issuerKey, signingKey := keys[0], keys[1], keys[2]
+   chain := testIssuer(t, rootKey, issuerKey, KeyUsageIssuerDevice)
+   chain.Certificates[0].BasicInfo.ExpirationDate = uint32(time.Now().Add(time.Hour).Unix())
+   testSign(t, &chain.Certificates[0], rootKey)
+   verify := testVerify(t, rootKey)
+   invalid := []LeafOptions{
+      {SecurityLevel: 3000},
+      {Expiration: time.Now().Add(2 * time.Hour)},
+      {Type: CertTypeServer},
+   }
+   for _, opts := range invalid {
+      opts.Verify = verify
+      _, err := chain.GenerateLeaf(issuerKey, signingKey, nil, &opts)
+      if err == nil {
+         t.Fatalf("%+v: expected error", opts)
+      }
+   }
+   opts := LeafOptions{
+      SecurityLevel: 150,
+      Features:      []Feature{FeatureSecureClock, FeatureAntiRollbackClock, FeatureSupportsPr3Features},
+      CbMaxLicense:  1,
+      ClientId:      [16]byte{1},
+      Manufacturer:  &ManufacturerStrings{ManufacturerName: "name", ModelName: "model"},
+      Verify:        verify,
+   }
+   encryptKey, err := chain.GenerateLeaf(issuerKey, signingKey, nil, &opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   chain, err = ParseChain(chain.Bytes())
+   if err != nil {
+      t.Fatal(err)
+   }
+   leaf := &chain.Certificates[0]
+   if leaf.BasicInfo.SecurityLevel != 150 || leaf.BasicInfo.ClientID.Rgb != opts.ClientId {
+      t.Fatalf("%+v", leaf.BasicInfo)
+   }
+   if len(leaf.FeatureInfo.FeatureSet) != 3 || leaf.DeviceInfo.CbMaxLicense != 1 {
+      t.Fatalf("%+v %+v", leaf.FeatureInfo, leaf.DeviceInfo)
+   }
+   if leaf.ManufacturerInfo.ManufacturerStrings.ModelName.String() != "model" {
+      t.Fatalf("%+v", leaf.ManufacturerInfo)
+   }
+   encPub, err := publicKeyBytes(encryptKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(leaf.KeyInfo.Keys[1].Value, encPub) {
+      t.Fatal("encryption key mismatch")
+   }
+   rootPub, err := publicKeyBytes(rootKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = chain.Verify(&VerifyOptions{Roots: [][]byte{rootPub}})
+   if err != nil {
+      t.Fatal(err)
+   }
+   // the model certificate has a feature object
+   chain = testIssuer(t, rootKey, issuerKey, KeyUsageIssuerDevice)
+   model := &chain.Certificates[0]
+   model.FeatureInfo = &FeatureInfo{NumFeatureEntries: 1, FeatureSet: []uint32{uint32(FeatureSecureClock)}}
+   model.RecordOrder = slices.Insert(model.RecordOrder, 1, uint16(BcertObjectFeature))
+   testSign(t, model, rootKey)
+   _, err = chain.GenerateLeaf(issuerKey, signingKey, nil, &opts)
+   if err == nil {
+      t.Fatal("expected feature error")
+   }
+}
+
+func TestChainEdit(t *testing.T) {
+   ecosystem, err := NewEcosystem(nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   device, err := ecosystem.NewDevice(nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   chain := device.Chain
+   before, err := ParseChain(chain.Bytes())
+   if err != nil {
+      t.Fatal(err)
+   }
+   model, err := chain.ModelChain()
+   if err != nil {
+      t.Fatal(err)
+   }
+   if model.Header.Certs != 2 || int(model.Header.CbChain) != len(model.Bytes()) {
+      t.Fatalf("%+v", model.Header)
+   }
+   if len(chain.Diff(before)) >= 1 {
+      t.Fatal(chain.Diff(before))
+   }
+   // the model chain shares nothing with the chain
+   edited, err := chain.ModelChain()
+   if err != nil {
+      t.Fatal(err)
+   }
+   edited.Certificates[0].BasicInfo.SecurityLevel = 1
+   edited.Certificates[0].KeyInfo.Keys[0].UsageSet = nil
+   edited.Certificates[0].SignatureInfo.SignatureData.Value = nil
+   edited.UpdateLengths()
+   if !bytes.Equal(chain.Bytes(), before.Bytes()) {
+      t.Fatal("editing the model chain changed the chain")
+   }
+   signingKey, err := GenerateKey()
+   if err != nil {
+      t.Fatal(err)
+   }
+   roots, err := ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = chain.ReplaceLeaf(ecosystem.ModelKey, signingKey, nil, &LeafOptions{
+      SecurityLevel: 150,
+      Manufacturer:  &ManufacturerStrings{ModelName: "model"},
+      Verify:        &VerifyOptions{Roots: roots},
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   if chain.Header.Certs != 3 {
+      t.Fatalf("%+v", chain.Header)
+   }
+   err = chain.Verify(&VerifyOptions{Roots: roots})
+   if err != nil {
+      t.Fatal(err)
+   }
+   var changes []string
+   for _, diff := range before.Diff(chain) {
+      if diff.Index != 0 {
+         t.Fatalf("%v", diff)
+      }
+      changes = append(changes, diff.String())
+   }
+   want := []string{
+      "certificate 0: Basic changed",
+      "certificate 0: Key changed",
+      "certificate 0: Signature changed",
+      "certificate 0: Manufacturer added",
+   }
+   if !slices.Equal(changes, want) {
+      t.Fatalf("%q", changes)
+   }
+   _, err = model.ReplaceLeaf(ecosystem.ModelKey, signingKey, nil, nil)
+   if err == nil {
+      t.Fatal("expected error for chain without leaf")
+   }
+   diffs := model.Diff(chain)
+   if len(diffs) == 0 || diffs[len(diffs)-1].Old != nil {
+      t.Fatalf("%v", diffs)
+   }
+}
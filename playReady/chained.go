@@ -0,0 +1,194 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "errors"
+   "fmt"
+)
+
+var (
+   ErrRootLicenseRequired = errors.New("chained license requires a root license")
+   ErrRootLicenseNotFound = errors.New("root license not found")
+)
+
+// LicenseStore keeps decrypted root licenses by KID, so chained leaf licenses
+// can be decrypted against them. The zero value is ready to use
+type LicenseStore struct {
+   roots   map[string]*rootLicense
+   domains map[string]*Domain
+}
+
+type rootLicense struct {
+   license    *License
+   kid        []byte
+   contentKey []byte
+}
+
+// IsLeaf reports whether the license is a chained leaf license
+func (l *License) IsLeaf() bool {
+   if l.ContainerOuter.ContainerKeys.UplinkKid.Valid {
+      return true
+   }
+   ck, err := l.ContainerOuter.ContainerKeys.contentKey()
+   if err != nil {
+      return false
+   }
+   return AsymmetricEncryptionType(ck.KeyEncryptionCipherType) == AsymmetricEncryptionTypeChainedLicense
+}
+
+// AddRoot decrypts a root license with the device encryption key and stores
+// it. The license must have a KID for leaf licenses to name it
+func (s *LicenseStore) AddRoot(l *License, encryptKey *ecdsa.PrivateKey) error {
+   if l.IsLeaf() {
+      return errors.New("license is a leaf license")
+   }
+   if rootKid(l) == nil {
+      return errors.New("root license has no KID")
+   }
+   contentKey, err := l.Decrypt(encryptKey)
+   if err != nil {
+      return err
+   }
+   s.add(l, contentKey)
+   return nil
+}
+
+// rootKid returns the KID of the content key object, nil for an optimized
+// content key, which has none
+func rootKid(l *License) []byte {
+   key, err := l.ContainerOuter.ContainerKeys.contentKey()
+   if err != nil {
+      return nil
+   }
+   return key.GuidKeyID
+}
+
+// add stores a root license, unless it has no KID
+func (s *LicenseStore) add(l *License, contentKey []byte) {
+   kid := rootKid(l)
+   if kid == nil {
+      return
+   }
+   if s.roots == nil {
+      s.roots = map[string]*rootLicense{}
+   }
+   s.roots[string(kid)] = &rootLicense{license: l, kid: kid, contentKey: contentKey}
+}
+
+// Root returns the stored root license for kid
+func (s *LicenseStore) Root(kid []byte) (*License, bool) {
+   root, ok := s.roots[string(kid)]
+   if !ok {
+      return nil, false
+   }
+   return root.license, true
+}
+
+// AddDomain stores a joined domain, replacing any domain with the same
+// account ID
+func (s *LicenseStore) AddDomain(d *Domain) {
+   if s.domains == nil {
+      s.domains = map[string]*Domain{}
+   }
+   s.domains[string(d.AccountId)] = d
+}
+
+// Decrypt returns the content key of l. Leaf licenses are decrypted against
+// their stored root license, domain bound licenses with the stored domain key,
+// and any other license with encryptKey. Licenses other than leaf licenses are
+// stored as root licenses, if they have a KID
+func (s *LicenseStore) Decrypt(l *License, encryptKey *ecdsa.PrivateKey) ([]byte, error) {
+   if l.IsLeaf() {
+      return s.DecryptLeaf(l)
+   }
+   var (
+      contentKey []byte
+      err        error
+   )
+   if domainId := &l.ContainerOuter.DomainId; domainId.Valid {
+      domain, ok := s.domains[string(domainId.AccountId)]
+      if !ok {
+         return nil, ErrDomainRequired
+      }
+      contentKey, err = domain.Decrypt(l)
+   } else {
+      contentKey, err = l.Decrypt(encryptKey)
+   }
+   if err != nil {
+      return nil, err
+   }
+   s.add(l, contentKey)
+   return contentKey, nil
+}
+
+// DecryptLeaf decrypts a chained leaf license with the content key of the
+// root license named by its uplink KID
+func (s *LicenseStore) DecryptLeaf(l *License) ([]byte, error) {
+   uplink := &l.ContainerOuter.ContainerKeys.UplinkKid
+   if !uplink.Valid {
+      return nil, errors.New("no uplink KID found in license")
+   }
+   ck, err := l.ContainerOuter.ContainerKeys.contentKey()
+   if err != nil {
+      return nil, err
+   }
+   if AsymmetricEncryptionType(ck.KeyEncryptionCipherType) != AsymmetricEncryptionTypeChainedLicense {
+      return nil, errors.New("content key is not encrypted to a root license")
+   }
+   if len(ck.EncryptedKeyBuffer) != 32 {
+      return nil, errors.New("invalid chained key length")
+   }
+   root, ok := s.roots[string(uplink.GuidUplinkKID)]
+   if !ok {
+      return nil, ErrRootLicenseNotFound
+   }
+   err = uplink.check(root)
+   if err != nil {
+      return nil, err
+   }
+   decryptedKey, err := aesEcbDecrypt(ck.EncryptedKeyBuffer, root.contentKey)
+   if err != nil {
+      return nil, err
+   }
+   err = l.verify(decryptedKey[:16])
+   if err != nil {
+      return nil, err
+   }
+   return decryptedKey[16:], nil
+}
+
+// ChainedCheckSumTypeV1 is the checksum of keyChecksum. Version 1 uplink KID
+// objects have no type and always use it
+const ChainedCheckSumTypeV1 = 0
+
+// check binds a leaf license to the root license it names. The checksum is
+// required
+func (u *UplinkKid) check(root *rootLicense) error {
+   if u.Version >= 2 && u.ChainedCheckSumType != ChainedCheckSumTypeV1 {
+      return fmt.Errorf("unsupported chained checksum type %v", u.ChainedCheckSumType)
+   }
+   if len(u.ChainedCheckSum) != 8 {
+      return fmt.Errorf("invalid chained checksum length %v", len(u.ChainedCheckSum))
+   }
+   checksum, err := keyChecksum(root.kid, root.contentKey)
+   if err != nil {
+      return err
+   }
+   if !bytes.Equal(checksum, u.ChainedCheckSum) {
+      return errors.New("root license checksum mismatch")
+   }
+   return nil
+}
+
+// keyChecksum is the first 8 bytes of the KID encrypted with the content key
+func keyChecksum(kid, contentKey []byte) ([]byte, error) {
+   if len(kid) != 16 {
+      return nil, errors.New("invalid KID length")
+   }
+   data, err := aesEcbEncrypt(kid, contentKey)
+   if err != nil {
+      return nil, err
+   }
+   return data[:8], nil
+}
@@ -0,0 +1,75 @@
+package playReady
+
+import (
+   "crypto/ecdsa"
+   "time"
+
+   "41.neocities.org/diana/playReady/xml"
+)
+
+// ChallengeOptions configures the optional parts of a license challenge. The
+// zero value produces the same challenge as before, except that ClientTime
+// defaults to the current time
+type ChallengeOptions struct {
+   // CustomData is sent verbatim in the CustomData element
+   CustomData string
+   // ClientVersion is sent in CLIENTINFO/CLIENTVERSION, for example
+   // "10.0.16384.10011"
+   ClientVersion string
+   // ClientTime defaults to time.Now
+   ClientTime time.Time
+   // RevocationLists are the revocation list versions known to the client
+   RevocationLists []RevocationListVersion
+   // LicenseNonce defaults to 16 zero bytes
+   LicenseNonce []byte
+   // HeaderAttributes are added to CUSTOMATTRIBUTES in the WRMHEADER
+   HeaderAttributes []HeaderAttribute
+   // ServerKey is the license server public key the challenge is encrypted
+   // to. nil means the WMRM server key used by production servers
+   ServerKey *ecdsa.PublicKey
+}
+
+type HeaderAttribute struct {
+   Name  string
+   Value string
+}
+
+type RevocationListVersion struct {
+   ListId  []byte
+   Version uint32
+}
+
+func (o *ChallengeOptions) apply(la *xml.La) {
+   if o.ClientTime.IsZero() {
+      la.ClientTime = time.Now().Unix()
+   } else {
+      la.ClientTime = o.ClientTime.Unix()
+   }
+   if o.ClientVersion != "" {
+      la.ClientInfo = &xml.ClientInfo{ClientVersion: o.ClientVersion}
+   }
+   if len(o.RevocationLists) >= 1 {
+      la.RevocationLists = &xml.RevocationLists{}
+      for _, list := range o.RevocationLists {
+         la.RevocationLists.RevListInfo = append(
+            la.RevocationLists.RevListInfo,
+            xml.RevListInfo{ListId: list.ListId, Version: list.Version},
+         )
+      }
+   }
+   la.CustomData = o.CustomData
+   if o.LicenseNonce != nil {
+      la.LicenseNonce = o.LicenseNonce
+   }
+   if len(o.HeaderAttributes) >= 1 {
+      data := &la.ContentHeader.WrmHeader.Data
+      if data.CustomAttributes == nil {
+         data.CustomAttributes = &xml.CustomAttributes{}
+      }
+      for _, attr := range o.HeaderAttributes {
+         data.CustomAttributes.Attributes = append(
+            data.CustomAttributes.Attributes, xml.NewCustomAttribute(attr.Name, attr.Value),
+         )
+      }
+   }
+}
@@ -0,0 +1,103 @@
+package playReady
+
+import (
+   "strings"
+   "testing"
+   "time"
+)
+
+func TestChallengeOptions(t *testing.T) {
+   signingKey, err := GenerateKey()
+   if err != nil {
+      t.Fatal(err)
+   }
+   var chain Chain
+   data, err := chain.LicenseRequestBytes(
+      signingKey, make([]byte, 16), "", &ChallengeOptions{
+         CustomData:    "token=abc&amp",
+         ClientVersion: "10.0.16384.10011",
+         ClientTime:    time.Unix(1700000000, 0),
+         RevocationLists: []RevocationListVersion{
+            {ListId: make([]byte, 16), Version: 11},
+         },
+         LicenseNonce:     []byte("0123456789abcdef"),
+         HeaderAttributes: []HeaderAttribute{{Name: "USERID", Value: "42"}},
+      },
+   )
+   if err != nil {
+      t.Fatal(err)
+   }
+   challenge := string(data)
+   order := []string{
+      "<Version>1</Version>",
+      "<ContentHeader>",
+      "<USERID>42</USERID>",
+      "<CLIENTINFO><CLIENTVERSION>10.0.16384.10011</CLIENTVERSION></CLIENTINFO>",
+      "<RevocationLists><RevListInfo><ListID>AAAAAAAAAAAAAAAAAAAAAA==</ListID><Version>11</Version></RevListInfo></RevocationLists>",
+      "<CustomData>token=abc&amp;amp</CustomData>",
+      "<LicenseNonce>MDEyMzQ1Njc4OWFiY2RlZg==</LicenseNonce>",
+      "<ClientTime>1700000000</ClientTime>",
+      "<EncryptedData ",
+   }
+   offset := 0
+   for _, element := range order {
+      index := strings.Index(challenge[offset:], element)
+      if index == -1 {
+         t.Fatalf("%v missing or out of order in %v", element, challenge)
+      }
+      offset += index + len(element)
+   }
+}
+
+func TestAcknowledge(t *testing.T) {
+   signingKey, err := GenerateKey()
+   if err != nil {
+      t.Fatal(err)
+   }
+   var license License
+   if license.AcknowledgementRequired() {
+      t.Fatal("AcknowledgementRequired")
+   }
+   license.TransactionId = []byte("transaction")
+   license.RightsIdBuffer = []byte("0123456789abcdef")
+   license.ContainerOuter.ContainerKeys.ContentKey.GuidKeyID = make([]byte, 16)
+   var chain Chain
+   data, err := chain.AcknowledgeRequestBytes(signingKey, &license)
+   if err != nil {
+      t.Fatal(err)
+   }
+   for _, element := range []string{
+      "<AcknowledgeLicense xmlns=",
+      "<TransactionID>dHJhbnNhY3Rpb24=</TransactionID>",
+      "<License><KID>AAAAAAAAAAAAAAAAAAAAAA==</KID><LID>MDEyMzQ1Njc4OWFiY2RlZg==</LID><Result>0</Result></License>",
+      "<SignatureValue>",
+   } {
+      if !strings.Contains(string(data), element) {
+         t.Fatalf("%v missing in %s", element, data)
+      }
+   }
+   response := `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+      <soap:Body>
+         <AcknowledgeLicenseResponse xmlns="http://schemas.microsoft.com/DRM/2007/03/protocols">
+            <AcknowledgeLicenseResult>
+               <Response>
+                  <AckResponse><TransactionID>dHJhbnNhY3Rpb24=</TransactionID></AckResponse>
+               </Response>
+            </AcknowledgeLicenseResult>
+         </AcknowledgeLicenseResponse>
+      </soap:Body>
+   </soap:Envelope>`
+   err = ParseAcknowledgement([]byte(response), license.TransactionId)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = ParseAcknowledgement([]byte(response), []byte("other"))
+   if err == nil {
+      t.Fatal("expected transaction ID mismatch")
+   }
+   response = strings.Replace(response, "<TransactionID>dHJhbnNhY3Rpb24=</TransactionID>", "", 1)
+   err = ParseAcknowledgement([]byte(response), license.TransactionId)
+   if err == nil {
+      t.Fatal("expected error for missing transaction ID")
+   }
+}
@@ -7,6 +7,7 @@ import (
    "crypto/ecdsa"
    "crypto/elliptic"
    "encoding/hex"
+   "errors"
    "filippo.io/nistec"
    "github.com/emmansun/gmsm/cipher"
 )
@@ -41,12 +42,50 @@ func (x *xmlKey) aesKey() []byte {
    return x.X[16:]
 }
 
-func newLa(pubKey *ecdsa.PublicKey, cipherData, kid []byte, contentId string) (*xml.La, error) {
-   genKey, err := elGamalKeyGeneration()
+// newEncryptedData encrypts pubKey to serverKey, or to the WMRM server key if
+// serverKey is nil
+func newEncryptedData(pubKey *ecdsa.PublicKey, cipherData []byte, serverKey *ecdsa.PublicKey) (*xml.EncryptedData, error) {
+   if serverKey == nil {
+      var err error
+      serverKey, err = elGamalKeyGeneration()
+      if err != nil {
+         return nil, err
+      }
+   }
+   cipherValue, err := elGamalEncrypt(pubKey, serverKey)
    if err != nil {
       return nil, err
    }
-   cipherValue, err := elGamalEncrypt(pubKey, genKey)
+   return &xml.EncryptedData{ // microsoft.com
+      CipherData: xml.CipherData{ // microsoft.com
+         CipherValue: cipherData, // microsoft.com
+      },
+      EncryptionMethod: xml.EncryptionMethod{ // microsoft.com
+         Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc", // microsoft.com
+      },
+      KeyInfo: xml.EncryptedDataInfo{ // microsoft.com
+         EncryptedKey: xml.EncryptedKey{ // microsoft.com
+            CipherData: xml.CipherData{ // microsoft.com
+               CipherValue: cipherValue, // microsoft.com
+            },
+            EncryptionMethod: xml.EncryptionMethod{ // microsoft.com
+               Algorithm: "http://schemas.microsoft.com/DRM/2007/03/protocols#ecc256", // microsoft.com
+            },
+            KeyInfo: xml.EncryptedKeyInfo{ // microsoft.com
+               KeyName: "WMRMServer",                         // microsoft.com
+               XmlNs:   "http://www.w3.org/2000/09/xmldsig#", // microsoft.com
+            },
+            XmlNs: "http://www.w3.org/2001/04/xmlenc#", // microsoft.com
+         },
+         XmlNs: "http://www.w3.org/2000/09/xmldsig#", // microsoft.com
+      },
+      Type:  "http://www.w3.org/2001/04/xmlenc#Element", // microsoft.com
+      XmlNs: "http://www.w3.org/2001/04/xmlenc#",        // microsoft.com
+   }, nil
+}
+
+func newLa(pubKey *ecdsa.PublicKey, cipherData, kid []byte, contentId string, opts *ChallengeOptions) (*xml.La, error) {
+   encryptedData, err := newEncryptedData(pubKey, cipherData, opts.ServerKey)
    if err != nil {
       return nil, err
    }
@@ -64,7 +103,7 @@ func newLa(pubKey *ecdsa.PublicKey, cipherData, kid []byte, contentId string) (*
       }
    }
 
-   return &xml.La{
+   la := &xml.La{
       ContentHeader: xml.ContentHeader{ // microsoft.com
          WrmHeader: xml.WrmHeader{ // microsoft.com
             Data:    headerData,                                                 // microsoft.com
@@ -72,37 +111,14 @@ func newLa(pubKey *ecdsa.PublicKey, cipherData, kid []byte, contentId string) (*
             XmlNs:   "http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader", // microsoft.com
          },
       },
-      EncryptedData: xml.EncryptedData{ // microsoft.com
-         CipherData: xml.CipherData{ // microsoft.com
-            CipherValue: cipherData, // microsoft.com
-         },
-         EncryptionMethod: xml.EncryptionMethod{ // microsoft.com
-            Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc", // microsoft.com
-         },
-         KeyInfo: xml.EncryptedDataInfo{ // microsoft.com
-            EncryptedKey: xml.EncryptedKey{ // microsoft.com
-               CipherData: xml.CipherData{ // microsoft.com
-                  CipherValue: cipherValue, // microsoft.com
-               },
-               EncryptionMethod: xml.EncryptionMethod{ // microsoft.com
-                  Algorithm: "http://schemas.microsoft.com/DRM/2007/03/protocols#ecc256", // microsoft.com
-               },
-               KeyInfo: xml.EncryptedKeyInfo{ // microsoft.com
-                  KeyName: "WMRMServer",                         // microsoft.com
-                  XmlNs:   "http://www.w3.org/2000/09/xmldsig#", // microsoft.com
-               },
-               XmlNs: "http://www.w3.org/2001/04/xmlenc#", // microsoft.com
-            },
-            XmlNs: "http://www.w3.org/2000/09/xmldsig#", // microsoft.com
-         },
-         Type:  "http://www.w3.org/2001/04/xmlenc#Element", // microsoft.com
-         XmlNs: "http://www.w3.org/2001/04/xmlenc#",        // microsoft.com
-      },
-      Id:           "SignedData",                                         // microsoft.com
-      LicenseNonce: make([]byte, 16),                                     // 9c9media.com
-      Version:      "1",                                                  // microsoft.com
-      XmlNs:        "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
-   }, nil
+      EncryptedData: *encryptedData,                                       // microsoft.com
+      Id:            "SignedData",                                         // microsoft.com
+      LicenseNonce:  make([]byte, 16),                                     // 9c9media.com
+      Version:       "1",                                                  // microsoft.com
+      XmlNs:         "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+   }
+   opts.apply(la)
+   return la, nil
 }
 
 func GenerateKey() (*ecdsa.PrivateKey, error) {
@@ -135,6 +151,9 @@ const wmrmPublicKey = "C8B6AF16EE941AADAA5389B4AF2C10E356BE42AF175EF3FACE93254E7
 const magicConstantZero = "7ee9ed4af773224f00b8ea7efb027cbb"
 
 func elGamalDecrypt(ciphertext []byte, privKey *ecdsa.PrivateKey) ([]byte, error) {
+   if len(ciphertext) < 128 {
+      return nil, errors.New("ElGamal ciphertext too short")
+   }
    c1Bytes := [65]byte{4}
    copy(c1Bytes[1:], ciphertext[:64])
    c1, err := nistec.NewP256Point().SetBytes(c1Bytes[:])
@@ -165,6 +184,9 @@ func elGamalDecrypt(ciphertext []byte, privKey *ecdsa.PrivateKey) ([]byte, error
 }
 
 func aesEcbEncrypt(data, key []byte) ([]byte, error) {
+   if len(data)%aes.BlockSize != 0 {
+      return nil, errors.New("data is not a multiple of the block size")
+   }
    block, err := aes.NewCipher(key)
    if err != nil {
       return nil, err
@@ -174,6 +196,19 @@ func aesEcbEncrypt(data, key []byte) ([]byte, error) {
    return encData, nil
 }
 
+func aesEcbDecrypt(data, key []byte) ([]byte, error) {
+   if len(data)%aes.BlockSize != 0 {
+      return nil, errors.New("data is not a multiple of the block size")
+   }
+   block, err := aes.NewCipher(key)
+   if err != nil {
+      return nil, err
+   }
+   decData := make([]byte, len(data))
+   cipher.NewECBDecrypter(block).CryptBlocks(decData, data)
+   return decData, nil
+}
+
 func xorKey(left, right []byte) []byte {
    if len(left) != len(right) {
       panic("slices have different lengths")
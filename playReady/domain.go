@@ -0,0 +1,404 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "encoding/binary"
+   "errors"
+   "fmt"
+
+   "41.neocities.org/diana/playReady/xml"
+)
+
+// DomainOptions configures JoinDomain and LeaveDomain challenges
+type DomainOptions struct {
+   ServiceId []byte
+   // AccountId can be empty when joining, in which case the server picks the
+   // account
+   AccountId    []byte
+   Revision     uint32
+   FriendlyName string
+   CustomData   string
+   // ServerKey is the server public key the challenge is encrypted to. nil
+   // means the WMRM server key
+   ServerKey *ecdsa.PublicKey
+   // Verify checks the domain chain of a JoinDomain response with
+   // Chain.Verify. nil trusts RootPublicKey only
+   Verify *VerifyOptions
+}
+
+// Domain is a joined domain: its certificate chain and private keys. Licenses
+// bound to the domain are decrypted with the domain key of their revision
+type Domain struct {
+   ServiceId []byte
+   AccountId []byte
+   // Revision is the current key revision
+   Revision uint32
+   // Chain is the domain certificate chain, starting with the domain
+   // certificate
+   Chain *Chain
+   Keys  []DomainKey
+}
+
+// DomainKey is a domain private key along with its revision
+type DomainKey struct {
+   Revision uint32
+   Key      *ecdsa.PrivateKey
+}
+
+// JoinDomainRequestBytes builds a signed JoinDomain SOAP challenge
+func (c *Chain) JoinDomainRequestBytes(signingKey *ecdsa.PrivateKey, opts *DomainOptions) ([]byte, error) {
+   domain, signature, err := c.domainChallenge(signingKey, opts)
+   if err != nil {
+      return nil, err
+   }
+   return xml.Marshal(xml.Envelope{
+      Body: xml.Body{ // microsoft.com
+         JoinDomain: &xml.JoinDomain{ // microsoft.com
+            Challenge: xml.OuterChallenge{ // microsoft.com
+               Challenge: xml.InnerChallenge{ // microsoft.com
+                  Domain:    domain,                                                        // microsoft.com
+                  Signature: *signature,                                                    // microsoft.com
+                  XmlNs:     "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+               },
+            },
+            XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+         },
+      },
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   })
+}
+
+// LeaveDomainRequestBytes builds a signed LeaveDomain SOAP challenge
+func (c *Chain) LeaveDomainRequestBytes(signingKey *ecdsa.PrivateKey, opts *DomainOptions) ([]byte, error) {
+   if len(opts.AccountId) == 0 {
+      return nil, errors.New("leaving a domain needs its account ID")
+   }
+   domain, signature, err := c.domainChallenge(signingKey, opts)
+   if err != nil {
+      return nil, err
+   }
+   return xml.Marshal(xml.Envelope{
+      Body: xml.Body{ // microsoft.com
+         LeaveDomain: &xml.LeaveDomain{ // microsoft.com
+            Challenge: xml.OuterChallenge{ // microsoft.com
+               Challenge: xml.InnerChallenge{ // microsoft.com
+                  Domain:    domain,                                                        // microsoft.com
+                  Signature: *signature,                                                    // microsoft.com
+                  XmlNs:     "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+               },
+            },
+            XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+         },
+      },
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   })
+}
+
+// domainChallenge returns the signed Domain element of JoinDomain and
+// LeaveDomain challenges
+func (c *Chain) domainChallenge(signingKey *ecdsa.PrivateKey, opts *DomainOptions) (*xml.Domain, *xml.Signature, error) {
+   if len(opts.ServiceId) != 16 {
+      return nil, nil, errors.New("invalid service ID length")
+   }
+   encryptedData, err := c.encryptedData(opts.ServerKey)
+   if err != nil {
+      return nil, nil, err
+   }
+   domain := &xml.Domain{
+      AccountId:     opts.AccountId,                                       // microsoft.com
+      CustomData:    opts.CustomData,                                      // microsoft.com
+      EncryptedData: *encryptedData,                                       // microsoft.com
+      FriendlyName:  opts.FriendlyName,                                    // microsoft.com
+      Id:            "SignedData",                                         // microsoft.com
+      Revision:      opts.Revision,                                        // microsoft.com
+      ServiceId:     opts.ServiceId,                                       // microsoft.com
+      Version:       "2",                                                  // microsoft.com
+      XmlNs:         "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+   }
+   data, err := xml.Marshal(domain)
+   if err != nil {
+      return nil, nil, err
+   }
+   signature, err := newSignature(signingKey, data)
+   if err != nil {
+      return nil, nil, err
+   }
+   return domain, signature, nil
+}
+
+// ParseJoinDomainResponse returns the domain joined with the challenge of
+// opts, after checking the domain chain. The domain keys are decrypted with
+// the device encryption key. A SOAP fault is returned as *FaultError
+func ParseJoinDomainResponse(data []byte, encryptKey *ecdsa.PrivateKey, opts *DomainOptions) (*Domain, error) {
+   envelope, err := decodeEnvelope(data)
+   if err != nil {
+      return nil, err
+   }
+   if envelope.Body.JoinDomainResponse == nil {
+      return nil, errors.New("JoinDomainResponse not found")
+   }
+   response := &envelope.Body.JoinDomainResponse.JoinDomainResult.Response.Domain
+   if !bytes.Equal(response.ServiceId, opts.ServiceId) {
+      return nil, errors.New("domain service ID mismatch")
+   }
+   chain, err := ParseChain(response.CertificateChain)
+   if err != nil {
+      return nil, err
+   }
+   err = chain.Verify(opts.Verify)
+   if err != nil {
+      return nil, err
+   }
+   keys, err := decodeDomainKeys(response.DomainKeys, encryptKey)
+   if err != nil {
+      return nil, err
+   }
+   d := &Domain{
+      ServiceId: response.ServiceId,
+      AccountId: response.AccountId,
+      Revision:  response.Revision,
+      Chain:     chain,
+      Keys:      keys,
+   }
+   err = d.check()
+   if err != nil {
+      return nil, err
+   }
+   return d, nil
+}
+
+// ParseLeaveDomainResponse checks a LeaveDomain response. A SOAP fault is
+// returned as *FaultError
+func ParseLeaveDomainResponse(data []byte, accountId []byte) error {
+   envelope, err := decodeEnvelope(data)
+   if err != nil {
+      return err
+   }
+   if envelope.Body.LeaveDomainResponse == nil {
+      return errors.New("LeaveDomainResponse not found")
+   }
+   response := &envelope.Body.LeaveDomainResponse.LeaveDomainResult.Response.Domain
+   if !bytes.Equal(response.AccountId, accountId) {
+      return errors.New("domain account ID mismatch")
+   }
+   return nil
+}
+
+// check makes sure the domain certificate holds the current domain key
+func (d *Domain) check() error {
+   if len(d.AccountId) != 16 {
+      return errors.New("invalid domain account ID length")
+   }
+   if len(d.Chain.Certificates) == 0 {
+      return errors.New("domain certificate chain is empty")
+   }
+   cert := &d.Chain.Certificates[0]
+   if cert.BasicInfo == nil || CertType(cert.BasicInfo.Type) != CertTypeDomain {
+      return errors.New("first certificate is not a domain certificate")
+   }
+   key, err := d.Key(d.Revision)
+   if err != nil {
+      return err
+   }
+   pub, err := publicKeyBytes(key)
+   if err != nil {
+      return err
+   }
+   if cert.KeyInfo != nil {
+      for _, certKey := range cert.KeyInfo.Keys {
+         if bytes.Equal(certKey.Value, pub) {
+            return nil
+         }
+      }
+   }
+   return errors.New("domain certificate does not hold the domain key")
+}
+
+// Key returns the domain private key of revision
+func (d *Domain) Key(revision uint32) (*ecdsa.PrivateKey, error) {
+   for _, key := range d.Keys {
+      if key.Revision == revision {
+         return key.Key, nil
+      }
+   }
+   return nil, fmt.Errorf("no domain key for revision %v", revision)
+}
+
+// Decrypt returns the content key of a license bound to the domain
+func (d *Domain) Decrypt(l *License) ([]byte, error) {
+   domainId := &l.ContainerOuter.DomainId
+   if !domainId.Valid {
+      return nil, errors.New("license is not bound to a domain")
+   }
+   if !bytes.Equal(domainId.AccountId, d.AccountId) {
+      return nil, errors.New("license is bound to another domain")
+   }
+   key, err := d.Key(domainId.Revision)
+   if err != nil {
+      return nil, err
+   }
+   return l.Decrypt(key)
+}
+
+// The DomainKeys of a JoinDomain response are a domain key XMR: a header of
+// constant, version and total length, then objects with the same flags, type
+// and length header as XMR objects. The session key object is the key type,
+// encryption type, key length and the AES session key, encrypted to the device
+// encryption key like a content key. The private key container holds an object
+// for each revision: the revision, key type, encryption type, key length and
+// the domain private key, encrypted with the session key using AES ECB
+const (
+   domainKeysMagic   = 0x444b584d // "DKXM"
+   domainKeysVersion = 1
+
+   domainKeysSessionKey   = 1
+   domainKeysKeyContainer = 2
+   domainKeysPrivateKey   = 3
+
+   domainKeysTypeAes128 = 1
+   domainKeysTypeEcc256 = 1
+
+   domainKeysEncryptionEcc256 = 1
+   domainKeysEncryptionAesEcb = 1
+)
+
+// encodeDomainKeys encrypts keys to the device encryption key
+func encodeDomainKeys(encryptKey *ecdsa.PublicKey, keys []DomainKey) ([]byte, error) {
+   point, integrity, err := keyPoint(nil, make([]byte, 16))
+   if err != nil {
+      return nil, err
+   }
+   // the random half of the point is the session key
+   sessionKey := integrity
+   encrypted, err := elGamalEncryptPoint(point, encryptKey)
+   if err != nil {
+      return nil, err
+   }
+   objects := encodeFtlv(xmrFlagMustUnderstand, domainKeysSessionKey, appendDomainKey(
+      nil, domainKeysTypeAes128, domainKeysEncryptionEcc256, encrypted,
+   ))
+   var container []byte
+   for _, key := range keys {
+      private, err := PrivateKeyBytes(key.Key)
+      if err != nil {
+         return nil, err
+      }
+      private, err = aesEcbEncrypt(private, sessionKey)
+      if err != nil {
+         return nil, err
+      }
+      value := binary.BigEndian.AppendUint32(nil, key.Revision)
+      value = appendDomainKey(value, domainKeysTypeEcc256, domainKeysEncryptionAesEcb, private)
+      container = append(container, encodeFtlv(xmrFlagMustUnderstand, domainKeysPrivateKey, value)...)
+   }
+   objects = append(objects, encodeFtlv(xmrFlagMustUnderstand, domainKeysKeyContainer, container)...)
+   data := binary.BigEndian.AppendUint32(nil, domainKeysMagic)
+   data = binary.BigEndian.AppendUint32(data, domainKeysVersion)
+   data = binary.BigEndian.AppendUint32(data, uint32(12+len(objects)))
+   return append(data, objects...), nil
+}
+
+// appendDomainKey appends the key type, encryption type, length and key
+func appendDomainKey(data []byte, keyType, encryption uint16, key []byte) []byte {
+   data = binary.BigEndian.AppendUint16(data, keyType)
+   data = binary.BigEndian.AppendUint16(data, encryption)
+   data = binary.BigEndian.AppendUint32(data, uint32(len(key)))
+   return append(data, key...)
+}
+
+// decodeDomainKey returns the encryption type and key of a session key or
+// private key value, after the revision of the latter
+func decodeDomainKey(data []byte) (uint16, []byte, error) {
+   if len(data) < 8 {
+      return 0, nil, ErrTruncated
+   }
+   length := binary.BigEndian.Uint32(data[4:])
+   if uint64(length) != uint64(len(data)-8) {
+      return 0, nil, ErrInvalidLength
+   }
+   return binary.BigEndian.Uint16(data[2:]), data[8:], nil
+}
+
+func decodeDomainKeys(data []byte, encryptKey *ecdsa.PrivateKey) ([]DomainKey, error) {
+   if len(data) < 12 {
+      return nil, ErrTruncated
+   }
+   if binary.BigEndian.Uint32(data) != domainKeysMagic {
+      return nil, ErrInvalidMagic
+   }
+   if version := binary.BigEndian.Uint32(data[4:]); version != domainKeysVersion {
+      return nil, fmt.Errorf("unsupported domain keys version %v", version)
+   }
+   length := binary.BigEndian.Uint32(data[8:])
+   if length < 12 || uint64(length) > uint64(len(data)) {
+      return nil, ErrInvalidLength
+   }
+   var sessionKey, container []byte
+   for data = data[12:length]; len(data) >= 1; {
+      f, n, err := decodeFtlv(data)
+      if err != nil {
+         return nil, err
+      }
+      switch f.Type {
+      case domainKeysSessionKey:
+         encryption, key, err := decodeDomainKey(f.Value)
+         if err != nil {
+            return nil, err
+         }
+         if encryption != domainKeysEncryptionEcc256 {
+            return nil, fmt.Errorf("unsupported domain session key encryption %v", encryption)
+         }
+         decrypted, err := elGamalDecrypt(key, encryptKey)
+         if err != nil {
+            return nil, err
+         }
+         sessionKey = decrypted[:16]
+      case domainKeysKeyContainer:
+         container = f.Value
+      }
+      data = data[n:]
+   }
+   if sessionKey == nil {
+      return nil, errors.New("domain keys have no session key")
+   }
+   var keys []DomainKey
+   for len(container) >= 1 {
+      f, n, err := decodeFtlv(container)
+      if err != nil {
+         return nil, err
+      }
+      container = container[n:]
+      if f.Type != domainKeysPrivateKey {
+         continue
+      }
+      if len(f.Value) < 4 {
+         return nil, ErrTruncated
+      }
+      encryption, private, err := decodeDomainKey(f.Value[4:])
+      if err != nil {
+         return nil, err
+      }
+      if encryption != domainKeysEncryptionAesEcb {
+         return nil, fmt.Errorf("unsupported domain private key encryption %v", encryption)
+      }
+      if len(private) != 32 {
+         return nil, ErrInvalidLength
+      }
+      private, err = aesEcbDecrypt(private, sessionKey)
+      if err != nil {
+         return nil, err
+      }
+      key, err := ParseRawPrivateKey(private)
+      if err != nil {
+         return nil, err
+      }
+      keys = append(keys, DomainKey{
+         Revision: binary.BigEndian.Uint32(f.Value), Key: key,
+      })
+   }
+   if len(keys) == 0 {
+      return nil, errors.New("no domain keys found")
+   }
+   return keys, nil
+}
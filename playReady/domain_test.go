@@ -0,0 +1,169 @@
+package playReady
+
+import (
+   "bytes"
+   "encoding/hex"
+   "errors"
+   "testing"
+)
+
+func TestDomain(t *testing.T) {
+   setup := newTestSetup(t, &EcosystemOptions{
+      Model: IssuerOptions{KeyUsages: []KeyUsage{KeyUsageIssuerDevice, KeyUsageIssuerDomain}},
+   })
+   device, server := setup.device, setup.server
+   roots, err := setup.ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   domainCert, err := setup.ecosystem.NewDevice(&LeafOptions{Type: CertTypeDomain})
+   if err != nil {
+      t.Fatal(err)
+   }
+   server.Domain = &Domain{
+      ServiceId: []byte("service---------"),
+      AccountId: []byte("account---------"),
+      Revision:  2,
+      Chain:     domainCert.Chain,
+      Keys:      []DomainKey{{Revision: 2, Key: domainCert.EncryptKey}},
+   }
+   opts := &DomainOptions{
+      ServiceId:    server.Domain.ServiceId,
+      FriendlyName: "test",
+      ServerKey:    &server.Key.PublicKey,
+      Verify:       &VerifyOptions{Roots: roots},
+   }
+   challenge, err := device.Chain.JoinDomainRequestBytes(device.SigningKey, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   response, err := server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = ParseJoinDomainResponse(response, device.EncryptKey, &DomainOptions{
+      ServiceId: []byte("other-----------"), Verify: opts.Verify,
+   })
+   if err == nil {
+      t.Fatal("expected error for service ID")
+   }
+   _, err = ParseJoinDomainResponse(response, device.EncryptKey, &DomainOptions{
+      ServiceId: opts.ServiceId,
+   })
+   if err == nil {
+      t.Fatal("expected error for untrusted domain chain")
+   }
+   domain, err := ParseJoinDomainResponse(response, device.EncryptKey, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if domain.Revision != 2 || string(domain.AccountId) != "account---------" {
+      t.Fatalf("%+v", domain)
+   }
+   if !domain.Keys[0].Key.Equal(domainCert.EncryptKey) {
+      t.Fatal("domain key mismatch")
+   }
+
+   response = setup.response(t, nil)
+   license, err := ParseLicense(response)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !license.ContainerOuter.DomainId.Valid || license.ContainerOuter.DomainId.Revision != 2 {
+      t.Fatalf("%+v", license.ContainerOuter.DomainId)
+   }
+   _, err = license.Decrypt(device.EncryptKey)
+   if err == nil {
+      t.Fatal("expected error for device key")
+   }
+   var store LicenseStore
+   _, err = store.Decrypt(license, device.EncryptKey)
+   if !errors.Is(err, ErrDomainRequired) {
+      t.Fatalf("expected ErrDomainRequired, got %v", err)
+   }
+   store.AddDomain(domain)
+   contentKey, err := store.Decrypt(license, device.EncryptKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(contentKey) != testContentKey {
+      t.Fatalf("content key %q", contentKey)
+   }
+
+   opts.AccountId = domain.AccountId
+   challenge, err = device.Chain.LeaveDomainRequestBytes(device.SigningKey, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   response, err = server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = ParseLeaveDomainResponse(response, domain.AccountId)
+   if err != nil {
+      t.Fatal(err)
+   }
+   opts.AccountId = []byte("other-----------")
+   challenge, err = device.Chain.LeaveDomainRequestBytes(device.SigningKey, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   response, err = server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = ParseLeaveDomainResponse(response, opts.AccountId)
+   if !errors.Is(err, ErrDomainRequired) {
+      t.Fatalf("expected ErrDomainRequired, got %v", err)
+   }
+}
+
+// domain key XMR for the device key of 32 bytes 0x01, holding the domain key
+// 0x0102...20 of revision 2. The header is the constant, version and length
+const domainKeysHex = "444b584d" + "00000001" + "000000d8" +
+   // session key: flags, type, length, key type, encryption type, key length
+   "0001" + "0001" + "00000090" + "0001" + "0001" + "00000080" +
+   "83a781b4687d49703fff9e1d79c5503de1caf642d7f67e0d6687a32030cdca22" +
+   "8a6b11d8a51c8b56f8a2ea45e6fd56767ebede482964663a5d6df1f0b474f49d" +
+   "3722d3b856c991643c7467420c74822e424d0df53b829bcdfdb5a2eb0c4ccea3" +
+   "ea0a1367d36d1f470bf372c3479f6b5cd0ab982aa03eab9a83bba79d61d6e7a1" +
+   // private key container: flags, type, length
+   "0001" + "0002" + "0000003c" +
+   // private key: flags, type, length, revision, key type, encryption type,
+   // key length
+   "0001" + "0003" + "00000034" + "00000002" + "0001" + "0001" + "00000020" +
+   "f190796bc8281139a39bb1a71c2efd1aa9b2eb29ff6d34d7ad4668052ea05155"
+
+func TestDecodeDomainKeys(t *testing.T) {
+   data, err := hex.DecodeString(domainKeysHex)
+   if err != nil {
+      t.Fatal(err)
+   }
+   encryptKey, err := ParseRawPrivateKey(bytes.Repeat([]byte{1}, 32))
+   if err != nil {
+      t.Fatal(err)
+   }
+   keys, err := decodeDomainKeys(data, encryptKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(keys) != 1 || keys[0].Revision != 2 {
+      t.Fatalf("%+v", keys)
+   }
+   private, err := PrivateKeyBytes(keys[0].Key)
+   if err != nil {
+      t.Fatal(err)
+   }
+   want, err := hex.DecodeString("0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(private, want) {
+      t.Fatalf("domain key %x", private)
+   }
+   data[0] ^= 1
+   _, err = decodeDomainKeys(data, encryptKey)
+   if !errors.Is(err, ErrInvalidMagic) {
+      t.Fatalf("expected ErrInvalidMagic, got %v", err)
+   }
+}
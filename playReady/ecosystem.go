@@ -0,0 +1,185 @@
+package playReady
+
+import (
+   "crypto/ecdsa"
+   "crypto/sha256"
+   "time"
+)
+
+// Ecosystem is a private PlayReady trust hierarchy for tests: a root key, a
+// company certificate signed by it, and a model certificate signed by the
+// company, from which device chains are made. Use Roots as
+// VerifyOptions.Roots
+type Ecosystem struct {
+   RootKey    *ecdsa.PrivateKey
+   CompanyKey *ecdsa.PrivateKey
+   ModelKey   *ecdsa.PrivateKey
+   // Model is the model certificate followed by the company certificate
+   Model *Chain
+}
+
+// EcosystemOptions configures NewEcosystem. The zero value is valid
+type EcosystemOptions struct {
+   // Company KeyUsages defaults to KeyUsageIssuerAll
+   Company IssuerOptions
+   // Model KeyUsages defaults to KeyUsageIssuerDevice
+   Model IssuerOptions
+}
+
+// IssuerOptions is the template of an issuer certificate
+type IssuerOptions struct {
+   // SecurityLevel defaults to 2000
+   SecurityLevel uint32
+   // Features is omitted when empty
+   Features  []Feature
+   KeyUsages []KeyUsage
+   // Expiration defaults to never
+   Expiration   time.Time
+   Manufacturer *ManufacturerStrings
+}
+
+// Device is a device chain along with its private keys
+type Device struct {
+   Chain      *Chain
+   SigningKey *ecdsa.PrivateKey
+   EncryptKey *ecdsa.PrivateKey
+}
+
+// NewEcosystem generates every key and issuer certificate. opts can be nil
+func NewEcosystem(opts *EcosystemOptions) (*Ecosystem, error) {
+   if opts == nil {
+      opts = &EcosystemOptions{}
+   }
+   var (
+      e   Ecosystem
+      err error
+   )
+   for _, key := range []**ecdsa.PrivateKey{&e.RootKey, &e.CompanyKey, &e.ModelKey} {
+      *key, err = GenerateKey()
+      if err != nil {
+         return nil, err
+      }
+   }
+   company, err := newIssuer(e.CompanyKey, e.RootKey, &opts.Company, KeyUsageIssuerAll)
+   if err != nil {
+      return nil, err
+   }
+   model, err := newIssuer(e.ModelKey, e.CompanyKey, &opts.Model, KeyUsageIssuerDevice)
+   if err != nil {
+      return nil, err
+   }
+   e.Model = &Chain{
+      Header:       ChainHeader{HeaderTag: ChainHeaderTag, Version: ChainVersion},
+      Certificates: []Certificate{*model, *company},
+   }
+   e.Model.UpdateLengths()
+   return &e, nil
+}
+
+// Roots returns the trusted root key of the ecosystem
+func (e *Ecosystem) Roots() ([][]byte, error) {
+   root, err := publicKeyBytes(e.RootKey)
+   if err != nil {
+      return nil, err
+   }
+   return [][]byte{root}, nil
+}
+
+// NewDevice generates device keys and a device chain, see
+// Chain.GenerateLeaf. opts can be nil, and the chain is checked against the
+// ecosystem root unless opts.Verify is set
+func (e *Ecosystem) NewDevice(opts *LeafOptions) (*Device, error) {
+   var leaf LeafOptions
+   if opts != nil {
+      leaf = *opts
+   }
+   if leaf.Verify == nil {
+      roots, err := e.Roots()
+      if err != nil {
+         return nil, err
+      }
+      leaf.Verify = &VerifyOptions{Roots: roots}
+   }
+   signingKey, err := GenerateKey()
+   if err != nil {
+      return nil, err
+   }
+   // a decoded copy shares nothing with the model
+   chain, err := ParseChain(e.Model.Bytes())
+   if err != nil {
+      return nil, err
+   }
+   encryptKey, err := chain.GenerateLeaf(e.ModelKey, signingKey, nil, &leaf)
+   if err != nil {
+      return nil, err
+   }
+   return &Device{Chain: chain, SigningKey: signingKey, EncryptKey: encryptKey}, nil
+}
+
+// newIssuer returns an issuer certificate for key, signed by issuerKey
+func newIssuer(key, issuerKey *ecdsa.PrivateKey, opts *IssuerOptions, usage KeyUsage) (*Certificate, error) {
+   pub, err := publicKeyBytes(key)
+   if err != nil {
+      return nil, err
+   }
+   issuerPub, err := publicKeyBytes(issuerKey)
+   if err != nil {
+      return nil, err
+   }
+   cert := Certificate{
+      Header: CertHeader{HeaderTag: CertHeaderTag, Version: CertVersion},
+      BasicInfo: &BasicInfo{
+         SecurityLevel:  2000,
+         Type:           uint32(CertTypeIssuer),
+         ExpirationDate: neverExpires,
+      },
+   }
+   if opts.SecurityLevel >= 1 {
+      cert.BasicInfo.SecurityLevel = opts.SecurityLevel
+   }
+   if !opts.Expiration.IsZero() {
+      cert.BasicInfo.ExpirationDate = uint32(opts.Expiration.Unix())
+   }
+   digest := sha256.Sum256(pub)
+   copy(cert.BasicInfo.DigestValue[:], digest[:])
+   cert.RecordOrder = append(cert.RecordOrder, uint16(BcertObjectBasic))
+
+   if len(opts.Features) >= 1 {
+      cert.FeatureInfo = &FeatureInfo{}
+      for _, feature := range opts.Features {
+         cert.FeatureInfo.FeatureSet = append(cert.FeatureInfo.FeatureSet, uint32(feature))
+      }
+      cert.RecordOrder = append(cert.RecordOrder, uint16(BcertObjectFeature))
+   }
+
+   usages := opts.KeyUsages
+   if usages == nil {
+      usages = []KeyUsage{usage}
+   }
+   certKey := CertKey{
+      Type:  1, // ECC 256
+      Value: pub,
+   }
+   for _, usage := range usages {
+      certKey.UsageSet = append(certKey.UsageSet, uint32(usage))
+   }
+   cert.KeyInfo = &KeyInfo{Keys: []CertKey{certKey}}
+   cert.RecordOrder = append(cert.RecordOrder, uint16(BcertObjectKey))
+
+   if opts.Manufacturer != nil {
+      cert.ManufacturerInfo = &ManufacturerInfo{ManufacturerStrings: *opts.Manufacturer}
+      cert.RecordOrder = append(cert.RecordOrder, uint16(BcertObjectManufacturer))
+   }
+
+   cert.SignatureInfo = &SignatureInfo{
+      Header:        ObjectHeader{Flags: 1},
+      SignatureType: uint16(SignatureTypeP256),
+      IssuerKey:     issuerPub,
+   }
+   cert.RecordOrder = append(cert.RecordOrder, uint16(BcertObjectSignature))
+   err = cert.sign(issuerKey)
+   if err != nil {
+      return nil, err
+   }
+   return &cert, nil
+}
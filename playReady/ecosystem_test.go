@@ -0,0 +1,77 @@
+package playReady
+
+import (
+   "bytes"
+   "errors"
+   "testing"
+)
+
+func TestEcosystem(t *testing.T) {
+   ecosystem, err := NewEcosystem(&EcosystemOptions{
+      Model: IssuerOptions{
+         SecurityLevel: 150,
+         Features:      []Feature{FeatureSecureClock, FeatureScalable},
+         KeyUsages:     []KeyUsage{KeyUsageIssuerDevice, KeyUsageIssuerDomain},
+         Manufacturer:  &ManufacturerStrings{ModelName: "model"},
+      },
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   roots, err := ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   device, err := ecosystem.NewDevice(&LeafOptions{Features: []Feature{FeatureSecureClock}})
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(ecosystem.Model.Certificates) != 2 {
+      t.Fatal("model chain was modified")
+   }
+   // the issuer certificates of a device are its own
+   model := ecosystem.Model.Bytes()
+   device.Chain.Certificates[1].BasicInfo.SecurityLevel = 1
+   device.Chain.Certificates[1].KeyInfo.Keys[0].Value[0] ^= 1
+   if !bytes.Equal(ecosystem.Model.Bytes(), model) {
+      t.Fatal("model chain shares the device certificates")
+   }
+   device, err = ecosystem.NewDevice(&LeafOptions{Features: []Feature{FeatureSecureClock}})
+   if err != nil {
+      t.Fatal(err)
+   }
+   chain, err := ParseChain(device.Chain.Bytes())
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = chain.Verify(&VerifyOptions{Roots: roots})
+   if err != nil {
+      t.Fatal(err)
+   }
+   for i := range chain.Certificates {
+      err = chain.Certificates[i].CheckEncoding()
+      if err != nil {
+         t.Fatal(err)
+      }
+   }
+   if chain.Certificates[0].BasicInfo.SecurityLevel != 150 {
+      t.Fatalf("%+v", chain.Certificates[0].BasicInfo)
+   }
+   var verifyErr *VerifyError
+   err = chain.Verify(nil)
+   if !errors.As(err, &verifyErr) || verifyErr.Rule != RuleTrust {
+      t.Fatalf("expected trust error, got %v", err)
+   }
+   _, err = ecosystem.NewDevice(&LeafOptions{Type: CertTypeDomain})
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = ecosystem.NewDevice(&LeafOptions{Type: CertTypeServer})
+   if err == nil {
+      t.Fatal("expected error for server certificate")
+   }
+   _, err = ecosystem.NewDevice(&LeafOptions{Features: []Feature{FeatureTransmitter}})
+   if err == nil {
+      t.Fatal("expected error for feature not permitted by model")
+   }
+}
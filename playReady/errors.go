@@ -0,0 +1,37 @@
+package playReady
+
+import (
+   "errors"
+   "fmt"
+)
+
+var (
+   ErrInvalidLength = errors.New("invalid length")
+   ErrInvalidMagic  = errors.New("invalid magic")
+   ErrTruncated     = errors.New("data truncated")
+)
+
+// DecodeError reports malformed binary input. Offset is relative to the start
+// of the buffer given to the exported parser
+type DecodeError struct {
+   Format string
+   Offset int
+   Err    error
+}
+
+func (d *DecodeError) Error() string {
+   return fmt.Sprintf("%v: offset %v: %v", d.Format, d.Offset, d.Err)
+}
+
+func (d *DecodeError) Unwrap() error {
+   return d.Err
+}
+
+const (
+   formatBcert   = "BCert"
+   formatChain   = "BCert chain"
+   formatCrl     = "CRL"
+   formatPro     = "PRO"
+   formatRevInfo = "RevInfo"
+   formatXmr     = "XMR"
+)
@@ -0,0 +1,136 @@
+package playReady
+
+import (
+   "errors"
+   "fmt"
+   "strconv"
+   "strings"
+
+   "41.neocities.org/diana/playReady/xml"
+)
+
+// StatusCode is a DRM_RESULT (HRESULT) carried in the Exception detail of a
+// SOAP fault
+type StatusCode uint32
+
+const (
+   StatusLicenseNotFound          StatusCode = 0x8004C013 // DRM_E_LICENSE_NOT_FOUND
+   StatusDeviceRevoked            StatusCode = 0x8004C065 // DRM_E_DEVCERT_REVOKED
+   StatusClientTimeInvalid        StatusCode = 0x8004C0C5 // DRM_E_CLIENT_TIME_INVALID
+   StatusServerInternalError      StatusCode = 0x8004C600 // DRM_E_SERVER_INTERNAL_ERROR
+   StatusServerInvalidMessage     StatusCode = 0x8004C601 // DRM_E_SERVER_INVALID_MESSAGE
+   StatusServerDeviceLimit        StatusCode = 0x8004C602 // DRM_E_SERVER_DEVICE_LIMIT_REACHED
+   StatusServerIndivRequired      StatusCode = 0x8004C603 // DRM_E_SERVER_INDIV_REQUIRED
+   StatusServerServiceSpecific    StatusCode = 0x8004C604 // DRM_E_SERVER_SERVICE_SPECIFIC
+   StatusServerDomainRequired     StatusCode = 0x8004C605 // DRM_E_SERVER_DOMAIN_REQUIRED
+   StatusServerRenewDomain        StatusCode = 0x8004C606 // DRM_E_SERVER_RENEW_DOMAIN
+   StatusServerNotAMember         StatusCode = 0x8004C60A // DRM_E_SERVER_NOT_A_MEMBER
+   StatusServerProtocolRedirect   StatusCode = 0x8004C60D // DRM_E_SERVER_PROTOCOL_REDIRECT
+   StatusServerUnknownTransaction StatusCode = 0x8004C610 // DRM_E_SERVER_UNKNOWN_TRANSACTIONID
+)
+
+var (
+   ErrClientTimeInvalid = errors.New("client time invalid")
+   ErrDeviceRevoked     = errors.New("device revoked")
+   ErrDomainRequired    = errors.New("domain required")
+   ErrLicenseNotFound   = errors.New("license not found")
+   ErrProtocolRedirect  = errors.New("protocol redirect")
+)
+
+var statusErrors = map[StatusCode]error{
+   StatusClientTimeInvalid:      ErrClientTimeInvalid,
+   StatusDeviceRevoked:          ErrDeviceRevoked,
+   StatusLicenseNotFound:        ErrLicenseNotFound,
+   StatusServerDomainRequired:   ErrDomainRequired,
+   StatusServerNotAMember:       ErrDomainRequired,
+   StatusServerProtocolRedirect: ErrProtocolRedirect,
+}
+
+func (s StatusCode) String() string {
+   return fmt.Sprintf("0x%08X", uint32(s))
+}
+
+// FaultError is a SOAP fault returned by a PlayReady server, including the
+// DRM specific Exception detail when present
+type FaultError struct {
+   Code        string
+   String      string
+   Actor       string
+   StatusCode  StatusCode
+   CustomData  string
+   RedirectUrl string
+   ServiceId   string
+}
+
+func (f *FaultError) Error() string {
+   var b strings.Builder
+   b.WriteString("playReady fault")
+   if f.StatusCode != 0 {
+      b.WriteString(" ")
+      b.WriteString(f.StatusCode.String())
+   }
+   if f.String != "" {
+      b.WriteString(": ")
+      b.WriteString(f.String)
+   }
+   return b.String()
+}
+
+// Is reports whether the fault status code maps to target, so callers can use
+// errors.Is(err, ErrDeviceRevoked) and friends
+func (f *FaultError) Is(target error) bool {
+   err, ok := statusErrors[f.StatusCode]
+   return ok && err == target
+}
+
+// decodeEnvelope decodes a SOAP 1.1 or SOAP 1.2 response, returning any SOAP
+// fault as *FaultError
+func decodeEnvelope(data []byte) (*xml.EnvelopeResponse, error) {
+   envelope, err := xml.DecodeEnvelope(data)
+   if err != nil {
+      return nil, err
+   }
+   if envelope.Body.Fault != nil {
+      return nil, newFaultError(envelope.Body.Fault)
+   }
+   return envelope, nil
+}
+
+// newFaultError keeps StatusCode zero if the Exception has one that does not
+// parse, so that the rest of the fault still reaches the caller
+func newFaultError(fault *xml.Fault) *FaultError {
+   f := &FaultError{
+      Code:   strings.TrimSpace(fault.Code),
+      String: strings.TrimSpace(fault.String),
+      Actor:  strings.TrimSpace(fault.Actor),
+   }
+   if fault.Detail == nil {
+      return f
+   }
+   exception := &fault.Detail.Exception
+   f.CustomData = exception.CustomData
+   f.RedirectUrl = strings.TrimSpace(exception.RedirectUrl)
+   f.ServiceId = strings.TrimSpace(exception.ServiceId)
+   if status, err := parseStatusCode(exception.StatusCode); err == nil {
+      f.StatusCode = status
+   }
+   return f
+}
+
+// parseStatusCode accepts the hexadecimal form ("0x8004C600") as well as the
+// signed decimal form ("-2147170816") servers sometimes send
+func parseStatusCode(data string) (StatusCode, error) {
+   data = strings.TrimSpace(data)
+   if strings.HasPrefix(data, "-") {
+      value, err := strconv.ParseInt(data, 10, 32)
+      if err != nil {
+         return 0, err
+      }
+      return StatusCode(uint32(value)), nil
+   }
+   value, err := strconv.ParseUint(data, 0, 32)
+   if err != nil {
+      return 0, err
+   }
+   return StatusCode(value), nil
+}
@@ -0,0 +1,144 @@
+package playReady
+
+import (
+   "errors"
+   "strings"
+   "testing"
+)
+
+const faultResponse = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+   <soap:Body>
+      <soap:Fault>
+         <faultcode>soap:Server</faultcode>
+         <faultstring>System.Web.Services.Protocols.SoapException: Device revoked.</faultstring>
+         <faultactor>http://test.playready.microsoft.com/service/rightsmanager.asmx</faultactor>
+         <detail>
+            <Exception xmlns="http://schemas.microsoft.com/DRM/2007/03/protocols/messages">
+               <StatusCode>0x8004C065</StatusCode>
+               <CustomData>hello</CustomData>
+               <RedirectUrl>https://example.com/rightsmanager.asmx</RedirectUrl>
+               <ServiceId>2d6e7a3c-0a5b-4d8a-9e6f-1c2b3a4d5e6f</ServiceId>
+            </Exception>
+         </detail>
+      </soap:Fault>
+   </soap:Body>
+</soap:Envelope>`
+
+func TestFault(t *testing.T) {
+   _, err := ParseLicense([]byte(faultResponse))
+   var fault *FaultError
+   if !errors.As(err, &fault) {
+      t.Fatalf("expected *FaultError, got %v", err)
+   }
+   if fault.StatusCode != StatusDeviceRevoked {
+      t.Errorf("StatusCode %v", fault.StatusCode)
+   }
+   if fault.Code != "soap:Server" {
+      t.Errorf("Code %q", fault.Code)
+   }
+   if fault.CustomData != "hello" {
+      t.Errorf("CustomData %q", fault.CustomData)
+   }
+   if fault.RedirectUrl != "https://example.com/rightsmanager.asmx" {
+      t.Errorf("RedirectUrl %q", fault.RedirectUrl)
+   }
+   if fault.ServiceId == "" {
+      t.Error("ServiceId")
+   }
+   if !errors.Is(err, ErrDeviceRevoked) {
+      t.Error("expected ErrDeviceRevoked")
+   }
+   if errors.Is(err, ErrLicenseNotFound) {
+      t.Error("unexpected ErrLicenseNotFound")
+   }
+}
+
+func TestFaultBadStatusCode(t *testing.T) {
+   response := strings.Replace(faultResponse, "0x8004C065", "bogus", 1)
+   _, err := ParseLicense([]byte(response))
+   var fault *FaultError
+   if !errors.As(err, &fault) {
+      t.Fatalf("expected *FaultError, got %v", err)
+   }
+   if fault.StatusCode != 0 || fault.CustomData != "hello" || fault.Code != "soap:Server" {
+      t.Fatalf("%+v", fault)
+   }
+}
+
+func TestEncodeFault(t *testing.T) {
+   want := &FaultError{
+      Code:       "soap:Server",
+      String:     "revoked",
+      Actor:      "http://example.com/rightsmanager.asmx",
+      StatusCode: StatusDeviceRevoked,
+   }
+   data, err := encodeFault(want)
+   if err != nil {
+      t.Fatal(err)
+   }
+   text := string(data)
+   if !strings.Contains(text, "<soap:Fault>") {
+      t.Fatalf("fault not in envelope namespace %s", data)
+   }
+   code := strings.Index(text, "<faultcode>")
+   faultString := strings.Index(text, "<faultstring>")
+   actor := strings.Index(text, "<faultactor>")
+   detail := strings.Index(text, "<detail>")
+   if code == -1 || code > faultString || faultString > actor || actor > detail {
+      t.Fatalf("element order %s", data)
+   }
+   _, err = ParseLicense(data)
+   var fault *FaultError
+   if !errors.As(err, &fault) {
+      t.Fatalf("expected *FaultError, got %v", err)
+   }
+   if fault.Actor != want.Actor || fault.StatusCode != want.StatusCode {
+      t.Fatalf("%+v", fault)
+   }
+}
+
+func TestParseStatusCode(t *testing.T) {
+   for _, test := range []string{"0x8004C600", "0X8004c600", "-2147170816"} {
+      status, err := parseStatusCode(test)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if status != StatusServerInternalError {
+         t.Errorf("%v %v", test, status)
+      }
+   }
+}
+
+const fault12Response = `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope">
+   <s:Body>
+      <s:Fault>
+         <s:Code>
+            <s:Value>s:Receiver</s:Value>
+         </s:Code>
+         <s:Reason>
+            <s:Text xml:lang="en">License not found.</s:Text>
+         </s:Reason>
+         <s:Detail>
+            <Exception xmlns="http://schemas.microsoft.com/DRM/2007/03/protocols/messages">
+               <StatusCode>0x8004C013</StatusCode>
+            </Exception>
+         </s:Detail>
+      </s:Fault>
+   </s:Body>
+</s:Envelope>`
+
+func TestFault12(t *testing.T) {
+   _, err := ParseLicense([]byte(fault12Response))
+   var fault *FaultError
+   if !errors.As(err, &fault) {
+      t.Fatalf("expected *FaultError, got %v", err)
+   }
+   if fault.Code != "s:Receiver" || fault.String != "License not found." {
+      t.Errorf("%+v", fault)
+   }
+   if !errors.Is(err, ErrLicenseNotFound) {
+      t.Errorf("expected ErrLicenseNotFound, got %v", err)
+   }
+}
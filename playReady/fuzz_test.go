@@ -0,0 +1,64 @@
+package playReady
+
+import (
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/hex"
+   "fmt"
+   "testing"
+)
+
+func FuzzParsePro(f *testing.F) {
+   data, err := hex.DecodeString(hexStr)
+   if err != nil {
+      f.Fatal(err)
+   }
+   f.Add(data)
+   f.Fuzz(func(t *testing.T, data []byte) {
+      ParsePro(data)
+   })
+}
+
+func FuzzParseChain(f *testing.F) {
+   keys := testKeys(f, 2)
+   f.Add(testIssuer(f, keys[0], keys[1], KeyUsageIssuerAll).Bytes())
+   f.Fuzz(func(t *testing.T, data []byte) {
+      ParseChain(data)
+   })
+}
+
+// testXmr returns a license holding an optimized content key
+func testXmr() []byte {
+   key := binary.BigEndian.AppendUint16(nil, uint16(AsymmetricEncryptionTypeECC256))
+   key = binary.BigEndian.AppendUint16(key, 4)
+   key = append(key, 1, 2, 3, 4)
+   keys := encodeFtlv(xmrFlagMustUnderstand, XmrObjectKeyMaterialContainer, encodeFtlv(xmrFlagMustUnderstand, XmrObjectOptimizedContentKeyObject, key))
+   signature := binary.BigEndian.AppendUint16(nil, 1)
+   signature = binary.BigEndian.AppendUint16(signature, 16)
+   signature = append(signature, make([]byte, 16)...)
+   keys = append(keys, encodeFtlv(xmrFlagMustUnderstand, XmrObjectSignatureObject, signature)...)
+   data := binary.BigEndian.AppendUint32(nil, MagicConstant)
+   data = binary.BigEndian.AppendUint16(data, 0)
+   data = binary.BigEndian.AppendUint16(data, 3)
+   data = append(data, make([]byte, 16)...)
+   return append(data, encodeFtlv(xmrFlagMustUnderstand, XmrObjectOuterContainer, keys)...)
+}
+
+func FuzzParseLicense(f *testing.F) {
+   f.Add([]byte(faultResponse))
+   f.Add(fmt.Appendf(nil, licenseResponse, base64.StdEncoding.EncodeToString(testXmr())))
+   f.Fuzz(func(t *testing.T, data []byte) {
+      ParseLicense(data)
+   })
+}
+
+func FuzzDecodeXmr(f *testing.F) {
+   f.Add(testXmr())
+   f.Fuzz(func(t *testing.T, data []byte) {
+      var license License
+      if license.decode(data) == nil {
+         license.IsLeaf()
+         license.verify(make([]byte, 16))
+      }
+   })
+}
@@ -7,35 +7,236 @@ import (
    "encoding/binary"
    "encoding/hex"
    "errors"
-   "log"
+   "fmt"
 
    "41.neocities.org/diana/playReady/xml"
    "github.com/emmansun/gmsm/cbcmac"
 )
 
-// ParseLicense processes XML license data and returns the parsed License object.
+var (
+   // ErrKeyHardware means the content key is bound to hardware (a TEE) and
+   // can not be decrypted in software
+   ErrKeyHardware = errors.New("key encryption requires hardware")
+   // ErrKeyUnsupported means the key encryption type is known but needs a
+   // key this package does not have, such as an RSA device key
+   ErrKeyUnsupported = errors.New("key encryption type not supported")
+   ErrKeyUnknown     = errors.New("unknown key encryption type")
+)
+
+// KeyEncryptionError reports a content key this package can not decrypt
+type KeyEncryptionError struct {
+   Type AsymmetricEncryptionType
+   Err  error
+}
+
+func (k *KeyEncryptionError) Error() string {
+   return "cannot decrypt " + k.Type.String() + " content key: " + k.Err.Error()
+}
+
+func (k *KeyEncryptionError) Unwrap() error {
+   return k.Err
+}
+
+// ErrResponseUnsigned means a license response has no server signature
+var ErrResponseUnsigned = errors.New("license response is not signed")
+
+// ResponseOptions configures ParseLicenseResponse. The zero value is valid
+type ResponseOptions struct {
+   // Verify checks the server chain with Chain.Verify. nil trusts
+   // RootPublicKey only
+   Verify *VerifyOptions
+   // LicenseNonce is the nonce sent with ChallengeOptions. nil means 16 zero
+   // bytes, the challenge default
+   LicenseNonce []byte
+   // TransactionId, when set, must match the acknowledgement transaction ID
+   // of the response
+   TransactionId []byte
+}
+
+// ParseLicenseResponse is ParseLicense after checking the response signature
+// against the server certificate chain it carries, and that the response
+// echoes the challenge. opts can be nil
+func ParseLicenseResponse(data []byte, opts *ResponseOptions) (*License, error) {
+   response, err := decodeLicenseResponse(data)
+   if err != nil {
+      return nil, err
+   }
+   err = response.verify(opts)
+   if err != nil {
+      return nil, err
+   }
+   return response.license()
+}
+
+// ParseLicense processes XML license data and returns the parsed License
+// object. The response signature is not checked, see ParseLicenseResponse.
+// A response with several licenses is an error, see Cdm.Response
 func ParseLicense(data []byte) (*License, error) {
-   l := &License{}
-   var envelope xml.EnvelopeResponse
-   err := xml.Unmarshal(data, &envelope)
+   response, err := decodeLicenseResponse(data)
+   if err != nil {
+      return nil, err
+   }
+   return response.license()
+}
+
+// responseElement is the LicenseResponse element of an AcquireLicense
+// response
+type responseElement struct {
+   xml.LicenseResponse
+   // data is the whole response, which raw and signature are part of
+   data []byte
+   // raw is the element as sent, which the signature covers
+   raw []byte
+   // signature is the Signature sibling as sent, nil if there is none
+   signature []byte
+   // licenses are those of raw
+   licenses [][]byte
+}
+
+// decodeLicenseResponse locates the single
+// Body/AcquireLicenseResponse/AcquireLicenseResult/Response/LicenseResponse
+// element by qualified name, along with its Signature sibling. Licenses are
+// taken from inside the LicenseResponse only, whatever their nesting
+func decodeLicenseResponse(data []byte) (*responseElement, error) {
+   envelope, err := decodeEnvelope(data)
+   if err != nil {
+      return nil, err
+   }
+   if envelope.Body.AcquireLicenseResponse == nil {
+      return nil, &xml.MissingElementError{
+         Parent: "Body", Name: xml.Name{Space: xml.NamespaceProtocols, Local: "AcquireLicenseResponse"},
+      }
+   }
+   path := []xml.Name{
+      {Local: "Body"},
+      {Space: xml.NamespaceProtocols, Local: "AcquireLicenseResponse"},
+      {Space: xml.NamespaceProtocols, Local: "AcquireLicenseResult"},
+      {Space: xml.NamespaceProtocols, Local: "Response"},
+      {Space: xml.NamespaceMessages, Local: "LicenseResponse"},
+   }
+   response := responseElement{data: data}
+   response.raw, err = xml.Path(data, path...)
+   if err != nil {
+      return nil, err
+   }
+   path[len(path)-1] = xml.Name{Local: "Signature"}
+   signatures, err := xml.FindPath(data, path...)
    if err != nil {
       return nil, err
    }
-   if envelope.Body.Fault != nil {
-      return nil, errors.New(envelope.Body.Fault.Fault)
+   switch len(signatures) {
+   case 0:
+   case 1:
+      response.signature = signatures[0]
+   default:
+      return nil, errors.New("Signature repeated in Response")
+   }
+   err = xml.Unmarshal(response.raw, &response.LicenseResponse)
+   if err != nil {
+      return nil, err
+   }
+   found, err := xml.FindAll(response.raw, xml.Name{Local: "License"})
+   if err != nil {
+      return nil, err
+   }
+   if len(found) == 0 {
+      return nil, &xml.MissingElementError{
+         Parent: "LicenseResponse", Name: xml.Name{Space: xml.NamespaceMessages, Local: "License"},
+      }
+   }
+   for _, raw := range found {
+      var license xml.Bytes
+      err = xml.Unmarshal(raw, &license)
+      if err != nil {
+         return nil, err
+      }
+      if len(license) == 0 {
+         return nil, errors.New("License element is empty")
+      }
+      response.licenses = append(response.licenses, license)
+   }
+   return &response, nil
+}
+
+// verify checks the signature against the server certificate chain it
+// carries, and that the response echoes the challenge. opts can be nil
+func (r *responseElement) verify(opts *ResponseOptions) error {
+   if opts == nil {
+      opts = &ResponseOptions{}
+   }
+   if r.signature == nil {
+      return ErrResponseUnsigned
+   }
+   var signature xml.Signature
+   err := xml.Unmarshal(r.signature, &signature)
+   if err != nil {
+      return err
+   }
+   if signature.KeyInfo == nil {
+      return ErrResponseUnsigned
+   }
+   chain, err := ParseChain(signature.KeyInfo.CertificateChain)
+   if err != nil {
+      return err
+   }
+   err = chain.Verify(opts.Verify)
+   if err != nil {
+      return err
+   }
+   leaf := &chain.Certificates[0]
+   if CertType(leaf.BasicInfo.Type) != CertTypeServer {
+      return errors.New("license response is not signed by a server certificate")
+   }
+   signKey, err := leaf.publicKey(KeyUsageSign)
+   if err != nil {
+      return err
+   }
+   err = verifySignature(signKey, r.data, r.raw, r.signature)
+   if err != nil {
+      return err
+   }
+   nonce := opts.LicenseNonce
+   if nonce == nil {
+      nonce = make([]byte, 16)
    }
+   if !bytes.Equal(r.LicenseNonce, nonce) {
+      return errors.New("license nonce mismatch")
+   }
+   if opts.TransactionId != nil {
+      ack := r.Acknowledgement
+      if ack == nil || !bytes.Equal(ack.TransactionId, opts.TransactionId) {
+         return errors.New("license transaction ID mismatch")
+      }
+   }
+   return nil
+}
 
-   rawXmr := envelope.Body.AcquireLicenseResponse.AcquireLicenseResult.Response.LicenseResponse.Licenses.License
-   err = l.decode(rawXmr)
+// license returns the single license of the response
+func (r *responseElement) license() (*License, error) {
+   if len(r.licenses) >= 2 {
+      return nil, fmt.Errorf("response has %v licenses", len(r.licenses))
+   }
+   l := &License{}
+   err := l.decode(r.licenses[0])
    if err != nil {
       return nil, err
    }
+   if r.Acknowledgement != nil {
+      l.TransactionId = r.Acknowledgement.TransactionId
+   }
+   if r.Revocations != nil {
+      for _, revocation := range r.Revocations.Revocation {
+         l.Revocations = append(l.Revocations, RevocationData{
+            ListId: revocation.ListId, Data: revocation.ListData,
+         })
+      }
+   }
    return l, nil
 }
 
 func (l *License) decode(data []byte) error {
    if len(data) < HeaderLength {
-      return errors.New("license data too short")
+      return &DecodeError{formatXmr, 0, ErrTruncated}
    }
 
    // Keep full raw XMR for verifying signature locally without rebuilding
@@ -45,7 +246,7 @@ func (l *License) decode(data []byte) error {
    magic := binary.BigEndian.Uint32(data[0:4])
    if magic != MagicConstant {
       if string(data[:3]) != "XMR" {
-         return errors.New("invalid XMR magic keyword")
+         return &DecodeError{formatXmr, 0, ErrInvalidMagic}
       }
    }
 
@@ -62,10 +263,16 @@ func (l *License) decode(data []byte) error {
    }
 
    for offset < len(data) {
-      f, n := decodeFtlv(data[offset:])
+      f, n, err := decodeFtlv(data[offset:])
+      if err != nil {
+         return &DecodeError{formatXmr, offset, err}
+      }
       if XmrObject(f.Type) == XmrObjectOuterContainer {
          l.ContainerOuter.Valid = true
-         l.parseOuterContainer(f.Value)
+         err = l.parseOuterContainer(f.Value, offset+8)
+         if err != nil {
+            return err
+         }
       }
       offset += n
    }
@@ -73,15 +280,31 @@ func (l *License) decode(data []byte) error {
    return nil
 }
 
-func (l *License) parseOuterContainer(data []byte) {
+// parseOuterContainer decodes the objects of the outer container. base is the
+// offset of data within the license
+func (l *License) parseOuterContainer(data []byte, base int) error {
    offset := 0
    for offset < len(data) {
-      f, n := decodeFtlv(data[offset:])
+      f, n, err := decodeFtlv(data[offset:])
+      if err != nil {
+         return &DecodeError{formatXmr, base + offset, err}
+      }
       switch XmrObject(f.Type) {
+      case XmrObjectGlobalPolicyContainer:
+         err = l.parseGlobalPolicyContainer(f.Value, base+offset+8)
+         if err != nil {
+            return err
+         }
       case XmrObjectKeyMaterialContainer:
          l.ContainerOuter.ContainerKeys.Valid = true
-         l.parseKeyMaterialContainer(f.Value)
+         err = l.parseKeyMaterialContainer(f.Value, base+offset+8)
+         if err != nil {
+            return err
+         }
       case XmrObjectSignatureObject:
+         if len(f.Value) < 4 {
+            return &DecodeError{formatXmr, base + offset + 8, ErrTruncated}
+         }
          l.ContainerOuter.Signature.Valid = true
          l.ContainerOuter.Signature.Type = binary.BigEndian.Uint16(f.Value[0:2])
          l.ContainerOuter.Signature.CBSignature = binary.BigEndian.Uint16(f.Value[2:4])
@@ -89,12 +312,76 @@ func (l *License) parseOuterContainer(data []byte) {
       }
       offset += n
    }
+   return nil
+}
+
+func (l *License) parseGlobalPolicyContainer(data []byte, base int) error {
+   offset := 0
+   for offset < len(data) {
+      f, n, err := decodeFtlv(data[offset:])
+      if err != nil {
+         return &DecodeError{formatXmr, base + offset, err}
+      }
+      switch XmrObject(f.Type) {
+      case XmrObjectDomainIdObject:
+         if len(f.Value) < 20 {
+            return &DecodeError{formatXmr, base + offset + 8, ErrTruncated}
+         }
+         domain := &l.ContainerOuter.DomainId
+         domain.Valid = true
+         domain.AccountId = f.Value[:16]
+         domain.Revision = binary.BigEndian.Uint32(f.Value[16:20])
+      case XmrObjectMeteringObject:
+         if len(f.Value) < 16 {
+            return &DecodeError{formatXmr, base + offset + 8, ErrTruncated}
+         }
+         l.ContainerOuter.MeteringId.Valid = true
+         l.ContainerOuter.MeteringId.Id = f.Value[:16]
+      case XmrObjectExpirationObject:
+         if len(f.Value) < 8 {
+            return &DecodeError{formatXmr, base + offset + 8, ErrTruncated}
+         }
+         expiration := &l.ContainerOuter.Expiration
+         expiration.Valid = true
+         expiration.BeginDate = binary.BigEndian.Uint32(f.Value)
+         expiration.EndDate = binary.BigEndian.Uint32(f.Value[4:])
+      case XmrObjectRevocationInformationVersionObject,
+         XmrObjectRevocationInformationVersion2Object:
+         if len(f.Value) < 4 {
+            return &DecodeError{formatXmr, base + offset + 8, ErrTruncated}
+         }
+         version := &l.ContainerOuter.RevInfoVersion
+         if XmrObject(f.Type) == XmrObjectRevocationInformationVersionObject {
+            version = &l.ContainerOuter.RevInfoVersion1
+         }
+         version.Valid = true
+         version.Version = binary.BigEndian.Uint32(f.Value)
+      }
+      offset += n
+   }
+   return nil
+}
+
+// minKeyObjectLength is the fixed part of each key material object
+var minKeyObjectLength = map[XmrObject]int{
+   XmrObjectContentKeyObject:          22,
+   XmrObjectOptimizedContentKeyObject: 4,
+   XmrObjectEccDeviceKeyObject:        4,
+   XmrObjectUplinkKidObject:           18,
+   XmrObjectUplinkKid2Object:          20,
+   XmrObjectAuxKeyObject:              2,
 }
 
-func (l *License) parseKeyMaterialContainer(data []byte) {
+func (l *License) parseKeyMaterialContainer(data []byte, base int) error {
    offset := 0
    for offset < len(data) {
-      f, n := decodeFtlv(data[offset:])
+      f, n, err := decodeFtlv(data[offset:])
+      if err != nil {
+         return &DecodeError{formatXmr, base + offset, err}
+      }
+      if len(f.Value) < minKeyObjectLength[XmrObject(f.Type)] {
+         return &DecodeError{formatXmr, base + offset + 8, ErrTruncated}
+      }
       switch XmrObject(f.Type) {
       case XmrObjectContentKeyObject:
          ck := &l.ContainerOuter.ContainerKeys.ContentKey
@@ -104,16 +391,46 @@ func (l *License) parseKeyMaterialContainer(data []byte) {
          ck.KeyEncryptionCipherType = binary.BigEndian.Uint16(f.Value[18:20])
          ck.CBEncryptedKey = binary.BigEndian.Uint16(f.Value[20:22])
          ck.EncryptedKeyBuffer = f.Value[22:]
+      case XmrObjectOptimizedContentKeyObject:
+         ok := &l.ContainerOuter.ContainerKeys.OptimizedContentKey
+         ok.Valid = true
+         ok.KeyEncryptionCipherType = binary.BigEndian.Uint16(f.Value[0:2])
+         ok.CBEncryptedKey = binary.BigEndian.Uint16(f.Value[2:4])
+         ok.EncryptedKeyBuffer = f.Value[4:]
       case XmrObjectEccDeviceKeyObject:
          ek := &l.ContainerOuter.ContainerKeys.ECCKey
          ek.Valid = true
          ek.EccCurveType = binary.BigEndian.Uint16(f.Value[0:2])
          ek.CBKeyData = binary.BigEndian.Uint16(f.Value[2:4])
          ek.KeyData = f.Value[4:]
+      case XmrObjectUplinkKidObject:
+         uk := &l.ContainerOuter.ContainerKeys.UplinkKid
+         uk.Valid = true
+         uk.Version = 1
+         uk.GuidUplinkKID = f.Value[0:16]
+         uk.CBChainedCheckSum = binary.BigEndian.Uint16(f.Value[16:18])
+         if len(f.Value[18:]) < int(uk.CBChainedCheckSum) {
+            return &DecodeError{formatXmr, base + offset + 24, ErrTruncated}
+         }
+         uk.ChainedCheckSum = f.Value[18:][:uk.CBChainedCheckSum]
+      case XmrObjectUplinkKid2Object:
+         uk := &l.ContainerOuter.ContainerKeys.UplinkKid
+         uk.Valid = true
+         uk.Version = 2
+         uk.GuidUplinkKID = f.Value[0:16]
+         uk.ChainedCheckSumType = binary.BigEndian.Uint16(f.Value[16:18])
+         uk.CBChainedCheckSum = binary.BigEndian.Uint16(f.Value[18:20])
+         if len(f.Value[20:]) < int(uk.CBChainedCheckSum) {
+            return &DecodeError{formatXmr, base + offset + 26, ErrTruncated}
+         }
+         uk.ChainedCheckSum = f.Value[20:][:uk.CBChainedCheckSum]
       case XmrObjectAuxKeyObject:
          ak := &l.ContainerOuter.ContainerKeys.AuxKey
          ak.Valid = true
          ak.Entries = binary.BigEndian.Uint16(f.Value[0:2])
+         if len(f.Value[2:]) < int(ak.Entries)*20 {
+            return &DecodeError{formatXmr, base + offset + 10, ErrTruncated}
+         }
          if ak.Entries > 0 {
             ak.EntriesList = make([]AuxKeyEntry, ak.Entries)
             vOff := 2
@@ -126,18 +443,48 @@ func (l *License) parseKeyMaterialContainer(data []byte) {
       }
       offset += n
    }
+   return nil
 }
 
 func (c *ContentKey) decrypt(privKey *ecdsa.PrivateKey, aux *AuxKey) ([]byte, error) {
    switch AsymmetricEncryptionType(c.KeyEncryptionCipherType) {
    case AsymmetricEncryptionTypeECC256:
-      log.Print("AsymmetricEncryptionTypeECC256")
       return elGamalDecrypt(c.EncryptedKeyBuffer, privKey)
    case AsymmetricEncryptionTypeECC256ViaSymmetric: // scalable
-      log.Print("AsymmetricEncryptionTypeECC256ViaSymmetric")
       return c.scalable(privKey, aux)
+   case AsymmetricEncryptionTypeChainedLicense:
+      return nil, ErrRootLicenseRequired
+   case AsymmetricEncryptionTypeRSA1024:
+      return nil, &KeyEncryptionError{
+         Type: AsymmetricEncryptionTypeRSA1024, Err: ErrKeyUnsupported,
+      }
+   case AsymmetricEncryptionTypeECC256WithKZ, AsymmetricEncryptionTypeTEETransient:
+      return nil, &KeyEncryptionError{
+         Type: AsymmetricEncryptionType(c.KeyEncryptionCipherType),
+         Err:  ErrKeyHardware,
+      }
+   }
+   return nil, &KeyEncryptionError{
+      Type: AsymmetricEncryptionType(c.KeyEncryptionCipherType),
+      Err:  ErrKeyUnknown,
    }
-   return nil, errors.New("cannot decrypt key")
+}
+
+// contentKey returns the content key object, falling back to the optimized
+// content key object
+func (k *KeyMaterial) contentKey() (*ContentKey, error) {
+   if k.ContentKey.Valid {
+      return &k.ContentKey, nil
+   }
+   if k.OptimizedContentKey.Valid {
+      return &ContentKey{
+         Valid:                   true,
+         KeyEncryptionCipherType: k.OptimizedContentKey.KeyEncryptionCipherType,
+         CBEncryptedKey:          k.OptimizedContentKey.CBEncryptedKey,
+         EncryptedKeyBuffer:      k.OptimizedContentKey.EncryptedKeyBuffer,
+      }, nil
+   }
+   return nil, errors.New("no content key object found")
 }
 
 func (c *ContentKey) scalable(privKey *ecdsa.PrivateKey, aux *AuxKey) ([]byte, error) {
@@ -201,12 +548,11 @@ func (l *License) Decrypt(encryptKey *ecdsa.PrivateKey) ([]byte, error) {
       return nil, errors.New("license response is not for this device")
    }
 
-   ck := &l.ContainerOuter.ContainerKeys.ContentKey
-   aux := &l.ContainerOuter.ContainerKeys.AuxKey
-
-   if !ck.Valid {
-      return nil, errors.New("no content key object found")
+   ck, err := l.ContainerOuter.ContainerKeys.contentKey()
+   if err != nil {
+      return nil, err
    }
+   aux := &l.ContainerOuter.ContainerKeys.AuxKey
 
    decryptedKey, err := ck.decrypt(encryptKey, aux)
    if err != nil {
@@ -0,0 +1,412 @@
+package playReady
+
+import (
+   "bytes"
+   "encoding/base64"
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "strings"
+   "sync"
+   "testing"
+   "time"
+
+   "41.neocities.org/diana/playReady/xml"
+)
+
+const licenseResponse = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+   <soap:Body>
+      <AcquireLicenseResponse xmlns="http://schemas.microsoft.com/DRM/2007/03/protocols">
+         <AcquireLicenseResult>
+            <Response>
+               <LicenseResponse xmlns="http://schemas.microsoft.com/DRM/2007/03/protocols/messages">
+                  <Licenses>
+                     <License>%v</License>
+                  </Licenses>
+               </LicenseResponse>
+            </Response>
+         </AcquireLicenseResult>
+      </AcquireLicenseResponse>
+   </soap:Body>
+</soap:Envelope>`
+
+func TestOptimizedContentKey(t *testing.T) {
+   key := binary.BigEndian.AppendUint16(nil, uint16(AsymmetricEncryptionTypeTEETransient))
+   key = binary.BigEndian.AppendUint16(key, 4)
+   key = append(key, 1, 2, 3, 4)
+   keys := encodeFtlv(xmrFlagMustUnderstand, XmrObjectKeyMaterialContainer, encodeFtlv(xmrFlagMustUnderstand, XmrObjectOptimizedContentKeyObject, key))
+   data := binary.BigEndian.AppendUint32(nil, MagicConstant)
+   data = binary.BigEndian.AppendUint16(data, 0)
+   data = binary.BigEndian.AppendUint16(data, 3)
+   data = append(data, make([]byte, 16)...)
+   data = append(data, encodeFtlv(xmrFlagMustUnderstand, XmrObjectOuterContainer, keys)...)
+   var license License
+   err := license.decode(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   optimized := &license.ContainerOuter.ContainerKeys.OptimizedContentKey
+   if !optimized.Valid || optimized.CBEncryptedKey != 4 {
+      t.Fatalf("%+v", optimized)
+   }
+   ck, err := license.ContainerOuter.ContainerKeys.contentKey()
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = ck.decrypt(nil, nil)
+   var keyErr *KeyEncryptionError
+   if !errors.As(err, &keyErr) || keyErr.Type != AsymmetricEncryptionTypeTEETransient {
+      t.Fatalf("unexpected error %v", err)
+   }
+   if !errors.Is(err, ErrKeyHardware) {
+      t.Fatalf("expected ErrKeyHardware, got %v", err)
+   }
+   // without a KID, no leaf license can name it as its root
+   var store LicenseStore
+   err = store.AddRoot(&license, nil)
+   if err == nil {
+      t.Fatal("expected error for root license without KID")
+   }
+   store.add(&license, []byte("root content key"))
+   if _, ok := store.Root(nil); ok {
+      t.Fatal("root license stored without KID")
+   }
+}
+
+func TestKeyEncryptionError(t *testing.T) {
+   tests := []struct {
+      keyType AsymmetricEncryptionType
+      err     error
+   }{
+      {AsymmetricEncryptionTypeRSA1024, ErrKeyUnsupported},
+      {AsymmetricEncryptionTypeECC256WithKZ, ErrKeyHardware},
+      {AsymmetricEncryptionTypeChainedLicense, ErrRootLicenseRequired},
+      {0x99, ErrKeyUnknown},
+   }
+   for _, test := range tests {
+      ck := ContentKey{KeyEncryptionCipherType: uint16(test.keyType)}
+      _, err := ck.decrypt(nil, nil)
+      if !errors.Is(err, test.err) {
+         t.Errorf("%v: got %v", test.keyType, err)
+      }
+   }
+}
+
+func TestBuildLicense(t *testing.T) {
+   keys := testKeys(t, 1)
+   opts := LicenseOptions{
+      KeyId:         []byte("0123456789abcdef"),
+      ContentKey:    []byte("fedcba9876543210"),
+      EncryptKey:    &keys[0].PublicKey,
+      SecurityLevel: 2000,
+      Expiration:    time.Now().Add(time.Hour),
+      PlayCount:     1,
+   }
+   data, err := BuildLicense(&opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   license, err := ParseLicense(
+      fmt.Appendf(nil, licenseResponse, base64.StdEncoding.EncodeToString(data)),
+   )
+   if err != nil {
+      t.Fatal(err)
+   }
+   contentKey, err := license.Decrypt(keys[0])
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(contentKey, opts.ContentKey) {
+      t.Fatalf("content key %x", contentKey)
+   }
+
+   leaf, err := BuildLicense(&LicenseOptions{
+      KeyId:      []byte("leaf leaf leaf l"),
+      ContentKey: []byte("leaf content key"),
+      Uplink:     &Uplink{KeyId: opts.KeyId, ContentKey: opts.ContentKey},
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   var leafLicense License
+   err = leafLicense.decode(leaf)
+   if err != nil {
+      t.Fatal(err)
+   }
+   var store LicenseStore
+   _, err = store.DecryptLeaf(&leafLicense)
+   if !errors.Is(err, ErrRootLicenseNotFound) {
+      t.Fatalf("expected ErrRootLicenseNotFound, got %v", err)
+   }
+   err = store.AddRoot(license, keys[0])
+   if err != nil {
+      t.Fatal(err)
+   }
+   contentKey, err = store.Decrypt(&leafLicense, nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(contentKey) != "leaf content key" {
+      t.Fatalf("leaf content key %q", contentKey)
+   }
+}
+
+func TestChainedChecksum(t *testing.T) {
+   rootKid, rootKey := []byte("root root root r"), []byte("root content key")
+   var root License
+   root.ContainerOuter.ContainerKeys.ContentKey.Valid = true
+   root.ContainerOuter.ContainerKeys.ContentKey.GuidKeyID = rootKid
+   var store LicenseStore
+   store.add(&root, rootKey)
+   data, err := BuildLicense(&LicenseOptions{
+      KeyId:      []byte("leaf leaf leaf l"),
+      ContentKey: []byte("leaf content key"),
+      Uplink:     &Uplink{KeyId: rootKid, ContentKey: rootKey},
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   tests := []func(*UplinkKid){
+      func(u *UplinkKid) { u.ChainedCheckSum = nil },
+      func(u *UplinkKid) { u.ChainedCheckSum = u.ChainedCheckSum[:7] },
+      func(u *UplinkKid) { u.ChainedCheckSum = bytes.Repeat([]byte{1}, 8) },
+      func(u *UplinkKid) { u.Version, u.ChainedCheckSumType = 2, 1 },
+   }
+   for i, edit := range tests {
+      var leaf License
+      err = leaf.decode(data)
+      if err != nil {
+         t.Fatal(err)
+      }
+      edit(&leaf.ContainerOuter.ContainerKeys.UplinkKid)
+      _, err = store.DecryptLeaf(&leaf)
+      if err == nil {
+         t.Fatalf("test %v: expected checksum error", i)
+      }
+   }
+   var leaf License
+   err = leaf.decode(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   leaf.ContainerOuter.ContainerKeys.UplinkKid.Version = 2
+   contentKey, err := store.DecryptLeaf(&leaf)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(contentKey) != "leaf content key" {
+      t.Fatalf("leaf content key %q", contentKey)
+   }
+}
+
+func TestLicenseResponse(t *testing.T) {
+   setup := newTestSetup(t, &EcosystemOptions{
+      Model: IssuerOptions{KeyUsages: []KeyUsage{KeyUsageIssuerDevice, KeyUsageIssuerServer}},
+   })
+   device, server := setup.device, setup.server
+   roots, err := setup.ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   serverCert, err := setup.ecosystem.NewDevice(&LeafOptions{Type: CertTypeServer})
+   if err != nil {
+      t.Fatal(err)
+   }
+   server.TransactionId = []byte("transaction-----")
+   nonce := []byte("nonce-----------")
+   challenge := setup.challenge(t, &ChallengeOptions{LicenseNonce: nonce})
+   response, err := server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   opts := &ResponseOptions{Verify: &VerifyOptions{Roots: roots}, LicenseNonce: nonce}
+   _, err = ParseLicenseResponse(response, opts)
+   if !errors.Is(err, ErrResponseUnsigned) {
+      t.Fatalf("expected ErrResponseUnsigned, got %v", err)
+   }
+
+   server.SigningKey, server.Chain = serverCert.SigningKey, serverCert.Chain
+   // the chain is encoded once, whatever the number of requests
+   var group sync.WaitGroup
+   for range 4 {
+      group.Go(func() {
+         _, err := server.Response(challenge)
+         if err != nil {
+            t.Error(err)
+         }
+      })
+   }
+   group.Wait()
+   response, err = server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   license, err := ParseLicenseResponse(response, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(license.TransactionId) != "transaction-----" {
+      t.Fatalf("transaction ID %q", license.TransactionId)
+   }
+   opts.TransactionId = license.TransactionId
+   _, err = ParseLicenseResponse(response, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = ParseLicenseResponse(response, &ResponseOptions{
+      Verify: opts.Verify, LicenseNonce: nonce, TransactionId: []byte("other"),
+   })
+   if err == nil {
+      t.Fatal("expected error for transaction ID")
+   }
+   _, err = ParseLicenseResponse(response, &ResponseOptions{Verify: opts.Verify})
+   if err == nil {
+      t.Fatal("expected error for license nonce")
+   }
+   _, err = ParseLicenseResponse(response, nil)
+   if err == nil {
+      t.Fatal("expected error for untrusted root")
+   }
+   tampered := bytes.Replace(
+      response, []byte(base64.StdEncoding.EncodeToString(nonce)),
+      []byte(base64.StdEncoding.EncodeToString([]byte("swapped---------"))), 1,
+   )
+   if bytes.Equal(tampered, response) {
+      t.Fatal("nonce not found in response")
+   }
+   _, err = ParseLicenseResponse(tampered, opts)
+   if err == nil {
+      t.Fatal("expected error for tampered response")
+   }
+
+   // a copy of the signed element next to it, or in its place with the
+   // signed element moved into a wrapper
+   signed, err := xml.Find(
+      response, xml.Name{Space: xml.NamespaceMessages, Local: "LicenseResponse"}, "Response",
+   )
+   if err != nil {
+      t.Fatal(err)
+   }
+   forged := bytes.Replace(signed, []byte(`Id="SignedData"`), []byte(`Id="SignedData" Forged="1"`), 1)
+   for name, data := range map[string][]byte{
+      "duplicated": bytes.Replace(response, signed, append(bytes.Clone(forged), signed...), 1),
+      "appended":   bytes.Replace(response, signed, append(bytes.Clone(signed), forged...), 1),
+      "wrapped": bytes.Replace(
+         response, signed, append(fmt.Appendf(nil, "<Wrapper>%s</Wrapper>", signed), forged...), 1,
+      ),
+   } {
+      _, err = ParseLicenseResponse(data, opts)
+      if err == nil {
+         t.Fatalf("expected error for %v element", name)
+      }
+   }
+
+   server.Chain = device.Chain
+   server.SigningKey = device.SigningKey
+   response, err = server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = ParseLicenseResponse(response, opts)
+   if err == nil {
+      t.Fatal("expected error for device certificate")
+   }
+}
+
+// soap12Response is a SOAP 1.2 license response with other prefixes and an
+// extra wrapper around the licenses
+const soap12Response = `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope" xmlns:m="http://schemas.microsoft.com/DRM/2007/03/protocols/messages">
+   <env:Header/>
+   <env:Body>
+      <p:AcquireLicenseResponse xmlns:p="http://schemas.microsoft.com/DRM/2007/03/protocols">
+         <p:AcquireLicenseResult>
+            <p:Response>
+               <m:LicenseResponse>
+                  <m:Wrapper>
+                     <m:Licenses>
+                        <m:License>%v</m:License>
+                     </m:Licenses>
+                  </m:Wrapper>
+               </m:LicenseResponse>
+            </p:Response>
+         </p:AcquireLicenseResult>
+      </p:AcquireLicenseResponse>
+   </env:Body>
+</env:Envelope>`
+
+func TestLicenseNamespaces(t *testing.T) {
+   keys := testKeys(t, 1)
+   data, err := BuildLicense(&LicenseOptions{
+      KeyId:      []byte("0123456789abcdef"),
+      ContentKey: []byte("fedcba9876543210"),
+      EncryptKey: &keys[0].PublicKey,
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   license, err := ParseLicense(
+      fmt.Appendf(nil, soap12Response, base64.StdEncoding.EncodeToString(data)),
+   )
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(license.XMRLic, data) {
+      t.Fatal("license mismatch")
+   }
+   // licenses outside the LicenseResponse are not its own
+   other, err := BuildLicense(&LicenseOptions{
+      KeyId:      []byte("fedcba9876543210"),
+      ContentKey: []byte("0123456789abcdef"),
+      EncryptKey: &keys[0].PublicKey,
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   injected := fmt.Sprintf(
+      "<env:Header><m:License>%v</m:License></env:Header>", base64.StdEncoding.EncodeToString(other),
+   )
+   response := strings.Replace(soap12Response, "<env:Header/>", injected, 1)
+   license, err = ParseLicense(fmt.Appendf(nil, response, base64.StdEncoding.EncodeToString(data)))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(license.XMRLic, data) {
+      t.Fatal("license outside LicenseResponse")
+   }
+   two := fmt.Sprintf(
+      "%v</m:License><m:License>%v",
+      base64.StdEncoding.EncodeToString(data), base64.StdEncoding.EncodeToString(other),
+   )
+   _, err = ParseLicense(fmt.Appendf(nil, soap12Response, two))
+   if err == nil {
+      t.Fatal("expected error for several licenses")
+   }
+   response = strings.Replace(
+      soap12Response, "<m:LicenseResponse>", "<m:LicenseResponse></m:LicenseResponse><m:LicenseResponse>", 1,
+   )
+   _, err = ParseLicense(fmt.Appendf(nil, response, base64.StdEncoding.EncodeToString(data)))
+   if err == nil {
+      t.Fatal("expected error for repeated LicenseResponse")
+   }
+
+   var missing *xml.MissingElementError
+   response = strings.Replace(soap12Response, "m:License>", "m:Other>", 2)
+   _, err = ParseLicense(fmt.Appendf(nil, response, ""))
+   if !errors.As(err, &missing) || missing.Name.Local != "License" {
+      t.Fatalf("expected missing License, got %v", err)
+   }
+   response = strings.ReplaceAll(soap12Response, "2007/03/protocols/messages", "other")
+   _, err = ParseLicense(fmt.Appendf(nil, response, ""))
+   if !errors.As(err, &missing) || missing.Name.Local != "LicenseResponse" {
+      t.Fatalf("expected missing LicenseResponse, got %v", err)
+   }
+   response = strings.ReplaceAll(soap12Response, "www.w3.org/2003/05/soap-envelope", "example.com")
+   _, err = ParseLicense(fmt.Appendf(nil, response, ""))
+   if !errors.As(err, &missing) || missing.Name.Local != "Envelope" {
+      t.Fatalf("expected missing Envelope, got %v", err)
+   }
+   _, err = ParseLicense(fmt.Appendf(nil, licenseResponse, ""))
+   if err == nil || err.Error() != "License element is empty" {
+      t.Fatalf("expected empty License, got %v", err)
+   }
+}
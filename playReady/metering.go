@@ -0,0 +1,271 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "crypto/rand"
+   "errors"
+   "slices"
+   "time"
+
+   "41.neocities.org/diana/playReady/xml"
+)
+
+// Session tracks the playback of a license, for ProcessMeteringData and
+// ProcessSecureStop reports
+type Session struct {
+   Id    []byte
+   KeyId []byte
+   // MeteringId is nil unless the license is metered
+   MeteringId []byte
+   Start      time.Time
+   Stop       time.Time
+   Plays      uint32
+}
+
+// NewSession starts tracking a license with a random session ID. kid is used
+// when the license has no KID, as with an optimized content key
+func (l *License) NewSession(kid []byte) (*Session, error) {
+   key, err := l.ContainerOuter.ContainerKeys.contentKey()
+   if err != nil {
+      return nil, err
+   }
+   s := &Session{Id: make([]byte, 16), KeyId: key.GuidKeyID}
+   if s.KeyId == nil {
+      s.KeyId = kid
+   }
+   if len(s.KeyId) != 16 {
+      return nil, errors.New("invalid KID length")
+   }
+   rand.Read(s.Id)
+   if l.ContainerOuter.MeteringId.Valid {
+      s.MeteringId = l.ContainerOuter.MeteringId.Id
+   }
+   return s, nil
+}
+
+// Play records the start of a playback
+func (s *Session) Play() {
+   if s.Start.IsZero() {
+      s.Start = time.Now()
+   }
+   s.Stop = time.Time{}
+   s.Plays++
+}
+
+// End records the end of playback
+func (s *Session) End() {
+   s.Stop = time.Now()
+}
+
+// MeteringReport is the play counts of metered sessions by KID
+type MeteringReport struct {
+   MeteringId    []byte
+   TransactionId []byte
+   Counts        map[string]uint32
+}
+
+// NewMeteringReport adds up the plays of the sessions with meteringId
+func NewMeteringReport(meteringId []byte, sessions ...*Session) *MeteringReport {
+   r := &MeteringReport{
+      MeteringId:    meteringId,
+      TransactionId: make([]byte, 16),
+      Counts:        map[string]uint32{},
+   }
+   rand.Read(r.TransactionId)
+   for _, session := range sessions {
+      if bytes.Equal(session.MeteringId, meteringId) {
+         r.Counts[string(session.KeyId)] += session.Plays
+      }
+   }
+   return r
+}
+
+// ReportOptions configures ProcessMeteringData and ProcessSecureStop
+// challenges. The zero value is valid
+type ReportOptions struct {
+   CustomData string
+   // ServerKey is the server public key a ProcessSecureStop challenge is
+   // encrypted to. nil means the WMRM server key
+   ServerKey *ecdsa.PublicKey
+   // Verify checks the metering certificate chain. nil trusts RootPublicKey
+   // only
+   Verify *VerifyOptions
+}
+
+// MeteringInfo returns the Metering object of the leaf, which must be a
+// CertTypeMetering certificate. Metering challenges are sent to its
+// MeteringUrl
+func (c *Chain) MeteringInfo() (*MeteringInfo, error) {
+   if len(c.Certificates) == 0 {
+      return nil, errors.New("certificate chain is empty")
+   }
+   leaf := &c.Certificates[0]
+   if leaf.BasicInfo == nil || CertType(leaf.BasicInfo.Type) != CertTypeMetering {
+      return nil, errors.New("not a metering certificate")
+   }
+   if leaf.MeteringInfo == nil {
+      return nil, errors.New("Metering object not found")
+   }
+   return leaf.MeteringInfo, nil
+}
+
+// MeteringRequestBytes builds a signed ProcessMeteringData SOAP challenge,
+// encrypted to the metering certificate meteringCert of the report metering
+// ID. opts can be nil
+func (c *Chain) MeteringRequestBytes(signingKey *ecdsa.PrivateKey, meteringCert *Chain, report *MeteringReport, opts *ReportOptions) ([]byte, error) {
+   if opts == nil {
+      opts = &ReportOptions{}
+   }
+   if len(report.MeteringId) != 16 {
+      return nil, errors.New("invalid metering ID length")
+   }
+   info, err := meteringCert.MeteringInfo()
+   if err != nil {
+      return nil, err
+   }
+   if !bytes.Equal(info.MeteringId[:], report.MeteringId) {
+      return nil, errors.New("metering ID mismatch")
+   }
+   err = meteringCert.Verify(opts.Verify)
+   if err != nil {
+      return nil, err
+   }
+   meteringKey, err := meteringCert.Certificates[0].publicKey(KeyUsageEncryptKey)
+   if err != nil {
+      return nil, err
+   }
+   encryptedData, err := c.encryptedData(meteringKey)
+   if err != nil {
+      return nil, err
+   }
+   metering := &xml.Metering{
+      CustomData:    opts.CustomData,                                      // microsoft.com
+      EncryptedData: *encryptedData,                                       // microsoft.com
+      Id:            "SignedData",                                         // microsoft.com
+      MeteringId:    report.MeteringId,                                    // microsoft.com
+      TransactionId: report.TransactionId,                                 // microsoft.com
+      Version:       "1",                                                  // microsoft.com
+      XmlNs:         "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+   }
+   kids := make([]string, 0, len(report.Counts))
+   for kid := range report.Counts {
+      kids = append(kids, kid)
+   }
+   slices.Sort(kids)
+   for _, kid := range kids {
+      metering.Records.Record = append(metering.Records.Record, xml.MeteringRecord{
+         Count: report.Counts[kid], // microsoft.com
+         Kid:   []byte(kid),        // microsoft.com
+      })
+   }
+   data, err := xml.Marshal(metering)
+   if err != nil {
+      return nil, err
+   }
+   signature, err := newSignature(signingKey, data)
+   if err != nil {
+      return nil, err
+   }
+   return xml.Marshal(xml.Envelope{
+      Body: xml.Body{ // microsoft.com
+         ProcessMeteringData: &xml.ProcessMeteringData{ // microsoft.com
+            Challenge: xml.OuterChallenge{ // microsoft.com
+               Challenge: xml.InnerChallenge{ // microsoft.com
+                  Metering:  metering,                                                      // microsoft.com
+                  Signature: *signature,                                                    // microsoft.com
+                  XmlNs:     "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+               },
+            },
+            XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+         },
+      },
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   })
+}
+
+// ParseMeteringResponse checks a ProcessMeteringData response, after which the
+// reported plays can be cleared. A SOAP fault is returned as *FaultError
+func ParseMeteringResponse(data []byte, report *MeteringReport) error {
+   envelope, err := decodeEnvelope(data)
+   if err != nil {
+      return err
+   }
+   if envelope.Body.ProcessMeteringDataResponse == nil {
+      return errors.New("ProcessMeteringDataResponse not found")
+   }
+   response := &envelope.Body.ProcessMeteringDataResponse.ProcessMeteringDataResult.Response.MeteringResponse
+   if !bytes.Equal(response.MeteringId, report.MeteringId) {
+      return errors.New("metering ID mismatch")
+   }
+   if !bytes.Equal(response.TransactionId, report.TransactionId) {
+      return errors.New("metering transaction ID mismatch")
+   }
+   return nil
+}
+
+// SecureStopRequestBytes builds a signed ProcessSecureStop SOAP challenge for
+// an ended session. opts can be nil
+func (c *Chain) SecureStopRequestBytes(signingKey *ecdsa.PrivateKey, session *Session, opts *ReportOptions) ([]byte, error) {
+   if opts == nil {
+      opts = &ReportOptions{}
+   }
+   if session.Start.IsZero() || session.Stop.IsZero() {
+      return nil, errors.New("session has not ended")
+   }
+   encryptedData, err := c.encryptedData(opts.ServerKey)
+   if err != nil {
+      return nil, err
+   }
+   stop := &xml.SecureStop{
+      CustomData:    opts.CustomData,                                      // microsoft.com
+      EncryptedData: *encryptedData,                                       // microsoft.com
+      Id:            "SignedData",                                         // microsoft.com
+      Kid:           session.KeyId,                                        // microsoft.com
+      SessionId:     session.Id,                                           // microsoft.com
+      StartTime:     session.Start.Unix(),                                 // microsoft.com
+      StopTime:      session.Stop.Unix(),                                  // microsoft.com
+      Version:       "1",                                                  // microsoft.com
+      XmlNs:         "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+   }
+   data, err := xml.Marshal(stop)
+   if err != nil {
+      return nil, err
+   }
+   signature, err := newSignature(signingKey, data)
+   if err != nil {
+      return nil, err
+   }
+   return xml.Marshal(xml.Envelope{
+      Body: xml.Body{ // microsoft.com
+         ProcessSecureStop: &xml.ProcessSecureStop{ // microsoft.com
+            Challenge: xml.OuterChallenge{ // microsoft.com
+               Challenge: xml.InnerChallenge{ // microsoft.com
+                  SecureStop: stop,                                                          // microsoft.com
+                  Signature:  *signature,                                                    // microsoft.com
+                  XmlNs:      "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+               },
+            },
+            XmlNs: "http://schemas.microsoft.com/DRM/2007/03/protocols", // microsoft.com
+         },
+      },
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   })
+}
+
+// ParseSecureStopResponse checks a ProcessSecureStop response, after which
+// the session can be dropped. A SOAP fault is returned as *FaultError
+func ParseSecureStopResponse(data []byte, session *Session) error {
+   envelope, err := decodeEnvelope(data)
+   if err != nil {
+      return err
+   }
+   if envelope.Body.ProcessSecureStopResponse == nil {
+      return errors.New("ProcessSecureStopResponse not found")
+   }
+   response := &envelope.Body.ProcessSecureStopResponse.ProcessSecureStopResult.Response.SecureStopResponse
+   if !bytes.Equal(response.SessionId, session.Id) {
+      return errors.New("secure stop session ID mismatch")
+   }
+   return nil
+}
@@ -0,0 +1,142 @@
+package playReady
+
+import (
+   "bytes"
+   "testing"
+)
+
+func TestMetering(t *testing.T) {
+   setup := newTestSetup(t, &EcosystemOptions{
+      Model: IssuerOptions{KeyUsages: []KeyUsage{KeyUsageIssuerDevice, KeyUsageIssuerMetering}},
+   })
+   device, server := setup.device, setup.server
+   roots, err := setup.ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   kid := []byte(testKid)
+   meteringId := []byte("metering--------")
+   info := &MeteringInfo{MeteringUrl: "https://metering.example"}
+   copy(info.MeteringId[:], meteringId)
+   meteringCert, err := setup.ecosystem.NewDevice(&LeafOptions{
+      Type: CertTypeMetering, Metering: info,
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   server.MeteringKey = meteringCert.EncryptKey
+   server.License.MeteringId = meteringId
+   response := setup.response(t, nil)
+   license, err := ParseLicense(response)
+   if err != nil {
+      t.Fatal(err)
+   }
+   session, err := license.NewSession(nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(session.MeteringId, meteringId) || !bytes.Equal(session.KeyId, kid) {
+      t.Fatalf("%+v", session)
+   }
+   opts := &ReportOptions{
+      ServerKey: &server.Key.PublicKey, Verify: &VerifyOptions{Roots: roots},
+   }
+   _, err = device.Chain.SecureStopRequestBytes(device.SigningKey, session, opts)
+   if err == nil {
+      t.Fatal("expected error for session not ended")
+   }
+   session.Play()
+   session.Play()
+   session.End()
+
+   report := NewMeteringReport(meteringId, session, &Session{KeyId: kid, Plays: 5})
+   if report.Counts[string(kid)] != 2 {
+      t.Fatalf("%+v", report)
+   }
+   decoded, err := meteringCert.Chain.MeteringInfo()
+   if err != nil {
+      t.Fatal(err)
+   }
+   if decoded.MeteringUrl != "https://metering.example" {
+      t.Fatal(decoded.MeteringUrl)
+   }
+   _, err = device.Chain.MeteringRequestBytes(device.SigningKey, device.Chain, report, opts)
+   if err == nil {
+      t.Fatal("expected error for device certificate")
+   }
+   other := NewMeteringReport([]byte("other-----------"), session)
+   _, err = device.Chain.MeteringRequestBytes(device.SigningKey, meteringCert.Chain, other, opts)
+   if err == nil {
+      t.Fatal("expected metering ID mismatch")
+   }
+   challenge, err := device.Chain.MeteringRequestBytes(device.SigningKey, meteringCert.Chain, report, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   response, err = server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = ParseMeteringResponse(response, report)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if server.Plays[string(kid)] != 2 {
+      t.Fatalf("%v", server.Plays)
+   }
+   err = ParseMeteringResponse(response, NewMeteringReport(meteringId))
+   if err == nil {
+      t.Fatal("expected transaction ID mismatch")
+   }
+
+   challenge, err = device.Chain.SecureStopRequestBytes(device.SigningKey, session, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   response, err = server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = ParseSecureStopResponse(response, session)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(server.SecureStops) != 1 || !bytes.Equal(server.SecureStops[0], session.Id) {
+      t.Fatalf("%x", server.SecureStops)
+   }
+   // signed by another key
+   challenge, err = device.Chain.SecureStopRequestBytes(device.EncryptKey, session, opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   response, err = server.Response(challenge)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = ParseSecureStopResponse(response, session)
+   if err == nil {
+      t.Fatal("expected fault for bad signature")
+   }
+}
+
+func TestOptimizedSession(t *testing.T) {
+   var license License
+   keys := &license.ContainerOuter.ContainerKeys
+   _, err := license.NewSession(nil)
+   if err == nil {
+      t.Fatal("expected error for license without content key")
+   }
+   keys.OptimizedContentKey.Valid = true
+   _, err = license.NewSession(nil)
+   if err == nil {
+      t.Fatal("expected error for missing KID")
+   }
+   kid := []byte(testKid)
+   session, err := license.NewSession(kid)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(session.KeyId, kid) {
+      t.Fatalf("%+v", session)
+   }
+}
@@ -0,0 +1,197 @@
+package playReady
+
+import (
+   "bytes"
+   "fmt"
+   "reflect"
+   "strconv"
+)
+
+var bcertObjectNames = map[BcertObject]string{
+   BcertObjectBasic:            "Basic",
+   BcertObjectDomain:           "Domain",
+   BcertObjectPc:               "Pc",
+   BcertObjectDevice:           "Device",
+   BcertObjectFeature:          "Feature",
+   BcertObjectKey:              "Key",
+   BcertObjectManufacturer:     "Manufacturer",
+   BcertObjectSignature:        "Signature",
+   BcertObjectSilverlight:      "Silverlight",
+   BcertObjectMetering:         "Metering",
+   BcertObjectExtDataSignKey:   "ExtDataSignKey",
+   BcertObjectExtDataContainer: "ExtDataContainer",
+   BcertObjectExtDataSignature: "ExtDataSignature",
+   BcertObjectExtDataHwid:      "ExtDataHwid",
+   BcertObjectServer:           "Server",
+   BcertObjectSecurityVersion:  "SecurityVersion",
+   BcertObjectSecurityVersion2: "SecurityVersion2",
+}
+
+func (b BcertObject) String() string {
+   if name, ok := bcertObjectNames[b]; ok {
+      return name
+   }
+   return fmt.Sprintf("BcertObject(0x%04x)", uint16(b))
+}
+
+var certTypeNames = map[CertType]string{
+   CertTypeUnknown:          "UNKNOWN",
+   CertTypePc:               "PC",
+   CertTypeDevice:           "DEVICE",
+   CertTypeDomain:           "DOMAIN",
+   CertTypeIssuer:           "ISSUER",
+   CertTypeCrlSigner:        "CRL_SIGNER",
+   CertTypeService:          "SERVICE",
+   CertTypeSilverlight:      "SILVERLIGHT",
+   CertTypeApplication:      "APPLICATION",
+   CertTypeMetering:         "METERING",
+   CertTypeKeyFileSigner:    "KEYFILESIGNER",
+   CertTypeServer:           "SERVER",
+   CertTypeLicenseSigner:    "LICENSESIGNER",
+   CertTypeSecureTimeServer: "SECURETIMESERVER",
+   CertTypeRprovModelAuth:   "RPROVMODELAUTH",
+}
+
+func (c CertType) String() string {
+   if name, ok := certTypeNames[c]; ok {
+      return name
+   }
+   return fmt.Sprintf("CertType(0x%08x)", uint32(c))
+}
+
+var keyUsageNames = map[KeyUsage]string{
+   KeyUsageUnknown:                             "UNKNOWN",
+   KeyUsageSign:                                "SIGN",
+   KeyUsageEncryptKey:                          "ENCRYPT_KEY",
+   KeyUsageSignCrl:                             "SIGN_CRL",
+   KeyUsageIssuerAll:                           "ISSUER_ALL",
+   KeyUsageIssuerIndiv:                         "ISSUER_INDIV",
+   KeyUsageIssuerDevice:                        "ISSUER_DEVICE",
+   KeyUsageIssuerLink:                          "ISSUER_LINK",
+   KeyUsageIssuerDomain:                        "ISSUER_DOMAIN",
+   KeyUsageIssuerSilverlight:                   "ISSUER_SILVERLIGHT",
+   KeyUsageIssuerApplication:                   "ISSUER_APPLICATION",
+   KeyUsageIssuerCrl:                           "ISSUER_CRL",
+   KeyUsageIssuerMetering:                      "ISSUER_METERING",
+   KeyUsageIssuerSignKeyFile:                   "ISSUER_SIGN_KEYFILE",
+   KeyUsageSignKeyFile:                         "SIGN_KEYFILE",
+   KeyUsageIssuerServer:                        "ISSUER_SERVER",
+   KeyUsageEncryptKeySampleProtectionRc4:       "ENCRYPTKEY_SAMPLE_PROTECTION_RC4",
+   KeyUsageReserved2:                           "RESERVED2",
+   KeyUsageIssuerSignLicense:                   "ISSUER_SIGN_LICENSE",
+   KeyUsageSignLicense:                         "SIGN_LICENSE",
+   KeyUsageSignResponse:                        "SIGN_RESPONSE",
+   KeyUsagePrndEncryptKeyDeprecated:            "PRND_ENCRYPT_KEY_DEPRECATED",
+   KeyUsageEncryptKeySampleProtectionAes128Ctr: "ENCRYPTKEY_SAMPLE_PROTECTION_AES128CTR",
+   KeyUsageIssuerSecurityVersion:               "ISSUER_SECURITY_VERSION",
+   KeyUsageSignSecurityVersion:                 "SIGN_SECURITY_VERSION",
+}
+
+func (k KeyUsage) String() string {
+   if name, ok := keyUsageNames[k]; ok {
+      return name
+   }
+   return fmt.Sprintf("KeyUsage(0x%08x)", uint32(k))
+}
+
+var featureNames = map[Feature]string{
+   FeatureTransmitter:         "TRANSMITTER",
+   FeatureReceiver:            "RECEIVER",
+   FeatureSharedCertificate:   "SHARED_CERTIFICATE",
+   FeatureSecureClock:         "SECURE_CLOCK",
+   FeatureAntiRollbackClock:   "ANTI_ROLLBACK_CLOCK",
+   FeatureReservedMetering:    "RESERVED_METERING",
+   FeatureReservedLicSync:     "RESERVED_LICSYNC",
+   FeatureReservedSymOpt:      "RESERVED_SYMOPT",
+   FeatureSupportsCrls:        "SUPPORTS_CRLS",
+   FeatureServerBuildDevice:   "SERVER_BUILD_DEVICE",
+   FeatureServerBuildService:  "SERVER_BUILD_SERVICE",
+   FeatureSupportsPr3Features: "SUPPORTS_PR3_FEATURES",
+   FeatureScalable:            "SCALABLE",
+}
+
+func (f Feature) String() string {
+   if name, ok := featureNames[f]; ok {
+      return name
+   }
+   return fmt.Sprintf("Feature(0x%08x)", uint32(f))
+}
+
+var signatureTypeNames = map[SignatureType]string{
+   SignatureTypeP256: "P256",
+}
+
+func (s SignatureType) String() string {
+   if name, ok := signatureTypeNames[s]; ok {
+      return name
+   }
+   return fmt.Sprintf("SignatureType(0x%04x)", uint16(s))
+}
+
+// parseName reverses the String methods above
+func parseName[T ~uint16 | ~uint32](names map[T]string, text []byte) (T, error) {
+   for value, name := range names {
+      if name == string(text) {
+         return value, nil
+      }
+   }
+   // for example Feature(0x0000000e), with the type name String uses
+   prefix := reflect.TypeFor[T]().Name() + "("
+   if bytes.HasPrefix(text, []byte(prefix)) && bytes.HasSuffix(text, []byte(")")) {
+      value, err := strconv.ParseUint(string(text[len(prefix):len(text)-1]), 0, 32)
+      if err == nil && uint64(T(value)) == value {
+         return T(value), nil
+      }
+   }
+   return 0, fmt.Errorf("unknown name %q", text)
+}
+
+func (b BcertObject) MarshalText() ([]byte, error) {
+   return []byte(b.String()), nil
+}
+
+func (b *BcertObject) UnmarshalText(text []byte) error {
+   var err error
+   *b, err = parseName(bcertObjectNames, text)
+   return err
+}
+
+func (c CertType) MarshalText() ([]byte, error) {
+   return []byte(c.String()), nil
+}
+
+func (c *CertType) UnmarshalText(text []byte) error {
+   var err error
+   *c, err = parseName(certTypeNames, text)
+   return err
+}
+
+func (f Feature) MarshalText() ([]byte, error) {
+   return []byte(f.String()), nil
+}
+
+func (f *Feature) UnmarshalText(text []byte) error {
+   var err error
+   *f, err = parseName(featureNames, text)
+   return err
+}
+
+func (k KeyUsage) MarshalText() ([]byte, error) {
+   return []byte(k.String()), nil
+}
+
+func (k *KeyUsage) UnmarshalText(text []byte) error {
+   var err error
+   *k, err = parseName(keyUsageNames, text)
+   return err
+}
+
+func (s SignatureType) MarshalText() ([]byte, error) {
+   return []byte(s.String()), nil
+}
+
+func (s *SignatureType) UnmarshalText(text []byte) error {
+   var err error
+   *s, err = parseName(signatureTypeNames, text)
+   return err
+}
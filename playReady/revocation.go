@@ -0,0 +1,481 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "crypto/sha256"
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "maps"
+   "math"
+   "math/big"
+   "slices"
+   "time"
+)
+
+// Revocation list IDs, in GUID byte order as sent in challenges and
+// responses
+var (
+   // RevocationListRevInfo2 is CCDE5A55-A688-4405-A88B-D13F90D5BA3E
+   RevocationListRevInfo2 = []byte{
+      0x55, 0x5a, 0xde, 0xcc, 0x88, 0xa6, 0x05, 0x44,
+      0xa8, 0x8b, 0xd1, 0x3f, 0x90, 0xd5, 0xba, 0x3e,
+   }
+   // RevocationListRuntime is 4E9D8C8A-B652-45A7-9791-6925A6B4791F
+   RevocationListRuntime = []byte{
+      0x8a, 0x8c, 0x9d, 0x4e, 0x52, 0xb6, 0xa7, 0x45,
+      0x97, 0x91, 0x69, 0x25, 0xa6, 0xb4, 0x79, 0x1f,
+   }
+   // RevocationListApplication is 90A37313-0ECF-4CAA-A906-B188F6129300
+   RevocationListApplication = []byte{
+      0x13, 0x73, 0xa3, 0x90, 0xcf, 0x0e, 0xaa, 0x4c,
+      0xa9, 0x06, 0xb1, 0x88, 0xf6, 0x12, 0x93, 0x00,
+   }
+)
+
+var (
+   ErrRevoked          = errors.New("certificate revoked")
+   ErrRevInfoOutdated  = errors.New("newer revocation info required")
+   errUnknownListId    = errors.New("unknown revocation list ID")
+   errRevocationSigner = errors.New("revocation signer has no SIGN_CRL key")
+   errRevInfoVersion1  = errors.New("license requires revocation info version 1")
+)
+
+// RevInfo version 2 is the RLV2 magic, the length of the signed bytes, the
+// format version and three reserved bytes, the sequence number, the issued
+// time as a FILETIME, the record count, and for each record the list ID and
+// 64 bit version. A CRL is the list ID, CRL version, entry count and the 32
+// byte entries. Every integer is big endian. Both are followed by the
+// signature type, signature length, signature, signer chain length and
+// signer chain, the signature covering everything before it
+const (
+   revInfoMagic         = 0x524c5632 // "RLV2"
+   revInfoVersion       = 2
+   revInfoSignatureType = 2 // ECC-256 with SHA-256
+   crlSignatureType     = 1 // ECC-256 with SHA-256
+)
+
+// RevocationData is a revocation list as sent in license responses
+type RevocationData struct {
+   ListId []byte
+   Data   []byte
+}
+
+// RevInfo is revocation info version 2: the current version of every
+// revocation list
+type RevInfo struct {
+   SequenceNumber uint32
+   IssuedTime     time.Time
+   Lists          []RevocationListVersion
+   // Signer is the chain of the signing certificate, whose leaf has a
+   // KeyUsageSignCrl key
+   Signer    *Chain
+   Signature []byte
+   // Raw is the encoded RevInfo, set by ParseRevInfo and Sign
+   Raw    []byte
+   signed []byte
+}
+
+// Crl is a certificate revocation list. Entries are the DigestValue of the
+// revoked certificates
+type Crl struct {
+   // ListId is RevocationListRuntime or RevocationListApplication
+   ListId    []byte
+   Version   uint32
+   Entries   [][32]byte
+   Signer    *Chain
+   Signature []byte
+   // Raw is the encoded CRL, set by ParseCrl and Sign
+   Raw    []byte
+   signed []byte
+}
+
+func ParseRevInfo(data []byte) (*RevInfo, error) {
+   if len(data) < 32 {
+      return nil, &DecodeError{formatRevInfo, 0, ErrTruncated}
+   }
+   if binary.BigEndian.Uint32(data) != revInfoMagic {
+      return nil, &DecodeError{formatRevInfo, 0, ErrInvalidMagic}
+   }
+   if data[8] != revInfoVersion {
+      return nil, &DecodeError{formatRevInfo, 8, errors.New("unsupported version")}
+   }
+   r := &RevInfo{
+      SequenceNumber: binary.BigEndian.Uint32(data[12:]),
+      IssuedTime:     fromFiletime(binary.BigEndian.Uint64(data[16:])),
+      Raw:            data,
+   }
+   count := binary.BigEndian.Uint32(data[24:])
+   offset := 28
+   if uint64(count)*24 > uint64(len(data)-offset) {
+      return nil, &DecodeError{formatRevInfo, 24, ErrInvalidLength}
+   }
+   for range count {
+      version := binary.BigEndian.Uint64(data[offset+16:])
+      if version > math.MaxUint32 {
+         return nil, &DecodeError{formatRevInfo, offset + 16, errors.New("list version out of range")}
+      }
+      r.Lists = append(r.Lists, RevocationListVersion{
+         ListId:  data[offset : offset+16],
+         Version: uint32(version),
+      })
+      offset += 24
+   }
+   if binary.BigEndian.Uint32(data[4:]) != uint32(offset) {
+      return nil, &DecodeError{formatRevInfo, 4, ErrInvalidLength}
+   }
+   r.signed = data[:offset]
+   var err error
+   r.Signature, r.Signer, err = decodeRevocationSignature(
+      data, offset, formatRevInfo, revInfoSignatureType,
+   )
+   if err != nil {
+      return nil, err
+   }
+   return r, nil
+}
+
+// Sign encodes the RevInfo and signs it with the KeyUsageSignCrl key of the
+// signer leaf certificate
+func (r *RevInfo) Sign(signingKey *ecdsa.PrivateKey, signer *Chain) ([]byte, error) {
+   data := binary.BigEndian.AppendUint32(nil, revInfoMagic)
+   data = binary.BigEndian.AppendUint32(data, uint32(28+24*len(r.Lists)))
+   data = append(data, revInfoVersion, 0, 0, 0)
+   data = binary.BigEndian.AppendUint32(data, r.SequenceNumber)
+   data = binary.BigEndian.AppendUint64(data, toFiletime(r.IssuedTime))
+   data = binary.BigEndian.AppendUint32(data, uint32(len(r.Lists)))
+   for _, list := range r.Lists {
+      if len(list.ListId) != 16 {
+         return nil, errors.New("invalid list ID length")
+      }
+      data = append(data, list.ListId...)
+      data = binary.BigEndian.AppendUint64(data, uint64(list.Version))
+   }
+   data, err := appendRevocationSignature(data, revInfoSignatureType, signingKey, signer)
+   if err != nil {
+      return nil, err
+   }
+   parsed, err := ParseRevInfo(data)
+   if err != nil {
+      return nil, err
+   }
+   *r = *parsed
+   return data, nil
+}
+
+// Verify checks the signature, and the signer chain with Chain.Verify
+func (r *RevInfo) Verify(opts *VerifyOptions) error {
+   return verifyRevocationSignature(r.signed, r.Signature, r.Signer, opts)
+}
+
+// Version returns the version of the list listId
+func (r *RevInfo) Version(listId []byte) (uint32, bool) {
+   for _, list := range r.Lists {
+      if bytes.Equal(list.ListId, listId) {
+         return list.Version, true
+      }
+   }
+   return 0, false
+}
+
+func ParseCrl(data []byte) (*Crl, error) {
+   if len(data) < 24 {
+      return nil, &DecodeError{formatCrl, 0, ErrTruncated}
+   }
+   c := &Crl{
+      ListId:  data[:16],
+      Version: binary.BigEndian.Uint32(data[16:]),
+      Raw:     data,
+   }
+   count := binary.BigEndian.Uint32(data[20:])
+   offset := 24
+   if uint64(count)*32 > uint64(len(data)-offset) {
+      return nil, &DecodeError{formatCrl, 20, ErrInvalidLength}
+   }
+   c.Entries = make([][32]byte, count)
+   for i := range c.Entries {
+      copy(c.Entries[i][:], data[offset:])
+      offset += 32
+   }
+   c.signed = data[:offset]
+   var err error
+   c.Signature, c.Signer, err = decodeRevocationSignature(
+      data, offset, formatCrl, crlSignatureType,
+   )
+   if err != nil {
+      return nil, err
+   }
+   return c, nil
+}
+
+// Sign encodes the CRL and signs it with the KeyUsageSignCrl key of the
+// signer leaf certificate
+func (c *Crl) Sign(signingKey *ecdsa.PrivateKey, signer *Chain) ([]byte, error) {
+   if len(c.ListId) != 16 {
+      return nil, errors.New("invalid list ID length")
+   }
+   data := bytes.Clone(c.ListId)
+   data = binary.BigEndian.AppendUint32(data, c.Version)
+   data = binary.BigEndian.AppendUint32(data, uint32(len(c.Entries)))
+   for _, entry := range c.Entries {
+      data = append(data, entry[:]...)
+   }
+   data, err := appendRevocationSignature(data, crlSignatureType, signingKey, signer)
+   if err != nil {
+      return nil, err
+   }
+   parsed, err := ParseCrl(data)
+   if err != nil {
+      return nil, err
+   }
+   *c = *parsed
+   return data, nil
+}
+
+// Verify checks the signature, and the signer chain with Chain.Verify
+func (c *Crl) Verify(opts *VerifyOptions) error {
+   return verifyRevocationSignature(c.signed, c.Signature, c.Signer, opts)
+}
+
+// Check returns a *VerifyError with RuleRevoked if a certificate of chain is
+// on the list
+func (c *Crl) Check(chain *Chain) error {
+   for index, cert := range chain.Certificates {
+      if cert.BasicInfo == nil {
+         continue
+      }
+      if slices.Contains(c.Entries, cert.BasicInfo.DigestValue) {
+         return &VerifyError{
+            Index:  index,
+            Rule:   RuleRevoked,
+            Reason: fmt.Sprintf("digest %x is on CRL version %v", cert.BasicInfo.DigestValue, c.Version),
+         }
+      }
+   }
+   return nil
+}
+
+// The signed data is followed by the signature type, signature length,
+// signature, signer chain length and signer chain
+
+func appendRevocationSignature(
+   data []byte, signatureType uint8, signingKey *ecdsa.PrivateKey, signer *Chain,
+) ([]byte, error) {
+   key, err := signer.crlSigningKey()
+   if err != nil {
+      return nil, err
+   }
+   if !key.Equal(&signingKey.PublicKey) {
+      return nil, errors.New("signing key is not the signer SIGN_CRL key")
+   }
+   digest := sha256.Sum256(data)
+   r, s, err := ecdsa.Sign(nil, signingKey, digest[:])
+   if err != nil {
+      return nil, err
+   }
+   var sign [64]byte
+   r.FillBytes(sign[:32])
+   s.FillBytes(sign[32:])
+   chain := signer.Bytes()
+   data = append(data, signatureType)
+   data = binary.BigEndian.AppendUint16(data, uint16(len(sign)))
+   data = append(data, sign[:]...)
+   data = binary.BigEndian.AppendUint32(data, uint32(len(chain)))
+   return append(data, chain...), nil
+}
+
+// decodeRevocationSignature decodes the signature starting at offset
+func decodeRevocationSignature(
+   data []byte, offset int, format string, signatureType uint8,
+) ([]byte, *Chain, error) {
+   if len(data)-offset < 3 {
+      return nil, nil, &DecodeError{format, offset, ErrTruncated}
+   }
+   if data[offset] != signatureType {
+      return nil, nil, &DecodeError{format, offset, errors.New("unsupported signature type")}
+   }
+   length := int(binary.BigEndian.Uint16(data[offset+1:]))
+   offset += 3
+   if length != 64 || len(data)-offset < length+4 {
+      return nil, nil, &DecodeError{format, offset - 2, ErrInvalidLength}
+   }
+   signature := data[offset : offset+length]
+   offset += length
+   chainLength := binary.BigEndian.Uint32(data[offset:])
+   offset += 4
+   if uint64(chainLength) != uint64(len(data)-offset) {
+      return nil, nil, &DecodeError{format, offset - 4, ErrInvalidLength}
+   }
+   signer, err := ParseChain(data[offset:])
+   if err != nil {
+      return nil, nil, &DecodeError{format, offset, err}
+   }
+   return signature, signer, nil
+}
+
+func verifyRevocationSignature(signed, signature []byte, signer *Chain, opts *VerifyOptions) error {
+   err := signer.Verify(opts)
+   if err != nil {
+      return err
+   }
+   pub, err := signer.crlSigningKey()
+   if err != nil {
+      return err
+   }
+   digest := sha256.Sum256(signed)
+   r := new(big.Int).SetBytes(signature[:32])
+   s := new(big.Int).SetBytes(signature[32:])
+   if !ecdsa.Verify(pub, digest[:], r, s) {
+      return errors.New("revocation data signature does not verify")
+   }
+   return nil
+}
+
+// filetimeEpoch is 1601-01-01 in Unix seconds
+const filetimeEpoch = -11644473600
+
+// fromFiletime returns the time of t, 100 nanosecond intervals since 1601
+func fromFiletime(t uint64) time.Time {
+   return time.Unix(filetimeEpoch+int64(t/1e7), int64(t%1e7)*100)
+}
+
+func toFiletime(t time.Time) uint64 {
+   return uint64(t.Unix()-filetimeEpoch)*1e7 + uint64(t.Nanosecond()/100)
+}
+
+// crlSigningKey returns the KeyUsageSignCrl key of the leaf certificate
+func (c *Chain) crlSigningKey() (*ecdsa.PublicKey, error) {
+   if len(c.Certificates) == 0 {
+      return nil, errRevocationSigner
+   }
+   key, err := c.Certificates[0].publicKey(KeyUsageSignCrl)
+   if err != nil {
+      return nil, errRevocationSigner
+   }
+   return key, nil
+}
+
+// RevocationStore keeps the newest RevInfo and CRLs seen. The zero value is
+// ready to use
+type RevocationStore struct {
+   // Verify, when set, checks the signer chain of added data
+   Verify  *VerifyOptions
+   revInfo *RevInfo
+   crls    map[string]*Crl
+}
+
+// Add parses and verifies revocation data, then keeps it unless a newer
+// version is already stored
+func (s *RevocationStore) Add(listId, data []byte) error {
+   switch {
+   case bytes.Equal(listId, RevocationListRevInfo2):
+      revInfo, err := ParseRevInfo(data)
+      if err != nil {
+         return err
+      }
+      err = revInfo.Verify(s.Verify)
+      if err != nil {
+         return err
+      }
+      if s.revInfo == nil || revInfo.SequenceNumber > s.revInfo.SequenceNumber {
+         s.revInfo = revInfo
+      }
+   case bytes.Equal(listId, RevocationListRuntime),
+      bytes.Equal(listId, RevocationListApplication):
+      crl, err := ParseCrl(data)
+      if err != nil {
+         return err
+      }
+      if !bytes.Equal(crl.ListId, listId) {
+         return errors.New("CRL list ID mismatch")
+      }
+      err = crl.Verify(s.Verify)
+      if err != nil {
+         return err
+      }
+      if s.crls == nil {
+         s.crls = map[string]*Crl{}
+      }
+      old, ok := s.crls[string(listId)]
+      if !ok || crl.Version > old.Version {
+         s.crls[string(listId)] = crl
+      }
+   default:
+      return errUnknownListId
+   }
+   return nil
+}
+
+// AddLicense adds the revocation data sent along with a license. Nothing is
+// kept unless all of it is valid
+func (s *RevocationStore) AddLicense(l *License) error {
+   next := RevocationStore{Verify: s.Verify, revInfo: s.revInfo, crls: maps.Clone(s.crls)}
+   for _, revocation := range l.Revocations {
+      err := next.Add(revocation.ListId, revocation.Data)
+      if err != nil {
+         return err
+      }
+   }
+   *s = next
+   return nil
+}
+
+// RevInfo returns the stored RevInfo, or nil
+func (s *RevocationStore) RevInfo() *RevInfo {
+   return s.revInfo
+}
+
+// Crl returns the stored CRL of listId, or nil
+func (s *RevocationStore) Crl(listId []byte) *Crl {
+   return s.crls[string(listId)]
+}
+
+// Versions returns the stored versions, for ChallengeOptions.RevocationLists
+func (s *RevocationStore) Versions() []RevocationListVersion {
+   var versions []RevocationListVersion
+   if s.revInfo != nil {
+      versions = append(versions, RevocationListVersion{
+         ListId: RevocationListRevInfo2, Version: s.revInfo.SequenceNumber,
+      })
+   }
+   for _, listId := range [][]byte{RevocationListRuntime, RevocationListApplication} {
+      if crl, ok := s.crls[string(listId)]; ok {
+         versions = append(versions, RevocationListVersion{
+            ListId: listId, Version: crl.Version,
+         })
+      }
+   }
+   return versions
+}
+
+// Check checks chain against every stored CRL. A revoked chain returns an
+// error wrapping ErrRevoked
+func (s *RevocationStore) Check(chain *Chain) error {
+   for _, listId := range [][]byte{RevocationListRuntime, RevocationListApplication} {
+      if crl, ok := s.crls[string(listId)]; ok {
+         err := crl.Check(chain)
+         if err != nil {
+            return fmt.Errorf("%w: %w", ErrRevoked, err)
+         }
+      }
+   }
+   return nil
+}
+
+// CheckLicense returns ErrRevInfoOutdated if the license needs a newer
+// RevInfo than the stored one. A license that needs only a version 1 RevInfo
+// fails, as those are not stored
+func (s *RevocationStore) CheckLicense(l *License) error {
+   version := &l.ContainerOuter.RevInfoVersion
+   if !version.Valid {
+      if l.ContainerOuter.RevInfoVersion1.Valid {
+         return errRevInfoVersion1
+      }
+      return nil
+   }
+   if s.revInfo == nil || s.revInfo.SequenceNumber < version.Version {
+      return ErrRevInfoOutdated
+   }
+   return nil
+}
@@ -0,0 +1,182 @@
+package playReady
+
+import (
+   "bytes"
+   "encoding/binary"
+   "encoding/hex"
+   "errors"
+   "testing"
+   "time"
+)
+
+func TestRevocation(t *testing.T) {
+   setup := newTestSetup(t, &EcosystemOptions{
+      Model: IssuerOptions{KeyUsages: []KeyUsage{KeyUsageIssuerDevice, KeyUsageIssuerCrl}},
+   })
+   device, server := setup.device, setup.server
+   roots, err := setup.ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   signer, err := setup.ecosystem.NewDevice(&LeafOptions{
+      Type: CertTypeCrlSigner, EncryptKeyUsages: []KeyUsage{KeyUsageSignCrl},
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   revInfo := &RevInfo{
+      SequenceNumber: 7,
+      IssuedTime:     time.Unix(1700000000, 0),
+      Lists:          []RevocationListVersion{{ListId: RevocationListRuntime, Version: 3}},
+   }
+   revInfoData, err := revInfo.Sign(signer.EncryptKey, signer.Chain)
+   if err != nil {
+      t.Fatal(err)
+   }
+   crl := &Crl{ListId: RevocationListRuntime, Version: 3, Entries: [][32]byte{device.Chain.Certificates[0].BasicInfo.DigestValue}}
+   crlData, err := crl.Sign(signer.EncryptKey, signer.Chain)
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = crl.Sign(device.SigningKey, signer.Chain)
+   if err == nil {
+      t.Fatal("expected error for signing key")
+   }
+   // magic, signed length, format version, sequence number, issued time,
+   // record count, record, signature type and length
+   want := "524c5632" + "00000034" + "02000000" + "00000007" + "01da1747c66d0000" +
+      "00000001" + "8a8c9d4e52b6a74597916925a6b4791f" + "0000000000000003" + "02" + "0040"
+   if got := hex.EncodeToString(revInfoData[:len(want)/2]); got != want {
+      t.Fatalf("RevInfo\n%v\n%v", got, want)
+   }
+   // list ID, version, entry count, entry, signature type and length
+   want = "8a8c9d4e52b6a74597916925a6b4791f" + "00000003" + "00000001" +
+      hex.EncodeToString(crl.Entries[0][:]) + "01" + "0040"
+   if got := hex.EncodeToString(crlData[:len(want)/2]); got != want {
+      t.Fatalf("CRL\n%v\n%v", got, want)
+   }
+
+   server.License.RevInfoVersion = 7
+   server.Revocations = []RevocationData{
+      {ListId: RevocationListRevInfo2, Data: revInfoData},
+      {ListId: RevocationListRuntime, Data: crlData},
+   }
+   response := setup.response(t, nil)
+   license, err := ParseLicense(response)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if license.ContainerOuter.RevInfoVersion.Version != 7 {
+      t.Fatalf("%+v", license.ContainerOuter.RevInfoVersion)
+   }
+   store := RevocationStore{Verify: &VerifyOptions{Roots: roots}}
+   if !errors.Is(store.CheckLicense(license), ErrRevInfoOutdated) {
+      t.Fatal("expected ErrRevInfoOutdated")
+   }
+   err = store.AddLicense(license)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = store.CheckLicense(license)
+   if err != nil {
+      t.Fatal(err)
+   }
+   versions := store.Versions()
+   if len(versions) != 2 || versions[0].Version != 7 || versions[1].Version != 3 {
+      t.Fatalf("%+v", versions)
+   }
+   if version, _ := store.RevInfo().Version(RevocationListRuntime); version != 3 {
+      t.Fatalf("runtime version %v", version)
+   }
+
+   err = store.Check(device.Chain)
+   if !errors.Is(err, ErrRevoked) {
+      t.Fatalf("expected ErrRevoked, got %v", err)
+   }
+   var verifyErr *VerifyError
+   if !errors.As(err, &verifyErr) || verifyErr.Rule != RuleRevoked || verifyErr.Index != 0 {
+      t.Fatalf("%v", err)
+   }
+   err = store.Check(signer.Chain)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   older := &Crl{ListId: RevocationListRuntime, Version: 2}
+   olderData, err := older.Sign(signer.EncryptKey, signer.Chain)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = store.Add(RevocationListRuntime, olderData)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if store.Crl(RevocationListRuntime).Version != 3 {
+      t.Fatal("older CRL replaced newer one")
+   }
+   err = store.Add(bytes.Repeat([]byte{1}, 16), crlData)
+   if err == nil {
+      t.Fatal("expected error for unknown list ID")
+   }
+   err = (&RevocationStore{}).Add(RevocationListRuntime, crlData)
+   if err == nil {
+      t.Fatal("expected error for untrusted signer")
+   }
+   tampered := bytes.Clone(crlData)
+   tampered[30] ^= 1
+   err = store.Add(RevocationListRuntime, tampered)
+   if err == nil {
+      t.Fatal("expected error for tampered CRL")
+   }
+
+   err = store.Add(RevocationListApplication, crlData)
+   if err == nil {
+      t.Fatal("expected error for list ID")
+   }
+
+   // nothing is kept from a license with a bad list
+   application := &Crl{ListId: RevocationListApplication, Version: 1}
+   applicationData, err := application.Sign(signer.EncryptKey, signer.Chain)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = store.AddLicense(&License{Revocations: []RevocationData{
+      {ListId: RevocationListApplication, Data: applicationData},
+      {ListId: RevocationListRuntime, Data: tampered},
+   }})
+   if err == nil {
+      t.Fatal("expected error for tampered CRL")
+   }
+   if store.Crl(RevocationListApplication) != nil {
+      t.Fatal("failed AddLicense changed the store")
+   }
+}
+
+func TestRevInfoVersion1(t *testing.T) {
+   version := encodeFtlv(
+      xmrFlagMustUnderstand, XmrObjectRevocationInformationVersionObject,
+      binary.BigEndian.AppendUint32(nil, 9),
+   )
+   policy := encodeFtlv(
+      xmrFlagMustUnderstand|xmrFlagContainer, XmrObjectGlobalPolicyContainer, version,
+   )
+   data := binary.BigEndian.AppendUint32(nil, MagicConstant)
+   data = binary.BigEndian.AppendUint16(data, 0)
+   data = binary.BigEndian.AppendUint16(data, 3)
+   data = append(data, make([]byte, 16)...)
+   data = append(data, encodeFtlv(xmrFlagMustUnderstand|xmrFlagContainer, XmrObjectOuterContainer, policy)...)
+   var license License
+   err := license.decode(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   outer := &license.ContainerOuter
+   if outer.RevInfoVersion.Valid || !outer.RevInfoVersion1.Valid || outer.RevInfoVersion1.Version != 9 {
+      t.Fatalf("%+v %+v", outer.RevInfoVersion, outer.RevInfoVersion1)
+   }
+   var store RevocationStore
+   err = store.CheckLicense(&license)
+   if err == nil || errors.Is(err, ErrRevInfoOutdated) {
+      t.Fatalf("expected version 1 error, got %v", err)
+   }
+}
@@ -0,0 +1,508 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/ecdsa"
+   "crypto/elliptic"
+   "crypto/sha256"
+   "errors"
+   "fmt"
+   "io"
+   "math/big"
+   "net/http"
+   "strings"
+   "sync"
+
+   "41.neocities.org/diana/playReady/xml"
+   "github.com/emmansun/gmsm/padding"
+)
+
+// Server is a stand-in PlayReady license server for tests. It implements
+// http.Handler, so it can run under httptest.NewServer. Clients must encrypt
+// their challenges to Key with ChallengeOptions.ServerKey
+type Server struct {
+   Key *ecdsa.PrivateKey
+   // ContentKeys maps KID to content key
+   ContentKeys map[string][]byte
+   // License is the template of issued licenses. KeyId, ContentKey and
+   // EncryptKey are set from the challenge
+   License LicenseOptions
+   // Verify, when set, checks the client chain with Chain.Verify
+   Verify *VerifyOptions
+   // Fault, when set, is sent instead of a license
+   Fault *FaultError
+   // Domain, when set, is joined by JoinDomain challenges, and licenses are
+   // bound to its current revision
+   Domain *Domain
+   // MeteringKey decrypts ProcessMeteringData challenges. It is the private
+   // key of the metering certificate the client encrypts them to
+   MeteringKey *ecdsa.PrivateKey
+   // Plays adds up the reported metering data by KID
+   Plays map[string]uint32
+   // SecureStops are the session IDs of the reported secure stops
+   SecureStops [][]byte
+   // Revocations are sent along with every license
+   Revocations []RevocationData
+   // TransactionId, when set, is sent in the Acknowledgement element so
+   // clients acknowledge their licenses
+   TransactionId []byte
+   // SigningKey and Chain, when set, sign license responses. The leaf of
+   // Chain is a CertTypeServer certificate holding the SigningKey public key.
+   // Chain and Domain.Chain are encoded once, the first time they are sent
+   SigningKey *ecdsa.PrivateKey
+   Chain      *Chain
+   mu         sync.Mutex
+   chains     map[*Chain][]byte
+}
+
+// ServeHTTP answers faults with status 500, as SOAP 1.1 requires
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+   data, err := io.ReadAll(r.Body)
+   if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+   }
+   data, fault, err := s.respond(data)
+   if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+   }
+   w.Header().Set("content-type", "text/xml; charset=utf-8")
+   if fault {
+      w.WriteHeader(http.StatusInternalServerError)
+   }
+   w.Write(data)
+}
+
+// Response returns the SOAP response to an AcquireLicense, JoinDomain or
+// LeaveDomain challenge. Malformed challenges are answered with a SOAP fault
+func (s *Server) Response(challenge []byte) ([]byte, error) {
+   data, _, err := s.respond(challenge)
+   return data, err
+}
+
+// respond is Response, also reporting whether the response is a fault
+func (s *Server) respond(challenge []byte) ([]byte, bool, error) {
+   if s.Fault != nil {
+      data, err := encodeFault(s.Fault)
+      return data, true, err
+   }
+   body, err := s.response(challenge)
+   if err != nil {
+      var fault *FaultError
+      if !errors.As(err, &fault) {
+         fault = &FaultError{
+            Code:       "soap:Client",
+            String:     err.Error(),
+            StatusCode: StatusServerInvalidMessage,
+         }
+      }
+      data, err := encodeFault(fault)
+      return data, true, err
+   }
+   data, err := xml.Marshal(xml.Envelope{
+      Body: *body,                                       // microsoft.com
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   })
+   return data, false, err
+}
+
+// chainBytes returns the encoded chain, encoding it once
+func (s *Server) chainBytes(chain *Chain) []byte {
+   s.mu.Lock()
+   defer s.mu.Unlock()
+   data, ok := s.chains[chain]
+   if !ok {
+      data = chain.Bytes()
+      if s.chains == nil {
+         s.chains = map[*Chain][]byte{}
+      }
+      s.chains[chain] = data
+   }
+   return data
+}
+
+func (s *Server) response(challenge []byte) (*xml.Body, error) {
+   var envelope xml.EnvelopeResponse
+   err := xml.Unmarshal(challenge, &envelope)
+   if err != nil {
+      return nil, err
+   }
+   switch body := &envelope.Body; {
+   case body.AcquireLicense != nil:
+      license, err := s.license(challenge, &body.AcquireLicense.Challenge.Challenge)
+      if err != nil {
+         return nil, err
+      }
+      var response xml.AcquireLicenseResponse
+      response.XmlNs = "http://schemas.microsoft.com/DRM/2007/03/protocols"
+      licenseResponse := &response.AcquireLicenseResult.Response.LicenseResponse
+      licenseResponse.Licenses.License = license
+      if len(s.Revocations) >= 1 {
+         licenseResponse.Revocations = &xml.Revocations{}
+         for _, revocation := range s.Revocations {
+            licenseResponse.Revocations.Revocation = append(
+               licenseResponse.Revocations.Revocation,
+               xml.Revocation{ListId: revocation.ListId, ListData: revocation.Data},
+            )
+         }
+      }
+      if s.TransactionId != nil {
+         licenseResponse.Acknowledgement = &xml.Acknowledgement{TransactionId: s.TransactionId}
+      }
+      licenseResponse.LicenseNonce = body.AcquireLicense.Challenge.Challenge.La.LicenseNonce
+      licenseResponse.XmlNs = "http://schemas.microsoft.com/DRM/2007/03/protocols/messages"
+      if s.SigningKey != nil && s.Chain != nil {
+         licenseResponse.Id = "SignedData"
+         data, err := xml.Marshal(licenseResponse)
+         if err != nil {
+            return nil, err
+         }
+         signature, err := newSignature(s.SigningKey, data)
+         if err != nil {
+            return nil, err
+         }
+         signature.KeyInfo = &xml.SignatureKeyInfo{CertificateChain: s.chainBytes(s.Chain)}
+         response.AcquireLicenseResult.Response.Signature = signature
+      }
+      return &xml.Body{AcquireLicenseResponse: &response}, nil
+   case body.JoinDomain != nil:
+      domain, err := s.joinDomain(challenge, &body.JoinDomain.Challenge.Challenge)
+      if err != nil {
+         return nil, err
+      }
+      var response xml.JoinDomainResponse
+      response.XmlNs = "http://schemas.microsoft.com/DRM/2007/03/protocols"
+      response.JoinDomainResult.Response.Domain = *domain
+      return &xml.Body{JoinDomainResponse: &response}, nil
+   case body.LeaveDomain != nil:
+      domain, err := s.leaveDomain(challenge, &body.LeaveDomain.Challenge.Challenge)
+      if err != nil {
+         return nil, err
+      }
+      var response xml.LeaveDomainResponse
+      response.XmlNs = "http://schemas.microsoft.com/DRM/2007/03/protocols"
+      response.LeaveDomainResult.Response.Domain = *domain
+      return &xml.Body{LeaveDomainResponse: &response}, nil
+   case body.ProcessMeteringData != nil:
+      metering, err := s.metering(challenge, &body.ProcessMeteringData.Challenge.Challenge)
+      if err != nil {
+         return nil, err
+      }
+      var response xml.ProcessMeteringDataResponse
+      response.XmlNs = "http://schemas.microsoft.com/DRM/2007/03/protocols"
+      response.ProcessMeteringDataResult.Response.MeteringResponse = *metering
+      return &xml.Body{ProcessMeteringDataResponse: &response}, nil
+   case body.ProcessSecureStop != nil:
+      stop, err := s.secureStop(challenge, &body.ProcessSecureStop.Challenge.Challenge)
+      if err != nil {
+         return nil, err
+      }
+      var response xml.ProcessSecureStopResponse
+      response.XmlNs = "http://schemas.microsoft.com/DRM/2007/03/protocols"
+      response.ProcessSecureStopResult.Response.SecureStopResponse = *stop
+      return &xml.Body{ProcessSecureStopResponse: &response}, nil
+   }
+   return nil, errors.New("no challenge found")
+}
+
+// client returns the leaf certificate of the client chain decrypted with key,
+// after checking the chain and the signature of the element name
+func (s *Server) client(key *ecdsa.PrivateKey, challenge []byte, encrypted *xml.EncryptedData, name string) (*Certificate, error) {
+   chain, err := decryptChain(key, encrypted)
+   if err != nil {
+      return nil, err
+   }
+   if len(chain.Certificates) == 0 {
+      return nil, errors.New("certificate chain is empty")
+   }
+   if s.Verify != nil {
+      err = chain.Verify(s.Verify)
+      if err != nil {
+         return nil, &FaultError{
+            Code: "soap:Client", String: err.Error(), StatusCode: StatusDeviceRevoked,
+         }
+      }
+   }
+   leaf := &chain.Certificates[0]
+   signKey, err := leaf.publicKey(KeyUsageSign)
+   if err != nil {
+      return nil, err
+   }
+   signed, signature, err := challengeElement(challenge, name)
+   if err != nil {
+      return nil, err
+   }
+   err = verifySignature(signKey, challenge, signed, signature)
+   if err != nil {
+      return nil, err
+   }
+   return leaf, nil
+}
+
+func (s *Server) license(challenge []byte, inner *xml.InnerChallenge) ([]byte, error) {
+   if inner.La == nil {
+      return nil, errors.New("LA not found")
+   }
+   leaf, err := s.client(s.Key, challenge, &inner.La.EncryptedData, "LA")
+   if err != nil {
+      return nil, err
+   }
+   encryptKey, err := leaf.publicKey(KeyUsageEncryptKey)
+   if err != nil {
+      return nil, err
+   }
+   kid := inner.La.ContentHeader.WrmHeader.Data.Kid
+   contentKey, ok := s.ContentKeys[string(kid)]
+   if !ok {
+      return nil, &FaultError{
+         Code:       "soap:Server",
+         String:     fmt.Sprintf("no content key for KID %x", kid),
+         StatusCode: StatusLicenseNotFound,
+      }
+   }
+   opts := s.License
+   opts.KeyId = kid
+   opts.ContentKey = contentKey
+   opts.EncryptKey = encryptKey
+   if s.Domain != nil {
+      domainKey, err := s.Domain.Key(s.Domain.Revision)
+      if err != nil {
+         return nil, err
+      }
+      opts.EncryptKey = &domainKey.PublicKey
+      opts.Domain = &DomainId{AccountId: s.Domain.AccountId, Revision: s.Domain.Revision}
+   }
+   return BuildLicense(&opts)
+}
+
+func (s *Server) joinDomain(challenge []byte, inner *xml.InnerChallenge) (*xml.DomainResponse, error) {
+   if inner.Domain == nil {
+      return nil, errors.New("Domain not found")
+   }
+   if s.Domain == nil {
+      return nil, &FaultError{
+         Code: "soap:Server", String: "no domain", StatusCode: StatusServerDomainRequired,
+      }
+   }
+   leaf, err := s.client(s.Key, challenge, &inner.Domain.EncryptedData, "Domain")
+   if err != nil {
+      return nil, err
+   }
+   encryptKey, err := leaf.publicKey(KeyUsageEncryptKey)
+   if err != nil {
+      return nil, err
+   }
+   keys, err := encodeDomainKeys(encryptKey, s.Domain.Keys)
+   if err != nil {
+      return nil, err
+   }
+   return &xml.DomainResponse{
+      AccountId:        s.Domain.AccountId,                                            // microsoft.com
+      CertificateChain: s.chainBytes(s.Domain.Chain),                                  // microsoft.com
+      DomainKeys:       keys,                                                          // microsoft.com
+      Revision:         s.Domain.Revision,                                             // microsoft.com
+      ServiceId:        s.Domain.ServiceId,                                            // microsoft.com
+      XmlNs:            "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+   }, nil
+}
+
+func (s *Server) leaveDomain(challenge []byte, inner *xml.InnerChallenge) (*xml.DomainResponse, error) {
+   if inner.Domain == nil {
+      return nil, errors.New("Domain not found")
+   }
+   if s.Domain == nil || !bytes.Equal(inner.Domain.AccountId, s.Domain.AccountId) {
+      return nil, &FaultError{
+         Code: "soap:Server", String: "not a member", StatusCode: StatusServerNotAMember,
+      }
+   }
+   _, err := s.client(s.Key, challenge, &inner.Domain.EncryptedData, "Domain")
+   if err != nil {
+      return nil, err
+   }
+   return &xml.DomainResponse{
+      AccountId: s.Domain.AccountId,                                            // microsoft.com
+      ServiceId: s.Domain.ServiceId,                                            // microsoft.com
+      XmlNs:     "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+   }, nil
+}
+
+func (s *Server) metering(challenge []byte, inner *xml.InnerChallenge) (*xml.MeteringResponse, error) {
+   if inner.Metering == nil {
+      return nil, errors.New("Metering not found")
+   }
+   _, err := s.client(s.MeteringKey, challenge, &inner.Metering.EncryptedData, "Metering")
+   if err != nil {
+      return nil, err
+   }
+   s.mu.Lock()
+   defer s.mu.Unlock()
+   if s.Plays == nil {
+      s.Plays = map[string]uint32{}
+   }
+   for _, record := range inner.Metering.Records.Record {
+      s.Plays[string(record.Kid)] += record.Count
+   }
+   return &xml.MeteringResponse{
+      MeteringId:    inner.Metering.MeteringId,                                     // microsoft.com
+      TransactionId: inner.Metering.TransactionId,                                  // microsoft.com
+      XmlNs:         "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+   }, nil
+}
+
+func (s *Server) secureStop(challenge []byte, inner *xml.InnerChallenge) (*xml.SecureStopResponse, error) {
+   if inner.SecureStop == nil {
+      return nil, errors.New("SecureStop not found")
+   }
+   _, err := s.client(s.Key, challenge, &inner.SecureStop.EncryptedData, "SecureStop")
+   if err != nil {
+      return nil, err
+   }
+   s.mu.Lock()
+   defer s.mu.Unlock()
+   s.SecureStops = append(s.SecureStops, inner.SecureStop.SessionId)
+   return &xml.SecureStopResponse{
+      SessionId: inner.SecureStop.SessionId,                                    // microsoft.com
+      XmlNs:     "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+   }, nil
+}
+
+// decryptChain reverses Chain.cipherData
+func decryptChain(privKey *ecdsa.PrivateKey, encrypted *xml.EncryptedData) (*Chain, error) {
+   if privKey == nil {
+      return nil, errors.New("server has no key")
+   }
+   point, err := elGamalDecrypt(encrypted.KeyInfo.EncryptedKey.CipherData.CipherValue, privKey)
+   if err != nil {
+      return nil, err
+   }
+   var key xmlKey
+   copy(key.X[:], point)
+   data := encrypted.CipherData.CipherValue
+   if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+      return nil, errors.New("invalid cipher data length")
+   }
+   block, err := aes.NewCipher(key.aesKey())
+   if err != nil {
+      return nil, err
+   }
+   plain := make([]byte, len(data)-aes.BlockSize)
+   cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[aes.BlockSize:])
+   plain, err = padding.NewPKCS7Padding(aes.BlockSize).Unpad(plain)
+   if err != nil {
+      return nil, err
+   }
+   var value xml.Data
+   err = xml.Unmarshal(plain, &value)
+   if err != nil {
+      return nil, err
+   }
+   return ParseChain(value.CertificateChains.CertificateChain)
+}
+
+// verifySignature checks signature, a Signature element of data, against
+// signed, the element of data its reference points to. Both are hashed in
+// the canonical form the SignedInfo declares
+func verifySignature(key *ecdsa.PublicKey, data, signed, signature []byte) error {
+   var value xml.Signature
+   err := xml.Unmarshal(signature, &value)
+   if err != nil {
+      return err
+   }
+   id, ok := strings.CutPrefix(value.SignedInfo.Reference.Uri, "#")
+   if !ok || id == "" || xml.Attr(signed, "Id") != id {
+      return fmt.Errorf("signature reference %q is not the signed element", value.SignedInfo.Reference.Uri)
+   }
+   method := value.SignedInfo.CanonicalizationMethod.Algorithm
+   canonical, err := xml.Canonicalize(data, signed, method)
+   if err != nil {
+      return err
+   }
+   digest := sha256.Sum256(canonical)
+   if !bytes.Equal(digest[:], value.SignedInfo.Reference.DigestValue) {
+      return errors.New("signed data digest mismatch")
+   }
+   signedInfo, err := xml.Path(signature, xml.Name{Local: "SignedInfo"})
+   if err != nil {
+      return err
+   }
+   canonical, err = xml.Canonicalize(data, signedInfo, method)
+   if err != nil {
+      return err
+   }
+   if len(value.SignatureValue) != 64 {
+      return errors.New("invalid signature length")
+   }
+   digest = sha256.Sum256(canonical)
+   r := new(big.Int).SetBytes(value.SignatureValue[:32])
+   s := new(big.Int).SetBytes(value.SignatureValue[32:])
+   if !ecdsa.Verify(key, digest[:], r, s) {
+      return errors.New("signature does not verify")
+   }
+   return nil
+}
+
+// challengeElement returns the element name of a challenge along with its
+// Signature sibling, as sent, since the signature covers the exact bytes
+func challengeElement(challenge []byte, name string) ([]byte, []byte, error) {
+   path := []xml.Name{
+      {Local: "Body"},
+      {}, // AcquireLicense, JoinDomain and so on
+      {Local: "challenge"},
+      {Local: "Challenge"},
+      {Local: name},
+   }
+   signed, err := xml.Path(challenge, path...)
+   if err != nil {
+      return nil, nil, err
+   }
+   path[len(path)-1] = xml.Name{Local: "Signature"}
+   signature, err := xml.Path(challenge, path...)
+   if err != nil {
+      return nil, nil, err
+   }
+   return signed, signature, nil
+}
+
+// publicKey returns the first key with usage
+func (c *Certificate) publicKey(usage KeyUsage) (*ecdsa.PublicKey, error) {
+   if c.KeyInfo != nil {
+      for _, key := range c.KeyInfo.Keys {
+         if key.hasUsage(usage) {
+            return ecdsa.ParseUncompressedPublicKey(
+               elliptic.P256(), append([]byte{4}, key.Value...),
+            )
+         }
+      }
+   }
+   return nil, fmt.Errorf("no key with usage %v", usage)
+}
+
+func encodeFault(fault *FaultError) ([]byte, error) {
+   value := &xml.Fault{
+      Code:   fault.Code,
+      String: fault.String,
+      Actor:  fault.Actor,
+   }
+   if fault.StatusCode != 0 || fault.CustomData != "" || fault.RedirectUrl != "" || fault.ServiceId != "" {
+      value.Detail = &xml.Detail{
+         Exception: xml.Exception{ // microsoft.com
+            CustomData:  fault.CustomData,                                              // microsoft.com
+            RedirectUrl: fault.RedirectUrl,                                             // microsoft.com
+            ServiceId:   fault.ServiceId,                                               // microsoft.com
+            XmlNs:       "http://schemas.microsoft.com/DRM/2007/03/protocols/messages", // microsoft.com
+         },
+      }
+      if fault.StatusCode != 0 {
+         value.Detail.Exception.StatusCode = fault.StatusCode.String()
+      }
+   }
+   return xml.Marshal(xml.Envelope{
+      Body: xml.Body{ // microsoft.com
+         Fault: value, // microsoft.com
+      },
+      Soap: "http://schemas.xmlsoap.org/soap/envelope/", // microsoft.com
+   })
+}
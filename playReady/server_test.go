@@ -0,0 +1,218 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/base64"
+   "errors"
+   "fmt"
+   "io"
+   "net/http"
+   "net/http/httptest"
+   "strings"
+   "testing"
+
+   "41.neocities.org/diana/playReady/xml"
+)
+
+func TestServer(t *testing.T) {
+   setup := newTestSetup(t, nil)
+   chain, server := setup.device.Chain, setup.server
+   signingKey, encryptKey := setup.device.SigningKey, setup.device.EncryptKey
+   roots, err := setup.ecosystem.Roots()
+   if err != nil {
+      t.Fatal(err)
+   }
+   kid := []byte(testKid)
+   server.License = LicenseOptions{SecurityLevel: 2000}
+   server.Verify = &VerifyOptions{Roots: roots}
+   ts := httptest.NewServer(server)
+   defer ts.Close()
+
+   var status int
+   post := func(signingKey *ecdsa.PrivateKey, kid []byte) ([]byte, error) {
+      challenge, err := chain.LicenseRequestBytes(
+         signingKey, kid, "", &ChallengeOptions{ServerKey: &server.Key.PublicKey},
+      )
+      if err != nil {
+         return nil, err
+      }
+      resp, err := http.Post(ts.URL, "text/xml", bytes.NewReader(challenge))
+      if err != nil {
+         return nil, err
+      }
+      defer resp.Body.Close()
+      status = resp.StatusCode
+      return io.ReadAll(resp.Body)
+   }
+
+   data, err := post(signingKey, kid)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if status != http.StatusOK {
+      t.Fatalf("license status %v", status)
+   }
+   license, err := ParseLicense(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   contentKey, err := license.Decrypt(encryptKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(contentKey) != testContentKey {
+      t.Fatalf("content key %q", contentKey)
+   }
+
+   var fault *FaultError
+   data, err = post(signingKey, []byte("fedcba9876543210"))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if status != http.StatusInternalServerError {
+      t.Fatalf("fault status %v", status)
+   }
+   _, err = ParseLicense(data)
+   if !errors.Is(err, ErrLicenseNotFound) {
+      t.Fatalf("expected ErrLicenseNotFound, got %v", err)
+   }
+   data, err = post(encryptKey, kid)
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = ParseLicense(data)
+   if !errors.As(err, &fault) || fault.StatusCode != StatusServerInvalidMessage {
+      t.Fatalf("expected signature fault, got %v", err)
+   }
+
+   server.Fault = &FaultError{Code: "soap:Server", StatusCode: StatusDeviceRevoked}
+   data, err = post(signingKey, kid)
+   if err != nil {
+      t.Fatal(err)
+   }
+   _, err = ParseLicense(data)
+   if !errors.Is(err, ErrDeviceRevoked) {
+      t.Fatalf("expected ErrDeviceRevoked, got %v", err)
+   }
+}
+
+func TestVerifySignature(t *testing.T) {
+   key := testKeys(t, 1)[0]
+   // verify places the elements in a response, as siblings
+   verify := func(signed string, signature []byte) error {
+      data := fmt.Appendf(nil, "<Response>%s%s</Response>", signed, signature)
+      start := len("<Response>")
+      end := start + len(signed)
+      return verifySignature(
+         &key.PublicKey, data, data[start:end], data[end:end+len(signature)],
+      )
+   }
+   sign := func(signed string) []byte {
+      signature, err := newSignature(key, []byte(signed))
+      if err != nil {
+         t.Fatal(err)
+      }
+      data, err := xml.Marshal(signature)
+      if err != nil {
+         t.Fatal(err)
+      }
+      return data
+   }
+   signed := `<LA xmlns="http://schemas.microsoft.com/DRM/2007/03/protocols/messages" Id="SignedData"><Version>1</Version></LA>`
+   err := verify(signed, sign(signed))
+   if err != nil {
+      t.Fatal(err)
+   }
+   // a valid signature of an element the reference does not name
+   other := strings.Replace(signed, `Id="SignedData"`, `Id="Other"`, 1)
+   err = verify(other, sign(other))
+   if err == nil {
+      t.Fatal("expected error for reference")
+   }
+}
+
+// a response as a server might send it: the SignedInfo inherits its
+// namespace, the empty elements are self-closing, and the signature is over
+// the canonical forms, inherited namespaces included
+func TestVerifySignatureCanonical(t *testing.T) {
+   const (
+      envelope            = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>%s</soap:Body></soap:Envelope>`
+      response            = `<LicenseResponse xmlns="urn:messages" Id="SignedData"><Version>1</Version><Licenses/></LicenseResponse>`
+      canonicalResponse   = `<LicenseResponse xmlns="urn:messages" xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" Id="SignedData"><Version>1</Version><Licenses></Licenses></LicenseResponse>`
+      signedInfo          = `<SignedInfo><CanonicalizationMethod Algorithm="http://www.w3.org/TR/2001/REC-xml-c14n-20010315" /><SignatureMethod Algorithm="http://schemas.microsoft.com/DRM/2007/03/protocols#ecdsa-sha256" /><Reference URI="#SignedData"><DigestMethod Algorithm="http://schemas.microsoft.com/DRM/2007/03/protocols#sha256" /><DigestValue>%s</DigestValue></Reference></SignedInfo>`
+      canonicalSignedInfo = `<SignedInfo xmlns="http://www.w3.org/2000/09/xmldsig#" xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><CanonicalizationMethod Algorithm="http://www.w3.org/TR/2001/REC-xml-c14n-20010315"></CanonicalizationMethod><SignatureMethod Algorithm="http://schemas.microsoft.com/DRM/2007/03/protocols#ecdsa-sha256"></SignatureMethod><Reference URI="#SignedData"><DigestMethod Algorithm="http://schemas.microsoft.com/DRM/2007/03/protocols#sha256"></DigestMethod><DigestValue>%s</DigestValue></Reference></SignedInfo>`
+   )
+   key := testKeys(t, 1)[0]
+   digest := sha256.Sum256([]byte(canonicalResponse))
+   digestValue := base64.StdEncoding.EncodeToString(digest[:])
+   digest = sha256.Sum256(fmt.Appendf(nil, canonicalSignedInfo, digestValue))
+   r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+   if err != nil {
+      t.Fatal(err)
+   }
+   var signatureValue [64]byte
+   r.FillBytes(signatureValue[:32])
+   s.FillBytes(signatureValue[32:])
+   signature := fmt.Sprintf(
+      `<Signature xmlns="http://www.w3.org/2000/09/xmldsig#">%s<SignatureValue>%s</SignatureValue></Signature>`,
+      fmt.Sprintf(signedInfo, digestValue),
+      base64.StdEncoding.EncodeToString(signatureValue[:]),
+   )
+   data := fmt.Appendf(nil, envelope, response+signature)
+   signedElement, err := xml.Path(data, xml.Name{Local: "Body"}, xml.Name{Local: "LicenseResponse"})
+   if err != nil {
+      t.Fatal(err)
+   }
+   signatureElement, err := xml.Path(data, xml.Name{Local: "Body"}, xml.Name{Local: "Signature"})
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = verifySignature(&key.PublicKey, data, signedElement, signatureElement)
+   if err != nil {
+      t.Fatal(err)
+   }
+   // the signature does not cover the text
+   forged := bytes.Replace(data, []byte("<Version>1"), []byte("<Version>2"), 1)
+   signedElement, err = xml.Path(forged, xml.Name{Local: "Body"}, xml.Name{Local: "LicenseResponse"})
+   if err != nil {
+      t.Fatal(err)
+   }
+   signatureElement, err = xml.Path(forged, xml.Name{Local: "Body"}, xml.Name{Local: "Signature"})
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = verifySignature(&key.PublicKey, forged, signedElement, signatureElement)
+   if err == nil {
+      t.Fatal("expected digest mismatch")
+   }
+}
+
+func TestChallengeWrapping(t *testing.T) {
+   setup := newTestSetup(t, nil)
+   challenge := setup.challenge(t, nil)
+   la, err := xml.Find(challenge, xml.Name{Local: "LA"}, "Challenge")
+   if err != nil {
+      t.Fatal(err)
+   }
+   forged := bytes.Replace(la, []byte("<Version>"), []byte("<Version>forged"), 1)
+   for name, data := range map[string][]byte{
+      "duplicated": bytes.Replace(challenge, la, append(bytes.Clone(forged), la...), 1),
+      "appended":   bytes.Replace(challenge, la, append(bytes.Clone(la), forged...), 1),
+      "wrapped": bytes.Replace(
+         challenge, la, append(fmt.Appendf(nil, "<Wrapper>%s</Wrapper>", la), forged...), 1,
+      ),
+   } {
+      response, err := setup.server.Response(data)
+      if err != nil {
+         t.Fatal(err)
+      }
+      var fault *FaultError
+      _, err = ParseLicense(response)
+      if !errors.As(err, &fault) {
+         t.Fatalf("%v: expected fault, got %v", name, err)
+      }
+   }
+}
@@ -0,0 +1,221 @@
+package playReady
+
+import (
+   "bytes"
+   "encoding/hex"
+   "fmt"
+   "slices"
+   "time"
+)
+
+// RootPublicKey is the Microsoft PlayReady root issuer key (X||Y)
+const RootPublicKey = "864d61cff2256e422c568b3c28001cfb3e1527658584ba0521b79b1828d936de1d826a8fc3e6e7fa7a90d5ca2946f1f64a2efb9f5dcffe7e434eb44293fac5ab"
+
+// neverExpires is the ExpirationDate of a certificate without expiration
+const neverExpires = 0xFFFFFFFF
+
+type VerifyRule string
+
+const (
+   RuleStructure     VerifyRule = "structure"
+   RuleTrust         VerifyRule = "trust"
+   RuleIssuer        VerifyRule = "issuer"
+   RuleSignature     VerifyRule = "signature"
+   RuleKeyUsage      VerifyRule = "key usage"
+   RuleExpiration    VerifyRule = "expiration"
+   RuleChainDepth    VerifyRule = "chain depth"
+   RuleSecurityLevel VerifyRule = "security level"
+   RuleRevoked       VerifyRule = "revoked"
+)
+
+// VerifyError names the certificate (0 is the leaf) and the rule that failed
+type VerifyError struct {
+   Index  int
+   Rule   VerifyRule
+   Reason string
+}
+
+func (v *VerifyError) Error() string {
+   return fmt.Sprintf("certificate %v: %v: %v", v.Index, v.Rule, v.Reason)
+}
+
+type VerifyOptions struct {
+   // Roots are the trusted issuer keys (X||Y) of the last certificate. nil
+   // trusts RootPublicKey only
+   Roots [][]byte
+   // CurrentTime is used for the expiration check. The zero value means
+   // time.Now
+   CurrentTime time.Time
+}
+
+// issuerUsages maps a certificate type to the issuer key usages allowed to
+// sign it, in addition to KeyUsageIssuerAll
+var issuerUsages = map[CertType]KeyUsage{
+   CertTypePc:            KeyUsageIssuerIndiv,
+   CertTypeDevice:        KeyUsageIssuerDevice,
+   CertTypeDomain:        KeyUsageIssuerDomain,
+   CertTypeCrlSigner:     KeyUsageIssuerCrl,
+   CertTypeSilverlight:   KeyUsageIssuerSilverlight,
+   CertTypeApplication:   KeyUsageIssuerApplication,
+   CertTypeMetering:      KeyUsageIssuerMetering,
+   CertTypeKeyFileSigner: KeyUsageIssuerSignKeyFile,
+   CertTypeServer:        KeyUsageIssuerServer,
+   CertTypeLicenseSigner: KeyUsageIssuerSignLicense,
+}
+
+func isIssuerUsage(usage KeyUsage) bool {
+   switch usage {
+   case KeyUsageIssuerAll, KeyUsageIssuerIndiv, KeyUsageIssuerDevice,
+      KeyUsageIssuerLink, KeyUsageIssuerDomain, KeyUsageIssuerSilverlight,
+      KeyUsageIssuerApplication, KeyUsageIssuerCrl, KeyUsageIssuerMetering,
+      KeyUsageIssuerSignKeyFile, KeyUsageIssuerServer,
+      KeyUsageIssuerSignLicense, KeyUsageIssuerSecurityVersion:
+      return true
+   }
+   return false
+}
+
+func (k *CertKey) hasUsage(usage KeyUsage) bool {
+   return slices.Contains(k.UsageSet, uint32(usage))
+}
+
+// Verify checks every certificate signature up to a trusted root, along with
+// key usages, expiration dates, chain depth and security levels
+func (c *Chain) Verify(opts *VerifyOptions) error {
+   if opts == nil {
+      opts = &VerifyOptions{}
+   }
+   roots := opts.Roots
+   if roots == nil {
+      root, err := hex.DecodeString(RootPublicKey)
+      if err != nil {
+         return err
+      }
+      roots = [][]byte{root}
+   }
+   now := opts.CurrentTime
+   if now.IsZero() {
+      now = time.Now()
+   }
+   if len(c.Certificates) == 0 {
+      return &VerifyError{Index: -1, Rule: RuleStructure, Reason: "chain is empty"}
+   }
+   for index := range c.Certificates {
+      err := c.Certificates[index].checkStructure()
+      if err != nil {
+         return &VerifyError{Index: index, Rule: RuleStructure, Reason: err.Error()}
+      }
+   }
+   last := len(c.Certificates) - 1
+   trusted := slices.ContainsFunc(roots, func(root []byte) bool {
+      return bytes.Equal(root, c.Certificates[last].SignatureInfo.IssuerKey)
+   })
+   if !trusted {
+      return &VerifyError{Index: last, Rule: RuleTrust, Reason: "issuer key is not a trusted root"}
+   }
+   for index := last; index >= 0; index-- {
+      cert := &c.Certificates[index]
+      if index < last {
+         err := c.verifyIssuer(index)
+         if err != nil {
+            return err
+         }
+      }
+      if !cert.verify(cert.SignatureInfo.IssuerKey) {
+         return &VerifyError{Index: index, Rule: RuleSignature, Reason: "signature does not verify"}
+      }
+      expiration := cert.BasicInfo.ExpirationDate
+      if expiration != neverExpires && now.After(time.Unix(int64(expiration), 0)) {
+         return &VerifyError{
+            Index:  index,
+            Rule:   RuleExpiration,
+            Reason: "expired " + time.Unix(int64(expiration), 0).UTC().Format(time.RFC3339),
+         }
+      }
+      if cert.DeviceInfo != nil && uint32(last-index) > cert.DeviceInfo.MaxChainDepth {
+         return &VerifyError{
+            Index: index,
+            Rule:  RuleChainDepth,
+            Reason: fmt.Sprintf(
+               "%v issuers exceed MaxChainDepth %v", last-index, cert.DeviceInfo.MaxChainDepth,
+            ),
+         }
+      }
+   }
+   return nil
+}
+
+// verifyIssuer checks certificate index against its issuer at index+1
+func (c *Chain) verifyIssuer(index int) error {
+   cert := &c.Certificates[index]
+   issuer := &c.Certificates[index+1]
+   if CertType(issuer.BasicInfo.Type) != CertTypeIssuer {
+      return &VerifyError{
+         Index:  index + 1,
+         Rule:   RuleKeyUsage,
+         Reason: fmt.Sprintf("certificate type %v can not issue", CertType(issuer.BasicInfo.Type)),
+      }
+   }
+   var issuerKey *CertKey
+   for i, key := range issuer.KeyInfo.Keys {
+      if bytes.Equal(key.Value, cert.SignatureInfo.IssuerKey) {
+         issuerKey = &issuer.KeyInfo.Keys[i]
+         break
+      }
+   }
+   if issuerKey == nil {
+      return &VerifyError{Index: index, Rule: RuleIssuer, Reason: "issuer key not found in next certificate"}
+   }
+   if !issuerKey.hasUsage(KeyUsageIssuerAll) {
+      certType := CertType(cert.BasicInfo.Type)
+      if certType == CertTypeIssuer {
+         for _, key := range cert.KeyInfo.Keys {
+            for _, usage := range key.UsageSet {
+               if isIssuerUsage(KeyUsage(usage)) && !issuerKey.hasUsage(KeyUsage(usage)) {
+                  return &VerifyError{
+                     Index:  index,
+                     Rule:   RuleKeyUsage,
+                     Reason: fmt.Sprintf("issuer key lacks usage %v", KeyUsage(usage)),
+                  }
+               }
+            }
+         }
+      } else {
+         usage, ok := issuerUsages[certType]
+         if !ok || !issuerKey.hasUsage(usage) {
+            return &VerifyError{
+               Index:  index,
+               Rule:   RuleKeyUsage,
+               Reason: fmt.Sprintf("issuer key can not issue certificate type %v", certType),
+            }
+         }
+      }
+   }
+   if cert.BasicInfo.SecurityLevel > issuer.BasicInfo.SecurityLevel {
+      return &VerifyError{
+         Index: index,
+         Rule:  RuleSecurityLevel,
+         Reason: fmt.Sprintf(
+            "security level %v above issuer %v",
+            cert.BasicInfo.SecurityLevel, issuer.BasicInfo.SecurityLevel,
+         ),
+      }
+   }
+   return nil
+}
+
+func (c *Certificate) checkStructure() error {
+   switch {
+   case c.BasicInfo == nil:
+      return fmt.Errorf("missing %v object", BcertObjectBasic)
+   case c.KeyInfo == nil || len(c.KeyInfo.Keys) == 0:
+      return fmt.Errorf("missing %v object", BcertObjectKey)
+   case c.SignatureInfo == nil:
+      return fmt.Errorf("missing %v object", BcertObjectSignature)
+   case len(c.SignatureInfo.SignatureData.Value) != 64:
+      return fmt.Errorf("signature length %v", len(c.SignatureInfo.SignatureData.Value))
+   case len(c.SignatureInfo.IssuerKey) != 64:
+      return fmt.Errorf("issuer key length %v", len(c.SignatureInfo.IssuerKey))
+   }
+   return nil
+}
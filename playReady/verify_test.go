@@ -0,0 +1,242 @@
+package playReady
+
+import (
+   "bytes"
+   "crypto/ecdsa"
+   "crypto/sha256"
+   "encoding/binary"
+   "errors"
+   "testing"
+   "time"
+)
+
+// testIssuer returns a chain holding one issuer certificate for issuerKey,
+// signed by rootKey
+func testIssuer(t testing.TB, rootKey, issuerKey *ecdsa.PrivateKey, usage KeyUsage) *Chain {
+   rootPub, err := publicKeyBytes(rootKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   issuerPub, err := publicKeyBytes(issuerKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   cert := Certificate{
+      Header: CertHeader{HeaderTag: CertHeaderTag, Version: CertVersion},
+      BasicInfo: &BasicInfo{
+         SecurityLevel:  2000,
+         Type:           uint32(CertTypeIssuer),
+         ExpirationDate: neverExpires,
+      },
+      KeyInfo: &KeyInfo{
+         Keys: []CertKey{{
+            Type: 1, Value: issuerPub, UsageSet: []uint32{uint32(usage)},
+         }},
+      },
+      SignatureInfo: &SignatureInfo{
+         Header:        ObjectHeader{Flags: 1},
+         SignatureType: 1,
+         SignatureData: SignatureData{Value: make([]byte, 64)},
+         IssuerKey:     rootPub,
+      },
+      RecordOrder: []uint16{
+         uint16(BcertObjectBasic), uint16(BcertObjectKey), uint16(BcertObjectSignature),
+      },
+   }
+   testSign(t, &cert, rootKey)
+   chain := &Chain{
+      Header:       ChainHeader{HeaderTag: ChainHeaderTag, Version: ChainVersion},
+      Certificates: []Certificate{cert},
+   }
+   chain.UpdateLengths()
+   return chain
+}
+
+// testSign signs cert with issuerKey
+func testSign(t testing.TB, cert *Certificate, issuerKey *ecdsa.PrivateKey) {
+   data := cert.Bytes()
+   digest := sha256.Sum256(data[:binary.BigEndian.Uint32(data[12:16])])
+   r, s, err := ecdsa.Sign(nil, issuerKey, digest[:])
+   if err != nil {
+      t.Fatal(err)
+   }
+   r.FillBytes(cert.SignatureInfo.SignatureData.Value[:32])
+   s.FillBytes(cert.SignatureInfo.SignatureData.Value[32:])
+}
+
+// testVerify trusts rootKey only
+func testVerify(t testing.TB, rootKey *ecdsa.PrivateKey) *VerifyOptions {
+   rootPub, err := publicKeyBytes(rootKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   return &VerifyOptions{Roots: [][]byte{rootPub}}
+}
+
+const (
+   testKid        = "0123456789abcdef"
+   testContentKey = "fedcba9876543210"
+)
+
+// testSetup is a device of a synthetic ecosystem and a license server holding
+// the content key of testKid
+type testSetup struct {
+   ecosystem *Ecosystem
+   device    *Device
+   server    *Server
+}
+
+// newTestSetup makes the ecosystem with opts, which can be nil
+func newTestSetup(t testing.TB, opts *EcosystemOptions) *testSetup {
+   ecosystem, err := NewEcosystem(opts)
+   if err != nil {
+      t.Fatal(err)
+   }
+   device, err := ecosystem.NewDevice(nil)
+   if err != nil {
+      t.Fatal(err)
+   }
+   serverKey, err := GenerateKey()
+   if err != nil {
+      t.Fatal(err)
+   }
+   return &testSetup{
+      ecosystem: ecosystem,
+      device:    device,
+      server: &Server{
+         Key:         serverKey,
+         ContentKeys: map[string][]byte{testKid: []byte(testContentKey)},
+      },
+   }
+}
+
+// challenge returns a license challenge of the device for testKid, encrypted
+// to the server key. opts can be nil
+func (s *testSetup) challenge(t testing.TB, opts *ChallengeOptions) []byte {
+   var options ChallengeOptions
+   if opts != nil {
+      options = *opts
+   }
+   options.ServerKey = &s.server.Key.PublicKey
+   challenge, err := s.device.Chain.LicenseRequestBytes(
+      s.device.SigningKey, []byte(testKid), "", &options,
+   )
+   if err != nil {
+      t.Fatal(err)
+   }
+   return challenge
+}
+
+// response returns the server response to a license challenge, see challenge
+func (s *testSetup) response(t testing.TB, opts *ChallengeOptions) []byte {
+   response, err := s.server.Response(s.challenge(t, opts))
+   if err != nil {
+      t.Fatal(err)
+   }
+   return response
+}
+
+func testKeys(t testing.TB, n int) []*ecdsa.PrivateKey {
+   keys := make([]*ecdsa.PrivateKey, n)
+   for i := range keys {
+      var err error
+      keys[i], err = GenerateKey()
+      if err != nil {
+         t.Fatal(err)
+      }
+   }
+   return keys
+}
+
+func TestVerify(t *testing.T) {
+   keys := testKeys(t, 4)
+   rootKey, issuerKey, signingKey, encryptKey := keys[0], keys[1], keys[2], keys[3]
+   rootPub, err := publicKeyBytes(rootKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   chain := testIssuer(t, rootKey, issuerKey, KeyUsageIssuerDevice)
+   _, err = chain.GenerateLeaf(issuerKey, signingKey, encryptKey, &LeafOptions{
+      Verify: testVerify(t, rootKey),
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   data := chain.Bytes()
+   chain, err = ParseChain(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = chain.Verify(&VerifyOptions{Roots: [][]byte{rootPub}})
+   if err != nil {
+      t.Fatal(err)
+   }
+   var verifyErr *VerifyError
+   err = chain.Verify(nil)
+   if !errors.As(err, &verifyErr) || verifyErr.Rule != RuleTrust || verifyErr.Index != 1 {
+      t.Fatalf("expected trust failure, got %v", err)
+   }
+   chain.Certificates[1].BasicInfo.ExpirationDate = uint32(time.Now().Add(-time.Hour).Unix())
+   err = chain.Verify(&VerifyOptions{Roots: [][]byte{rootPub}})
+   if !errors.As(err, &verifyErr) || verifyErr.Rule != RuleSignature {
+      t.Fatalf("expected signature failure, got %v", err)
+   }
+   // each edit is signed again, so that only the rule under test fails
+   tests := []struct {
+      index  int
+      rule   VerifyRule
+      edit   func(*Certificate)
+      signer *ecdsa.PrivateKey
+   }{
+      {1, RuleExpiration, func(c *Certificate) {
+         c.BasicInfo.ExpirationDate = uint32(time.Now().Add(-time.Hour).Unix())
+      }, rootKey},
+      {0, RuleChainDepth, func(c *Certificate) {
+         c.DeviceInfo.MaxChainDepth = 0
+      }, issuerKey},
+      {0, RuleSecurityLevel, func(c *Certificate) {
+         c.BasicInfo.SecurityLevel = 3000
+      }, issuerKey},
+   }
+   for _, test := range tests {
+      chain, err := ParseChain(bytes.Clone(data))
+      if err != nil {
+         t.Fatal(err)
+      }
+      cert := &chain.Certificates[test.index]
+      test.edit(cert)
+      testSign(t, cert, test.signer)
+      err = chain.Verify(&VerifyOptions{Roots: [][]byte{rootPub}})
+      if !errors.As(err, &verifyErr) || verifyErr.Rule != test.rule || verifyErr.Index != test.index {
+         t.Fatalf("expected %v failure, got %v", test.rule, err)
+      }
+   }
+}
+
+func TestVerifyKeyUsage(t *testing.T) {
+   keys := testKeys(t, 4)
+   rootKey, issuerKey, signingKey, encryptKey := keys[0], keys[1], keys[2], keys[3]
+   chain := testIssuer(t, rootKey, issuerKey, KeyUsageIssuerDomain)
+   verify := testVerify(t, rootKey)
+   _, err := chain.GenerateLeaf(issuerKey, signingKey, encryptKey, &LeafOptions{Verify: verify})
+   if err == nil {
+      t.Fatal("expected GenerateLeaf to reject certificate type")
+   }
+   _, err = chain.GenerateLeaf(issuerKey, signingKey, encryptKey, &LeafOptions{
+      Type: CertTypeDomain, Verify: verify,
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   // key usage is checked before the leaf signature
+   chain.Certificates[0].BasicInfo.Type = uint32(CertTypeDevice)
+   rootPub, err := publicKeyBytes(rootKey)
+   if err != nil {
+      t.Fatal(err)
+   }
+   err = chain.Verify(&VerifyOptions{Roots: [][]byte{rootPub}})
+   var verifyErr *VerifyError
+   if !errors.As(err, &verifyErr) || verifyErr.Rule != RuleKeyUsage || verifyErr.Index != 0 {
+      t.Fatalf("expected key usage failure, got %v", err)
+   }
+}
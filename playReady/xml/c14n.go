@@ -0,0 +1,268 @@
+package xml
+
+import (
+   "bytes"
+   "encoding/xml"
+   "errors"
+   "fmt"
+   "io"
+   "maps"
+   "slices"
+   "strings"
+)
+
+const (
+   Canonical          = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+   ExclusiveCanonical = "http://www.w3.org/2001/10/xml-exc-c14n#"
+   namespaceXml       = "http://www.w3.org/XML/1998/namespace"
+)
+
+// Canonicalize returns element, an element of data as returned by Find or
+// Path, in the canonical form of algorithm, without comments. The namespaces
+// element inherits are those declared by its ancestors in data
+func Canonicalize(data, element []byte, algorithm string) ([]byte, error) {
+   if algorithm != Canonical && algorithm != ExclusiveCanonical {
+      return nil, fmt.Errorf("unsupported canonicalization method %q", algorithm)
+   }
+   start := cap(data) - cap(element)
+   if len(element) == 0 || start < 0 || start+len(element) > len(data) ||
+      &data[start] != &element[0] {
+      return nil, errors.New("element is not part of data")
+   }
+   scope, err := inheritedScope(data, int64(start))
+   if err != nil {
+      return nil, err
+   }
+   c := canonicalizer{exclusive: algorithm == ExclusiveCanonical}
+   return c.canonicalize(element, scope)
+}
+
+// inheritedScope returns the namespaces in scope for the element at offset
+func inheritedScope(data []byte, offset int64) (map[string]string, error) {
+   decoder := xml.NewDecoder(bytes.NewReader(data))
+   scopes := []map[string]string{{}}
+   for {
+      if decoder.InputOffset() == offset {
+         return scopes[len(scopes)-1], nil
+      }
+      token, err := decoder.RawToken()
+      if err != nil {
+         return nil, err
+      }
+      switch token := token.(type) {
+      case xml.StartElement:
+         scopes = append(scopes, declare(scopes[len(scopes)-1], token.Attr))
+      case xml.EndElement:
+         if len(scopes) <= 1 {
+            return nil, io.ErrUnexpectedEOF
+         }
+         scopes = scopes[:len(scopes)-1]
+      }
+   }
+}
+
+// declare returns scope with the namespace declarations of attrs
+func declare(scope map[string]string, attrs []xml.Attr) map[string]string {
+   var next map[string]string
+   for _, attr := range attrs {
+      prefix, ok := namespacePrefix(attr.Name)
+      if !ok {
+         continue
+      }
+      if next == nil {
+         next = maps.Clone(scope)
+      }
+      next[prefix] = attr.Value
+   }
+   if next == nil {
+      return scope
+   }
+   return next
+}
+
+// namespacePrefix returns the prefix name declares, if it is xmlns or
+// xmlns:prefix
+func namespacePrefix(name xml.Name) (string, bool) {
+   switch {
+   case name.Space == "" && name.Local == "xmlns":
+      return "", true
+   case name.Space == "xmlns":
+      return name.Local, true
+   }
+   return "", false
+}
+
+type canonicalizer struct {
+   exclusive bool
+   buf       bytes.Buffer
+}
+
+func (c *canonicalizer) canonicalize(element []byte, scope map[string]string) ([]byte, error) {
+   decoder := xml.NewDecoder(bytes.NewReader(element))
+   type level struct {
+      scope    map[string]string
+      rendered map[string]string
+   }
+   levels := []level{{scope: scope, rendered: map[string]string{}}}
+   for {
+      token, err := decoder.RawToken()
+      if err == io.EOF {
+         break
+      }
+      if err != nil {
+         return nil, err
+      }
+      switch token := token.(type) {
+      case xml.StartElement:
+         parent := levels[len(levels)-1]
+         scope := declare(parent.scope, token.Attr)
+         levels = append(levels, level{
+            scope: scope, rendered: c.startElement(token, scope, parent.rendered),
+         })
+      case xml.EndElement:
+         if len(levels) <= 1 {
+            return nil, errors.New("unexpected end element")
+         }
+         levels = levels[:len(levels)-1]
+         c.buf.WriteString("</")
+         c.buf.WriteString(qualified(token.Name))
+         c.buf.WriteByte('>')
+      case xml.CharData:
+         if len(levels) >= 2 {
+            escape(&c.buf, token, false)
+         }
+      case xml.ProcInst:
+         if len(levels) >= 2 {
+            c.buf.WriteString("<?")
+            c.buf.WriteString(token.Target)
+            if len(token.Inst) >= 1 {
+               c.buf.WriteByte(' ')
+               c.buf.Write(token.Inst)
+            }
+            c.buf.WriteString("?>")
+         }
+      }
+   }
+   if len(levels) != 1 {
+      return nil, io.ErrUnexpectedEOF
+   }
+   return c.buf.Bytes(), nil
+}
+
+// startElement writes the start tag and returns the namespaces rendered in
+// scope of the element
+func (c *canonicalizer) startElement(
+   start xml.StartElement, scope, rendered map[string]string,
+) map[string]string {
+   // the namespaces to consider rendering
+   var prefixes []string
+   if c.exclusive {
+      prefixes = append(prefixes, start.Name.Space)
+      for _, attr := range start.Attr {
+         if _, ok := namespacePrefix(attr.Name); !ok && attr.Name.Space != "" {
+            prefixes = append(prefixes, attr.Name.Space)
+         }
+      }
+   } else {
+      for prefix := range scope {
+         prefixes = append(prefixes, prefix)
+      }
+   }
+   slices.Sort(prefixes)
+   prefixes = slices.Compact(prefixes)
+   var next map[string]string
+   c.buf.WriteByte('<')
+   c.buf.WriteString(qualified(start.Name))
+   for _, prefix := range prefixes {
+      if prefix == "xml" {
+         continue
+      }
+      uri := scope[prefix]
+      if have, ok := rendered[prefix]; ok && have == uri || !ok && uri == "" {
+         continue
+      }
+      if next == nil {
+         next = maps.Clone(rendered)
+      }
+      next[prefix] = uri
+      c.buf.WriteString(" xmlns")
+      if prefix != "" {
+         c.buf.WriteByte(':')
+         c.buf.WriteString(prefix)
+      }
+      c.buf.WriteString(`="`)
+      escape(&c.buf, []byte(uri), true)
+      c.buf.WriteByte('"')
+   }
+   var attrs []xml.Attr
+   for _, attr := range start.Attr {
+      if _, ok := namespacePrefix(attr.Name); !ok {
+         attrs = append(attrs, attr)
+      }
+   }
+   namespace := func(name xml.Name) string {
+      switch name.Space {
+      case "":
+         return ""
+      case "xml":
+         return namespaceXml
+      }
+      return scope[name.Space]
+   }
+   slices.SortStableFunc(attrs, func(a, b xml.Attr) int {
+      return cmpNames(namespace(a.Name), a.Name.Local, namespace(b.Name), b.Name.Local)
+   })
+   for _, attr := range attrs {
+      c.buf.WriteByte(' ')
+      c.buf.WriteString(qualified(attr.Name))
+      c.buf.WriteString(`="`)
+      escape(&c.buf, []byte(attr.Value), true)
+      c.buf.WriteByte('"')
+   }
+   c.buf.WriteByte('>')
+   if next == nil {
+      return rendered
+   }
+   return next
+}
+
+func cmpNames(spaceA, localA, spaceB, localB string) int {
+   if n := strings.Compare(spaceA, spaceB); n != 0 {
+      return n
+   }
+   return strings.Compare(localA, localB)
+}
+
+// qualified returns the name as written, prefix and all, as RawToken leaves
+// the prefix in Space
+func qualified(name xml.Name) string {
+   if name.Space == "" {
+      return name.Local
+   }
+   return name.Space + ":" + name.Local
+}
+
+// escape writes text escaped as canonical XML does, for an attribute value
+// or for character data
+func escape(buf *bytes.Buffer, text []byte, attr bool) {
+   for _, b := range text {
+      switch {
+      case b == '&':
+         buf.WriteString("&amp;")
+      case b == '<':
+         buf.WriteString("&lt;")
+      case b == '>' && !attr:
+         buf.WriteString("&gt;")
+      case b == '"' && attr:
+         buf.WriteString("&quot;")
+      case b == '\t' && attr:
+         buf.WriteString("&#x9;")
+      case b == '\n' && attr:
+         buf.WriteString("&#xA;")
+      case b == '\r':
+         buf.WriteString("&#xD;")
+      default:
+         buf.WriteByte(b)
+      }
+   }
+}
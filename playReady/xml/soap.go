@@ -0,0 +1,252 @@
+package xml
+
+import (
+   "bytes"
+   "encoding/xml"
+   "fmt"
+   "io"
+)
+
+const (
+   NamespaceSoap11    = "http://schemas.xmlsoap.org/soap/envelope/"
+   NamespaceSoap12    = "http://www.w3.org/2003/05/soap-envelope"
+   NamespaceProtocols = "http://schemas.microsoft.com/DRM/2007/03/protocols"
+   NamespaceMessages  = "http://schemas.microsoft.com/DRM/2007/03/protocols/messages"
+   NamespaceSignature = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// MissingElementError reports an element a response lacks, along with the
+// element it was looked for in
+type MissingElementError struct {
+   Parent string
+   Name   xml.Name
+}
+
+func (m *MissingElementError) Error() string {
+   if m.Parent == "" {
+      return m.Name.Local + " not found"
+   }
+   return fmt.Sprintf("%v not found in %v", m.Name.Local, m.Parent)
+}
+
+// FindAll returns the elements name of data at any depth, as the exact bytes
+// sent. An empty name.Space matches any namespace
+func FindAll(data []byte, name xml.Name) ([][]byte, error) {
+   decoder := xml.NewDecoder(bytes.NewReader(data))
+   var (
+      found [][]byte
+      start int64
+      depth int
+   )
+   for {
+      offset := decoder.InputOffset()
+      token, err := decoder.Token()
+      if err == io.EOF {
+         return found, nil
+      }
+      if err != nil {
+         return nil, err
+      }
+      switch token := token.(type) {
+      case xml.StartElement:
+         if depth >= 1 {
+            depth++
+         } else if matchName(token.Name, name) {
+            start = offset
+            depth = 1
+         }
+      case xml.EndElement:
+         if depth >= 1 {
+            depth--
+            if depth == 0 {
+               found = append(found, data[start:decoder.InputOffset()])
+            }
+         }
+      }
+   }
+}
+
+// Find returns the first element name of data, see FindAll
+func Find(data []byte, name xml.Name, parent string) ([]byte, error) {
+   found, err := FindAll(data, name)
+   if err != nil {
+      return nil, err
+   }
+   if len(found) == 0 {
+      return nil, &MissingElementError{Parent: parent, Name: name}
+   }
+   return found[0], nil
+}
+
+// FindPath returns the elements at path from the root element of data, each
+// element a child of the one before, as the exact bytes sent. An element
+// before the last that is missing or repeated is an error, as a repeated
+// element could be a copy wrapping the one that is signed. Namespaces are
+// those of the whole document. An empty name.Local matches any element
+func FindPath(data []byte, path ...xml.Name) ([][]byte, error) {
+   return findPath(data, path, len(path)-1)
+}
+
+// Path returns the single element at path, see FindPath
+func Path(data []byte, path ...xml.Name) ([]byte, error) {
+   found, err := findPath(data, path, len(path))
+   if err != nil {
+      return nil, err
+   }
+   return found[0], nil
+}
+
+// findPath is FindPath, with the first single elements of path required once
+func findPath(data []byte, path []xml.Name, single int) ([][]byte, error) {
+   decoder := xml.NewDecoder(bytes.NewReader(data))
+   var (
+      found  [][]byte
+      start  int64
+      root   string
+      counts = make([]int, len(path))
+      // levels is, for each open element, the length of the path it is at,
+      // or -1
+      levels []int
+   )
+   for {
+      offset := decoder.InputOffset()
+      token, err := decoder.Token()
+      if err == io.EOF {
+         break
+      }
+      if err != nil {
+         return nil, err
+      }
+      switch token := token.(type) {
+      case xml.StartElement:
+         level := -1
+         if len(levels) == 0 {
+            level, root = 0, token.Name.Local
+         } else if parent := levels[len(levels)-1]; parent >= 0 && parent < len(path) {
+            if matchName(token.Name, path[parent]) {
+               level = parent + 1
+               counts[parent]++
+            }
+         }
+         if level == len(path) {
+            start = offset
+         }
+         levels = append(levels, level)
+      case xml.EndElement:
+         if levels[len(levels)-1] == len(path) {
+            found = append(found, data[start:decoder.InputOffset()])
+         }
+         levels = levels[:len(levels)-1]
+      }
+   }
+   if root == "" {
+      return nil, io.ErrUnexpectedEOF
+   }
+   parent := root
+   for i, name := range path[:max(single, 0)] {
+      switch {
+      case counts[i] == 0:
+         return nil, &MissingElementError{Parent: parent, Name: name}
+      case counts[i] >= 2:
+         return nil, fmt.Errorf("%v repeated in %v", name.Local, parent)
+      }
+      parent = name.Local
+   }
+   return found, nil
+}
+
+// Attr returns the attribute name of the root element of data
+func Attr(data []byte, name string) string {
+   root, err := rootElement(data)
+   if err != nil {
+      return ""
+   }
+   for _, attr := range root.Attr {
+      if attr.Name.Space == "" && attr.Name.Local == name {
+         return attr.Value
+      }
+   }
+   return ""
+}
+
+func matchName(have, want xml.Name) bool {
+   if want.Local != "" && have.Local != want.Local {
+      return false
+   }
+   return want.Space == "" || have.Space == want.Space
+}
+
+// DecodeEnvelope decodes a SOAP 1.1 or SOAP 1.2 response, whatever the
+// namespace prefixes. The Fault is that of the envelope namespace, and SOAP
+// 1.2 faults are returned in the SOAP 1.1 form
+func DecodeEnvelope(data []byte) (*EnvelopeResponse, error) {
+   root, err := rootElement(data)
+   if err != nil {
+      return nil, err
+   }
+   if root.Name.Local != "Envelope" || root.Name.Space != NamespaceSoap11 && root.Name.Space != NamespaceSoap12 {
+      return nil, &MissingElementError{Name: xml.Name{Space: NamespaceSoap11, Local: "Envelope"}}
+   }
+   body, err := Find(data, xml.Name{Space: root.Name.Space, Local: "Body"}, "Envelope")
+   if err != nil {
+      return nil, err
+   }
+   var envelope EnvelopeResponse
+   err = xml.Unmarshal(body, &envelope.Body)
+   if err != nil {
+      return nil, err
+   }
+   faults, err := FindPath(
+      data,
+      xml.Name{Space: root.Name.Space, Local: "Body"},
+      xml.Name{Space: root.Name.Space, Local: "Fault"},
+   )
+   if err != nil || len(faults) == 0 {
+      return &envelope, err
+   }
+   if root.Name.Space == NamespaceSoap11 {
+      envelope.Body.Fault = &Fault{}
+      err = xml.Unmarshal(faults[0], envelope.Body.Fault)
+      if err != nil {
+         return nil, err
+      }
+      return &envelope, nil
+   }
+   var value fault12
+   err = xml.Unmarshal(faults[0], &value)
+   if err != nil {
+      return nil, err
+   }
+   envelope.Body.Fault = &Fault{
+      Actor:  value.Role,
+      Code:   value.Code.Value,
+      Detail: value.Detail,
+      String: value.Reason.Text,
+   }
+   return &envelope, nil
+}
+
+// fault12 is a SOAP 1.2 fault
+type fault12 struct {
+   Code struct {
+      Value string
+   }
+   Reason struct {
+      Text string
+   }
+   Role   string
+   Detail *Detail
+}
+
+func rootElement(data []byte) (*xml.StartElement, error) {
+   decoder := xml.NewDecoder(bytes.NewReader(data))
+   for {
+      token, err := decoder.Token()
+      if err != nil {
+         return nil, err
+      }
+      if start, ok := token.(xml.StartElement); ok {
+         return &start, nil
+      }
+   }
+}
@@ -11,27 +11,68 @@ var (
    Unmarshal = xml.Unmarshal
 )
 
+type Name = xml.Name
+
+type Ack struct {
+   // ELEMENT ORDER MATTERS
+   Version               string                // microsoft.com
+   TransactionId         Bytes                 `xml:"TransactionID"` // microsoft.com
+   LicenseStorageResults LicenseStorageResults // microsoft.com
+   EncryptedData         EncryptedData         // microsoft.com
+   XMLName               xml.Name              `xml:"Ack"` // microsoft.com
+   // ATTRIBUTE ORDER MATTERS
+   XmlNs string `xml:"xmlns,attr"` // microsoft.com
+   Id    string `xml:"Id,attr"`    // microsoft.com
+}
+
+type AcknowledgeLicense struct {
+   Challenge OuterChallenge `xml:"challenge"`  // microsoft.com
+   XmlNs     string         `xml:"xmlns,attr"` // microsoft.com
+}
+
+type Acknowledgement struct {
+   TransactionId Bytes `xml:"TransactionID"` // microsoft.com
+}
+
 type AcquireLicense struct {
    Challenge OuterChallenge `xml:"challenge"`  // microsoft.com
    XmlNs     string         `xml:"xmlns,attr"` // microsoft.com
 }
 
+type AcquireLicenseResponse struct {
+   AcquireLicenseResult struct {
+      Response struct {
+         LicenseResponse LicenseResponse // microsoft.com
+         Signature       *Signature      // microsoft.com
+      }
+   }
+   XmlNs string `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
 type Body struct {
-   AcquireLicense         *AcquireLicense // microsoft.com
-   AcquireLicenseResponse *struct {
-      AcquireLicenseResult struct {
+   AcknowledgeLicense         *AcknowledgeLicense // microsoft.com
+   AcknowledgeLicenseResponse *struct {
+      AcknowledgeLicenseResult struct {
          Response struct {
-            LicenseResponse struct {
-               Licenses struct {
-                  License Bytes
-               }
+            AckResponse struct {
+               TransactionId Bytes `xml:"TransactionID"`
             }
          }
       }
    }
-   Fault *struct {
-      Fault string `xml:"faultstring"`
-   }
+   AcquireLicense         *AcquireLicense         // microsoft.com
+   AcquireLicenseResponse *AcquireLicenseResponse // microsoft.com
+   // Fault is in the envelope namespace, and decoded by DecodeEnvelope
+   Fault               *Fault               `xml:"soap:Fault"` // microsoft.com
+   JoinDomain          *JoinDomain          // microsoft.com
+   JoinDomainResponse  *JoinDomainResponse  // microsoft.com
+   LeaveDomain         *LeaveDomain         // microsoft.com
+   LeaveDomainResponse *LeaveDomainResponse // microsoft.com
+
+   ProcessMeteringData         *ProcessMeteringData         // microsoft.com
+   ProcessMeteringDataResponse *ProcessMeteringDataResponse // microsoft.com
+   ProcessSecureStop           *ProcessSecureStop           // microsoft.com
+   ProcessSecureStopResponse   *ProcessSecureStopResponse   // microsoft.com
 }
 
 func (b Bytes) MarshalText() ([]byte, error) {
@@ -61,8 +102,22 @@ type ContentHeader struct {
    WrmHeader WrmHeader `xml:"WRMHEADER"` // microsoft.com
 }
 
+type ClientInfo struct {
+   ClientVersion string `xml:"CLIENTVERSION"` // microsoft.com
+}
+
+type CustomAttribute struct {
+   XMLName xml.Name
+   Value   string `xml:",chardata"`
+}
+
+func NewCustomAttribute(name, value string) CustomAttribute {
+   return CustomAttribute{XMLName: xml.Name{Local: name}, Value: value}
+}
+
 type CustomAttributes struct {
-   ContentId string `xml:"CONTENTID"` // 9c9media.com
+   ContentId  string            `xml:"CONTENTID,omitempty"` // 9c9media.com
+   Attributes []CustomAttribute `xml:",any"`
 }
 
 type Data struct {
@@ -70,6 +125,30 @@ type Data struct {
    Features          Features          // microsoft.com
 }
 
+type Domain struct {
+   // ELEMENT ORDER MATTERS
+   Version       string        // microsoft.com
+   ServiceId     Bytes         `xml:"ServiceID"`           // microsoft.com
+   AccountId     Bytes         `xml:"AccountID,omitempty"` // microsoft.com
+   Revision      uint32        // microsoft.com
+   FriendlyName  string        `xml:",omitempty"` // microsoft.com
+   CustomData    string        `xml:",omitempty"` // microsoft.com
+   EncryptedData EncryptedData // microsoft.com
+   XMLName       xml.Name      `xml:"Domain"` // microsoft.com
+   // ATTRIBUTE ORDER MATTERS
+   XmlNs string `xml:"xmlns,attr"` // microsoft.com
+   Id    string `xml:"Id,attr"`    // microsoft.com
+}
+
+type DomainResponse struct {
+   ServiceId        Bytes  `xml:"ServiceID"`            // microsoft.com
+   AccountId        Bytes  `xml:"AccountID"`            // microsoft.com
+   Revision         uint32 `xml:",omitempty"`           // microsoft.com
+   CertificateChain Bytes  `xml:",omitempty"`           // microsoft.com
+   DomainKeys       Bytes  `xml:",omitempty"`           // microsoft.com
+   XmlNs            string `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
 type EncryptedData struct {
    CipherData       CipherData        // microsoft.com
    EncryptionMethod EncryptionMethod  // microsoft.com
@@ -110,6 +189,26 @@ type EnvelopeResponse struct {
    Body Body
 }
 
+type Detail struct {
+   Exception Exception // microsoft.com
+}
+
+type Exception struct {
+   CustomData  string `xml:",omitempty"`           // microsoft.com
+   RedirectUrl string `xml:",omitempty"`           // microsoft.com
+   ServiceId   string `xml:",omitempty"`           // microsoft.com
+   StatusCode  string `xml:",omitempty"`           // microsoft.com
+   XmlNs       string `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
+// Fault is in the element order of SOAP 1.1
+type Fault struct {
+   Code   string  `xml:"faultcode"`            // microsoft.com
+   String string  `xml:"faultstring"`          // microsoft.com
+   Actor  string  `xml:"faultactor,omitempty"` // microsoft.com
+   Detail *Detail `xml:"detail"`               // microsoft.com
+}
+
 type Feature struct {
    Name string `xml:",attr"` // microsoft.com
 }
@@ -119,45 +218,214 @@ type Features struct {
 }
 
 type InnerChallenge struct {
-   La        *La       // microsoft.com
-   Signature Signature // microsoft.com
-   XmlNs     string    `xml:"xmlns,attr"` // microsoft.com
+   Ack        *Ack        // microsoft.com
+   Domain     *Domain     // microsoft.com
+   La         *La         // microsoft.com
+   Metering   *Metering   // microsoft.com
+   SecureStop *SecureStop // microsoft.com
+   Signature  Signature   // microsoft.com
+   XmlNs      string      `xml:"xmlns,attr"` // microsoft.com
+}
+
+type JoinDomain struct {
+   Challenge OuterChallenge `xml:"challenge"`  // microsoft.com
+   XmlNs     string         `xml:"xmlns,attr"` // microsoft.com
+}
+
+type JoinDomainResponse struct {
+   JoinDomainResult struct {
+      Response struct {
+         Domain DomainResponse // microsoft.com
+      }
+   }
+   XmlNs string `xml:"xmlns,attr,omitempty"` // microsoft.com
 }
 
 type La struct {
-   ClientTime    int           // 9c9media.com
-   ContentHeader ContentHeader // microsoft.com
-   EncryptedData EncryptedData // microsoft.com
-   LicenseNonce  Bytes         // 9c9media.com
-   Version       string        // microsoft.com
-   XMLName       xml.Name      `xml:"LA"` // microsoft.com
+   // ELEMENT ORDER MATTERS
+   Version         string           // microsoft.com
+   ContentHeader   ContentHeader    // microsoft.com
+   ClientInfo      *ClientInfo      `xml:"CLIENTINFO"` // microsoft.com
+   RevocationLists *RevocationLists // microsoft.com
+   CustomData      string           `xml:",omitempty"` // microsoft.com
+   LicenseNonce    Bytes            // 9c9media.com
+   ClientTime      int64            // 9c9media.com
+   EncryptedData   EncryptedData    // microsoft.com
+   XMLName         xml.Name         `xml:"LA"` // microsoft.com
    // ATTRIBUTE ORDER MATTERS
    XmlNs string `xml:"xmlns,attr"` // microsoft.com
    Id    string `xml:"Id,attr"`    // microsoft.com
 }
 
+type LeaveDomain struct {
+   Challenge OuterChallenge `xml:"challenge"`  // microsoft.com
+   XmlNs     string         `xml:"xmlns,attr"` // microsoft.com
+}
+
+type LeaveDomainResponse struct {
+   LeaveDomainResult struct {
+      Response struct {
+         Domain DomainResponse // microsoft.com
+      }
+   }
+   XmlNs string `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
+type LicenseResponse struct {
+   Acknowledgement *Acknowledgement // microsoft.com
+   Licenses        struct {
+      License Bytes // microsoft.com
+   }
+   Revocations  *Revocations // microsoft.com
+   LicenseNonce Bytes        `xml:",omitempty"` // microsoft.com
+   // ATTRIBUTE ORDER MATTERS
+   XmlNs string `xml:"xmlns,attr,omitempty"` // microsoft.com
+   Id    string `xml:"Id,attr,omitempty"`    // microsoft.com
+}
+
+type LicenseStorageResult struct {
+   Kid    Bytes `xml:"KID"` // microsoft.com
+   Lid    Bytes `xml:"LID"` // microsoft.com
+   Result int32 // microsoft.com
+}
+
+type LicenseStorageResults struct {
+   License []LicenseStorageResult // microsoft.com
+}
+
+type Metering struct {
+   // ELEMENT ORDER MATTERS
+   Version       string          // microsoft.com
+   MeteringId    Bytes           `xml:"MID"`        // microsoft.com
+   TransactionId Bytes           `xml:"TID"`        // microsoft.com
+   CustomData    string          `xml:",omitempty"` // microsoft.com
+   Records       MeteringRecords // microsoft.com
+   EncryptedData EncryptedData   // microsoft.com
+   XMLName       xml.Name        `xml:"Metering"` // microsoft.com
+   // ATTRIBUTE ORDER MATTERS
+   XmlNs string `xml:"xmlns,attr"` // microsoft.com
+   Id    string `xml:"Id,attr"`    // microsoft.com
+}
+
+type MeteringRecord struct {
+   Kid   Bytes  `xml:"KID"` // microsoft.com
+   Count uint32 // microsoft.com
+}
+
+type MeteringRecords struct {
+   Record []MeteringRecord // microsoft.com
+}
+
+type MeteringResponse struct {
+   MeteringId    Bytes  `xml:"MID"`                  // microsoft.com
+   TransactionId Bytes  `xml:"TID"`                  // microsoft.com
+   XmlNs         string `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
+type Method struct {
+   Algorithm string `xml:"Algorithm,attr"` // microsoft.com
+}
+
 type OuterChallenge struct {
    Challenge InnerChallenge // microsoft.com
 }
 
+type ProcessMeteringData struct {
+   Challenge OuterChallenge `xml:"challenge"`  // microsoft.com
+   XmlNs     string         `xml:"xmlns,attr"` // microsoft.com
+}
+
+type ProcessMeteringDataResponse struct {
+   ProcessMeteringDataResult struct {
+      Response struct {
+         MeteringResponse MeteringResponse // microsoft.com
+      }
+   }
+   XmlNs string `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
+type ProcessSecureStop struct {
+   Challenge OuterChallenge `xml:"challenge"`  // microsoft.com
+   XmlNs     string         `xml:"xmlns,attr"` // microsoft.com
+}
+
+type ProcessSecureStopResponse struct {
+   ProcessSecureStopResult struct {
+      Response struct {
+         SecureStopResponse SecureStopResponse // microsoft.com
+      }
+   }
+   XmlNs string `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
 type ProtectInfo struct {
    AlgId  string `xml:"ALGID"`  // microsoft.com
    KeyLen int    `xml:"KEYLEN"` // microsoft.com
 }
 
 type Reference struct {
-   DigestValue Bytes  // microsoft.com
-   Uri         string `xml:"URI,attr"` // microsoft.com
+   // ELEMENT ORDER MATTERS
+   DigestMethod Method // microsoft.com
+   DigestValue  Bytes  // microsoft.com
+   Uri          string `xml:"URI,attr"` // microsoft.com
+}
+
+type RevListInfo struct {
+   ListId  Bytes  `xml:"ListID"` // microsoft.com
+   Version uint32 // microsoft.com
+}
+
+type Revocation struct {
+   ListId   Bytes `xml:"ListID"` // microsoft.com
+   ListData Bytes // microsoft.com
+}
+
+type Revocations struct {
+   Revocation []Revocation // microsoft.com
+}
+
+type RevocationLists struct {
+   RevListInfo []RevListInfo // microsoft.com
+}
+
+type SecureStop struct {
+   // ELEMENT ORDER MATTERS
+   Version       string        // microsoft.com
+   SessionId     Bytes         `xml:"SessionID"` // microsoft.com
+   Kid           Bytes         `xml:"KID"`       // microsoft.com
+   StartTime     int64         // microsoft.com
+   StopTime      int64         // microsoft.com
+   CustomData    string        `xml:",omitempty"` // microsoft.com
+   EncryptedData EncryptedData // microsoft.com
+   XMLName       xml.Name      `xml:"SecureStop"` // microsoft.com
+   // ATTRIBUTE ORDER MATTERS
+   XmlNs string `xml:"xmlns,attr"` // microsoft.com
+   Id    string `xml:"Id,attr"`    // microsoft.com
+}
+
+type SecureStopResponse struct {
+   SessionId Bytes  `xml:"SessionID"`            // microsoft.com
+   XmlNs     string `xml:"xmlns,attr,omitempty"` // microsoft.com
 }
 
 type Signature struct {
-   SignatureValue Bytes      // microsoft.com
-   SignedInfo     SignedInfo // microsoft.com
+   // ELEMENT ORDER MATTERS
+   SignedInfo     SignedInfo        // microsoft.com
+   SignatureValue Bytes             // microsoft.com
+   KeyInfo        *SignatureKeyInfo // microsoft.com
+   XmlNs          string            `xml:"xmlns,attr,omitempty"` // microsoft.com
+}
+
+type SignatureKeyInfo struct {
+   CertificateChain Bytes // microsoft.com
 }
 
 type SignedInfo struct {
-   Reference Reference // microsoft.com
-   XmlNs     string    `xml:"xmlns,attr"` // microsoft.com
+   // ELEMENT ORDER MATTERS
+   CanonicalizationMethod Method    // microsoft.com
+   SignatureMethod        Method    // microsoft.com
+   Reference              Reference // microsoft.com
+   XmlNs                  string    `xml:"xmlns,attr"` // microsoft.com
 }
 
 type WrmHeader struct {
@@ -171,4 +439,5 @@ type WrmHeaderData struct {
    CustomAttributes *CustomAttributes `xml:"CUSTOMATTRIBUTES"` // 9c9media.com
    Kid              Bytes             `xml:"KID"`              // microsoft.com
    ProtectInfo      ProtectInfo       `xml:"PROTECTINFO"`      // microsoft.com
+   LaUrl            string            `xml:"LA_URL,omitempty"` // microsoft.com
 }
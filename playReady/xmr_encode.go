@@ -0,0 +1,323 @@
+package playReady
+
+import (
+   "crypto/aes"
+   "crypto/ecdh"
+   "crypto/ecdsa"
+   "crypto/rand"
+   "encoding/binary"
+   "errors"
+   "filippo.io/nistec"
+   "github.com/emmansun/gmsm/cbcmac"
+   "time"
+)
+
+const (
+   xmrFlagMustUnderstand = 0x0001
+   xmrFlagContainer      = 0x0002
+   // xmrVersion is the XMR version of licenses with ECC keys
+   xmrVersion = 3
+)
+
+// OutputProtection is the minimum output protection levels of a license
+type OutputProtection struct {
+   CompressedDigitalVideo   uint16
+   UncompressedDigitalVideo uint16
+   AnalogVideo              uint16
+   CompressedDigitalAudio   uint16
+   UncompressedDigitalAudio uint16
+}
+
+// Uplink is the root license a chained leaf license is bound to
+type Uplink struct {
+   KeyId      []byte
+   ContentKey []byte
+}
+
+// LicenseOptions describes a license for BuildLicense
+type LicenseOptions struct {
+   KeyId      []byte
+   ContentKey []byte
+   // EncryptKey is the device encryption key the content key is encrypted to
+   EncryptKey *ecdsa.PublicKey
+   // IntegrityKey signs the license. nil picks a random key
+   IntegrityKey []byte
+   // RightsId is random if nil
+   RightsId      []byte
+   SecurityLevel uint16
+   // IssueDate is time.Now if zero
+   IssueDate time.Time
+   // Begin and Expiration are omitted if zero
+   Begin            time.Time
+   Expiration       time.Time
+   PlayCount        uint32
+   OutputProtection *OutputProtection
+   // Uplink makes a chained leaf license. The content key is encrypted with
+   // the root content key instead of EncryptKey
+   Uplink *Uplink
+   // Domain binds the license to a domain. EncryptKey is then the domain key
+   // of that revision
+   Domain *DomainId
+   // MeteringId asks the client to report plays with ProcessMeteringData
+   MeteringId []byte
+   // RevInfoVersion is the RevInfo sequence number the client needs. Zero
+   // means none
+   RevInfoVersion uint32
+}
+
+// BuildLicense returns a signed XMR license
+func BuildLicense(opts *LicenseOptions) ([]byte, error) {
+   if len(opts.KeyId) != 16 {
+      return nil, errors.New("invalid KID length")
+   }
+   if len(opts.ContentKey) != 16 {
+      return nil, errors.New("invalid content key length")
+   }
+   if opts.EncryptKey == nil && opts.Uplink == nil {
+      return nil, errors.New("no device encryption key")
+   }
+   if opts.Domain != nil && len(opts.Domain.AccountId) != 16 {
+      return nil, errors.New("invalid domain account ID length")
+   }
+   if opts.MeteringId != nil && len(opts.MeteringId) != 16 {
+      return nil, errors.New("invalid metering ID length")
+   }
+   rightsId := opts.RightsId
+   if rightsId == nil {
+      rightsId = make([]byte, 16)
+      rand.Read(rightsId)
+   } else if len(rightsId) != 16 {
+      return nil, errors.New("invalid rights ID length")
+   }
+
+   integrityKey, keyMaterial, err := opts.keyMaterial()
+   if err != nil {
+      return nil, err
+   }
+   container := encodeFtlv(
+      xmrFlagMustUnderstand|xmrFlagContainer, XmrObjectGlobalPolicyContainer,
+      opts.globalPolicy(),
+   )
+   container = append(container, encodeFtlv(
+      xmrFlagMustUnderstand|xmrFlagContainer, XmrObjectPlaybackPolicyContainer,
+      opts.playbackPolicy(),
+   )...)
+   container = append(container, encodeFtlv(
+      xmrFlagMustUnderstand|xmrFlagContainer, XmrObjectKeyMaterialContainer,
+      keyMaterial,
+   )...)
+
+   data := binary.BigEndian.AppendUint32(nil, MagicConstant)
+   data = binary.BigEndian.AppendUint32(data, xmrVersion)
+   data = append(data, rightsId...)
+   // the outer container ends with the signature object, which signs
+   // everything before it
+   const signatureLength = 8 + 4 + aes.BlockSize
+   data = binary.BigEndian.AppendUint16(data, xmrFlagMustUnderstand|xmrFlagContainer)
+   data = binary.BigEndian.AppendUint16(data, uint16(XmrObjectOuterContainer))
+   data = binary.BigEndian.AppendUint32(data, uint32(8+len(container)+signatureLength))
+   data = append(data, container...)
+
+   block, err := aes.NewCipher(integrityKey)
+   if err != nil {
+      return nil, err
+   }
+   signature := binary.BigEndian.AppendUint16(nil, 1) // AES-128 OMAC1
+   signature = binary.BigEndian.AppendUint16(signature, aes.BlockSize)
+   signature = append(signature, cbcmac.NewCMAC(block, aes.BlockSize).MAC(data)...)
+   return append(data, encodeFtlv(xmrFlagMustUnderstand, XmrObjectSignatureObject, signature)...), nil
+}
+
+func (o *LicenseOptions) globalPolicy() []byte {
+   data := encodeFtlv(
+      xmrFlagMustUnderstand, XmrObjectSecurityLevel,
+      binary.BigEndian.AppendUint16(nil, o.SecurityLevel),
+   )
+   issueDate := o.IssueDate
+   if issueDate.IsZero() {
+      issueDate = time.Now()
+   }
+   data = append(data, encodeFtlv(
+      xmrFlagMustUnderstand, XmrObjectIssuedateObject,
+      binary.BigEndian.AppendUint32(nil, uint32(issueDate.Unix())),
+   )...)
+   if o.Domain != nil {
+      value := append([]byte{}, o.Domain.AccountId...)
+      data = append(data, encodeFtlv(
+         xmrFlagMustUnderstand, XmrObjectDomainIdObject,
+         binary.BigEndian.AppendUint32(value, o.Domain.Revision),
+      )...)
+   }
+   if o.MeteringId != nil {
+      data = append(data, encodeFtlv(xmrFlagMustUnderstand, XmrObjectMeteringObject, o.MeteringId)...)
+   }
+   if o.RevInfoVersion >= 1 {
+      data = append(data, encodeFtlv(
+         xmrFlagMustUnderstand, XmrObjectRevocationInformationVersion2Object,
+         binary.BigEndian.AppendUint32(nil, o.RevInfoVersion),
+      )...)
+   }
+   if !o.Begin.IsZero() || !o.Expiration.IsZero() {
+      var begin, end uint32 = 0, neverExpires
+      if !o.Begin.IsZero() {
+         begin = uint32(o.Begin.Unix())
+      }
+      if !o.Expiration.IsZero() {
+         end = uint32(o.Expiration.Unix())
+      }
+      value := binary.BigEndian.AppendUint32(nil, begin)
+      data = append(data, encodeFtlv(
+         xmrFlagMustUnderstand, XmrObjectExpirationObject,
+         binary.BigEndian.AppendUint32(value, end),
+      )...)
+   }
+   return data
+}
+
+func (o *LicenseOptions) playbackPolicy() []byte {
+   var data []byte
+   if o.PlayCount >= 1 {
+      data = encodeFtlv(
+         xmrFlagMustUnderstand, XmrObjectPlaycountObject,
+         binary.BigEndian.AppendUint32(nil, o.PlayCount),
+      )
+   }
+   if p := o.OutputProtection; p != nil {
+      var value []byte
+      for _, level := range []uint16{
+         p.CompressedDigitalVideo, p.UncompressedDigitalVideo, p.AnalogVideo,
+         p.CompressedDigitalAudio, p.UncompressedDigitalAudio,
+      } {
+         value = binary.BigEndian.AppendUint16(value, level)
+      }
+      data = append(data, encodeFtlv(xmrFlagMustUnderstand, XmrObjectOutputProtectionObject, value)...)
+   }
+   return data
+}
+
+// keyMaterial returns the integrity key and the key material container
+func (o *LicenseOptions) keyMaterial() ([]byte, []byte, error) {
+   var (
+      keyType      AsymmetricEncryptionType
+      integrityKey []byte
+      encryptedKey []byte
+   )
+   if o.Uplink != nil {
+      keyType = AsymmetricEncryptionTypeChainedLicense
+      integrityKey = o.IntegrityKey
+      if integrityKey == nil {
+         integrityKey = make([]byte, 16)
+         rand.Read(integrityKey)
+      } else if len(integrityKey) != 16 {
+         return nil, nil, errors.New("invalid integrity key length")
+      }
+      keys := append(append([]byte{}, integrityKey...), o.ContentKey...)
+      var err error
+      encryptedKey, err = aesEcbEncrypt(keys, o.Uplink.ContentKey)
+      if err != nil {
+         return nil, nil, err
+      }
+   } else {
+      keyType = AsymmetricEncryptionTypeECC256
+      var (
+         point *nistec.P256Point
+         err   error
+      )
+      point, integrityKey, err = keyPoint(o.IntegrityKey, o.ContentKey)
+      if err != nil {
+         return nil, nil, err
+      }
+      encryptedKey, err = elGamalEncryptPoint(point, o.EncryptKey)
+      if err != nil {
+         return nil, nil, err
+      }
+   }
+
+   value := append([]byte{}, o.KeyId...)
+   value = binary.BigEndian.AppendUint16(value, 1) // AES-128 CTR
+   value = binary.BigEndian.AppendUint16(value, uint16(keyType))
+   value = binary.BigEndian.AppendUint16(value, uint16(len(encryptedKey)))
+   data := encodeFtlv(xmrFlagMustUnderstand, XmrObjectContentKeyObject, append(value, encryptedKey...))
+
+   if o.EncryptKey != nil {
+      ecdhKey, err := o.EncryptKey.ECDH()
+      if err != nil {
+         return nil, nil, err
+      }
+      value = binary.BigEndian.AppendUint16(nil, 1) // P-256
+      value = binary.BigEndian.AppendUint16(value, 64)
+      value = append(value, ecdhKey.Bytes()[1:]...)
+      data = append(data, encodeFtlv(xmrFlagMustUnderstand, XmrObjectEccDeviceKeyObject, value)...)
+   }
+   if o.Uplink != nil {
+      checksum, err := keyChecksum(o.Uplink.KeyId, o.Uplink.ContentKey)
+      if err != nil {
+         return nil, nil, err
+      }
+      value = append([]byte{}, o.Uplink.KeyId...)
+      value = binary.BigEndian.AppendUint16(value, uint16(len(checksum)))
+      value = append(value, checksum...)
+      data = append(data, encodeFtlv(xmrFlagMustUnderstand, XmrObjectUplinkKidObject, value)...)
+   }
+   return integrityKey, data, nil
+}
+
+// keyPoint returns the curve point with X coordinate integrityKey||contentKey,
+// and the integrity key. Half of all X values are not on the curve, so a nil
+// integrityKey is retried until one is
+func keyPoint(integrityKey, contentKey []byte) (*nistec.P256Point, []byte, error) {
+   compressed := make([]byte, 33)
+   compressed[0] = 2
+   copy(compressed[17:], contentKey)
+   if integrityKey != nil {
+      if len(integrityKey) != 16 {
+         return nil, nil, errors.New("invalid integrity key length")
+      }
+      copy(compressed[1:], integrityKey)
+      point, err := nistec.NewP256Point().SetBytes(compressed)
+      if err != nil {
+         return nil, nil, errors.New("integrity key and content key are not a curve point")
+      }
+      return point, integrityKey, nil
+   }
+   for {
+      rand.Read(compressed[1:17])
+      point, err := nistec.NewP256Point().SetBytes(compressed)
+      if err == nil {
+         return point, compressed[1:17], nil
+      }
+   }
+}
+
+// elGamalEncryptPoint is elGamalEncrypt with a random ephemeral key
+func elGamalEncryptPoint(point *nistec.P256Point, pubKey *ecdsa.PublicKey) ([]byte, error) {
+   ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+   if err != nil {
+      return nil, err
+   }
+   c1, err := nistec.NewP256Point().ScalarBaseMult(ephemeral.Bytes())
+   if err != nil {
+      return nil, err
+   }
+   keyECDH, err := pubKey.ECDH()
+   if err != nil {
+      return nil, err
+   }
+   keyPoint, err := nistec.NewP256Point().SetBytes(keyECDH.Bytes())
+   if err != nil {
+      return nil, err
+   }
+   sharedSec, err := nistec.NewP256Point().ScalarMult(keyPoint, ephemeral.Bytes())
+   if err != nil {
+      return nil, err
+   }
+   c2 := nistec.NewP256Point().Add(point, sharedSec)
+   return append(c1.Bytes()[1:], c2.Bytes()[1:]...), nil
+}
+
+func encodeFtlv(flags uint16, object XmrObject, value []byte) []byte {
+   data := binary.BigEndian.AppendUint16(nil, flags)
+   data = binary.BigEndian.AppendUint16(data, uint16(object))
+   data = binary.BigEndian.AppendUint32(data, uint32(8+len(value)))
+   return append(data, value...)
+}
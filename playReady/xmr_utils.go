@@ -1,6 +1,9 @@
 package playReady
 
-import "encoding/binary"
+import (
+   "encoding/binary"
+   "fmt"
+)
 
 // AsymmetricEncryptionType is used for encrypting the content key
 type AsymmetricEncryptionType uint16
@@ -15,6 +18,23 @@ const (
    AsymmetricEncryptionTypeECC256ViaSymmetric AsymmetricEncryptionType = 0x0006
 )
 
+var asymmetricEncryptionTypeNames = map[AsymmetricEncryptionType]string{
+   AsymmetricEncryptionTypeInvalid:            "Invalid",
+   AsymmetricEncryptionTypeRSA1024:            "RSA1024",
+   AsymmetricEncryptionTypeChainedLicense:     "ChainedLicense",
+   AsymmetricEncryptionTypeECC256:             "ECC256",
+   AsymmetricEncryptionTypeECC256WithKZ:       "ECC256WithKZ",
+   AsymmetricEncryptionTypeTEETransient:       "TEETransient",
+   AsymmetricEncryptionTypeECC256ViaSymmetric: "ECC256ViaSymmetric",
+}
+
+func (a AsymmetricEncryptionType) String() string {
+   if name, ok := asymmetricEncryptionTypeNames[a]; ok {
+      return name
+   }
+   return fmt.Sprintf("AsymmetricEncryptionType(0x%04X)", uint16(a))
+}
+
 const (
    HeaderLength  = (4 * 2) + 16 // Assuming SIZEOF(DRM_ID) == 16
    MagicConstant = 0x584D5200   // 'XMR\0'
@@ -114,6 +134,16 @@ type ContentKey struct {
    IEncryptedKey           uint32
 }
 
+// OptimizedContentKey is XmrObjectOptimizedContentKeyObject, a content key
+// without KID or symmetric cipher type
+type OptimizedContentKey struct {
+   Valid                   bool
+   KeyEncryptionCipherType uint16
+   CBEncryptedKey          uint16
+   EncryptedKeyBuffer      []byte
+   IEncryptedKey           uint32
+}
+
 type EccDeviceKey struct {
    Valid        bool
    EccCurveType uint16
@@ -133,11 +163,25 @@ type AuxKey struct {
    EntriesList []AuxKeyEntry
 }
 
+// UplinkKid names the root license a chained (leaf) license depends on.
+// Version is 1 for XmrObjectUplinkKidObject and 2 for
+// XmrObjectUplinkKid2Object
+type UplinkKid struct {
+   Valid               bool
+   Version             int
+   GuidUplinkKID       []byte
+   ChainedCheckSumType uint16
+   CBChainedCheckSum   uint16
+   ChainedCheckSum     []byte
+}
+
 type KeyMaterial struct {
-   Valid      bool
-   ContentKey ContentKey
-   ECCKey     EccDeviceKey
-   AuxKey     AuxKey
+   Valid               bool
+   ContentKey          ContentKey
+   OptimizedContentKey OptimizedContentKey
+   ECCKey              EccDeviceKey
+   AuxKey              AuxKey
+   UplinkKid           UplinkKid
 }
 
 type Signature struct {
@@ -148,10 +192,47 @@ type Signature struct {
    CBSignature     uint16
 }
 
+// DomainId is XmrObjectDomainIdObject of the global policy container. It
+// binds the license to a domain, whose key the content key is encrypted to
+type DomainId struct {
+   Valid     bool
+   AccountId []byte
+   Revision  uint32
+}
+
+// MeteringId is XmrObjectMeteringObject of the global policy container. Plays
+// of the license are reported with ProcessMeteringData challenges
+type MeteringId struct {
+   Valid bool
+   Id    []byte
+}
+
+// RevInfoVersion is XmrObjectRevocationInformationVersion2Object of the
+// global policy container: the RevInfo sequence number the license needs
+type RevInfoVersion struct {
+   Valid   bool
+   Version uint32
+}
+
+// Expiration is XmrObjectExpirationObject of the global policy container.
+// EndDate 0xffffffff means the license does not expire
+type Expiration struct {
+   Valid     bool
+   BeginDate uint32
+   EndDate   uint32
+}
+
 type OuterContainer struct {
-   Valid         bool
-   ContainerKeys KeyMaterial
-   Signature     Signature
+   Valid          bool
+   ContainerKeys  KeyMaterial
+   Signature      Signature
+   DomainId       DomainId
+   MeteringId     MeteringId
+   RevInfoVersion RevInfoVersion
+   // RevInfoVersion1 is XmrObjectRevocationInformationVersionObject: the
+   // version of a RevInfo version 1, not a RevInfo sequence number
+   RevInfoVersion1 RevInfoVersion
+   Expiration      Expiration
 }
 
 type License struct {
@@ -161,6 +242,11 @@ type License struct {
    ContainerOuter OuterContainer
    XMRLic         []byte
    CBXMRLic       uint32
+   // TransactionId is set when the server requires an AcknowledgeLicense
+   // challenge for this license
+   TransactionId []byte
+   // Revocations are the revocation lists sent along with the license
+   Revocations []RevocationData
 }
 
 func UuidOrGuid(data []byte) {
@@ -177,24 +263,39 @@ type ftlv struct {
    Value  []byte
 }
 
-func decodeFtlv(data []byte) (ftlv, int) {
+func decodeFtlv(data []byte) (ftlv, int, error) {
    f := ftlv{}
+   if len(data) < 8 {
+      return f, 0, ErrTruncated
+   }
    f.Flags = binary.BigEndian.Uint16(data)
    n := 2
    f.Type = binary.BigEndian.Uint16(data[n:])
    n += 2
    f.Length = binary.BigEndian.Uint32(data[n:])
    n += 4
-   f.Value = data[n:][:f.Length-8]
+   if f.Length < 8 {
+      return f, 0, ErrInvalidLength
+   }
+   if uint64(len(data)) < uint64(f.Length) {
+      return f, 0, ErrTruncated
+   }
+   f.Value = data[n:f.Length]
    n += len(f.Value)
-   return f, n
+   return f, n, nil
 }
 
-func decodePaddedString(data []byte) (PaddedString, int) {
+func decodePaddedString(data []byte) (PaddedString, int, error) {
+   if len(data) < 4 {
+      return "", 0, ErrTruncated
+   }
    length := binary.BigEndian.Uint32(data)
-   paddedLength := (length + 3) &^ 3
+   paddedLength := (uint64(length) + 3) &^ 3
+   if uint64(len(data[4:])) < paddedLength {
+      return "", 0, ErrTruncated
+   }
    val := string(data[4 : 4+length])
-   return PaddedString(val), int(4 + paddedLength)
+   return PaddedString(val), int(4 + paddedLength), nil
 }
 
 func encodePaddedString(val PaddedString) []byte {
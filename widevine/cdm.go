@@ -0,0 +1,145 @@
+// cdm.go
+package widevine
+
+import (
+   "41.neocities.org/diana/cdm"
+   "41.neocities.org/protobuf"
+   "crypto/rand"
+   "crypto/rsa"
+   "errors"
+   "sync"
+   "time"
+)
+
+// Cdm implements cdm.Cdm with a device client ID and its private key.
+// Challenges can be answered in any order.
+type Cdm struct {
+   ClientId   []byte
+   PrivateKey *rsa.PrivateKey
+   mu         sync.Mutex
+   // requests are the license requests not yet answered, by request_id. A
+   // request is needed to derive the key encryption key of its response.
+   requests map[string][]byte
+}
+
+func (c *Cdm) SystemId() cdm.SystemId {
+   return cdm.Widevine
+}
+
+// Challenge returns a signed license request for Widevine pssh data, or a
+// pssh box holding it. Each request has a random request_id.
+func (c *Cdm) Challenge(initData []byte) ([]byte, error) {
+   data, err := cdm.InitData(initData, cdm.Widevine)
+   if err != nil {
+      return nil, err
+   }
+   pssh, err := DecodePsshData(data)
+   if err != nil {
+      return nil, err
+   }
+   requestId := make([]byte, 16)
+   rand.Read(requestId)
+   request, err := pssh.encodeLicenseRequest(c.ClientId, requestId)
+   if err != nil {
+      return nil, err
+   }
+   signed, err := EncodeSignedMessage(request, c.PrivateKey)
+   if err != nil {
+      return nil, err
+   }
+   c.mu.Lock()
+   defer c.mu.Unlock()
+   if c.requests == nil {
+      c.requests = map[string][]byte{}
+   }
+   c.requests[string(requestId)] = request
+   return signed, nil
+}
+
+// Response decrypts the keys of a license, using the request of the challenge
+// it answers.
+func (c *Cdm) Response(data []byte) (*cdm.License, error) {
+   requestId, request, err := c.request(data)
+   if err != nil {
+      return nil, err
+   }
+   keys, err := DecodeLicenseResponse(data, request, c.PrivateKey)
+   if err != nil {
+      return nil, err
+   }
+   var license cdm.License
+   for _, key := range keys {
+      license.Keys = append(license.Keys, cdm.Key{
+         Kid: key.Id, Key: key.Key, Type: cdm.KeyType(key.Type),
+      })
+   }
+   license.Expiration, err = licenseExpiration(data)
+   if err != nil {
+      return nil, err
+   }
+   c.mu.Lock()
+   delete(c.requests, requestId)
+   c.mu.Unlock()
+   return &license, nil
+}
+
+// request returns the pending request with the request_id of the license
+// identification. A license without request_id is matched to the only
+// pending request, if there is one. Error responses are returned as errors.
+func (c *Cdm) request(responseData []byte) (string, []byte, error) {
+   message, err := protobuf.DecodeMessage(responseData)
+   if err != nil {
+      return "", nil, err
+   }
+   msgField, ok := message.Field(2)
+   if !ok || msgField.Message == nil {
+      return "", nil, errors.New("missing message payload")
+   }
+   if typeField, ok := message.Field(1); ok && typeField.Numeric == 3 {
+      return "", nil, decodeErrorFromMessage(msgField.Message)
+   }
+   var requestId []byte
+   if id, ok := msgField.Message.Field(1); ok && id.Message != nil {
+      if field, ok := id.Message.Field(1); ok {
+         requestId = field.Bytes
+      }
+   }
+   c.mu.Lock()
+   defer c.mu.Unlock()
+   if requestId == nil && len(c.requests) == 1 {
+      for id, request := range c.requests {
+         return id, request, nil
+      }
+   }
+   request, ok := c.requests[string(requestId)]
+   if !ok {
+      return "", nil, errors.New("no license request for the response")
+   }
+   return string(requestId), request, nil
+}
+
+// licenseExpiration returns license_start_time plus the policy
+// license_duration_seconds, or the zero Time if the duration is unlimited.
+func licenseExpiration(responseData []byte) (time.Time, error) {
+   message, err := protobuf.DecodeMessage(responseData)
+   if err != nil {
+      return time.Time{}, err
+   }
+   msgField, ok := message.Field(2)
+   if !ok || msgField.Message == nil {
+      return time.Time{}, errors.New("missing message payload")
+   }
+   policy, ok := msgField.Message.Field(2)
+   if !ok || policy.Message == nil {
+      return time.Time{}, nil
+   }
+   duration, ok := policy.Message.Field(6)
+   if !ok || duration.Numeric == 0 {
+      return time.Time{}, nil
+   }
+   start, ok := msgField.Message.Field(4)
+   if !ok {
+      return time.Time{}, errors.New("missing license_start_time")
+   }
+   return time.Unix(int64(start.Numeric+duration.Numeric), 0), nil
+}
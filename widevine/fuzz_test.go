@@ -0,0 +1,62 @@
+package widevine
+
+import (
+   "41.neocities.org/protobuf"
+   "crypto/rand"
+   "crypto/rsa"
+   "crypto/sha1"
+   "testing"
+)
+
+func FuzzDecodePsshData(f *testing.F) {
+   pssh := PsshData{
+      ContentId: []byte("content"),
+      KeyIds:    [][]byte{make([]byte, 16)},
+   }
+   data, err := pssh.Encode()
+   if err != nil {
+      f.Fatal(err)
+   }
+   f.Add(data)
+   f.Add([]byte{0x12, 0xff})
+   f.Fuzz(func(t *testing.T, data []byte) {
+      DecodePsshData(data)
+   })
+}
+
+func FuzzDecodeLicenseResponse(f *testing.F) {
+   privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+   if err != nil {
+      f.Fatal(err)
+   }
+   sessionKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &privateKey.PublicKey, make([]byte, 16), nil)
+   if err != nil {
+      f.Fatal(err)
+   }
+   license := protobuf.Message{
+      protobuf.Varint(1, 2), // LICENSE
+      protobuf.Embed(2, protobuf.Embed(3,
+         protobuf.Bytes(1, make([]byte, 16)),
+         protobuf.Bytes(2, make([]byte, 16)),
+         protobuf.Bytes(3, make([]byte, 32)),
+      )),
+      protobuf.Bytes(4, sessionKey),
+   }
+   data, err := license.Encode()
+   if err != nil {
+      f.Fatal(err)
+   }
+   f.Add(data)
+   licenseError := protobuf.Message{
+      protobuf.Varint(1, 3), // ERROR_RESPONSE
+      protobuf.Embed(2, protobuf.Varint(1, 1)),
+   }
+   data, err = licenseError.Encode()
+   if err != nil {
+      f.Fatal(err)
+   }
+   f.Add(data)
+   f.Fuzz(func(t *testing.T, data []byte) {
+      DecodeLicenseResponse(data, []byte("request"), privateKey)
+   })
+}
@@ -1,7 +1,10 @@
 // pssh.go
 package widevine
 
-import "41.neocities.org/protobuf"
+import (
+   "41.neocities.org/diana/cdm"
+   "41.neocities.org/protobuf"
+)
 
 // DecodePsshData parses the protobuf wire format into a PsshData struct.
 func DecodePsshData(data []byte) (*PsshData, error) {
@@ -42,3 +45,12 @@ func (p *PsshData) Encode() ([]byte, error) {
    }
    return message.Encode()
 }
+
+// Pssh returns a version 0 pssh box holding the encoded PsshData.
+func (p *PsshData) Pssh() (*cdm.Pssh, error) {
+   data, err := p.Encode()
+   if err != nil {
+      return nil, err
+   }
+   return &cdm.Pssh{SystemId: cdm.Widevine, Data: data}, nil
+}
@@ -8,12 +8,21 @@ import (
 
 // EncodeLicenseRequest creates and serializes a LicenseRequest protobuf message.
 func (p *PsshData) EncodeLicenseRequest(clientId []byte) ([]byte, error) {
+   return p.encodeLicenseRequest(clientId, nil)
+}
+
+// encodeLicenseRequest sets the WidevinePsshData request_id, if any, which
+// servers return in the LicenseIdentification of the license.
+func (p *PsshData) encodeLicenseRequest(clientId, requestId []byte) ([]byte, error) {
    psshBytes, err := p.Encode()
    if err != nil {
       return nil, err
    }
-   psshDataField := protobuf.Bytes(1, psshBytes)
-   widevinePsshData := protobuf.Embed(1, psshDataField)
+   psshDataFields := []*protobuf.Field{protobuf.Bytes(1, psshBytes)}
+   if requestId != nil {
+      psshDataFields = append(psshDataFields, protobuf.Bytes(3, requestId))
+   }
+   widevinePsshData := protobuf.Embed(1, psshDataFields...)
    contentIdentification := protobuf.Embed(2, widevinePsshData)
 
    message := protobuf.Message{
@@ -81,7 +81,16 @@ func decodeLicenseFromMessage(message protobuf.Message, requestData []byte, sess
       if f, ok := m.Field(2); ok {
          kc.Iv = f.Bytes
       }
+      if f, ok := m.Field(4); ok {
+         kc.Type = f.Numeric
+      }
       if f, ok := m.Field(3); ok {
+         if len(kc.Iv) != aes.BlockSize {
+            return nil, fmt.Errorf("invalid key IV length %d", len(kc.Iv))
+         }
+         if len(f.Bytes) == 0 || len(f.Bytes)%aes.BlockSize != 0 {
+            return nil, fmt.Errorf("invalid encrypted key length %d", len(f.Bytes))
+         }
          dec := cipher.NewCBCDecrypter(ckCipher, kc.Iv)
          plain := make([]byte, len(f.Bytes))
          dec.CryptBlocks(plain, f.Bytes)
@@ -117,4 +126,6 @@ type KeyContainer struct {
    Id  []byte
    Iv  []byte
    Key []byte
+   // Type is the KeyContainer.KeyType, for example 2 for CONTENT.
+   Type uint64
 }